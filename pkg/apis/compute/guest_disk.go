@@ -91,6 +91,11 @@ type GuestdiskJsonDesc struct {
 	IsSSD            bool   `json:"is_ssd"`
 	NumQueues        uint8  `json:"num_queues"`
 
+	// advertised block sizes of virtio-blk and scsi disks, 512 or 4096,
+	// 0 means qemu default
+	LogicalBlockSize  int `json:"logical_block_size"`
+	PhysicalBlockSize int `json:"physical_block_size"`
+
 	// esxi
 	ImageInfo struct {
 		ImageType          string `json:"image_type"`
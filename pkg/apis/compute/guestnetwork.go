@@ -89,6 +89,7 @@ type GuestnetworkJsonDesc struct {
 	Routes     jsonutils.JSONObject `json:"routes"`
 	Ifname     string               `json:"ifname"`
 	Masklen    int8                 `json:"masklen"`
+	Ip6        string               `json:"ip6"`
 	Driver     string               `json:"driver"`
 	NumQueues  int                  `json:"num_queues"`
 	Vectors    *int                 `json:"vectors"`
@@ -100,6 +101,11 @@ type GuestnetworkJsonDesc struct {
 	ExternalId string               `json:"external_id"`
 	TeamWith   string               `json:"team_with"`
 	Manual     *bool                `json:"manual"`
+	Vhost      *bool                `json:"vhost"`
+
+	// virtio-net ring sizes, 0 means qemu default
+	RxQueueSize int `json:"rx_queue_size"`
+	TxQueueSize int `json:"tx_queue_size"`
 
 	Vpc struct {
 		Id           string `json:"id"`
@@ -37,6 +37,10 @@ type SGuestHardwareDesc struct {
 	Vga       string
 	Vdi       string
 	BootOrder string
+	// model of scsi controller, virtio-scsi-pci if empty
+	ScsiController string
+	// disks with driver scsi are spread across virtio-scsi controllers
+	ScsiControllerCount int
 
 	Cdrom           *api.GuestcdromJsonDesc
 	Disks           []*api.GuestdiskJsonDesc
@@ -45,11 +49,24 @@ type SGuestHardwareDesc struct {
 	IsolatedDevices []*api.IsolatedDeviceJsonDesc
 }
 
+// SGuestHostDesc is kept by host, desc synced from region doesn't carry it
+type SGuestHostDesc struct {
+	// pci slots of virtio disks and nics, keyed by disk id and nic mac
+	PciSlots map[string]int
+	// slots above builtin devices left to devices placed by qemu
+	PciAutoSlots int
+	// isolated host cpus vcpus of realtime guest are pinned to, in vcpu order
+	RealtimeCpus []int
+	// preferred display resolution in form of WIDTHxHEIGHT applied on next boot
+	DisplayResolution string
+}
+
 type SGuestDesc struct {
 	SGuestPorjectDesc
 	SGuestRegionDesc
 	SGuestControlDesc
 	SGuestHardwareDesc
+	SGuestHostDesc
 
 	Name         string
 	Uuid         string
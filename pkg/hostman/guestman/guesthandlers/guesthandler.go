@@ -340,6 +340,7 @@ func guestDestPrepareMigrateInternal(ctx context.Context, userCred mcclient.Toke
 	params.Sid = sid
 	params.Desc = guestDesc
 	params.QemuVersion = qemuVersion
+	params.TargetQemuVersion, _ = body.GetString("target_qemu_version")
 	params.LiveMigrate = liveMigrate
 	params.SourceQemuCmdline = qemuCmdline
 	params.EnableTLS = jsonutils.QueryBoolean(body, "enable_tls", false)
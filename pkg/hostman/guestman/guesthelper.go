@@ -47,6 +47,7 @@ type SDestPrepareMigrate struct {
 	Sid               string
 	ServerUrl         string
 	QemuVersion       string
+	TargetQemuVersion string
 	SourceQemuCmdline string
 	MigrateCerts      map[string]string
 	EnableTLS         bool
@@ -22,10 +22,13 @@ import (
 	"path"
 	"path/filepath"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"golang.org/x/sys/unix"
+
 	"yunion.io/x/jsonutils"
 	"yunion.io/x/log"
 	"yunion.io/x/pkg/errors"
@@ -86,6 +89,14 @@ type SGuestManager struct {
 	// dirty servers chan
 	dirtyServers     []*SKVMGuestInstance
 	dirtyServersChan chan struct{}
+
+	// live migrate ports reserved by destination guests
+	migratePorts     map[int]*SMigratePortReservation
+	migratePortsLock sync.Mutex
+
+	// slots of concurrent guest launches
+	startSlots     chan struct{}
+	startSlotsOnce sync.Once
 }
 
 func NewGuestManager(host hostutils.IHost, serversPath string) *SGuestManager {
@@ -828,6 +839,9 @@ func (m *SGuestManager) SrcPrepareMigrate(ctx context.Context, params interface{
 		return nil, hostutils.ParamsError
 	}
 	guest, _ := m.GetServer(migParams.Sid)
+	if err := guest.validateCpuMigratable(migParams.LiveMigrate); err != nil {
+		return nil, httperrors.NewBadRequestError("%v", err)
+	}
 	disksPrepare, err := guest.PrepareDisksMigrate(migParams.LiveMigrate)
 	if err != nil {
 		return nil, errors.Wrap(err, "PrepareDisksMigrate")
@@ -903,6 +917,9 @@ func (m *SGuestManager) DestPrepareMigrate(ctx context.Context, params interface
 	if migParams.LiveMigrate {
 		startParams := jsonutils.NewDict()
 		startParams.Set("qemu_version", jsonutils.NewString(migParams.QemuVersion))
+		if len(migParams.TargetQemuVersion) > 0 {
+			startParams.Set("target_qemu_version", jsonutils.NewString(migParams.TargetQemuVersion))
+		}
 		startParams.Set("need_migrate", jsonutils.JSONTrue)
 		startParams.Set("source_qemu_cmdline", jsonutils.NewString(migParams.SourceQemuCmdline))
 		startParams.Set("live_migrate_use_tls", jsonutils.NewBool(migParams.EnableTLS))
@@ -980,6 +997,182 @@ func (m *SGuestManager) GetFreePortByBase(basePort int) int {
 	}
 }
 
+// a reserved migrate port is kept this long waiting for destination qemu to listen on it
+const MIGRATE_PORT_RESERVE_GRACE_PERIOD = 5 * time.Minute
+
+var migratePortUsed = func(port int) bool {
+	return netutils2.IsTcpPortUsed("0.0.0.0", port)
+}
+
+type SMigratePortReservation struct {
+	Port       int       `json:"port"`
+	Sid        string    `json:"sid"`
+	ReservedAt time.Time `json:"reserved_at"`
+}
+
+// ReserveMigratePort picks a free live migrate port for incoming guest sid,
+// ports reserved but not listened yet are not handed out again
+func (m *SGuestManager) ReserveMigratePort(sid string) int {
+	m.migratePortsLock.Lock()
+	defer m.migratePortsLock.Unlock()
+	if m.migratePorts == nil {
+		m.migratePorts = map[int]*SMigratePortReservation{}
+	}
+	port := LIVE_MIGRATE_PORT_BASE + 1
+	for {
+		if _, ok := m.migratePorts[port]; !ok && !migratePortUsed(port) {
+			break
+		}
+		port += 1
+	}
+	m.migratePorts[port] = &SMigratePortReservation{Port: port, Sid: sid, ReservedAt: time.Now()}
+	return port
+}
+
+// ReleaseGuestMigratePort frees migrate port reserved by guest once incoming
+// migration completes or fails
+func (m *SGuestManager) ReleaseGuestMigratePort(guest *SKVMGuestInstance) {
+	m.migratePortsLock.Lock()
+	defer m.migratePortsLock.Unlock()
+	guest.migratePortLock.Lock()
+	defer guest.migratePortLock.Unlock()
+	if guest.LiveMigrateDestPort == nil {
+		return
+	}
+	port := *guest.LiveMigrateDestPort
+	if r, ok := m.migratePorts[port]; ok && r.Sid == guest.Id {
+		delete(m.migratePorts, port)
+	}
+	guest.LiveMigrateDestPort = nil
+	log.Infof("%s released migrate port %d", guest.logPrefix(), port)
+}
+
+func (m *SGuestManager) ListMigratePorts() []SMigratePortReservation {
+	m.migratePortsLock.Lock()
+	defer m.migratePortsLock.Unlock()
+	ret := make([]SMigratePortReservation, 0, len(m.migratePorts))
+	for _, r := range m.migratePorts {
+		ret = append(ret, *r)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Port < ret[j].Port })
+	return ret
+}
+
+// isMigratePortStale tells reservation is no longer backed by an incoming guest:
+// guest is gone, guest has moved to another port, or nothing listens on the port after
+// grace period, i.e. destination qemu never started or migration finished or abandoned
+func (m *SGuestManager) isMigratePortStale(r *SMigratePortReservation) bool {
+	guest, ok := m.GetServer(r.Sid)
+	if !ok {
+		return true
+	}
+	if port, ok := guest.getLiveMigrateDestPort(); !ok || port != r.Port {
+		return true
+	}
+	return time.Since(r.ReservedAt) > MIGRATE_PORT_RESERVE_GRACE_PERIOD && !migratePortUsed(r.Port)
+}
+
+// ReconcileMigratePorts audits reserved migrate ports against guests and listening sockets,
+// frees stale reservations and returns them
+func (m *SGuestManager) ReconcileMigratePorts() []SMigratePortReservation {
+	m.migratePortsLock.Lock()
+	defer m.migratePortsLock.Unlock()
+	freed := []SMigratePortReservation{}
+	for port, r := range m.migratePorts {
+		if !m.isMigratePortStale(r) {
+			continue
+		}
+		if guest, ok := m.GetServer(r.Sid); ok {
+			guest.migratePortLock.Lock()
+			if guest.LiveMigrateDestPort != nil && *guest.LiveMigrateDestPort == port {
+				guest.LiveMigrateDestPort = nil
+			}
+			guest.migratePortLock.Unlock()
+		}
+		log.Infof("free stale migrate port %d reserved by guest %s at %s", port, r.Sid, r.ReservedAt)
+		delete(m.migratePorts, port)
+		freed = append(freed, *r)
+	}
+	sort.Slice(freed, func(i, j int) bool { return freed[i].Port < freed[j].Port })
+	return freed
+}
+
+func ReconcileMigratePorts(ctx context.Context, userCred mcclient.TokenCredential, isStart bool) {
+	guestManager.ReconcileMigratePorts()
+}
+
+// withStartSlot runs launch of a guest once a start slot is available, so that
+// mass boot queues up instead of launching all guests at once
+func (m *SGuestManager) withStartSlot(launch func() error) error {
+	m.startSlotsOnce.Do(func() {
+		if limit := options.HostOptions.MaxConcurrentGuestStarts; limit > 0 {
+			m.startSlots = make(chan struct{}, limit)
+		}
+	})
+	if m.startSlots != nil {
+		m.startSlots <- struct{}{}
+		defer func() { <-m.startSlots }()
+	}
+	return launch()
+}
+
+// SGuestResourceCommitment sums resources committed to running guests,
+// memory sizes are in MB
+type SGuestResourceCommitment struct {
+	Guests int
+	Cpu    int64
+	Mem    int64
+	// size of hugetlbfs mounted for guests
+	HugepageReserved int64
+	// hugepages actually faulted in by qemu
+	HugepageBacked int64
+}
+
+// hugetlbfs of guests are mounted under it, replaced by tests
+var hugepagesDir = "/dev/hugepages"
+
+var statfsHugepages = func(dir string) (totalMb, freeMb int64, err error) {
+	var st unix.Statfs_t
+	if err := unix.Statfs(dir, &st); err != nil {
+		return 0, 0, errors.Wrapf(err, "statfs %s", dir)
+	}
+	return int64(st.Blocks) * st.Bsize / 1024 / 1024, int64(st.Bfree) * st.Bsize / 1024 / 1024, nil
+}
+
+// getGuestHugepages sums hugetlbfs mounts of guest, one mounted on start
+// and one more for each memory hotplug
+func getGuestHugepages(uuid string) (reserved, backed int64) {
+	dirs, _ := filepath.Glob(path.Join(hugepagesDir, uuid+"*"))
+	for _, dir := range dirs {
+		totalMb, freeMb, err := statfsHugepages(dir)
+		if err != nil {
+			log.Warningf("get hugepages of guest %s: %s", uuid, err)
+			continue
+		}
+		reserved += totalMb
+		backed += totalMb - freeMb
+	}
+	return reserved, backed
+}
+
+func (m *SGuestManager) GetResourceCommitment() *SGuestResourceCommitment {
+	ret := &SGuestResourceCommitment{}
+	m.Servers.Range(func(k, v interface{}) bool {
+		s := v.(*SKVMGuestInstance)
+		if !s.IsRunning() {
+			return true
+		}
+		ret.Guests += 1
+		ret.Cpu += s.Desc.Cpu
+		ret.Mem += s.Desc.Mem
+		reserved, backed := getGuestHugepages(s.Desc.Uuid)
+		ret.HugepageReserved += reserved
+		ret.HugepageBacked += backed
+		return true
+	})
+	return ret
+}
+
 func (m *SGuestManager) GetFreeVncPort() int {
 	vncPorts := make(map[int]struct{}, 0)
 	m.Servers.Range(func(k, v interface{}) bool {
@@ -1086,6 +1279,7 @@ func (m *SGuestManager) Resume(ctx context.Context, sid string, isLiveMigrate bo
 	}
 	var cb = func() {
 		resumeTask := NewGuestResumeTask(ctx, guest, !isLiveMigrate, cleanTLS)
+		resumeTask.fromLiveMigrate = isLiveMigrate
 		if isLiveMigrate {
 			guest.StartPresendArp()
 		}
@@ -0,0 +1,261 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"yunion.io/x/onecloud/pkg/hostman/guestman/desc"
+	"yunion.io/x/onecloud/pkg/hostman/options"
+)
+
+func TestSGuestManager_ReconcileMigratePorts(t *testing.T) {
+	listening := map[int]bool{
+		LIVE_MIGRATE_PORT_BASE + 1: true,
+	}
+	origPortUsed := migratePortUsed
+	migratePortUsed = func(port int) bool { return listening[port] }
+	defer func() { migratePortUsed = origPortUsed }()
+
+	m := &SGuestManager{Servers: new(sync.Map)}
+	addGuest := func(sid string) *SKVMGuestInstance {
+		s := NewKVMGuestInstance(sid, m)
+		port := m.ReserveMigratePort(sid)
+		s.LiveMigrateDestPort = &port
+		m.Servers.Store(sid, s)
+		return s
+	}
+
+	// port base+1 is listened by someone else, base+2 is reserved by incoming guest
+	incoming := addGuest("incoming")
+	assert.Equal(t, LIVE_MIGRATE_PORT_BASE+2, *incoming.LiveMigrateDestPort)
+	listening[LIVE_MIGRATE_PORT_BASE+2] = true
+
+	// never listened after grace period
+	neverStarted := addGuest("never-started")
+	assert.Equal(t, LIVE_MIGRATE_PORT_BASE+3, *neverStarted.LiveMigrateDestPort)
+	m.migratePorts[LIVE_MIGRATE_PORT_BASE+3].ReservedAt = time.Now().Add(-2 * MIGRATE_PORT_RESERVE_GRACE_PERIOD)
+
+	// recently reserved, destination qemu still starting
+	starting := addGuest("starting")
+
+	// guest deleted after reservation
+	deleted := addGuest("deleted")
+	m.Servers.Delete(deleted.Id)
+
+	// guest reserved another port
+	moved := addGuest("moved")
+	oldPort := *moved.LiveMigrateDestPort
+	newPort := m.ReserveMigratePort(moved.Id)
+	moved.LiveMigrateDestPort = &newPort
+
+	assert.Len(t, m.ListMigratePorts(), 6)
+
+	freed := m.ReconcileMigratePorts()
+	freedSids := map[int]string{}
+	for _, r := range freed {
+		freedSids[r.Port] = r.Sid
+	}
+	assert.Equal(t, map[int]string{
+		LIVE_MIGRATE_PORT_BASE + 3:   "never-started",
+		*deleted.LiveMigrateDestPort: "deleted",
+		oldPort:                      "moved",
+	}, freedSids)
+	assert.Nil(t, neverStarted.LiveMigrateDestPort)
+
+	kept := m.ListMigratePorts()
+	keptPorts := []int{}
+	for _, r := range kept {
+		keptPorts = append(keptPorts, r.Port)
+	}
+	assert.Equal(t, []int{*incoming.LiveMigrateDestPort, *starting.LiveMigrateDestPort, newPort}, keptPorts)
+
+	// freed ports are handed out again
+	assert.Equal(t, LIVE_MIGRATE_PORT_BASE+3, m.ReserveMigratePort("another"))
+}
+
+func TestSGuestManager_ReleaseGuestMigratePort(t *testing.T) {
+	origPortUsed := migratePortUsed
+	migratePortUsed = func(port int) bool { return false }
+	defer func() { migratePortUsed = origPortUsed }()
+
+	m := &SGuestManager{Servers: new(sync.Map)}
+	s := NewKVMGuestInstance("incoming", m)
+	m.Servers.Store(s.Id, s)
+
+	// nothing reserved
+	m.ReleaseGuestMigratePort(s)
+	assert.Empty(t, m.ListMigratePorts())
+
+	s.setLiveMigrateDestPort(m.ReserveMigratePort(s.Id))
+	other := m.ReserveMigratePort("other")
+	m.ReleaseGuestMigratePort(s)
+	_, ok := s.getLiveMigrateDestPort()
+	assert.False(t, ok)
+	assert.Equal(t, []SMigratePortReservation{{Port: other, Sid: "other"}}, zeroReservedAt(m.ListMigratePorts()))
+
+	// port reserved by another guest is kept
+	s.setLiveMigrateDestPort(other)
+	m.ReleaseGuestMigratePort(s)
+	_, ok = s.getLiveMigrateDestPort()
+	assert.False(t, ok)
+	assert.Len(t, m.ListMigratePorts(), 1)
+
+	// freed port is handed out again
+	assert.Equal(t, LIVE_MIGRATE_PORT_BASE+1, m.ReserveMigratePort("another"))
+}
+
+func zeroReservedAt(rs []SMigratePortReservation) []SMigratePortReservation {
+	for i := range rs {
+		rs[i].ReservedAt = time.Time{}
+	}
+	return rs
+}
+
+func TestSGuestManager_withStartSlot(t *testing.T) {
+	savedLimit := options.HostOptions.MaxConcurrentGuestStarts
+	defer func() { options.HostOptions.MaxConcurrentGuestStarts = savedLimit }()
+
+	for _, c := range []struct {
+		limit  int
+		starts int
+		want   int
+	}{
+		{limit: 2, starts: 6, want: 2},
+		{limit: 0, starts: 4, want: 4},
+	} {
+		options.HostOptions.MaxConcurrentGuestStarts = c.limit
+		m := &SGuestManager{}
+
+		var (
+			mutex   sync.Mutex
+			running int
+			peak    int
+			wg      sync.WaitGroup
+		)
+		// launches hold their slots until proceed is closed
+		proceed := make(chan struct{})
+		for i := 0; i < c.starts; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				m.withStartSlot(func() error {
+					mutex.Lock()
+					running += 1
+					if running > peak {
+						peak = running
+					}
+					mutex.Unlock()
+					<-proceed
+					mutex.Lock()
+					running -= 1
+					mutex.Unlock()
+					return nil
+				})
+			}()
+		}
+		time.Sleep(100 * time.Millisecond)
+		mutex.Lock()
+		assert.Equal(t, c.want, running, "limit %d", c.limit)
+		mutex.Unlock()
+		close(proceed)
+		wg.Wait()
+		assert.Equal(t, c.want, peak, "limit %d", c.limit)
+	}
+}
+
+func TestSGuestManager_GetResourceCommitment(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "resource-commitment")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedProcDir, savedHugepagesDir, savedStatfs := procDir, hugepagesDir, statfsHugepages
+	defer func() {
+		procDir, hugepagesDir, statfsHugepages = savedProcDir, savedHugepagesDir, savedStatfs
+	}()
+	procDir = path.Join(tmpDir, "proc")
+	hugepagesDir = path.Join(tmpDir, "hugepages")
+
+	// total and free MB of each hugetlbfs mount
+	mounts := map[string][2]int64{}
+	statfsHugepages = func(dir string) (int64, int64, error) {
+		st, ok := mounts[path.Base(dir)]
+		if !ok {
+			return 0, 0, fmt.Errorf("%s not mounted", dir)
+		}
+		return st[0], st[1], nil
+	}
+
+	m := &SGuestManager{Servers: new(sync.Map), ServersPath: path.Join(tmpDir, "servers")}
+	pid := 1000
+	addGuest := func(uuid string, cpu, mem int64, running bool) {
+		s := NewKVMGuestInstance(uuid, m)
+		s.Desc = &desc.SGuestDesc{Uuid: uuid}
+		s.Desc.Cpu, s.Desc.Mem = cpu, mem
+		m.Servers.Store(uuid, s)
+		if !running {
+			return
+		}
+		pid += 1
+		for _, dir := range []string{s.HomeDir(), path.Join(procDir, fmt.Sprintf("%d", pid))} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+		}
+		cmdline := fmt.Sprintf("/usr/bin/qemu-system-x86_64\x00-uuid\x00%s\x00", uuid)
+		if err := ioutil.WriteFile(path.Join(procDir, fmt.Sprintf("%d", pid), "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		if err := ioutil.WriteFile(s.GetPidFilePath(), []byte(fmt.Sprintf("%d\n", pid)), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	addHugepages := func(name string, totalMb, freeMb int64) {
+		if err := os.MkdirAll(path.Join(hugepagesDir, name), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		mounts[name] = [2]int64{totalMb, freeMb}
+	}
+
+	assert.Equal(t, &SGuestResourceCommitment{}, m.GetResourceCommitment())
+
+	addGuest("guest-a", 2, 2048, true)
+	addGuest("guest-b", 4, 4096, true)
+	// memory of guest b partly faulted in, plus 1G hotplugged and untouched
+	addHugepages("guest-b", 4096, 1024)
+	addHugepages("guest-b-1", 1024, 1024)
+	addGuest("guest-c", 8, 8192, true)
+	addHugepages("guest-c", 8192, 0)
+	// stopped guest with hugetlbfs left behind is not committed
+	addGuest("guest-d", 16, 16384, false)
+	addHugepages("guest-d", 16384, 16384)
+
+	assert.Equal(t, &SGuestResourceCommitment{
+		Guests:           3,
+		Cpu:              14,
+		Mem:              14336,
+		HugepageReserved: 13312,
+		HugepageBacked:   11264,
+	}, m.GetResourceCommitment())
+}
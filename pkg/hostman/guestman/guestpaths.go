@@ -0,0 +1,74 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"fmt"
+	"path"
+)
+
+// GuestPaths is the layout of files under a guest home dir, start, stop
+// and migrate all derive paths from it so they never disagree
+type GuestPaths struct {
+	HomeDir string
+
+	Desc            string
+	Pid             string
+	Vnc             string
+	EncryptKey      string
+	StartScript     string
+	StopScript      string
+	QemuLog         string
+	QemuTrace       string
+	QgaSocket       string
+	MonitorAuditLog string
+	PKIDir          string
+	FuseTmp         string
+	// memory state files are named of this prefix and an optional version
+	StateFilePrefix string
+}
+
+func NewGuestPaths(homeDir string) GuestPaths {
+	return GuestPaths{
+		HomeDir: homeDir,
+
+		Desc:            path.Join(homeDir, "desc"),
+		Pid:             path.Join(homeDir, "pid"),
+		Vnc:             path.Join(homeDir, "vnc"),
+		EncryptKey:      path.Join(homeDir, "key"),
+		StartScript:     path.Join(homeDir, "startvm"),
+		StopScript:      path.Join(homeDir, "stopvm"),
+		QemuLog:         path.Join(homeDir, "qemu.log"),
+		QemuTrace:       path.Join(homeDir, "qemu-trace.log"),
+		QgaSocket:       path.Join(homeDir, "qga.sock"),
+		MonitorAuditLog: path.Join(homeDir, "monitor-audit.log"),
+		PKIDir:          path.Join(homeDir, "pki"),
+		FuseTmp:         path.Join(homeDir, "tmp"),
+		StateFilePrefix: path.Join(homeDir, STATE_FILE_PREFIX),
+	}
+}
+
+// StateFile returns memory state file path of version, empty version is
+// the unversioned one
+func (p GuestPaths) StateFile(version string) string {
+	if version != "" {
+		return fmt.Sprintf("%s_%s", p.StateFilePrefix, version)
+	}
+	return p.StateFilePrefix
+}
+
+func (s *SKVMGuestInstance) Paths() GuestPaths {
+	return NewGuestPaths(s.HomeDir())
+}
@@ -0,0 +1,60 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSKVMGuestInstance_Paths(t *testing.T) {
+	s := newTestGuestWithServersPath("/opt/cloud/workspace/servers", nil)
+	s.Id = "guest-id"
+	home := s.HomeDir()
+	assert.Equal(t, "/opt/cloud/workspace/servers/guest-id", home)
+
+	paths := s.Paths()
+	assert.Equal(t, home, paths.HomeDir)
+	for _, c := range []struct {
+		name   string
+		path   string
+		helper string
+	}{
+		{"desc", paths.Desc, s.GetDescFilePath()},
+		{"pid", paths.Pid, s.GetPidFilePath()},
+		{"vnc", paths.Vnc, s.GetVncFilePath()},
+		{"key", paths.EncryptKey, s.getEncryptKeyPath()},
+		{"startvm", paths.StartScript, s.GetStartScriptPath()},
+		{"stopvm", paths.StopScript, s.GetStopScriptPath()},
+		{"qemu.log", paths.QemuLog, s.getQemuLogPath()},
+		{"qemu-trace.log", paths.QemuTrace, s.getQemuTracePath()},
+		{"qga.sock", paths.QgaSocket, s.getQgaSocketPath()},
+		{"monitor-audit.log", paths.MonitorAuditLog, s.getMonitorAuditLogPath()},
+		{"pki", paths.PKIDir, s.getPKIDirPath()},
+		{"tmp", paths.FuseTmp, s.GetFuseTmpPath()},
+		{STATE_FILE_PREFIX, paths.StateFilePrefix, s.getStateFilePathRootPrefix()},
+	} {
+		assert.Equal(t, path.Join(home, c.name), c.path, c.name)
+		assert.Equal(t, c.helper, c.path, c.name)
+		assert.True(t, strings.HasPrefix(c.path, home+"/"), c.name)
+	}
+
+	assert.Equal(t, path.Join(home, STATE_FILE_PREFIX), paths.StateFile(""))
+	assert.Equal(t, path.Join(home, STATE_FILE_PREFIX+"_v1"), paths.StateFile("v1"))
+	assert.Equal(t, s.GetStateFilePath("v1"), paths.StateFile("v1"))
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -78,15 +79,26 @@ func (s *SGuestStopTask) Start() {
 }
 
 func (s *SGuestStopTask) onPowerdownGuest(results string) {
-	s.ExitCleanup(true)
+	// qemu started with -no-shutdown stays after guest powered off,
+	// monitor is kept to quit it
+	if !s.isNoShutdown() {
+		s.ExitCleanup(true)
+	}
 	s.startPowerdown = time.Now()
 	s.checkGuestRunning()
 }
 
 func (s *SGuestStopTask) checkGuestRunning() {
+	s.quitNoShutdownQemu()
 	if !s.IsRunning() || time.Now().Sub(s.startPowerdown) > time.Duration(s.timeout)*time.Second {
-		s.Stop() // force stop
+		if s.startPowerdown.IsZero() {
+			// monitor not connected, stop script tries powerdown itself
+			s.StopGracefully()
+		} else {
+			s.Stop() // force stop
+		}
 		s.stopping = false
+		guestStopCounter.Inc()
 		hostutils.TaskComplete(s.ctx, nil)
 	} else {
 		s.CheckGuestRunningLater()
@@ -153,16 +165,16 @@ func (s *SGuestSuspendTask) onSaveMemStateCheck(status string) {
 		return
 	} else if status != "completed" {
 		time.Sleep(time.Second * 3)
-		log.Infof("Server %s saving memory state status %q", s.GetName(), status)
+		log.Infof("%s saving memory state status %q", s.logPrefix(), status)
 		s.onSaveMemStateWait("")
 	} else {
-		log.Infof("Server %s save memory completed", s.GetName())
+		log.Infof("%s save memory completed", s.logPrefix())
 		s.onFinishCallback(s, s.GetStateFilePath())
 	}
 }
 
 func (s *SGuestSuspendTask) onSaveMemStateComplete(_ *SGuestSuspendTask, _ string) {
-	log.Infof("Server %s memory state saved, stopping server", s.GetName())
+	log.Infof("%s memory state saved, stopping server", s.logPrefix())
 	s.ExecStopTask(s.ctx, int64(3))
 }
 
@@ -395,7 +407,14 @@ func (d *SGuestDiskSyncTask) onAddDiskSucc(disk *api.GuestdiskJsonDesc, results
 	}
 
 	if diskDirver == DISK_DRIVER_VIRTIO {
-		params["addr"] = fmt.Sprintf("0x%x", d.guest.GetDiskAddr(int(diskIndex)))
+		if bus := d.guest.GetPciBus(); bus == qemu.PCI_BRIDGE_ID {
+			// slot on pci-bridge is picked by qemu
+			params["bus"] = bus
+		} else {
+			params["addr"] = fmt.Sprintf("0x%x", d.guest.GetDiskAddr(int(diskIndex)))
+		}
+	} else if DISK_DRIVER_SCSI == diskDirver {
+		params["bus"] = qemu.GetScsiBus(diskIndex, d.guest.Desc.ScsiControllerCount)
 	} else if DISK_DRIVER_IDE == diskDirver {
 		params["unit"] = diskIndex % 2
 	}
@@ -474,6 +493,14 @@ func (n *SGuestNetworkSyncTask) delNicDevice(nic *api.GuestnetworkJsonDesc) {
 }
 
 func (n *SGuestNetworkSyncTask) addNic(nic *api.GuestnetworkJsonDesc) {
+	if runas := options.HostOptions.QemuRunasUser; len(runas) > 0 {
+		// qemu runs as unprivileged user can't create tap or run up script
+		err := errors.Errorf("hotplug nic %s is not supported by qemu running as %s, restart guest to apply", nic.Ifname, runas)
+		log.Errorln(err)
+		n.errors = append(n.errors, err)
+		n.syncNetworkConf()
+		return
+	}
 	if err := n.guest.generateNicScripts(nic); err != nil {
 		log.Errorln(err)
 		n.errors = append(n.errors, err)
@@ -486,6 +513,13 @@ func (n *SGuestNetworkSyncTask) addNic(nic *api.GuestnetworkJsonDesc) {
 		"ifname": nic.Ifname, "script": upscript, "downscript": downscript,
 		"vhost": "on", "vhostforce": "off",
 	}
+	if !qemu.IsNicVhostEnabled(nic) {
+		params["vhost"] = "off"
+		delete(params, "vhostforce")
+	}
+	if qemu.IsNicMultiQueue(nic) {
+		params["queues"] = strconv.Itoa(nic.NumQueues)
+	}
 	netType := "tap"
 
 	callback := func(res string) {
@@ -674,6 +708,7 @@ func NewGuestLiveMigrateTask(
 }
 
 func (s *SGuestLiveMigrateTask) Start() {
+	guestMigrateAttemptCounter.Inc()
 	s.Monitor.MigrateSetCapability("zero-blocks", "on", s.onSetZeroBlocks)
 }
 
@@ -697,7 +732,7 @@ func (s *SGuestLiveMigrateTask) startRamMigrateTimeout() {
 		migSeconds = options.HostOptions.MinMigrateTimeoutSeconds
 	}
 	s.timeoutAt = time.Now().Add(time.Second * time.Duration(migSeconds))
-	log.Infof("migrate timeout seconds: %d now: %v expectfinial: %v", migSeconds, time.Now(), s.timeoutAt)
+	log.Infof("%s migrate timeout seconds: %d now: %v expectfinial: %v", s.logPrefix(), migSeconds, time.Now(), s.timeoutAt)
 }
 
 func (s *SGuestLiveMigrateTask) startMigrate(res string) {
@@ -709,7 +744,7 @@ func (s *SGuestLiveMigrateTask) startMigrate(res string) {
 		// https://wiki.qemu.org/Features/MigrationTLS
 		// first remove possible existing tls0
 		s.Monitor.ObjectDel("tls0", func(res string) {
-			log.Infof("cleanup possible existing tls0: %s", res)
+			log.Infof("%s cleanup possible existing tls0: %s", s.logPrefix(), res)
 			s.Monitor.ObjectAdd("tls-creds-x509", map[string]string{
 				"dir":         s.getPKIDirPath(),
 				"endpoint":    "client",
@@ -741,6 +776,7 @@ func (s *SGuestLiveMigrateTask) startMigrate(res string) {
 }
 
 func (s *SGuestLiveMigrateTask) doMigrate() {
+	log.Infof("%s start migrate to %s:%d", s.logPrefix(), s.params.DestIp, s.params.DestPort)
 	var copyIncremental = false
 	if s.params.IsLocal {
 		// copy disk data
@@ -770,7 +806,7 @@ func (s *SGuestLiveMigrateTask) startMigrateStatusCheck(res string) {
 			if s.Monitor != nil {
 				s.Monitor.GetMigrateStatus(s.onGetMigrateStatus)
 			} else {
-				log.Errorf("server %s(%s) migrate stopped unexpectedly", s.GetId(), s.GetName())
+				log.Errorf("%s migrate stopped unexpectedly", s.logPrefix())
 				s.migrateFailed(fmt.Sprintf("Migrate error: %s", res))
 				return
 			}
@@ -789,7 +825,7 @@ func (s *SGuestLiveMigrateTask) onGetMigrateStatus(status string) {
 		if s.timeoutAt.IsZero() {
 			s.startRamMigrateTimeout()
 		} else if !s.doTimeoutMigrate && s.timeoutAt.Before(time.Now()) {
-			log.Warningf("migrate timeout, force stop to finish migrate")
+			log.Warningf("%s migrate timeout, force stop to finish migrate", s.logPrefix())
 			// timeout, start memory postcopy
 			// https://wiki.qemu.org/Features/PostCopyLiveMigration
 			s.Monitor.SimpleCommand("stop", s.onMigrateStartPostcopy)
@@ -803,11 +839,13 @@ func (s *SGuestLiveMigrateTask) onMigrateStartPostcopy(res string) {
 		s.migrateFailed(fmt.Sprintf("onMigrateStartPostcopy error: %s", res))
 		return
 	} else {
-		log.Infof("onMigrateStartPostcopy success")
+		log.Infof("%s onMigrateStartPostcopy success", s.logPrefix())
 	}
 }
 
 func (s *SGuestLiveMigrateTask) migrateComplete() {
+	log.Infof("%s migrate completed", s.logPrefix())
+	guestMigrateCounter.WithLabelValues(METRICS_RESULT_SUCCESS).Inc()
 	s.MigrateTask = nil
 	if s.c != nil {
 		close(s.c)
@@ -819,6 +857,8 @@ func (s *SGuestLiveMigrateTask) migrateComplete() {
 }
 
 func (s *SGuestLiveMigrateTask) migrateFailed(msg string) {
+	log.Errorf("%s migrate failed: %s", s.logPrefix(), msg)
+	guestMigrateCounter.WithLabelValues(METRICS_RESULT_FAILED).Inc()
 	cleanup := func() {
 		s.MigrateTask = nil
 		if s.c != nil {
@@ -829,7 +869,7 @@ func (s *SGuestLiveMigrateTask) migrateFailed(msg string) {
 	}
 	if s.params.EnableTLS {
 		s.Monitor.ObjectDel("tls0", func(res string) {
-			log.Infof("cleanup possible existing tls0: %s", res)
+			log.Infof("%s cleanup possible existing tls0: %s", s.logPrefix(), res)
 			cleanup()
 		})
 	} else {
@@ -849,6 +889,10 @@ type SGuestResumeTask struct {
 
 	isTimeout bool
 	cleanTLS  bool
+	// guest is restored from memory state file
+	fromStateFile bool
+	// guest is the destination of live migration
+	fromLiveMigrate bool
 
 	getTaskData func() (jsonutils.JSONObject, error)
 }
@@ -864,11 +908,12 @@ func NewGuestResumeTask(ctx context.Context, s *SKVMGuestInstance, isTimeout boo
 }
 
 func (s *SGuestResumeTask) Start() {
-	log.Debugf("[%s] GuestResumeTask start", s.GetId())
+	log.Debugf("%s GuestResumeTask start", s.logPrefix())
 	s.startTime = time.Now()
+	s.fromStateFile = len(s.ListStateFilePaths()) > 0
 	if s.cleanTLS {
 		s.Monitor.ObjectDel("tls0", func(res string) {
-			log.Infof("Clean %s tls0 object: %s", s.GetName(), res)
+			log.Infof("%s clean tls0 object: %s", s.logPrefix(), res)
 			pkiPath := s.getPKIDirPath()
 			if err := os.RemoveAll(pkiPath); err != nil {
 				log.Warningf("Remove tls pki dir %s error: %v", pkiPath, err)
@@ -899,7 +944,7 @@ func (s *SGuestResumeTask) confirmRunning() {
 }
 
 func (s *SGuestResumeTask) onConfirmRunning(status string) {
-	log.Infof("[%s] onConfirmRunning status %s", s.GetId(), status)
+	log.Infof("%s onConfirmRunning status %s", s.logPrefix(), status)
 	if status == "paused (prelaunch)" {
 		/* ref: qemu/src/qapi/run-state.json
 		 * prelaunch: QEMU was started with -S and guest has not started.
@@ -942,7 +987,7 @@ func (s *SGuestResumeTask) onConfirmRunning(status string) {
 }
 
 func (s *SGuestResumeTask) taskFailed(reason string) {
-	log.Infof("Start guest %s failed: %s", s.Id, reason)
+	log.Infof("%s start guest failed: %s", s.logPrefix(), reason)
 	s.ForceStop()
 	if s.ctx != nil && len(appctx.AppContextTaskId(s.ctx)) > 0 {
 		hostutils.TaskFailed(s.ctx, reason)
@@ -973,9 +1018,34 @@ func (s *SGuestResumeTask) SetGetTaskData(f func() (jsonutils.JSONObject, error)
 	s.getTaskData = f
 }
 
+// clock drifts after restored from state file or live migrated
+func (s *SGuestResumeTask) needSyncGuestTime() bool {
+	return options.HostOptions.SyncGuestTimeAfterResume && (s.fromStateFile || s.fromLiveMigrate)
+}
+
 func (s *SGuestResumeTask) onStartRunning() {
+	s.observeLaunchDuration()
+	// incoming migration, if any, has completed
+	s.manager.ReleaseGuestMigratePort(s.SKVMGuestInstance)
 	s.setCgroupPid()
 	s.removeStatefile()
+	if s.needSyncGuestTime() {
+		go func() {
+			if err := s.SyncGuestTime(); err != nil {
+				log.Errorf("%s sync time after resume: %s", s.logPrefix(), err)
+			}
+		}()
+	}
+	if s.isBalloonEnabled() && options.HostOptions.BalloonStatsPollingSeconds > 0 {
+		s.setBalloonStatsPolling(options.HostOptions.BalloonStatsPollingSeconds)
+	}
+	if len(options.HostOptions.GuestPostStartHook) > 0 {
+		go func() {
+			if err := s.runPostStartHook(); err != nil {
+				log.Errorf("%s run post-start hook: %s", s.logPrefix(), err)
+			}
+		}()
+	}
 	if s.ctx != nil && len(appctx.AppContextTaskId(s.ctx)) > 0 {
 		var (
 			data jsonutils.JSONObject
@@ -1090,7 +1160,7 @@ func (s *SGuestStreamDisksTask) onBlockDrivesSucc(blocks []monitor.QemuBlock) {
 			s.streamDevs = append(s.streamDevs, block.Device)
 		}
 	}
-	log.Infof("Stream devices %s: %v", s.GetName(), s.streamDevs)
+	log.Infof("%s stream devices: %v", s.logPrefix(), s.streamDevs)
 	if len(s.streamDevs) == 0 {
 		s.taskComplete()
 	} else {
@@ -1110,7 +1180,7 @@ func (s *SGuestStreamDisksTask) startDoBlockStream() {
 }
 
 func (s *SGuestStreamDisksTask) startWaitBlockStream(res string) {
-	log.Infof("Block stream command res %s: %q", s.GetName(), res)
+	log.Infof("%s block stream command res: %q", s.logPrefix(), res)
 	s.c = make(chan struct{})
 	for {
 		select {
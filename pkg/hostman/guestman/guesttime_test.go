@@ -0,0 +1,296 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/onecloud/pkg/hostman/monitor"
+	"yunion.io/x/onecloud/pkg/hostman/options"
+)
+
+// fakeMonitor records simple commands issued to qemu monitor
+type fakeMonitor struct {
+	monitor.Monitor
+
+	mutex    sync.Mutex
+	commands []string
+	// content written by screendump
+	screen []byte
+}
+
+func (m *fakeMonitor) IsConnected() bool {
+	return true
+}
+
+func (m *fakeMonitor) SimpleCommand(cmd string, callback monitor.StringCallback) {
+	m.mutex.Lock()
+	m.commands = append(m.commands, cmd)
+	m.mutex.Unlock()
+	if callback != nil {
+		callback("")
+	}
+}
+
+func (m *fakeMonitor) MigrateSetCapability(capability, state string, callback monitor.StringCallback) {
+	m.SimpleCommand("migrate-set-capabilities "+capability, callback)
+}
+
+func (m *fakeMonitor) MigrateSetParameter(key string, val interface{}, callback monitor.StringCallback) {
+	m.SimpleCommand(fmt.Sprintf("migrate-set-parameters %s %v", key, val), callback)
+}
+
+func (m *fakeMonitor) Disconnect() {}
+
+func (m *fakeMonitor) SetLink(name string, up bool, callback monitor.StringCallback) {
+	m.SimpleCommand(fmt.Sprintf("set_link %s %v", name, up), callback)
+}
+
+func (m *fakeMonitor) SetBalloon(sizeBytes int64, callback monitor.StringCallback) {
+	m.SimpleCommand(fmt.Sprintf("balloon %d", sizeBytes), callback)
+}
+
+func (m *fakeMonitor) ScreenDump(filename string, callback monitor.StringCallback) {
+	if err := ioutil.WriteFile(filename, m.screen, 0644); err != nil {
+		callback(err.Error())
+		return
+	}
+	m.SimpleCommand("screendump "+filename, callback)
+}
+
+func (m *fakeMonitor) SendKey(keys []string, holdTime int, callback monitor.StringCallback) {
+	m.SimpleCommand("sendkey "+strings.Join(keys, "-"), callback)
+}
+
+func (m *fakeMonitor) Commands() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return append([]string{}, m.commands...)
+}
+
+// serveFakeGuestAgent answers guest-sync and records other commands
+func serveFakeGuestAgent(t *testing.T, socketPath string) chan map[string]interface{} {
+	return serveFakeGuestAgentReplies(t, socketPath, nil)
+}
+
+// serveFakeGuestAgentReplies answers commands with return values of replies,
+// others are answered with empty return
+func serveFakeGuestAgentReplies(t *testing.T, socketPath string, replies map[string]interface{}) chan map[string]interface{} {
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen %s: %s", socketPath, err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	cmds := make(chan map[string]interface{}, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			decoder := json.NewDecoder(conn)
+			encoder := json.NewEncoder(conn)
+			for {
+				cmd := map[string]interface{}{}
+				if err := decoder.Decode(&cmd); err != nil {
+					break
+				}
+				if cmd["execute"] == "guest-sync" {
+					args := cmd["arguments"].(map[string]interface{})
+					encoder.Encode(map[string]interface{}{"return": args["id"]})
+					continue
+				}
+				cmds <- cmd
+				var ret interface{} = map[string]interface{}{}
+				if reply, ok := replies[cmd["execute"].(string)]; ok {
+					ret = reply
+				}
+				encoder.Encode(map[string]interface{}{"return": ret})
+			}
+			conn.Close()
+		}
+	}()
+	return cmds
+}
+
+func TestSKVMGuestInstance_SyncGuestTime(t *testing.T) {
+	serversPath, err := ioutil.TempDir("", "servers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(serversPath)
+
+	s := newTestGuestWithServersPath(serversPath, map[string]string{})
+	assert.NoError(t, os.MkdirAll(s.HomeDir(), 0755))
+
+	// no guest agent and no monitor
+	assert.Error(t, s.SyncGuestTime())
+
+	cmds := serveFakeGuestAgent(t, path.Join(s.HomeDir(), "qga.sock"))
+	before := time.Now()
+	assert.NoError(t, s.SyncGuestTime())
+	select {
+	case cmd := <-cmds:
+		assert.Equal(t, "guest-set-time", cmd["execute"])
+		args := cmd["arguments"].(map[string]interface{})
+		ts := time.Unix(0, int64(args["time"].(float64)))
+		assert.WithinDuration(t, before, ts, 5*time.Second)
+	default:
+		t.Fatal("guest-set-time not received")
+	}
+}
+
+func TestSKVMGuestInstance_GuestFsTrim(t *testing.T) {
+	s := newTestGuestWithServersPath(t.TempDir(), map[string]string{})
+	assert.NoError(t, os.MkdirAll(s.HomeDir(), 0755))
+
+	// no guest agent
+	_, err := s.GuestFsTrim(0)
+	if assert.Error(t, err) {
+		assert.Equal(t, errors.ErrNotSupported, errors.Cause(err))
+	}
+
+	cmds := serveFakeGuestAgentReplies(t, path.Join(s.HomeDir(), "qga.sock"), map[string]interface{}{
+		"guest-fstrim": map[string]interface{}{
+			"paths": []map[string]interface{}{
+				{"path": "/", "trimmed": 4096},
+				{"path": "/data", "error": "Operation not supported"},
+			},
+		},
+	})
+	results, err := s.GuestFsTrim(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []monitor.GuestFilesystemTrimResult{
+		{Path: "/", Trimmed: 4096},
+		{Path: "/data", Error: "Operation not supported"},
+	}, results)
+	assert.Equal(t, "guest-ping", (<-cmds)["execute"])
+	assert.Equal(t, "guest-fstrim", (<-cmds)["execute"])
+}
+
+func TestSKVMGuestInstance_GetWatchdogStatus(t *testing.T) {
+	serversPath, err := ioutil.TempDir("", "servers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(serversPath)
+
+	s := newTestGuestWithServersPath(serversPath, map[string]string{})
+	assert.NoError(t, os.MkdirAll(s.HomeDir(), 0755))
+	assert.False(t, s.GetWatchdogStatus().Serviced)
+
+	s.Desc.Metadata["watchdog_model"] = "i6300esb"
+	// guest agent not running
+	status := s.GetWatchdogStatus()
+	assert.Equal(t, "reset", status.Action)
+	assert.False(t, status.GuestAgent)
+	assert.False(t, status.Serviced)
+
+	serveFakeGuestAgent(t, path.Join(s.HomeDir(), "qga.sock"))
+	status = s.GetWatchdogStatus()
+	assert.True(t, status.GuestAgent)
+	assert.True(t, status.Serviced)
+
+	s.watchdogFiredAt = time.Now()
+	s.watchdogAction = "none"
+	status = s.GetWatchdogStatus()
+	assert.True(t, status.GuestAgent)
+	assert.False(t, status.Serviced)
+	assert.Equal(t, "none", status.LastFired)
+}
+
+func TestSKVMGuestInstance_GracefulReboot(t *testing.T) {
+	interval := gracefulRebootPollInterval
+	gracefulRebootPollInterval = 10 * time.Millisecond
+	defer func() { gracefulRebootPollInterval = interval }()
+
+	serversPath, err := ioutil.TempDir("", "servers")
+	assert.NoError(t, err)
+	defer os.RemoveAll(serversPath)
+
+	s := newTestGuestWithServersPath(serversPath, map[string]string{})
+	assert.NoError(t, os.MkdirAll(s.HomeDir(), 0755))
+
+	// no guest agent and no monitor
+	assert.Error(t, s.GracefulReboot(time.Second))
+
+	// no guest agent, reset by qmp
+	mon := &fakeMonitor{}
+	s.Monitor = mon
+	assert.NoError(t, s.GracefulReboot(time.Second))
+	assert.Equal(t, []string{"system_reset"}, mon.Commands())
+
+	cmds := serveFakeGuestAgent(t, path.Join(s.HomeDir(), "qga.sock"))
+
+	t.Run("rebooted by guest agent", func(t *testing.T) {
+		mon := &fakeMonitor{}
+		s.Monitor = mon
+		go func() {
+			cmd := <-cmds
+			assert.Equal(t, "guest-shutdown", cmd["execute"])
+			assert.Equal(t, map[string]interface{}{"mode": "reboot"}, cmd["arguments"])
+			s.eventGuestReset(&monitor.Event{Data: map[string]interface{}{"reason": "guest-reset"}})
+		}()
+		assert.NoError(t, s.GracefulReboot(5*time.Second))
+		assert.Len(t, mon.Commands(), 0)
+	})
+
+	t.Run("guest not reset in time", func(t *testing.T) {
+		mon := &fakeMonitor{}
+		s.Monitor = mon
+		assert.NoError(t, s.GracefulReboot(100*time.Millisecond))
+		assert.Equal(t, "guest-shutdown", (<-cmds)["execute"])
+		assert.Equal(t, []string{"system_reset"}, mon.Commands())
+	})
+}
+
+func TestSGuestResumeTask_needSyncGuestTime(t *testing.T) {
+	saved := options.HostOptions.SyncGuestTimeAfterResume
+	defer func() { options.HostOptions.SyncGuestTimeAfterResume = saved }()
+
+	s := newTestGuest(map[string]string{})
+	for _, c := range []struct {
+		name            string
+		isTimeout       bool
+		fromStateFile   bool
+		fromLiveMigrate bool
+		want            bool
+	}{
+		{name: "cold start", isTimeout: true},
+		{name: "restored from state file", isTimeout: true, fromStateFile: true, want: true},
+		{name: "live migration destination", fromLiveMigrate: true, want: true},
+		// master guests and memory snapshots resume without timeout
+		{name: "resumed without timeout"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			task := NewGuestResumeTask(nil, s, c.isTimeout, false)
+			task.fromStateFile = c.fromStateFile
+			task.fromLiveMigrate = c.fromLiveMigrate
+			options.HostOptions.SyncGuestTimeAfterResume = true
+			assert.Equal(t, c.want, task.needSyncGuestTime())
+			options.HostOptions.SyncGuestTimeAfterResume = false
+			assert.False(t, task.needSyncGuestTime())
+		})
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	METRICS_NAMESPACE = "host"
+	METRICS_SUBSYSTEM = "guest"
+
+	METRICS_RESULT_SUCCESS = "success"
+	METRICS_RESULT_FAILED  = "failed"
+)
+
+var (
+	// qemu launched by start script, failed counts starts given up after retries
+	guestStartCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "start_total",
+		Help:      "Count of guest starts by result",
+	}, []string{"result"})
+
+	guestStopCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "stop_total",
+		Help:      "Count of guests stopped by stop task",
+	})
+
+	guestMigrateAttemptCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "migrate_attempt_total",
+		Help:      "Count of live migrations started as source",
+	})
+
+	guestMigrateCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "migrate_total",
+		Help:      "Count of finished live migrations as source by result",
+	}, []string{"result"})
+
+	guestMemCleanerCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "memcleaner_start_total",
+		Help:      "Count of memcleaner processes started",
+	})
+
+	guestArpPresendCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "arp_presend_rounds_total",
+		Help:      "Count of gratuitous arp rounds sent for guest nics",
+	})
+)
+
+var (
+	guestGenerateScriptDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "generate_start_script_seconds",
+		Help:      "Latency of generating guest start script",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+
+	// from running start script until qemu reports running, includes monitor connecting
+	guestLaunchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: METRICS_NAMESPACE,
+		Subsystem: METRICS_SUBSYSTEM,
+		Name:      "launch_seconds",
+		Help:      "Latency from launching qemu to guest running",
+		Buckets:   prometheus.ExponentialBuckets(0.25, 2, 10),
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		guestStartCounter,
+		guestStopCounter,
+		guestMigrateAttemptCounter,
+		guestMigrateCounter,
+		guestMemCleanerCounter,
+		guestArpPresendCounter,
+		guestGenerateScriptDuration,
+		guestLaunchDuration,
+	)
+}
+
+// observeLaunchDuration records launch latency once per qemu launch,
+// guests resumed without being launched by this host are not counted
+func (s *SKVMGuestInstance) observeLaunchDuration() {
+	if s.launchedAt.IsZero() {
+		return
+	}
+	guestLaunchDuration.Observe(time.Since(s.launchedAt).Seconds())
+	s.launchedAt = time.Time{}
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+
+	"yunion.io/x/jsonutils"
+
+	"yunion.io/x/onecloud/pkg/apis"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
+	"yunion.io/x/onecloud/pkg/hostman/monitor"
+	"yunion.io/x/onecloud/pkg/hostman/options"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	m := &dto.Metric{}
+	if err := c.Write(m); err != nil {
+		t.Fatalf("write metric: %s", err)
+	}
+	return m.GetCounter().GetValue()
+}
+
+func histogramSampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	m := &dto.Metric{}
+	if err := h.Write(m); err != nil {
+		t.Fatalf("write metric: %s", err)
+	}
+	return m.GetHistogram().GetSampleCount()
+}
+
+func TestGuestStartMetrics(t *testing.T) {
+	savedBackoff := startRetryBackoff
+	defer func() { startRetryBackoff = savedBackoff }()
+	startRetryBackoff = func(int) time.Duration { return 0 }
+
+	succ := guestStartCounter.WithLabelValues(METRICS_RESULT_SUCCESS)
+	failed := guestStartCounter.WithLabelValues(METRICS_RESULT_FAILED)
+	succBefore, failedBefore := counterValue(t, succ), counterValue(t, failed)
+
+	assert.NoError(t, retryStart("test", func() error { return nil }))
+	assert.Equal(t, succBefore+1, counterValue(t, succ))
+	assert.Equal(t, failedBefore, counterValue(t, failed))
+
+	// retried launches count once
+	assert.Error(t, retryStart("test", func() error { return errors.New("Address already in use") }))
+	assert.Error(t, retryStart("test", func() error { return errors.New("unknown machine") }))
+	assert.Equal(t, succBefore+1, counterValue(t, succ))
+	assert.Equal(t, failedBefore+2, counterValue(t, failed))
+}
+
+func TestGuestStopMetrics(t *testing.T) {
+	before := counterValue(t, guestStopCounter)
+	s := newTestGuestWithServersPath(t.TempDir(), nil)
+	NewGuestStopTask(s, context.Background(), 0).Start()
+	assert.Equal(t, before+1, counterValue(t, guestStopCounter))
+	assert.False(t, s.IsStopping())
+}
+
+func TestGuestMigrateMetrics(t *testing.T) {
+	succ := guestMigrateCounter.WithLabelValues(METRICS_RESULT_SUCCESS)
+	failed := guestMigrateCounter.WithLabelValues(METRICS_RESULT_FAILED)
+	attemptBefore := counterValue(t, guestMigrateAttemptCounter)
+	succBefore, failedBefore := counterValue(t, succ), counterValue(t, failed)
+
+	s := newTestGuest(nil)
+	s.Monitor = &fakeMonitor{}
+	task := NewGuestLiveMigrateTask(context.Background(), s, &SLiveMigrate{})
+	task.migrateComplete()
+	assert.Equal(t, succBefore+1, counterValue(t, succ))
+
+	s.Monitor = &errorMonitor{}
+	task = NewGuestLiveMigrateTask(context.Background(), s, &SLiveMigrate{})
+	task.Start()
+	assert.Equal(t, attemptBefore+1, counterValue(t, guestMigrateAttemptCounter))
+	assert.Equal(t, failedBefore+1, counterValue(t, failed))
+	assert.Equal(t, succBefore+1, counterValue(t, succ))
+}
+
+// errorMonitor fails setting migrate capabilities
+type errorMonitor struct {
+	fakeMonitor
+}
+
+func (m *errorMonitor) MigrateSetCapability(capability, state string, callback monitor.StringCallback) {
+	callback("error: not supported")
+}
+
+func TestGuestMemCleanerMetrics(t *testing.T) {
+	savedPath := options.HostOptions.BinaryMemcleanPath
+	defer func() { options.HostOptions.BinaryMemcleanPath = savedPath }()
+
+	before := counterValue(t, guestMemCleanerCounter)
+	s := newTestGuestWithServersPath(t.TempDir(), nil)
+	options.HostOptions.BinaryMemcleanPath = "false"
+	assert.Error(t, s.startMemCleaner())
+	assert.Equal(t, before, counterValue(t, guestMemCleanerCounter))
+
+	options.HostOptions.BinaryMemcleanPath = "true"
+	assert.NoError(t, s.startMemCleaner())
+	assert.Equal(t, before+1, counterValue(t, guestMemCleanerCounter))
+}
+
+func TestGuestArpPresendMetrics(t *testing.T) {
+	savedInterval := presendArpInterval
+	defer func() { presendArpInterval = savedInterval }()
+	presendArpInterval = time.Millisecond
+
+	before := counterValue(t, guestArpPresendCounter)
+	s := newTestGuest(nil)
+	s.StartPresendArp()
+	assert.Eventually(t, func() bool {
+		return counterValue(t, guestArpPresendCounter) == before+5
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestGuestGenerateScriptMetrics(t *testing.T) {
+	before := histogramSampleCount(t, guestGenerateScriptDuration)
+	s := newTestStartGuest()
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	_, err := s.generateStartScript(data, host)
+	assert.NoError(t, err)
+	assert.Equal(t, before+1, histogramSampleCount(t, guestGenerateScriptDuration))
+}
+
+func TestGuestLaunchMetrics(t *testing.T) {
+	before := histogramSampleCount(t, guestLaunchDuration)
+	s := newTestGuest(nil)
+
+	// not launched by this host, e.g. reloaded after host restart
+	s.observeLaunchDuration()
+	assert.Equal(t, before, histogramSampleCount(t, guestLaunchDuration))
+
+	s.launchedAt = time.Now().Add(-time.Second)
+	s.observeLaunchDuration()
+	assert.Equal(t, before+1, histogramSampleCount(t, guestLaunchDuration))
+	assert.True(t, s.launchedAt.IsZero())
+
+	// later resumes of the same qemu are not launches
+	s.observeLaunchDuration()
+	assert.Equal(t, before+1, histogramSampleCount(t, guestLaunchDuration))
+}
@@ -0,0 +1,195 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
+	"yunion.io/x/onecloud/pkg/util/fileutils2"
+)
+
+var (
+	sysNodeDir       = "/sys/devices/system/node"
+	schedSetaffinity = unix.SchedSetaffinity
+)
+
+// sGuestNumaNode is a guest numa node of which memory and vcpus are local
+// to the host numa node
+type sGuestNumaNode struct {
+	HostNode int
+	Vcpus    []int
+	HostCpus []int
+	MemMb    uint64
+}
+
+// getHostNumaCpus returns cpus of each host numa node read from sysfs
+func getHostNumaCpus() (map[int][]int, error) {
+	dirs, err := ioutil.ReadDir(sysNodeDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", sysNodeDir)
+	}
+	nodes := map[int][]int{}
+	for _, dir := range dirs {
+		if !strings.HasPrefix(dir.Name(), "node") {
+			continue
+		}
+		node, err := strconv.Atoi(strings.TrimPrefix(dir.Name(), "node"))
+		if err != nil {
+			continue
+		}
+		cpuListFile := path.Join(sysNodeDir, dir.Name(), "cpulist")
+		content, err := fileutils2.FileGetContents(cpuListFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "read %s", cpuListFile)
+		}
+		cpus, err := parseCpuList(content)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s", cpuListFile)
+		}
+		nodes[node] = cpus
+	}
+	return nodes, nil
+}
+
+// computeGuestNumaNodes splits vcpus and memory evenly into one guest node per
+// host node, remainder of memory goes to the first node
+func computeGuestNumaNodes(vcpus int, memMb uint64, hostNodes []int, hostCpus map[int][]int) ([]sGuestNumaNode, error) {
+	if len(hostNodes) == 0 {
+		return nil, nil
+	}
+	if vcpus < len(hostNodes) {
+		return nil, errors.Errorf("%d vcpus can't spread over %d numa nodes", vcpus, len(hostNodes))
+	}
+	seen := map[int]bool{}
+	nodes := make([]sGuestNumaNode, 0, len(hostNodes))
+	for i, hostNode := range hostNodes {
+		if seen[hostNode] {
+			return nil, errors.Errorf("duplicate host numa node %d", hostNode)
+		}
+		seen[hostNode] = true
+		cpus, ok := hostCpus[hostNode]
+		if !ok {
+			return nil, errors.Wrapf(errors.ErrNotFound, "host numa node %d", hostNode)
+		}
+		if len(cpus) == 0 {
+			return nil, errors.Errorf("host numa node %d has no cpus", hostNode)
+		}
+		node := sGuestNumaNode{
+			HostNode: hostNode,
+			HostCpus: cpus,
+			MemMb:    memMb / uint64(len(hostNodes)),
+		}
+		if i == 0 {
+			node.MemMb += memMb % uint64(len(hostNodes))
+		}
+		for vcpu := i * vcpus / len(hostNodes); vcpu < (i+1)*vcpus/len(hostNodes); vcpu++ {
+			node.Vcpus = append(node.Vcpus, vcpu)
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+// getNumaNodes lays out guest numa nodes by metadata numa_host_nodes, a cpu
+// list style of host nodes, e.g. 0,1, guest node i is bound to the i-th one
+func (s *SKVMGuestInstance) getNumaNodes(memMb uint64) ([]sGuestNumaNode, error) {
+	val := s.Desc.Metadata["numa_host_nodes"]
+	if len(val) == 0 {
+		return nil, nil
+	}
+	hostNodes, err := parseCpuList(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse numa_host_nodes %q", val)
+	}
+	hostCpus, err := getHostNumaCpus()
+	if err != nil {
+		return nil, errors.Wrap(err, "getHostNumaCpus")
+	}
+	return computeGuestNumaNodes(int(s.Desc.Cpu), memMb, hostNodes, hostCpus)
+}
+
+func getNumaNodeOptions(nodes []sGuestNumaNode) []qemu.NumaNode {
+	opts := make([]qemu.NumaNode, 0, len(nodes))
+	for _, node := range nodes {
+		opts = append(opts, qemu.NumaNode{
+			Cpus:     fmt.Sprintf("%d-%d", node.Vcpus[0], node.Vcpus[len(node.Vcpus)-1]),
+			MemMB:    node.MemMb,
+			HostNode: node.HostNode,
+		})
+	}
+	return opts
+}
+
+// getVcpuThreads finds vcpu threads of qemu by thread names, which are
+// "CPU <index>/KVM" as qemu is started with debug-threads
+func getVcpuThreads(pid int) (map[int]int, error) {
+	taskDir := path.Join(procDir, strconv.Itoa(pid), "task")
+	tasks, err := ioutil.ReadDir(taskDir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", taskDir)
+	}
+	threads := map[int]int{}
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		comm, err := ioutil.ReadFile(path.Join(taskDir, task.Name(), "comm"))
+		if err != nil {
+			continue
+		}
+		var vcpu int
+		if _, err := fmt.Sscanf(strings.TrimSpace(string(comm)), "CPU %d/KVM", &vcpu); err != nil {
+			continue
+		}
+		threads[vcpu] = tid
+	}
+	return threads, nil
+}
+
+// pinNumaVcpus pins vcpu threads of each guest numa node to cpus of its host node
+func (s *SKVMGuestInstance) pinNumaVcpus(nodes []sGuestNumaNode) error {
+	threads, err := getVcpuThreads(s.GetPid())
+	if err != nil {
+		return errors.Wrap(err, "getVcpuThreads")
+	}
+	for _, node := range nodes {
+		set := unix.CPUSet{}
+		for _, cpu := range node.HostCpus {
+			set.Set(cpu)
+		}
+		for _, vcpu := range node.Vcpus {
+			tid, ok := threads[vcpu]
+			if !ok {
+				return errors.Wrapf(errors.ErrNotFound, "thread of vcpu %d", vcpu)
+			}
+			if err := schedSetaffinity(tid, &set); err != nil {
+				return errors.Wrapf(err, "set affinity of vcpu %d thread %d", vcpu, tid)
+			}
+		}
+		log.Infof("%s vcpus %v pinned to host numa node %d", s.logPrefix(), node.Vcpus, node.HostNode)
+	}
+	return nil
+}
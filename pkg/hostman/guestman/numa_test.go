@@ -0,0 +1,267 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"yunion.io/x/jsonutils"
+
+	"yunion.io/x/onecloud/pkg/apis"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
+)
+
+// two sockets host with hyper threading, node 2 is memory only
+func writeSampleNumaTopology(t *testing.T, dir string) {
+	for node, cpus := range map[string]string{
+		"node0": "0-3,8-11\n",
+		"node1": "4-7,12-15\n",
+		"node2": "\n",
+	} {
+		if err := os.MkdirAll(path.Join(dir, node), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, node, "cpulist"), []byte(cpus), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	// not a node
+	if err := os.MkdirAll(path.Join(dir, "power"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+}
+
+func Test_getHostNumaCpus(t *testing.T) {
+	savedSysNodeDir := sysNodeDir
+	defer func() { sysNodeDir = savedSysNodeDir }()
+	sysNodeDir = t.TempDir()
+	writeSampleNumaTopology(t, sysNodeDir)
+
+	nodes, err := getHostNumaCpus()
+	assert.NoError(t, err)
+	assert.Equal(t, map[int][]int{
+		0: {0, 1, 2, 3, 8, 9, 10, 11},
+		1: {4, 5, 6, 7, 12, 13, 14, 15},
+		2: {},
+	}, nodes)
+}
+
+func Test_computeGuestNumaNodes(t *testing.T) {
+	hostCpus := map[int][]int{
+		0: {0, 1, 2, 3, 8, 9, 10, 11},
+		1: {4, 5, 6, 7, 12, 13, 14, 15},
+		2: {},
+	}
+	cases := []struct {
+		name      string
+		vcpus     int
+		memMb     uint64
+		hostNodes []int
+		want      []sGuestNumaNode
+		wantErr   string
+	}{
+		{
+			name:  "no numa",
+			vcpus: 4,
+			memMb: 4096,
+		},
+		{
+			name:      "single node",
+			vcpus:     4,
+			memMb:     4096,
+			hostNodes: []int{1},
+			want: []sGuestNumaNode{
+				{HostNode: 1, Vcpus: []int{0, 1, 2, 3}, HostCpus: hostCpus[1], MemMb: 4096},
+			},
+		},
+		{
+			name:      "two nodes",
+			vcpus:     4,
+			memMb:     4096,
+			hostNodes: []int{0, 1},
+			want: []sGuestNumaNode{
+				{HostNode: 0, Vcpus: []int{0, 1}, HostCpus: hostCpus[0], MemMb: 2048},
+				{HostNode: 1, Vcpus: []int{2, 3}, HostCpus: hostCpus[1], MemMb: 2048},
+			},
+		},
+		{
+			name:      "uneven split in reversed order",
+			vcpus:     5,
+			memMb:     1025,
+			hostNodes: []int{1, 0},
+			want: []sGuestNumaNode{
+				{HostNode: 1, Vcpus: []int{0, 1}, HostCpus: hostCpus[1], MemMb: 513},
+				{HostNode: 0, Vcpus: []int{2, 3, 4}, HostCpus: hostCpus[0], MemMb: 512},
+			},
+		},
+		{
+			name:      "missing node",
+			vcpus:     4,
+			memMb:     4096,
+			hostNodes: []int{0, 3},
+			wantErr:   "host numa node 3",
+		},
+		{
+			name:      "node without cpus",
+			vcpus:     4,
+			memMb:     4096,
+			hostNodes: []int{2},
+			wantErr:   "host numa node 2 has no cpus",
+		},
+		{
+			name:      "duplicate node",
+			vcpus:     4,
+			memMb:     4096,
+			hostNodes: []int{0, 0},
+			wantErr:   "duplicate host numa node 0",
+		},
+		{
+			name:      "too few vcpus",
+			vcpus:     1,
+			memMb:     4096,
+			hostNodes: []int{0, 1},
+			wantErr:   "1 vcpus can't spread over 2 numa nodes",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			nodes, err := computeGuestNumaNodes(c.vcpus, c.memMb, c.hostNodes, hostCpus)
+			if len(c.wantErr) > 0 {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, nodes)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptNuma(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedSysNodeDir := sysNodeDir
+	defer func() {
+		guestManager = savedManager
+		sysNodeDir = savedSysNodeDir
+	}()
+	sysNodeDir = t.TempDir()
+	writeSampleNumaTopology(t, sysNodeDir)
+
+	render := func(metadata map[string]string) (string, error) {
+		s := newTestStartGuest()
+		s.Desc.Cpu = 4
+		s.Desc.Mem = 4096
+		for k, v := range metadata {
+			s.Desc.Metadata[k] = v
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		script, err := s.generateStartScript(data, host)
+		if err != nil {
+			return "", err
+		}
+		return s.getQemuCmdlineFromContent(script)
+	}
+
+	cmdline, err := render(nil)
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -object memory-backend-ram,id=mem,size=4096M -numa node,memdev=mem ")
+
+	cmdline, err = render(map[string]string{"numa_host_nodes": "0,1"})
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -object memory-backend-ram,id=mem0,size=2048M,host-nodes=0,policy=bind"+
+		" -numa node,nodeid=0,cpus=0-1,memdev=mem0"+
+		" -object memory-backend-ram,id=mem1,size=2048M,host-nodes=1,policy=bind"+
+		" -numa node,nodeid=1,cpus=2-3,cpus=4-127,memdev=mem1 ")
+	assert.NotContains(t, cmdline, "memdev=mem ")
+
+	_, err = render(map[string]string{"numa_host_nodes": "0,4"})
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_pinNumaVcpus(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir, savedSetaffinity := procDir, schedSetaffinity
+	defer func() { procDir, schedSetaffinity = savedProcDir, savedSetaffinity }()
+	procDir = path.Join(tmpDir, "proc")
+
+	s := newTestGuestWithServersPath(tmpDir, nil)
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	threads := map[string]string{
+		"1234": "qemu-system-x86",
+		"1240": "CPU 0/KVM",
+		"1241": "CPU 1/KVM",
+		"1242": "CPU 2/KVM",
+		"1243": "IO iothread0",
+	}
+	for tid, comm := range threads {
+		dir := path.Join(procDir, "1234", "task", tid)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := ioutil.WriteFile(path.Join(dir, "comm"), []byte(comm+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	vcpuThreads, err := getVcpuThreads(1234)
+	assert.NoError(t, err)
+	assert.Equal(t, map[int]int{0: 1240, 1: 1241, 2: 1242}, vcpuThreads)
+
+	pinned := map[int]string{}
+	schedSetaffinity = func(tid int, set *unix.CPUSet) error {
+		cpus := []int{}
+		for cpu := 0; cpu < 16; cpu++ {
+			if set.IsSet(cpu) {
+				cpus = append(cpus, cpu)
+			}
+		}
+		pinned[tid] = fmt.Sprintf("%v", cpus)
+		return nil
+	}
+	nodes := []sGuestNumaNode{
+		{HostNode: 0, Vcpus: []int{0}, HostCpus: []int{0, 1, 8, 9}},
+		{HostNode: 1, Vcpus: []int{1, 2}, HostCpus: []int{4, 5, 12, 13}},
+	}
+	assert.NoError(t, s.pinNumaVcpus(nodes))
+	assert.Equal(t, map[int]string{
+		1240: "[0 1 8 9]",
+		1241: "[4 5 12 13]",
+		1242: "[4 5 12 13]",
+	}, pinned)
+
+	nodes[1].Vcpus = append(nodes[1].Vcpus, 3)
+	assert.Error(t, s.pinNumaVcpus(nodes))
+}
@@ -24,6 +24,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"yunion.io/x/jsonutils"
@@ -41,6 +42,7 @@ import (
 	"yunion.io/x/onecloud/pkg/cloudcommon/consts"
 	"yunion.io/x/onecloud/pkg/cloudcommon/notifyclient"
 	"yunion.io/x/onecloud/pkg/hostman/guestman/desc"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
 	deployapi "yunion.io/x/onecloud/pkg/hostman/hostdeployer/apis"
 	"yunion.io/x/onecloud/pkg/hostman/hostdeployer/deployclient"
 	"yunion.io/x/onecloud/pkg/hostman/hostinfo"
@@ -61,6 +63,7 @@ import (
 	"yunion.io/x/onecloud/pkg/util/netutils2"
 	"yunion.io/x/onecloud/pkg/util/procutils"
 	"yunion.io/x/onecloud/pkg/util/qemuimg"
+	"yunion.io/x/onecloud/pkg/util/qemutils"
 	"yunion.io/x/onecloud/pkg/util/regutils2"
 	"yunion.io/x/onecloud/pkg/util/seclib2"
 	"yunion.io/x/onecloud/pkg/util/timeutils2"
@@ -73,14 +76,37 @@ const (
 	LIVE_MIGRATE_PORT_BASE        = 4396
 	BUILT_IN_NBD_SERVER_PORT_BASE = 7777
 	MAX_TRY                       = 3
+
+	// qmp monitor reconnect on transient errors, qemu exit is noticed after about 1.4s
+	MONITOR_RECONNECT_RETRIES     = 3
+	MONITOR_RECONNECT_BACKOFF     = 200 * time.Millisecond
+	MONITOR_RECONNECT_MAX_BACKOFF = 1 * time.Second
+
+	// guest reboot is a qemu in-place reset, the process, pid file and vnc file are kept
+	GUEST_REBOOT_ACTION_RESET = "reset"
+	// qemu started with -no-reboot exits on guest reboot and host restarts it
+	GUEST_REBOOT_ACTION_RESTART = "restart"
+
+	// qemu answers quit before exiting
+	MONITOR_QUIT_TIMEOUT = 5 * time.Second
+
+	// monitor disconnect within this period after a RESET event belongs to the reset
+	GUEST_RESET_GRACE_PERIOD = 30 * time.Second
+
+	QMP_SHUTDOWN_REASON_GUEST_RESET = "guest-reset"
+
+	HOST_ISOLATED_CPUS_PATH = "/sys/devices/system/cpu/isolated"
 )
 
 type SKVMInstanceRuntime struct {
 	QemuVersion string
 	VncPassword string
 
-	LiveMigrateDestPort *int
-	LiveMigrateUseTls   bool
+	// guarded by migratePortLock, manager may release it from other goroutines
+	LiveMigrateDestPort      *int
+	migratePortLock          sync.Mutex
+	LiveMigrateUseTls        bool
+	LiveMigrateDeferIncoming bool
 
 	SyncMeta *jsonutils.JSONDict
 
@@ -89,6 +115,16 @@ type SKVMInstanceRuntime struct {
 
 	stopping            bool
 	NeedSyncStreamDisks bool
+	// guarded by resetLock, written by monitor events
+	lastResetAt         time.Time
+	shutdownReason      string
+	resetLock           sync.Mutex
+	watchdogFiredAt     time.Time
+	watchdogAction      string
+	launchedAt          time.Time
+	// guarded by nicLinkLock, set by api and reset on start
+	nicLinkDown         map[string]bool
+	nicLinkLock         sync.Mutex
 	blockJobTigger      map[string]chan struct{}
 
 	StartupTask *SGuestResumeTask
@@ -98,20 +134,23 @@ type SKVMInstanceRuntime struct {
 type SKVMGuestInstance struct {
 	SKVMInstanceRuntime
 
-	Id      string
-	Desc    *desc.SGuestDesc
-	Monitor monitor.Monitor
-	manager *SGuestManager
+	Id         string
+	Desc       *desc.SGuestDesc
+	Monitor    monitor.Monitor
+	guestAgent *monitor.QemuGuestAgent
+	manager    *SGuestManager
 }
 
 func NewKVMGuestInstance(id string, manager *SGuestManager) *SKVMGuestInstance {
-	return &SKVMGuestInstance{
+	s := &SKVMGuestInstance{
 		SKVMInstanceRuntime: SKVMInstanceRuntime{
 			blockJobTigger: make(map[string]chan struct{}),
 		},
 		Id:      id,
 		manager: manager,
 	}
+	s.guestAgent = monitor.NewQemuGuestAgent(id, s.getQgaSocketPath())
+	return s
 }
 
 func (s *SKVMGuestInstance) IsStopping() bool {
@@ -130,20 +169,33 @@ func (s *SKVMGuestInstance) GetName() string {
 	return fmt.Sprintf("%s(%s)", s.Desc.Name, s.Desc.Uuid)
 }
 
+// logPrefix tags log lines with guest id and name, grep the id
+// to follow lifecycle of one guest on a busy host
+func (s *SKVMGuestInstance) logPrefix() string {
+	if s.Desc == nil || len(s.Desc.Name) == 0 {
+		return fmt.Sprintf("[guest %s]", s.Id)
+	}
+	return fmt.Sprintf("[guest %s %s]", s.Id, s.Desc.Name)
+}
+
 func (s *SKVMGuestInstance) getStateFilePathRootPrefix() string {
-	return path.Join(s.HomeDir(), STATE_FILE_PREFIX)
+	return s.Paths().StateFilePrefix
 }
 
 func (s *SKVMGuestInstance) GetStateFilePath(version string) string {
-	p := s.getStateFilePathRootPrefix()
-	if version != "" {
-		p = fmt.Sprintf("%s_%s", p, version)
-	}
-	return p
+	return s.Paths().StateFile(version)
+}
+
+func (s *SKVMGuestInstance) getQgaSocketPath() string {
+	return s.Paths().QgaSocket
 }
 
 func (s *SKVMGuestInstance) getQemuLogPath() string {
-	return path.Join(s.HomeDir(), "qemu.log")
+	return s.Paths().QemuLog
+}
+
+func (s *SKVMGuestInstance) getQemuTracePath() string {
+	return s.Paths().QemuTrace
 }
 
 func (s *SKVMGuestInstance) IsLoaded() bool {
@@ -163,15 +215,15 @@ func (s *SKVMGuestInstance) PrepareDir() error {
 }
 
 func (s *SKVMGuestInstance) GetPidFilePath() string {
-	return path.Join(s.HomeDir(), "pid")
+	return s.Paths().Pid
 }
 
 func (s *SKVMGuestInstance) GetVncFilePath() string {
-	return path.Join(s.HomeDir(), "vnc")
+	return s.Paths().Vnc
 }
 
 func (s *SKVMGuestInstance) getEncryptKeyPath() string {
-	return path.Join(s.HomeDir(), "key")
+	return s.Paths().EncryptKey
 }
 
 func (s *SKVMGuestInstance) getEncryptKeyId() string {
@@ -211,6 +263,9 @@ func (s *SKVMGuestInstance) getOriginId() string {
 	return s.Desc.Metadata["__origin_id"]
 }
 
+// proc filesystem mount point, replaced by tests
+var procDir = "/proc"
+
 func (s *SKVMGuestInstance) isImportFromLibvirt() bool {
 	return s.getOriginId() != ""
 }
@@ -230,7 +285,7 @@ func (s *SKVMGuestInstance) getPid(pidFile, uuid string) int {
 	}
 	pidStr, err := fileutils2.FileGetContents(pidFile)
 	if err != nil {
-		log.Errorf("Get pid file %s error %s: %s", pidFile, s.GetName(), err)
+		log.Errorf("%s get pid file %s error: %s", s.logPrefix(), pidFile, err)
 		return -2
 	}
 	pidStr = strings.TrimSpace(pidStr)
@@ -259,7 +314,14 @@ func (s *SKVMGuestInstance) isSelfQemuPid(pid, uuid string) bool {
 	if len(pid) == 0 {
 		return false
 	}
-	cmdlineFile := fmt.Sprintf("/proc/%s/cmdline", pid)
+	if state, err := readProcState(pid); err == nil && state == "Z" {
+		// cmdline of defunct process is empty, qemu is gone anyway. qemu is
+		// daemonized so it's never a child of host agent, its parent init or
+		// subreaper reaps it, stop script skips killing it meanwhile
+		log.Warningf("%s qemu process %s is defunct", s.logPrefix(), pid)
+		return false
+	}
+	cmdlineFile := path.Join(procDir, pid, "cmdline")
 	fi, err := os.Stat(cmdlineFile)
 	if err != nil {
 		return false
@@ -275,6 +337,43 @@ func (s *SKVMGuestInstance) isSelfQemuPid(pid, uuid string) bool {
 	return s.isSelfCmdline(string(cmdline), uuid)
 }
 
+// readProcState returns state of process from proc stat, which is parsed
+// after the last ')' as command name may contain spaces
+func readProcState(pid string) (string, error) {
+	statFile := path.Join(procDir, pid, "stat")
+	content, err := ioutil.ReadFile(statFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s", statFile)
+	}
+	stat := string(content)
+	fields := strings.Fields(stat[strings.LastIndex(stat, ")")+1:])
+	if len(fields) == 0 {
+		return "", errors.Errorf("invalid %s: %s", statFile, stat)
+	}
+	return fields[0], nil
+}
+
+// GetRunningCmdline returns options of running qemu process read from proc,
+// compare it with generated start script to find out what qemu actually runs with
+func (s *SKVMGuestInstance) GetRunningCmdline() (*qemutils.Cmdline, error) {
+	pid := s.GetPid()
+	if pid <= 0 {
+		return nil, errors.Wrapf(errors.ErrNotFound, "qemu process of guest %s", s.Id)
+	}
+	cmdlineFile := path.Join(procDir, strconv.Itoa(pid), "cmdline")
+	content, err := ioutil.ReadFile(cmdlineFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", cmdlineFile)
+	}
+	return parseProcCmdline(content)
+}
+
+// parseProcCmdline parses NUL separated arguments of proc cmdline file
+func parseProcCmdline(content []byte) (*qemutils.Cmdline, error) {
+	args := strings.Split(strings.TrimRight(string(content), "\x00"), "\x00")
+	return qemutils.NewCmdlineFromArgs(args)
+}
+
 func (s *SKVMGuestInstance) isSelfCmdline(cmdline, uuid string) bool {
 	return (strings.Index(cmdline, "qemu-system") >= 0 ||
 		strings.Index(cmdline, "qemu-kvm") >= 0) &&
@@ -282,7 +381,7 @@ func (s *SKVMGuestInstance) isSelfCmdline(cmdline, uuid string) bool {
 }
 
 func (s *SKVMGuestInstance) GetDescFilePath() string {
-	return path.Join(s.HomeDir(), "desc")
+	return s.Paths().Desc
 }
 
 func (s *SKVMGuestInstance) LoadDesc() error {
@@ -320,7 +419,7 @@ func (s *SKVMGuestInstance) DirtyServerRequestStart() {
 	_, err := modules.Servers.PerformClassAction(
 		hostutils.GetComputeSession(context.Background()), "dirty-server-start", body)
 	if err != nil {
-		log.Errorf("Dirty server request start error %s: %s", s.GetName(), err)
+		log.Errorf("%s dirty server request start error: %s", s.logPrefix(), err)
 	}
 }
 
@@ -373,44 +472,31 @@ func (s *SKVMGuestInstance) asyncScriptStart(ctx context.Context, params interfa
 	hostbridge.CleanDeletedPorts(options.HostOptions.BridgeDriver)
 	time.Sleep(100 * time.Millisecond)
 
-	var isStarted, tried = false, 0
-	for !isStarted && tried < MAX_TRY {
-		tried += 1
-
+	err = retryStart(s.logPrefix(), func() error {
 		vncPort := s.manager.GetFreeVncPort()
-		log.Infof("Use vnc port %d", vncPort)
-		if err = s.saveVncPort(vncPort); err != nil {
-			goto finally
-		} else {
-			data.Set("vnc_port", jsonutils.NewInt(int64(vncPort)))
+		log.Infof("%s use vnc port %d", s.logPrefix(), vncPort)
+		if err := s.saveVncPort(vncPort); err != nil {
+			return err
 		}
+		data.Set("vnc_port", jsonutils.NewInt(int64(vncPort)))
 
-		if err = s.saveScripts(data); err != nil {
-			goto finally
-		} else {
-			err = s.scriptStart()
-			if err == nil {
-				isStarted = true
+		// scripts are regenerated on every try, ports may have changed
+		return s.manager.withStartSlot(func() error {
+			if err := s.saveScripts(data); err != nil {
+				return err
 			}
-		}
-
-	finally:
-		if !isStarted {
-			log.Errorf("Start VM failed %s: %s", s.GetName(), err)
-			time.Sleep(time.Duration(1<<uint(tried-1)) * time.Second)
-		} else {
-			log.Infof("VM started %s ...", s.GetName())
-		}
-	}
+			return s.scriptStart()
+		})
+	})
 
 	// is on_async_script_start
-	if isStarted {
-		log.Infof("Async start server %s success!", s.GetName())
+	if err == nil {
+		log.Infof("%s async start success", s.logPrefix())
 		s.SyncMeta = s.CleanImportMetadata()
 		s.StartMonitor(ctx, nil)
 		return nil, nil
 	}
-	log.Errorf("Async start server %s failed: %s!!!", s.GetName(), err)
+	log.Errorf("%s async start failed: %s", s.logPrefix(), err)
 	if ctx != nil && len(appctx.AppContextTaskId(ctx)) >= 0 {
 		hostutils.TaskFailed(ctx, fmt.Sprintf("Async start server failed: %s", err))
 	}
@@ -422,8 +508,57 @@ func (s *SKVMGuestInstance) asyncScriptStart(ctx context.Context, params interfa
 	return nil, err
 }
 
+// errors matching these are likely to go away on a later try,
+// such as a port taken between allocation and qemu binding it
+var retryableStartErrors = []string{
+	"is in use",
+	"Address already in use",
+	"Device or resource busy",
+	`Failed to get "write" lock`,
+}
+
+var startRetryBackoff = func(tried int) time.Duration {
+	return time.Duration(1<<uint(tried-1)) * time.Second
+}
+
+func isRetryableStartError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	for _, pattern := range retryableStartErrors {
+		if strings.Contains(msg, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// retryStart calls launch up to MAX_TRY times, backing off between tries.
+// Errors not known to be transient, e.g. a bad machine type, fail fast.
+func retryStart(logPrefix string, launch func() error) error {
+	var err error
+	for tried := 1; tried <= MAX_TRY; tried++ {
+		if err = launch(); err == nil {
+			log.Infof("%s started", logPrefix)
+			guestStartCounter.WithLabelValues(METRICS_RESULT_SUCCESS).Inc()
+			return nil
+		}
+		if !isRetryableStartError(err) {
+			log.Errorf("%s start failed: %s, not retryable", logPrefix, err)
+			break
+		}
+		log.Errorf("%s start failed: %s, tried %d/%d", logPrefix, err, tried, MAX_TRY)
+		if tried < MAX_TRY {
+			time.Sleep(startRetryBackoff(tried))
+		}
+	}
+	guestStartCounter.WithLabelValues(METRICS_RESULT_FAILED).Inc()
+	return err
+}
+
 func (s *SKVMGuestInstance) saveScripts(data *jsonutils.JSONDict) error {
-	startScript, err := s.generateStartScript(data)
+	startScript, err := s.generateStartScript(data, sStartScriptHost{s.manager.host})
 	if err != nil {
 		return err
 	}
@@ -437,27 +572,39 @@ func (s *SKVMGuestInstance) saveScripts(data *jsonutils.JSONDict) error {
 		if err != nil {
 			return errors.Wrapf(err, "Get qemu cmdline from %q", startScript)
 		}
+		if err := verifyMigrateDiskDevices(currentCmd, srcCmdline); err != nil {
+			return errors.Wrap(err, "verifyMigrateDiskDevices")
+		}
 		unifyCmd, err := s.unifyMigrateQemuCmdline(currentCmd, srcCmdline)
 		if err != nil {
 			return errors.Wrap(err, "Unify migrate qemu cmdline")
 		}
 		// reinject cmd
 		startScript = strings.ReplaceAll(startScript, currentCmd, unifyCmd)
+		if s.isStablePciAddress() {
+			// devices keep slots of source qemu
+			if err := s.savePciSlotsFromCmdline(unifyCmd); err != nil {
+				return errors.Wrap(err, "savePciSlotsFromCmdline")
+			}
+		}
 	}
 
 	if err = fileutils2.FilePutContents(s.GetStartScriptPath(), startScript, false); err != nil {
 		return err
 	}
 	stopScript := s.generateStopScript(data)
-	return fileutils2.FilePutContents(s.GetStopScriptPath(), stopScript, false)
+	if err := fileutils2.FilePutContents(s.GetStopScriptPath(), stopScript, false); err != nil {
+		return err
+	}
+	return s.applyGuestSecurityLabels()
 }
 
 func (s *SKVMGuestInstance) GetStartScriptPath() string {
-	return path.Join(s.HomeDir(), "startvm")
+	return s.Paths().StartScript
 }
 
 func (s *SKVMGuestInstance) GetStopScriptPath() string {
-	return path.Join(s.HomeDir(), "stopvm")
+	return s.Paths().StopScript
 }
 
 func (s *SKVMGuestInstance) ImportServer(pendingDelete bool) {
@@ -472,7 +619,7 @@ func (s *SKVMGuestInstance) ImportServer(pendingDelete bool) {
 	s.manager.RemoveCandidateServer(s)
 
 	if (s.IsDirtyShotdown() || s.IsDaemon()) && !pendingDelete {
-		log.Infof("Server dirty shutdown or a daemon %s", s.GetName())
+		log.Infof("%s dirty shutdown or a daemon", s.logPrefix())
 
 		if s.Desc.IsMaster || s.Desc.IsSlave ||
 			len(s.GetNeedMergeBackingFileDiskIndexs()) > 0 {
@@ -483,7 +630,7 @@ func (s *SKVMGuestInstance) ImportServer(pendingDelete bool) {
 		return
 	}
 	if s.IsRunning() {
-		log.Infof("%s is running, pending_delete=%t", s.GetName(), pendingDelete)
+		log.Infof("%s is running, pending_delete=%t", s.logPrefix(), pendingDelete)
 		if !pendingDelete {
 			s.StartMonitor(context.Background(), nil)
 		}
@@ -492,7 +639,7 @@ func (s *SKVMGuestInstance) ImportServer(pendingDelete bool) {
 		if s.IsSuspend() {
 			action = "suspend"
 		}
-		log.Infof("%s is %s, pending_delete=%t", s.GetName(), action, pendingDelete)
+		log.Infof("%s is %s, pending_delete=%t", s.logPrefix(), action, pendingDelete)
 		if !s.IsSlave() {
 			s.SyncStatus("")
 		}
@@ -533,7 +680,7 @@ func (s *SKVMGuestInstance) IsMonitorAlive() bool {
 // }
 
 func (s *SKVMGuestInstance) onImportGuestMonitorDisConnect(err error) {
-	log.Infof("Import Guest %s monitor disconnect reason: %v", s.Id, err)
+	log.Infof("%s import guest monitor disconnect reason: %v", s.logPrefix(), err)
 	s.SyncStatus(fmt.Sprintf("import guest monitor disconnect %v", err))
 
 	// clean import pid file
@@ -546,7 +693,7 @@ func (s *SKVMGuestInstance) onImportGuestMonitorDisConnect(err error) {
 }
 
 func (s *SKVMGuestInstance) onImportGuestMonitorTimeout(ctx context.Context, err error) {
-	log.Errorf("Import guest %s monitor connect timeout: %s", s.Id, err)
+	log.Errorf("%s import guest monitor connect timeout: %s", s.logPrefix(), err)
 	// clean import pid file
 	if s.GetPid() == -2 {
 		spath := s.GetPidFilePath()
@@ -557,9 +704,9 @@ func (s *SKVMGuestInstance) onImportGuestMonitorTimeout(ctx context.Context, err
 }
 
 func (s *SKVMGuestInstance) onImportGuestMonitorConnected(ctx context.Context) {
-	log.Infof("Guest %s Monitor connect success", s.Id)
+	log.Infof("%s monitor connect success", s.logPrefix())
 	s.Monitor.GetVersion(func(version string) {
-		log.Infof("Guest %s qemu version %s", s.Id, version)
+		log.Infof("%s qemu version %s", s.logPrefix(), version)
 		s.QemuVersion = version
 		meta := jsonutils.NewDict()
 		meta.Set("hotplug_cpu_mem", jsonutils.NewString("disable"))
@@ -574,6 +721,16 @@ func (s *SKVMGuestInstance) GetMonitorPath() string {
 	return s.Desc.Metadata["__monitor_path"]
 }
 
+func (s *SKVMGuestInstance) getMonitorAuditLogPath() string {
+	return s.Paths().MonitorAuditLog
+}
+
+func (s *SKVMGuestInstance) setMonitorAuditLogger(mon monitor.Monitor) {
+	if options.HostOptions.EnableMonitorAuditLog {
+		mon.SetAuditLogger(monitor.NewMonitorAuditLogger(s.getMonitorAuditLogPath()))
+	}
+}
+
 func (s *SKVMGuestInstance) StartMonitorWithImportGuestSocketFile(ctx context.Context, socketFile string, cb func()) {
 	timeutils2.AddTimeout(100*time.Millisecond, func() {
 		var mon monitor.Monitor
@@ -591,6 +748,7 @@ func (s *SKVMGuestInstance) StartMonitorWithImportGuestSocketFile(ctx context.Co
 			}, // on monitor connected
 			s.onReceiveQMPEvent, // on reveive qmp event
 		)
+		s.setMonitorAuditLogger(mon)
 		mon.ConnectWithSocket(socketFile)
 	})
 }
@@ -614,9 +772,12 @@ func (s *SKVMGuestInstance) StartMonitor(ctx context.Context, cb func()) {
 				}, // on monitor connected
 				s.onReceiveQMPEvent, // on reveive qmp event
 			)
+			s.setMonitorAuditLogger(mon)
+			mon.(*monitor.QmpMonitor).EnableReconnect(MONITOR_RECONNECT_RETRIES,
+				MONITOR_RECONNECT_BACKOFF, MONITOR_RECONNECT_MAX_BACKOFF)
 			err := mon.Connect("127.0.0.1", s.GetQmpMonitorPort(-1))
 			if err != nil {
-				log.Errorf("Guest %s qmp monitor connect failed %s, try hmp", s.GetName(), err)
+				log.Errorf("%s qmp monitor connect failed %s, try hmp", s.logPrefix(), err)
 				mon = monitor.NewHmpMonitor(
 					s.GetName(),
 					s.Id,
@@ -630,10 +791,11 @@ func (s *SKVMGuestInstance) StartMonitor(ctx context.Context, cb func()) {
 						}
 					}, // on monitor connected
 				)
+				s.setMonitorAuditLogger(mon)
 				err = mon.Connect("127.0.0.1", s.GetHmpMonitorPort(-1))
 				if err != nil {
 					mon = nil
-					log.Errorf("Guest %s hmp monitor connect failed %s, something wrong", s.GetName(), err)
+					log.Errorf("%s hmp monitor connect failed %s, something wrong", s.logPrefix(), err)
 				}
 			}
 		})
@@ -654,6 +816,12 @@ func (s *SKVMGuestInstance) onReceiveQMPEvent(event *monitor.Event) {
 		s.eventBlockJobCompleted(event)
 	case event.Event == `"GUEST_PANICKED"`:
 		s.eventGuestPaniced(event)
+	case event.Event == `"RESET"`:
+		s.eventGuestReset(event)
+	case event.Event == `"SHUTDOWN"`:
+		s.eventGuestShutdown(event)
+	case event.Event == `"WATCHDOG"`:
+		s.eventGuestWatchdog(event)
 	case event.Event == `"STOP"`:
 		if s.MigrateTask != nil {
 			// migrating complete
@@ -697,6 +865,20 @@ func (s *SKVMGuestInstance) eventBlockJobCompleted(event *monitor.Event) {
 }
 
 func (s *SKVMGuestInstance) eventGuestPaniced(event *monitor.Event) {
+	s.sendGuestEvent(event)
+}
+
+// eventGuestWatchdog records expired watchdog, the guest is hung
+// even if qemu keeps running with action none or pause
+func (s *SKVMGuestInstance) eventGuestWatchdog(event *monitor.Event) {
+	action, _ := event.Data["action"].(string)
+	log.Warningf("%s watchdog expired, action: %s", s.logPrefix(), action)
+	s.watchdogFiredAt = time.Now()
+	s.watchdogAction = action
+	s.sendGuestEvent(event)
+}
+
+func (s *SKVMGuestInstance) sendGuestEvent(event *monitor.Event) {
 	// qemu runc state event source qemu/src/qapi/run-state.json
 	params := jsonutils.NewDict()
 	if action, ok := event.Data["action"]; ok {
@@ -711,10 +893,53 @@ func (s *SKVMGuestInstance) eventGuestPaniced(event *monitor.Event) {
 		hostutils.GetComputeSession(context.Background()),
 		s.GetId(), "event", params)
 	if err != nil {
-		log.Errorf("Server %s send event guest paniced got error %s", s.GetId(), err)
+		log.Errorf("%s send event %s got error %s", s.logPrefix(), event.Event, err)
 	}
 }
 
+func (s *SKVMGuestInstance) eventGuestReset(event *monitor.Event) {
+	reason, _ := event.Data["reason"].(string)
+	log.Infof("%s reset in place, reason: %s", s.logPrefix(), reason)
+	s.resetLock.Lock()
+	defer s.resetLock.Unlock()
+	s.lastResetAt = time.Now()
+	s.shutdownReason = ""
+}
+
+func (s *SKVMGuestInstance) eventGuestShutdown(event *monitor.Event) {
+	reason, _ := event.Data["reason"].(string)
+	log.Infof("%s shutdown, reason: %s", s.logPrefix(), reason)
+	s.resetLock.Lock()
+	defer s.resetLock.Unlock()
+	s.shutdownReason = reason
+}
+
+// getResetState returns time of last reset and reason of shutdown told by
+// monitor events, clear resets them once handled
+func (s *SKVMGuestInstance) getResetState(clear bool) (time.Time, string) {
+	s.resetLock.Lock()
+	defer s.resetLock.Unlock()
+	lastResetAt, shutdownReason := s.lastResetAt, s.shutdownReason
+	if clear {
+		s.lastResetAt = time.Time{}
+		s.shutdownReason = ""
+	}
+	return lastResetAt, shutdownReason
+}
+
+// getRebootLifecycle tells how a monitor disconnect is handled:
+// reset keeps the still running qemu and its pid/vnc files,
+// restart cleans up the exited qemu and starts it again
+func getRebootLifecycle(processAlive bool, lastResetAt time.Time, shutdownReason string) string {
+	if processAlive && !lastResetAt.IsZero() && time.Since(lastResetAt) < GUEST_RESET_GRACE_PERIOD {
+		return GUEST_REBOOT_ACTION_RESET
+	}
+	if !processAlive && shutdownReason == QMP_SHUTDOWN_REASON_GUEST_RESET {
+		return GUEST_REBOOT_ACTION_RESTART
+	}
+	return ""
+}
+
 func (s *SKVMGuestInstance) eventBlockJobReady(event *monitor.Event) {
 	itype, ok := event.Data["type"]
 	if !ok {
@@ -760,7 +985,7 @@ func (s *SKVMGuestInstance) eventBlockJobReady(event *monitor.Event) {
 			s.GetId(), "block-mirror-ready", params,
 		)
 		if err != nil {
-			log.Errorf("Server %s perform block-mirror-ready got error %s", s.GetId(), err)
+			log.Errorf("%s perform block-mirror-ready got error %s", s.logPrefix(), err)
 		}
 	}
 }
@@ -773,7 +998,7 @@ func (s *SKVMGuestInstance) SyncMirrorJobFailed(reason string) {
 		s.GetId(), "block-stream-failed", params,
 	)
 	if err != nil {
-		log.Errorf("Server %s perform block-stream-failed got error %s", s.GetId(), err)
+		log.Errorf("%s perform block-stream-failed got error %s", s.logPrefix(), err)
 	}
 }
 
@@ -785,7 +1010,6 @@ func (s *SKVMGuestInstance) onMonitorConnected(ctx context.Context) {
 }
 
 func (s *SKVMGuestInstance) setDestMigrateTLS(ctx context.Context, data *jsonutils.JSONDict) {
-	port, _ := data.Int("live_migrate_dest_port")
 	s.Monitor.ObjectAdd("tls-creds-x509", map[string]string{
 		"dir":         s.getPKIDirPath(),
 		"endpoint":    "server",
@@ -801,26 +1025,76 @@ func (s *SKVMGuestInstance) setDestMigrateTLS(ctx context.Context, data *jsonuti
 				hostutils.TaskFailed(ctx, fmt.Sprintf("Migrate set tls-creds tls0 error: %s", res))
 				return
 			}
-			address := fmt.Sprintf("tcp:0:%d", port)
-			s.Monitor.MigrateIncoming(address, func(res string) {
-				if strings.Contains(strings.ToLower(res), "error") {
-					hostutils.TaskFailed(ctx, fmt.Sprintf("Migrate set incoming %q error: %s", address, res))
-					return
-				}
-				hostutils.TaskComplete(ctx, data)
-			})
+			s.migrateIncoming(ctx, data)
 		})
 	})
 }
 
+// migrateIncoming starts listening for migration on qemu started with -incoming defer
+func (s *SKVMGuestInstance) migrateIncoming(ctx context.Context, data *jsonutils.JSONDict) {
+	port, _ := data.Int("live_migrate_dest_port")
+	address := fmt.Sprintf("tcp:0:%d", port)
+	s.Monitor.MigrateIncoming(address, func(res string) {
+		if strings.Contains(strings.ToLower(res), "error") {
+			hostutils.TaskFailed(ctx, fmt.Sprintf("Migrate set incoming %q error: %s", address, res))
+			return
+		}
+		hostutils.TaskComplete(ctx, data)
+	})
+}
+
+func (s *SKVMGuestInstance) getLiveMigrateDestPort() (int, bool) {
+	s.migratePortLock.Lock()
+	defer s.migratePortLock.Unlock()
+	if s.LiveMigrateDestPort == nil {
+		return 0, false
+	}
+	return *s.LiveMigrateDestPort, true
+}
+
+func (s *SKVMGuestInstance) setLiveMigrateDestPort(port int) {
+	s.migratePortLock.Lock()
+	defer s.migratePortLock.Unlock()
+	s.LiveMigrateDestPort = &port
+}
+
+// WaitIncomingReady blocks until destination qemu waits for incoming migration
+// and listens on migrate port, source should start migrating only after it
+func (s *SKVMGuestInstance) WaitIncomingReady(timeout time.Duration) error {
+	port, ok := s.getLiveMigrateDestPort()
+	if !ok {
+		return errors.Errorf("guest %s is not waiting for incoming migration", s.GetName())
+	}
+	qmp, ok := s.Monitor.(*monitor.QmpMonitor)
+	if !ok {
+		return errors.Wrap(errors.ErrNotSupported, "wait incoming ready needs qmp monitor")
+	}
+	deadline := time.Now().Add(timeout)
+	ch := make(chan error, 1)
+	qmp.WaitIncomingReady(timeout, func(err error) { ch <- err })
+	if err := <-ch; err != nil {
+		return err
+	}
+	// with -incoming defer nothing listens until migrate-incoming is done
+	for !migratePortUsed(port) {
+		if time.Now().After(deadline) {
+			return errors.Wrapf(errors.ErrTimeout, "migrate port %d not listened", port)
+		}
+		time.Sleep(monitor.INCOMING_READY_POLL_INTERVAL)
+	}
+	return nil
+}
+
 func (s *SKVMGuestInstance) onGetQemuVersion(ctx context.Context, version string) {
 	s.QemuVersion = version
-	log.Infof("Guest(%s) qemu version %s", s.Id, s.QemuVersion)
-	if s.LiveMigrateDestPort != nil && ctx != nil {
+	log.Infof("%s qemu version %s", s.logPrefix(), s.QemuVersion)
+	if port, ok := s.getLiveMigrateDestPort(); ok && ctx != nil {
 		body := jsonutils.NewDict()
-		body.Set("live_migrate_dest_port", jsonutils.NewInt(int64(*s.LiveMigrateDestPort)))
+		body.Set("live_migrate_dest_port", jsonutils.NewInt(int64(port)))
 		if s.LiveMigrateUseTls {
 			s.setDestMigrateTLS(ctx, body)
+		} else if s.LiveMigrateDeferIncoming {
+			s.migrateIncoming(ctx, body)
 		} else {
 			hostutils.TaskComplete(ctx, body)
 		}
@@ -842,9 +1116,31 @@ func (s *SKVMGuestInstance) onGetQemuVersion(ctx context.Context, version string
 }
 
 func (s *SKVMGuestInstance) onMonitorDisConnect(err error) {
-	log.Errorf("Guest %s on Monitor Disconnect reason: %v", s.Id, err)
+	log.Errorf("%s on monitor disconnect reason: %v", s.logPrefix(), err)
+	lastResetAt, shutdownReason := s.getResetState(true)
+	lifecycle := getRebootLifecycle(s.IsRunning(), lastResetAt, shutdownReason)
+	if lifecycle == GUEST_REBOOT_ACTION_RESTART && s.isOneShot() {
+		// one shot guest stays powered off after guest reboot
+		log.Infof("%s is one shot, exited on guest reboot", s.logPrefix())
+		lifecycle = ""
+	}
+	if lifecycle == GUEST_REBOOT_ACTION_RESET {
+		// qemu is still running after an in-place reset, keep pid and vnc files
+		log.Infof("%s monitor lost during reset, reconnect", s.logPrefix())
+		s.Monitor = nil
+		s.StartMonitor(context.Background(), nil)
+		return
+	}
 	s.CleanStartupTask()
 	s.scriptStop()
+	if lifecycle == GUEST_REBOOT_ACTION_RESTART {
+		log.Infof("%s exited on guest reboot, restart", s.logPrefix())
+		s.clearCgroup(0)
+		s.Monitor = nil
+		timeutils2.AddTimeout(
+			time.Second*3, func() { s.StartGuest(context.Background(), nil, jsonutils.NewDict()) })
+		return
+	}
 	if !s.IsSlave() {
 		s.SyncStatus(fmt.Sprintf("monitor disconnect %v", err))
 	}
@@ -870,7 +1166,7 @@ func (s *SKVMGuestInstance) startDiskBackupMirror(ctx context.Context) {
 		}
 
 		onSucc := func() {
-			cb := func(res string) { log.Infof("On backup mirror server(%s) resume start", s.Id) }
+			cb := func(res string) { log.Infof("%s on backup mirror server resume start", s.logPrefix()) }
 			s.Monitor.SimpleCommand("cont", cb)
 		}
 		NewDriveMirrorTask(ctx, s, nbdUri, "top", true, onSucc).Start()
@@ -973,22 +1269,22 @@ func (s *SKVMGuestInstance) BlockJobsCount() int {
 }
 
 func (s *SKVMGuestInstance) detachStartupTask() {
-	log.Infof("[%s] detachStartupTask", s.GetId())
+	log.Infof("%s detachStartupTask", s.logPrefix())
 	s.StartupTask = nil
 }
 
 func (s *SKVMGuestInstance) CleanStartupTask() {
 	if s.StartupTask != nil {
-		log.Infof("[%s] Clean startup task ... stop task ...", s.GetId())
+		log.Infof("%s clean startup task ... stop task ...", s.logPrefix())
 		s.StartupTask.Stop()
 		s.StartupTask = nil
 	} else {
-		log.Infof("[%s] Clean startup task ... no task", s.GetId())
+		log.Infof("%s clean startup task ... no task", s.logPrefix())
 	}
 }
 
 func (s *SKVMGuestInstance) onMonitorTimeout(ctx context.Context, err error) {
-	log.Errorf("Monitor connect timeout, VM %s frozen: %s force restart!!!!", s.Id, err)
+	log.Errorf("%s monitor connect timeout, VM frozen: %s force restart!!!!", s.logPrefix(), err)
 	s.ForceStop()
 	timeutils2.AddTimeout(
 		time.Second*3, func() { s.StartGuest(ctx, nil, jsonutils.NewDict()) })
@@ -1078,6 +1374,9 @@ func (s *SKVMGuestInstance) CheckBlockOrRunning(jobs int) {
 }
 
 func (s *SKVMGuestInstance) SaveDesc(desc *desc.SGuestDesc) error {
+	if s.Desc != nil && s.Desc != desc {
+		desc.SGuestHostDesc = s.Desc.SGuestHostDesc
+	}
 	s.Desc = desc
 
 	// fill in ovn vpc nic bridge field
@@ -1096,6 +1395,42 @@ func (s *SKVMGuestInstance) SaveDesc(desc *desc.SGuestDesc) error {
 	return nil
 }
 
+// SetDisplayResolution sets preferred resolution of guest display through xres
+// and yres of qxl or virtio gpu, kept in host desc. Qemu monitor has no command
+// resizing display of running guest, so running guest picks it up after restart.
+// It is a no-op for other vgas, e.g. std
+func (s *SKVMGuestInstance) SetDisplayResolution(width, height int) error {
+	if err := validateDisplayResolution(width, height); err != nil {
+		return err
+	}
+	isArm := s.manager.GetHost().IsAarch64()
+	if len(getDisplayResolutionDriver(isArm, s.Desc.Vga, s.IsVdiSpice())) == 0 {
+		log.Infof("%s vga %s doesn't support display resolution, %dx%d ignored, use qxl or virtio", s.logPrefix(), s.Desc.Vga, width, height)
+		return nil
+	}
+	oldVal := s.Desc.DisplayResolution
+	resolution := fmt.Sprintf("%dx%d", width, height)
+	if oldVal == resolution {
+		return nil
+	}
+	s.Desc.DisplayResolution = resolution
+	if err := s.SaveDesc(s.Desc); err != nil {
+		s.Desc.DisplayResolution = oldVal
+		return err
+	}
+	log.Infof("%s display resolution set to %s", s.logPrefix(), resolution)
+	if !s.IsRunning() {
+		return nil
+	}
+	data := jsonutils.NewDict()
+	data.Set("vnc_port", jsonutils.NewInt(int64(s.GetVncPort())))
+	if err := s.saveScripts(data); err != nil {
+		return errors.Wrap(err, "save scripts")
+	}
+	log.Infof("%s display resolution %s takes effect after restarted", s.logPrefix(), resolution)
+	return nil
+}
+
 func (s *SKVMGuestInstance) GetVpcNIC() *api.GuestnetworkJsonDesc {
 	for _, nic := range s.Desc.Nics {
 		if nic.Vpc.Provider == api.VPC_PROVIDER_OVN {
@@ -1199,17 +1534,18 @@ func (s *SKVMGuestInstance) StartDelete(ctx context.Context, migrated bool) erro
 }
 
 func (s *SKVMGuestInstance) ForceStop() bool {
+	log.Infof("%s force stop", s.logPrefix())
 	s.ExitCleanup(true)
 	if s.IsRunning() {
 		output, err := procutils.NewCommand("kill", "-9", fmt.Sprintf("%d", s.GetPid())).Output()
 		if err != nil {
-			log.Errorf("kill process %d failed: %s, %s", s.GetPid(), err, output)
+			log.Errorf("%s kill process %d failed: %s, %s", s.logPrefix(), s.GetPid(), err, output)
 			return false
 		}
 		for _, f := range s.GetCleanFiles() {
 			output, err := procutils.NewCommand("rm", "-f", f).Output()
 			if err != nil {
-				log.Errorf("rm %s failed: %s, %s", f, err, output)
+				log.Errorf("%s rm %s failed: %s, %s", s.logPrefix(), f, err, output)
 				return false
 			}
 		}
@@ -1224,6 +1560,8 @@ func (s *SKVMGuestInstance) ExitCleanup(clear bool) {
 		if pid > 0 {
 			s.clearCgroup(pid)
 		}
+		// incoming migration is over once qemu is going away
+		s.manager.ReleaseGuestMigratePort(s)
 	}
 	if s.Monitor != nil {
 		s.Monitor.Disconnect()
@@ -1234,7 +1572,7 @@ func (s *SKVMGuestInstance) ExitCleanup(clear bool) {
 func (s *SKVMGuestInstance) CleanupCpuset() {
 	task := cgrouputils.NewCGroupCPUSetTask(strconv.Itoa(s.GetPid()), s.GetCgroupName(), 0, "")
 	if !task.RemoveTask() {
-		log.Warningf("remove cpuset cgroup error: %s, pid: %d", s.Id, s.GetPid())
+		log.Warningf("%s remove cpuset cgroup error, pid: %d", s.logPrefix(), s.GetPid())
 	}
 }
 
@@ -1281,7 +1619,7 @@ func (s *SKVMGuestInstance) delFlatFiles(ctx context.Context) error {
 		}
 		_, err := deployclient.GetDeployClient().DisconnectEsxiDisks(ctx, connections)
 		if err != nil {
-			log.Errorf("Disconnect %s esxi disks failed %s", s.GetName(), err)
+			log.Errorf("%s disconnect esxi disks failed %s", s.logPrefix(), err)
 			return err
 		}
 	}
@@ -1298,42 +1636,144 @@ func (s *SKVMGuestInstance) Delete(ctx context.Context, migrated bool) error {
 	if fileutils2.Exists(s.getQemuLogPath()) {
 		procutils.NewRemoteCommandAsFarAsPossible("mv", s.getQemuLogPath(), fmt.Sprintf("/tmp/%s-qemu.log", s.GetId())).Run()
 	}
-	output, err := procutils.NewCommand("rm", "-rf", s.HomeDir()).Output()
+	if err := s.removeGuestSecurityProfile(); err != nil {
+		log.Errorf("%s remove security profile: %s", s.logPrefix(), err)
+	}
+	s.manager.ReleaseGuestMigratePort(s)
+	return s.CleanupGuestFiles()
+}
+
+// CleanupGuestFiles removes guest home dir with everything under it, e.g.
+// pki, encrypt key, logs, sockets and nic scripts, guest must be stopped
+func (s *SKVMGuestInstance) CleanupGuestFiles() error {
+	if s.IsRunning() {
+		return errors.Errorf("%s is running, refuse to remove its files", s.logPrefix())
+	}
+	homeDir := s.HomeDir()
+	// never rm -rf servers path or anything out of it
+	if len(s.Id) == 0 || s.Id == "." || s.Id == ".." || strings.Contains(s.Id, "/") ||
+		len(s.manager.ServersPath) == 0 || path.Dir(homeDir) != path.Clean(s.manager.ServersPath) {
+		return errors.Errorf("%s is not a guest dir", homeDir)
+	}
+	fi, err := os.Lstat(homeDir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return errors.Wrapf(err, "stat %s", homeDir)
+	}
+	if !fi.IsDir() {
+		return errors.Errorf("%s is not a guest dir", homeDir)
+	}
+	output, err := procutils.NewCommand("rm", "-rf", homeDir).Output()
 	if err != nil {
-		return errors.Wrapf(err, "rm %s failed: %s", s.HomeDir(), output)
+		return errors.Wrapf(err, "rm %s failed: %s", homeDir, output)
 	}
+	log.Infof("%s removed guest dir %s", s.logPrefix(), homeDir)
 	return nil
 }
 
+// Stop is the fallback of stop task after powerdown timed out, qemu is
+// terminated without waiting for powerdown again
 func (s *SKVMGuestInstance) Stop() bool {
+	log.Infof("%s stop", s.logPrefix())
 	s.ExitCleanup(true)
-	if s.scriptStop() {
-		return true
-	} else {
-		return false
-	}
+	return s.runStopScript(STOP_SCRIPT_ARG_NO_POWERDOWN)
+}
+
+// StopGracefully stops qemu in all stages of stop script, powerdown included
+func (s *SKVMGuestInstance) StopGracefully() bool {
+	log.Infof("%s stop gracefully", s.logPrefix())
+	s.ExitCleanup(true)
+	return s.runStopScript("")
 }
 
 func (s *SKVMGuestInstance) scriptStart() error {
+	s.launchedAt = time.Now()
+	// links of nics are up in newly started qemu
+	s.nicLinkLock.Lock()
+	s.nicLinkDown = nil
+	s.nicLinkLock.Unlock()
+	if err := s.prepareRunAsUser(); err != nil {
+		return errors.Wrap(err, "prepareRunAsUser")
+	}
 	output, err := procutils.NewRemoteCommandAsFarAsPossible("bash", s.GetStartScriptPath()).Output()
 	if err != nil {
 		s.scriptStop()
 		return fmt.Errorf("Start VM Failed %s %s", output, err)
 	}
+	timeout := time.Duration(options.HostOptions.QemuStartupTimeoutSeconds) * time.Second
+	if err := s.waitQemuStartup(timeout); err != nil {
+		s.forceScriptStop()
+		return errors.Wrap(err, "waitQemuStartup")
+	}
+	s.watchdogFiredAt = time.Time{}
+	s.watchdogAction = ""
 	return nil
 }
 
-func (s *SKVMGuestInstance) scriptStop() bool {
-	_, err := procutils.NewRemoteCommandAsFarAsPossible("bash", s.GetStopScriptPath()).Output()
-	if err != nil {
-		log.Errorln(err)
+var (
+	// interval of checking launched qemu, replaced by tests
+	qemuStartupPollInterval = 500 * time.Millisecond
+	probeQmpStatus          = monitor.ProbeQmpStatus
+)
+
+// waitQemuStartup waits launched qemu creating pid file and answering
+// query-status on qmp monitor, a hung qemu fails the start instead of
+// looking started until later queries fail, 0 timeout skips waiting
+func (s *SKVMGuestInstance) waitQemuStartup(timeout time.Duration) error {
+	if timeout <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(timeout)
+	for s.GetPid() <= 0 {
+		if time.Now().After(deadline) {
+			return errors.Wrapf(errors.ErrTimeout, "qemu pid file %s not created in %s", s.GetPidFilePath(), timeout)
+		}
+		time.Sleep(qemuStartupPollInterval)
+	}
+	port := s.GetQmpMonitorPort(-1)
+	if !options.HostOptions.EnableQmpMonitor || port <= 0 {
+		return nil
+	}
+	address := fmt.Sprintf("127.0.0.1:%d", port)
+	for {
+		probeTimeout := time.Until(deadline)
+		if probeTimeout < qemuStartupPollInterval {
+			probeTimeout = qemuStartupPollInterval
+		}
+		status, err := probeQmpStatus(address, probeTimeout)
+		if err == nil {
+			log.Infof("%s qemu %d started, status %s", s.logPrefix(), s.GetPid(), status)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(errors.ErrTimeout, "qemu not answering query-status in %s: %s", timeout, err)
+		}
+		time.Sleep(qemuStartupPollInterval)
+	}
+}
+
+// quitNoShutdownQemu quits qemu started with -no-shutdown once guest is
+// powered off, which is told by the SHUTDOWN event, otherwise qemu stays
+// until stop task times out and kills it
+func (s *SKVMGuestInstance) quitNoShutdownQemu() bool {
+	if _, shutdownReason := s.getResetState(false); s.Monitor == nil || len(shutdownReason) == 0 || !s.isNoShutdown() {
 		return false
 	}
+	log.Infof("%s powered off with qemu kept by -no-shutdown, quit qemu", s.logPrefix())
+	ch := make(chan string, 1)
+	s.Monitor.SimpleCommand("quit", func(res string) { ch <- res })
+	select {
+	case <-ch:
+	case <-time.After(MONITOR_QUIT_TIMEOUT):
+		log.Warningf("%s quit qemu timeout", s.logPrefix())
+	}
+	s.ExitCleanup(true)
 	return true
 }
 
-func (s *SKVMGuestInstance) forceScriptStop() bool {
-	_, err := procutils.NewRemoteCommandAsFarAsPossible("bash", s.GetStopScriptPath(), "--force").Output()
+func (s *SKVMGuestInstance) runStopScript(arg string) bool {
+	_, err := procutils.NewRemoteCommandAsFarAsPossible("bash", s.GetStopScriptPath(), arg).Output()
 	if err != nil {
 		log.Errorln(err)
 		return false
@@ -1341,6 +1781,15 @@ func (s *SKVMGuestInstance) forceScriptStop() bool {
 	return true
 }
 
+// scriptStop quits qemu at once for internal cleanup
+func (s *SKVMGuestInstance) scriptStop() bool {
+	return s.runStopScript(STOP_SCRIPT_ARG_QUIT)
+}
+
+func (s *SKVMGuestInstance) forceScriptStop() bool {
+	return s.runStopScript(STOP_SCRIPT_ARG_FORCE)
+}
+
 func (s *SKVMGuestInstance) ExecStopTask(ctx context.Context, params interface{}) (jsonutils.JSONObject, error) {
 	timeout, ok := params.(int64)
 	if !ok {
@@ -1370,6 +1819,57 @@ func (s *SKVMGuestInstance) GetNicDescMatch(mac, ip, port, bridge string) *api.G
 	return nil
 }
 
+// getNicById finds nic by ifname or mac
+func (s *SKVMGuestInstance) getNicById(nicId string) *api.GuestnetworkJsonDesc {
+	for _, nic := range s.Desc.Nics {
+		if nic.Ifname == nicId || netutils2.MacEqual(nic.Mac, nicId) {
+			return nic
+		}
+	}
+	return nil
+}
+
+// SetNicLink sets link of guest nic up or down without detaching it,
+// nic is identified by ifname or mac
+func (s *SKVMGuestInstance) SetNicLink(nicId string, up bool) error {
+	nic := s.getNicById(nicId)
+	if nic == nil {
+		return errors.Wrapf(errors.ErrNotFound, "nic %s", nicId)
+	}
+	if s.Monitor == nil {
+		return errors.Errorf("guest %s monitor not connected", s.GetName())
+	}
+	// kept during set_link so that recorded links follow order of qemu
+	s.nicLinkLock.Lock()
+	defer s.nicLinkLock.Unlock()
+	ch := make(chan string, 1)
+	s.Monitor.SetLink(fmt.Sprintf("netdev-%s", nic.Ifname), up, func(res string) { ch <- res })
+	if res := <-ch; len(res) > 0 {
+		return errors.Errorf("set_link %s: %s", nic.Ifname, res)
+	}
+	log.Infof("%s nic %s link up: %v", s.logPrefix(), nic.Ifname, up)
+	if up {
+		delete(s.nicLinkDown, nic.Ifname)
+	} else {
+		if s.nicLinkDown == nil {
+			s.nicLinkDown = map[string]bool{}
+		}
+		s.nicLinkDown[nic.Ifname] = true
+	}
+	return nil
+}
+
+// GetNicLink tells whether link of guest nic is up, links are up unless set down by SetNicLink
+func (s *SKVMGuestInstance) GetNicLink(nicId string) (bool, error) {
+	nic := s.getNicById(nicId)
+	if nic == nil {
+		return false, errors.Wrapf(errors.ErrNotFound, "nic %s", nicId)
+	}
+	s.nicLinkLock.Lock()
+	defer s.nicLinkLock.Unlock()
+	return !s.nicLinkDown[nic.Ifname], nil
+}
+
 func pathEqual(disk, ndisk *api.GuestdiskJsonDesc) bool {
 	if disk.Path != "" && ndisk.Path != "" {
 		return disk.Path == ndisk.Path
@@ -1588,18 +2088,28 @@ func (s *SKVMGuestInstance) SyncConfig(
 		}
 	}
 
+	oldName := s.Desc.Name
 	if err := s.SaveDesc(desc); err != nil {
 		return nil, err
 	}
+	if oldName != desc.Name {
+		log.Infof("%s renamed from %s", s.logPrefix(), oldName)
+	}
 
 	if !s.IsRunning() {
 		return nil, nil
 	}
 
+	// qemu can't change -name and process title at runtime, they are taken
+	// from regenerated start script on next restart
 	vncPort := s.GetVncPort()
 	data := jsonutils.NewDict()
 	data.Set("vnc_port", jsonutils.NewInt(int64(vncPort)))
-	s.saveScripts(data)
+	if err := s.saveScripts(data); err != nil {
+		log.Errorf("%s save scripts: %s", s.logPrefix(), err)
+	} else if oldName != desc.Name {
+		log.Infof("%s qemu -name is still %s until restarted", s.logPrefix(), oldName)
+	}
 
 	if fwOnly {
 		res := jsonutils.NewDict()
@@ -1717,23 +2227,52 @@ func (s *SKVMGuestInstance) setCgroupCpu() {
 
 func (s *SKVMGuestInstance) setCgroupCPUSet() {
 	var input *api.ServerCPUSetInput
+	var realtimeCpus []int
 	if cpuset, ok := s.Desc.Metadata[api.VM_METADATA_CGROUP_CPUSET]; ok {
 		cpusetJson, err := jsonutils.ParseString(cpuset)
 		if err != nil {
-			log.Errorf("failed parse server %s cpuset %s: %s", s.Id, cpuset, err)
+			log.Errorf("%s failed parse cpuset %s: %s", s.logPrefix(), cpuset, err)
 			return
 		}
 		input = new(api.ServerCPUSetInput)
 		err = cpusetJson.Unmarshal(input)
 		if err != nil {
-			log.Errorf("failed unmarshal server %s cpuset %s", s.Id, err)
+			log.Errorf("%s failed unmarshal cpuset %s", s.logPrefix(), err)
+			return
+		}
+	} else if s.isRealtimeMode() {
+		cpus, err := s.getRealtimeCpus()
+		if err != nil {
+			log.Errorf("%s failed get realtime cpus: %s", s.logPrefix(), err)
 			return
 		}
+		input = &api.ServerCPUSetInput{CPUS: cpus}
+		realtimeCpus = cpus
+	}
+	numaNodes, err := s.getNumaNodes(uint64(s.Desc.Mem))
+	if err != nil {
+		log.Errorf("%s failed get numa nodes: %s", s.logPrefix(), err)
+	}
+	if input == nil && len(numaNodes) > 0 {
+		// vcpu affinity must be within cpuset of the process
+		input = &api.ServerCPUSetInput{}
+		for _, node := range numaNodes {
+			input.CPUS = append(input.CPUS, node.HostCpus...)
+		}
 	}
 	if _, err := s.CPUSet(context.Background(), input); err != nil {
 		log.Errorf("Do CPUSet error: %v", err)
 		return
 	}
+	if len(realtimeCpus) > 0 {
+		if err := s.pinRealtimeVcpus(realtimeCpus); err != nil {
+			log.Errorf("%s pin realtime vcpus: %s", s.logPrefix(), err)
+		}
+	} else if len(numaNodes) > 0 {
+		if err := s.pinNumaVcpus(numaNodes); err != nil {
+			log.Errorf("%s pin numa vcpus: %s", s.logPrefix(), err)
+		}
+	}
 }
 
 func (s *SKVMGuestInstance) CreateFromDesc(desc *desc.SGuestDesc) error {
@@ -1924,7 +2463,7 @@ func (s *SKVMGuestInstance) ListStateFilePaths() []string {
 
 func (s *SKVMGuestInstance) CleanStatefiles() {
 	for _, stateFile := range s.ListStateFilePaths() {
-		log.Infof("Server %s remove statefile %q", s.GetName(), stateFile)
+		log.Infof("%s remove statefile %q", s.logPrefix(), stateFile)
 		if _, err := procutils.NewCommand("mountpoint", stateFile).Output(); err == nil {
 			if output, err := procutils.NewCommand("umount", stateFile).Output(); err != nil {
 				log.Errorf("umount %s failed: %s, %s", stateFile, err, output)
@@ -1940,11 +2479,11 @@ func (s *SKVMGuestInstance) CleanStatefiles() {
 }
 
 func (s *SKVMGuestInstance) GetFuseTmpPath() string {
-	return path.Join(s.HomeDir(), "tmp")
+	return s.Paths().FuseTmp
 }
 
 func (s *SKVMGuestInstance) StreamDisks(ctx context.Context, callback func(), disksIdx []int) {
-	log.Infof("Start guest block stream task %s ...", s.GetName())
+	log.Infof("%s start guest block stream task ...", s.logPrefix())
 	task := NewGuestStreamDisksTask(ctx, s, callback, disksIdx)
 	task.Start()
 }
@@ -2151,16 +2690,123 @@ func (s *SKVMGuestInstance) PrepareDisksMigrate(liveMigrage bool) (*jsonutils.JS
 	return disksBackFile, nil
 }
 
+// QueryBalloon returns actual memory size of guest with balloon device and
+// guest memory stats if stats polling is on
+func (s *SKVMGuestInstance) QueryBalloon() (*monitor.BalloonInfo, error) {
+	if !s.isBalloonEnabled() {
+		return nil, errors.Wrap(errors.ErrNotSupported, "guest has no balloon device")
+	}
+	mon, ok := s.Monitor.(*monitor.QmpMonitor)
+	if !ok {
+		return nil, errors.Wrap(errors.ErrNotSupported, "query balloon requires qmp monitor")
+	}
+	type result struct {
+		info *monitor.BalloonInfo
+		err  error
+	}
+	ch := make(chan result, 1)
+	mon.QueryBalloon(qemu.BALLOON_QOM_PATH, func(info *monitor.BalloonInfo, err error) {
+		ch <- result{info, err}
+	})
+	r := <-ch
+	return r.info, r.err
+}
+
+// SetBalloon changes guest memory to sizeBytes through balloon device, it
+// can't exceed memory guest is started with
+func (s *SKVMGuestInstance) SetBalloon(sizeBytes int64) error {
+	if !s.isBalloonEnabled() {
+		return errors.Wrap(errors.ErrNotSupported, "guest has no balloon device")
+	}
+	maxBytes := s.Desc.Mem * 1024 * 1024
+	if sizeBytes <= 0 || sizeBytes > maxBytes {
+		return errors.Errorf("balloon size %d out of range (0, %d]", sizeBytes, maxBytes)
+	}
+	if s.Monitor == nil {
+		return errors.Errorf("guest %s monitor not connected", s.GetName())
+	}
+	ch := make(chan string, 1)
+	s.Monitor.SetBalloon(sizeBytes, func(res string) { ch <- res })
+	if res := <-ch; len(res) > 0 {
+		return errors.Errorf("set balloon %d: %s", sizeBytes, res)
+	}
+	log.Infof("%s balloon set to %d bytes", s.logPrefix(), sizeBytes)
+	return nil
+}
+
+func (s *SKVMGuestInstance) setBalloonStatsPolling(interval int) {
+	mon, ok := s.Monitor.(*monitor.QmpMonitor)
+	if !ok {
+		return
+	}
+	mon.SetBalloonStatsPolling(qemu.BALLOON_QOM_PATH, interval, func(res string) {
+		if len(res) > 0 {
+			log.Errorf("%s set balloon stats polling interval %d: %s", s.logPrefix(), interval, res)
+		}
+	})
+}
+
 func (s *SKVMGuestInstance) onlineResizeDisk(ctx context.Context, diskId string, sizeMB int64) {
 	task := NewGuestOnlineResizeDiskTask(ctx, s, diskId, sizeMB)
 	task.Start()
 }
 
+// MirrorDisk moves running guest disk to targetPath, guest switches to target once mirror is in sync
+func (s *SKVMGuestInstance) MirrorDisk(diskId, targetPath string, callback monitor.StringCallback) error {
+	mon, ok := s.Monitor.(*monitor.QmpMonitor)
+	if !ok {
+		return errors.Wrap(errors.ErrNotSupported, "mirror disk requires qmp monitor")
+	}
+	for _, disk := range s.Desc.Disks {
+		if disk.DiskId != diskId {
+			continue
+		}
+		format := disk.Format
+		if len(format) == 0 {
+			format = "qcow2"
+		}
+		onProgress := func(job monitor.BlockJob) {
+			if job.Len > 0 {
+				hostutils.UpdateServerProgress(context.Background(), s.Id, float64(job.Offset)/float64(job.Len)*100.0, 0)
+			}
+		}
+		mon.MirrorDisk(fmt.Sprintf("drive_%d", disk.Index), targetPath, format, onProgress, callback)
+		return nil
+	}
+	return errors.Wrapf(errors.ErrNotFound, "disk %s", diskId)
+}
+
 func (s *SKVMGuestInstance) BlockIoThrottle(ctx context.Context, bps, iops int64) error {
 	task := SGuestBlockIoThrottleTask{s, ctx, bps, iops}
 	return task.Start()
 }
 
+var cgroupCpuThrottle = cgrouputils.CgroupCpuThrottle
+
+// SetCpuThrottle throttles percent of guest cpu time by cgroup cpu quota, 0 removes
+// throttling. During live migration the percent is also passed to qemu auto-converge
+// as cpu-throttle-initial
+func (s *SKVMGuestInstance) SetCpuThrottle(percent int) error {
+	if percent < 0 || percent > 100 {
+		return errors.Errorf("invalid cpu throttle percent %d, should be in 0..100", percent)
+	}
+	if !s.IsRunning() || s.cgroupPid == 0 {
+		return errors.Errorf("guest %s not running", s.GetName())
+	}
+	if err := cgroupCpuThrottle(strconv.Itoa(s.cgroupPid), s.GetCgroupName(), int(s.Desc.Cpu), percent); err != nil {
+		return errors.Wrap(err, "CgroupCpuThrottle")
+	}
+	// qemu only accepts cpu-throttle-initial in 1..99
+	if s.MigrateTask != nil && s.Monitor != nil && percent > 0 && percent < 100 {
+		s.Monitor.MigrateSetParameter("cpu-throttle-initial", percent, func(res string) {
+			if len(res) > 0 {
+				log.Errorf("%s set cpu-throttle-initial %d failed: %s", s.logPrefix(), percent, res)
+			}
+		})
+	}
+	return nil
+}
+
 func (s *SKVMGuestInstance) IsSharedStorage() bool {
 	disks := s.Desc.Disks
 	for i := 0; i < len(disks); i++ {
@@ -2176,11 +2822,11 @@ func (s *SKVMGuestInstance) IsSharedStorage() bool {
 	return true
 }
 
-func (s *SKVMGuestInstance) generateDiskSetupScripts(disks []*api.GuestdiskJsonDesc) (string, error) {
+func (s *SKVMGuestInstance) generateDiskSetupScripts(host startScriptHost, disks []*api.GuestdiskJsonDesc) (string, error) {
 	cmd := " "
 	for i := range disks {
 		diskPath := disks[i].Path
-		d, err := storageman.GetManager().GetDiskByPath(diskPath)
+		d, err := host.GetDiskByPath(diskPath)
 		if err != nil {
 			return "", errors.Wrapf(err, "GetDiskByPath(%s)", diskPath)
 		}
@@ -15,9 +15,17 @@
 package guestman
 
 import (
+	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
+	"os"
+	"os/user"
 	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -25,6 +33,7 @@ import (
 	"github.com/mdlayher/arp"
 	"github.com/mdlayher/ethernet"
 	"github.com/sergi/go-diff/diffmatchpatch"
+	"golang.org/x/sys/unix"
 
 	"yunion.io/x/jsonutils"
 	"yunion.io/x/log"
@@ -33,12 +42,18 @@ import (
 
 	"yunion.io/x/onecloud/pkg/apis"
 	api "yunion.io/x/onecloud/pkg/apis/compute"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/desc"
 	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
 	qemucerts "yunion.io/x/onecloud/pkg/hostman/guestman/qemu/certs"
+	"yunion.io/x/onecloud/pkg/hostman/hostutils"
+	"yunion.io/x/onecloud/pkg/hostman/monitor"
 	"yunion.io/x/onecloud/pkg/hostman/options"
+	"yunion.io/x/onecloud/pkg/hostman/storageman"
+	"yunion.io/x/onecloud/pkg/util/cgrouputils"
+	"yunion.io/x/onecloud/pkg/util/fileutils2"
+	"yunion.io/x/onecloud/pkg/util/netutils2"
 	"yunion.io/x/onecloud/pkg/util/procutils"
 	"yunion.io/x/onecloud/pkg/util/qemutils"
-	"yunion.io/x/onecloud/pkg/util/sysutils"
 )
 
 const (
@@ -58,8 +73,123 @@ const (
 	DISK_DRIVER_PVSCSI = qemu.DISK_DRIVER_PVSCSI
 	DISK_DRIVER_IDE    = qemu.DISK_DRIVER_IDE
 	DISK_DRIVER_SATA   = qemu.DISK_DRIVER_SATA
+
+	NIC_DRIVER_VIRTIO  = qemu.NIC_DRIVER_VIRTIO
+	NIC_DRIVER_E1000   = qemu.NIC_DRIVER_E1000
+	NIC_DRIVER_E1000E  = qemu.NIC_DRIVER_E1000E
+	NIC_DRIVER_VMXNET3 = qemu.NIC_DRIVER_VMXNET3
+)
+
+// max count of nic down scripts running concurrently in start script
+const NIC_DOWNSCRIPT_PARALLELISM = 8
+
+// generateParallelScripts runs cmds in background, at most parallel of them at a time
+func generateParallelScripts(cmds []string, parallel int) string {
+	if parallel < 1 {
+		parallel = 1
+	}
+	script := ""
+	for i, cmd := range cmds {
+		script += fmt.Sprintf("%s &\n", cmd)
+		if (i+1)%parallel == 0 || i == len(cmds)-1 {
+			script += "wait\n"
+		}
+	}
+	return script
+}
+
+// generateMultiQueueTapScripts creates persistent multi-queue taps of nics before
+// qemu attaches queues to them, taps already existing are left as they are
+func generateMultiQueueTapScripts(nics []*api.GuestnetworkJsonDesc) string {
+	script := ""
+	for _, nic := range nics {
+		if !qemu.IsNicMultiQueue(nic) {
+			continue
+		}
+		script += fmt.Sprintf("if [ ! -e /sys/class/net/%s ]; then\n", nic.Ifname)
+		script += fmt.Sprintf("  ip tuntap add dev %s mode tap multi_queue\n", nic.Ifname)
+		script += "fi\n"
+	}
+	return script
+}
+
+var (
+	envNameReg = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+	// variables of start script itself
+	startScriptVars = []string{
+		"CMD", "QEMU_CMD", "QEMU_CMD_KVM_ARG", "DEFAULT_QEMU_CMD",
+		"STATE_FILE", "PID_FILE", "VNC_FILE", "PATH",
+	}
 )
 
+// generateEnvScript exports envs before launching qemu, values are single quoted for shell
+func generateEnvScript(envs map[string]string) (string, error) {
+	names := make([]string, 0, len(envs))
+	for name := range envs {
+		if !envNameReg.MatchString(name) {
+			return "", errors.Errorf("invalid env name %q", name)
+		}
+		if utils.IsInStringArray(name, startScriptVars) || strings.HasPrefix(name, "DISK_") {
+			return "", errors.Errorf("env %s is reserved by start script", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	script := ""
+	for _, name := range names {
+		script += fmt.Sprintf("export %s='%s'\n", name, strings.ReplaceAll(envs[name], "'", `'\''`))
+	}
+	return script, nil
+}
+
+const (
+	GUEST_HOOK_PRE_START  = "pre-start"
+	GUEST_HOOK_POST_START = "post-start"
+	GUEST_HOOK_POST_STOP  = "post-stop"
+)
+
+// generateHookScript runs hook with guest identities in env, start or stop script
+// exits when hook fails if abortOnFail
+func (s *SKVMGuestInstance) generateHookScript(hook, event string, abortOnFail bool) string {
+	if len(hook) == 0 {
+		return ""
+	}
+	quote := func(val string) string {
+		return "'" + strings.ReplaceAll(val, "'", `'\''`) + "'"
+	}
+	script := fmt.Sprintf("GUEST_ID=%s GUEST_UUID=%s GUEST_NAME=%s %s\n",
+		quote(s.Id), quote(s.Desc.Uuid), quote(s.Desc.Name), quote(hook))
+	script += "if [ $? -ne 0 ]; then\n"
+	script += fmt.Sprintf("  echo \"%s hook %s failed\"\n", event, hook)
+	if abortOnFail {
+		script += "  exit 1\n"
+	}
+	script += "fi\n"
+	return script
+}
+
+// runPostStartHook runs hook after guest is confirmed running, guest keeps
+// running regardless of the hook result
+func (s *SKVMGuestInstance) runPostStartHook() error {
+	hook := options.HostOptions.GuestPostStartHook
+	if len(hook) == 0 {
+		return nil
+	}
+	output, err := procutils.NewCommand("env",
+		"GUEST_ID="+s.Id,
+		"GUEST_UUID="+s.Desc.Uuid,
+		"GUEST_NAME="+s.Desc.Name,
+		fmt.Sprintf("GUEST_PID=%d", s.GetPid()),
+		fmt.Sprintf("GUEST_VNC_PORT=%d", s.GetVncPort()),
+		hook,
+	).Output()
+	if err != nil {
+		return errors.Wrapf(err, "%s hook %s: %s", GUEST_HOOK_POST_START, hook, output)
+	}
+	return nil
+}
+
 func (s *SKVMGuestInstance) IsKvmSupport() bool {
 	return guestManager.GetHost().IsKvmSupport()
 }
@@ -75,10 +205,806 @@ func (s *SKVMGuestInstance) getOsname() string {
 	return OS_NAME_LINUX
 }
 
+// enable_balloon adds virtio balloon device, through which guest memory
+// stats are read
+func (s *SKVMGuestInstance) isBalloonEnabled() bool {
+	return s.Desc.Metadata["enable_balloon"] == "true"
+}
+
 func (s *SKVMGuestInstance) disableUsbKbd() bool {
 	return s.Desc.Metadata["disable_usb_kbd"] == "true"
 }
 
+func (s *SKVMGuestInstance) disableUsbTablet() bool {
+	return s.Desc.Metadata["disable_usb_tablet"] == "true"
+}
+
+// disable_usb removes usb controllers and usb input devices, virtio input
+// devices are kept
+func (s *SKVMGuestInstance) disableUsb() bool {
+	return isUsbDisabled(s.Desc)
+}
+
+func isUsbDisabled(desc *desc.SGuestDesc) bool {
+	return desc.Metadata["disable_usb"] == "true"
+}
+
+// input device type usb or virtio, default usb
+func (s *SKVMGuestInstance) getInputDeviceType() string {
+	if s.Desc.Metadata["input_device_type"] == "virtio" {
+		return "virtio"
+	}
+	return "usb"
+}
+
+// getAarch64Vga returns vga of aarch64 guest, which is virtio gpu or none for
+// headless guest, std vga of desc defaults to virtio gpu as aarch64 has no
+// legacy vga, other types are not supported and fall back to virtio gpu
+func (s *SKVMGuestInstance) getAarch64Vga() string {
+	switch s.Desc.Vga {
+	case "none":
+		return "none"
+	case "", "std", "virtio":
+	default:
+		log.Warningf("%s vga %s is not supported on aarch64, use virtio", s.logPrefix(), s.Desc.Vga)
+	}
+	return "virtio"
+}
+
+func (s *SKVMGuestInstance) getAarch64Devices(maxOutputs int) []string {
+	devices := []string{}
+	if s.getInputDeviceType() == "virtio" {
+		if !s.disableUsbTablet() {
+			devices = append(devices, "virtio-tablet-pci,id=input0")
+		}
+		if !s.disableUsbKbd() {
+			devices = append(devices, "virtio-keyboard-pci,id=input1")
+		}
+	} else if !s.disableUsb() && (!s.disableUsbTablet() || !s.disableUsbKbd()) {
+		devices = append(devices, "qemu-xhci,p2=8,p3=8,id=usb1")
+		if !s.disableUsbTablet() {
+			devices = append(devices, "usb-tablet,id=input0,bus=usb1.0,port=1")
+		}
+		if !s.disableUsbKbd() {
+			devices = append(devices, "usb-kbd,id=input1,bus=usb1.0,port=2")
+		}
+	}
+	if s.getAarch64Vga() == "none" {
+		return devices
+	}
+	return append(devices, fmt.Sprintf("virtio-gpu-pci,id=video1,max_outputs=%d", maxOutputs))
+}
+
+func (s *SKVMGuestInstance) getX86InputDevices() []string {
+	virtio := s.getInputDeviceType() == "virtio"
+	if !virtio && s.disableUsb() {
+		return []string{}
+	}
+	devices := []string{}
+	if !utils.IsInStringArray(s.getOsDistribution(), []string{OS_NAME_OPENWRT, OS_NAME_CIRROS}) &&
+		!s.isOldWindows() && !s.isWindows10() &&
+		!s.disableUsbKbd() {
+		if virtio {
+			devices = append(devices, "virtio-keyboard-pci")
+		} else {
+			devices = append(devices, "usb-kbd")
+		}
+	}
+	if s.getOsname() == OS_NAME_ANDROID {
+		if virtio {
+			devices = append(devices, "virtio-mouse-pci")
+		} else {
+			devices = append(devices, "usb-mouse")
+		}
+	} else if !s.isOldWindows() && !s.disableUsbTablet() {
+		if virtio {
+			devices = append(devices, "virtio-tablet-pci")
+		} else {
+			devices = append(devices, "usb-tablet")
+		}
+	}
+	return devices
+}
+
+func (s *SKVMGuestInstance) getCpuModel() string {
+	return s.Desc.Metadata["cpu_model"]
+}
+
+func (s *SKVMGuestInstance) getCpuFeatures() []string {
+	features := []string{}
+	for _, feature := range strings.Split(s.Desc.Metadata["cpu_features"], ",") {
+		feature = strings.TrimSpace(feature)
+		if len(feature) > 0 {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// features of metadata cpu_masked_features subtracted from host passthrough
+// cpu, e.g. pdpe1gb,avx512f for a migration safe baseline among hosts
+func (s *SKVMGuestInstance) getCpuMaskedFeatures() []string {
+	features := []string{}
+	for _, feature := range strings.Split(s.Desc.Metadata["cpu_masked_features"], ",") {
+		feature = strings.TrimSpace(feature)
+		if len(feature) > 0 {
+			features = append(features, feature)
+		}
+	}
+	return features
+}
+
+// getCpuMigratable returns on or off of metadata cpu_migratable, which only
+// takes effect on host passthrough cpu
+func (s *SKVMGuestInstance) getCpuMigratable() (string, error) {
+	val := s.Desc.Metadata["cpu_migratable"]
+	switch val {
+	case "", "on", "off":
+		return val, nil
+	}
+	return "", errors.Errorf("invalid cpu_migratable %q, want on or off", val)
+}
+
+// validateCpuMigratable rejects migrating a guest of which host cpu is
+// explicitly non-migratable
+func (s *SKVMGuestInstance) validateCpuMigratable(migrate bool) error {
+	migratable, err := s.getCpuMigratable()
+	if err != nil {
+		return err
+	}
+	if migrate && migratable == "off" && options.HostOptions.HostCpuPassthrough {
+		return errors.Errorf("host cpu with migratable=off can't be migrated")
+	}
+	return nil
+}
+
+func (s *SKVMGuestInstance) isBootMenuEnabled() bool {
+	return s.Desc.Metadata["boot_menu"] == "true"
+}
+
+func (s *SKVMGuestInstance) isBootStrict() bool {
+	return s.Desc.Metadata["boot_strict"] == "true"
+}
+
+// boot menu splash timeout in milliseconds, 0 means not set
+func (s *SKVMGuestInstance) getBootMenuSplashTime() (uint, error) {
+	val := s.Desc.Metadata["boot_splash_time"]
+	if len(val) == 0 {
+		return 0, nil
+	}
+	splashTime, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid boot_splash_time %q", val)
+	}
+	return uint(splashTime), nil
+}
+
+// getBootSplash returns bmp picture of metadata boot_splash shown as logo
+// during boot menu
+func (s *SKVMGuestInstance) getBootSplash() (string, error) {
+	splash := s.Desc.Metadata["boot_splash"]
+	if len(splash) == 0 {
+		return "", nil
+	}
+	if err := qemu.ValidateSafePath(splash); err != nil {
+		return "", errors.Wrap(err, "boot_splash")
+	}
+	f, err := os.Open(splash)
+	if err != nil {
+		return "", errors.Wrapf(err, "open boot_splash %s", splash)
+	}
+	defer f.Close()
+	magic := make([]byte, 2)
+	if _, err := io.ReadFull(f, magic); err != nil || string(magic) != "BM" {
+		return "", errors.Errorf("boot_splash %s is not a bmp picture", splash)
+	}
+	return splash, nil
+}
+
+func (s *SKVMGuestInstance) isOvercommitMemLock() bool {
+	return s.Desc.Metadata["overcommit_mem_lock"] == "true"
+}
+
+func (s *SKVMGuestInstance) isOvercommitCpuPm() bool {
+	return s.Desc.Metadata["overcommit_cpu_pm"] == "true"
+}
+
+// qemu inherits RLIMIT_MEMLOCK from host, mlock whole guest memory must fit in it
+func checkMemLockLimit(memMB uint64, limit *unix.Rlimit) error {
+	if limit.Cur == unix.RLIM_INFINITY {
+		return nil
+	}
+	memBytes := memMB * 1024 * 1024
+	if limit.Cur < memBytes {
+		return errors.Errorf("guest memory %dMB exceeds RLIMIT_MEMLOCK %d bytes", memMB, limit.Cur)
+	}
+	return nil
+}
+
+func validateMemLock(memMB uint64) error {
+	var limit unix.Rlimit
+	if err := unix.Getrlimit(unix.RLIMIT_MEMLOCK, &limit); err != nil {
+		return errors.Wrap(err, "get RLIMIT_MEMLOCK")
+	}
+	return checkMemLockLimit(memMB, &limit)
+}
+
+// global properties in form of driver.property=value separated by comma
+func (s *SKVMGuestInstance) getGlobalProperties() ([]qemu.GlobalProperty, error) {
+	props := []qemu.GlobalProperty{}
+	for _, str := range strings.Split(s.Desc.Metadata["qemu_global_properties"], ",") {
+		str = strings.TrimSpace(str)
+		if len(str) == 0 {
+			continue
+		}
+		prop, err := qemu.ParseGlobalProperty(str)
+		if err != nil {
+			return nil, err
+		}
+		props = append(props, prop)
+	}
+	return props, nil
+}
+
+const (
+	DISPLAY_RESOLUTION_MIN = 320
+	DISPLAY_RESOLUTION_MAX = 8192
+)
+
+func validateDisplayResolution(width, height int) error {
+	for _, v := range []int{width, height} {
+		if v < DISPLAY_RESOLUTION_MIN || v > DISPLAY_RESOLUTION_MAX {
+			return errors.Errorf("display resolution %dx%d out of range [%d, %d]",
+				width, height, DISPLAY_RESOLUTION_MIN, DISPLAY_RESOLUTION_MAX)
+		}
+	}
+	return nil
+}
+
+// getDisplayResolutionDriver returns display device of which xres and yres
+// set preferred resolution of guest, empty if vga doesn't support it
+func getDisplayResolutionDriver(isArm bool, vga string, isVdiSpice bool) string {
+	if isArm {
+		if vga == "none" {
+			return ""
+		}
+		return "virtio-gpu-pci"
+	}
+	if isVdiSpice {
+		return "qxl-vga"
+	}
+	switch vga {
+	case "qxl":
+		return "qxl-vga"
+	case "virtio":
+		return "virtio-vga"
+	}
+	return ""
+}
+
+// display resolution kept in host desc in form of WIDTHxHEIGHT, 0 means not set
+func (s *SKVMGuestInstance) getDisplayResolution() (int, int, error) {
+	val := s.Desc.DisplayResolution
+	if len(val) == 0 {
+		return 0, 0, nil
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(val, "%dx%d", &width, &height); err != nil || fmt.Sprintf("%dx%d", width, height) != val {
+		return 0, 0, errors.Errorf("invalid display resolution %q, want WIDTHxHEIGHT", val)
+	}
+	if err := validateDisplayResolution(width, height); err != nil {
+		return 0, 0, err
+	}
+	return width, height, nil
+}
+
+// getDisplayResolutionProperties sets xres and yres of display device
+func (s *SKVMGuestInstance) getDisplayResolutionProperties(isArm bool) ([]qemu.GlobalProperty, error) {
+	width, height, err := s.getDisplayResolution()
+	if err != nil || width == 0 {
+		return nil, err
+	}
+	driver := getDisplayResolutionDriver(isArm, s.Desc.Vga, s.IsVdiSpice())
+	if len(driver) == 0 {
+		log.Warningf("%s vga %s doesn't support display resolution, %dx%d ignored", s.logPrefix(), s.Desc.Vga, width, height)
+		return nil, nil
+	}
+	return []qemu.GlobalProperty{
+		{Driver: driver, Property: "xres", Value: strconv.Itoa(width)},
+		{Driver: driver, Property: "yres", Value: strconv.Itoa(height)},
+	}, nil
+}
+
+// virtio gpu supports 16 scanouts at most
+const DISPLAY_MAX_OUTPUTS_LIMIT = 16
+
+// number of virtio gpu outputs of metadata display_max_outputs for multiple
+// monitors, defaults to 1
+func (s *SKVMGuestInstance) getDisplayMaxOutputs() (int, error) {
+	val := s.Desc.Metadata["display_max_outputs"]
+	if len(val) == 0 {
+		return 1, nil
+	}
+	outputs, err := strconv.Atoi(val)
+	if err != nil || outputs < 1 || outputs > DISPLAY_MAX_OUTPUTS_LIMIT {
+		return 0, errors.Errorf("invalid display_max_outputs %q, want 1-%d", val, DISPLAY_MAX_OUTPUTS_LIMIT)
+	}
+	return outputs, nil
+}
+
+// getDisplayMaxOutputsProperties sets max_outputs of x86 virtio vga, virtio
+// gpu of aarch64 sets it in device options
+func (s *SKVMGuestInstance) getDisplayMaxOutputsProperties(maxOutputs int) []qemu.GlobalProperty {
+	if maxOutputs <= 1 {
+		return nil
+	}
+	driver := getDisplayResolutionDriver(false, s.Desc.Vga, s.IsVdiSpice())
+	if driver != "virtio-vga" {
+		log.Warningf("%s vga %s isn't virtio gpu, display_max_outputs %d ignored", s.logPrefix(), s.Desc.Vga, maxOutputs)
+		return nil
+	}
+	return []qemu.GlobalProperty{
+		{Driver: driver, Property: "max_outputs", Value: strconv.Itoa(maxOutputs)},
+	}
+}
+
+const (
+	ACPI_TABLE_HEADER_SIZE = 36
+	ACPI_TABLE_MAX_SIZE    = 1024 * 1024
+)
+
+// validateAcpiTable checks file holds a single acpi table: 4 chars signature
+// and length of header matching file size
+func validateAcpiTable(file string) error {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() || fi.Size() < ACPI_TABLE_HEADER_SIZE || fi.Size() > ACPI_TABLE_MAX_SIZE {
+		return errors.Errorf("%s is not an acpi table file of size %d-%d", file, ACPI_TABLE_HEADER_SIZE, ACPI_TABLE_MAX_SIZE)
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	header := make([]byte, ACPI_TABLE_HEADER_SIZE)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return errors.Wrap(err, "read header")
+	}
+	for _, c := range header[:4] {
+		if !(c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_') {
+			return errors.Errorf("%s invalid acpi table signature %q", file, header[:4])
+		}
+	}
+	if length := binary.LittleEndian.Uint32(header[4:8]); int64(length) != fi.Size() {
+		return errors.Errorf("%s acpi table length %d mismatches file size %d", file, length, fi.Size())
+	}
+	return nil
+}
+
+// acpi table files separated by comma, e.g. SLIC table for OEM activation,
+// only tables under host AcpiTablesDir are loaded as files are read by root
+func (s *SKVMGuestInstance) getAcpiTables() ([]string, error) {
+	files := []string{}
+	for _, file := range strings.Split(s.Desc.Metadata["acpi_tables"], ",") {
+		file = strings.TrimSpace(file)
+		if len(file) == 0 {
+			continue
+		}
+		if err := qemu.ValidateSafePath(file); err != nil {
+			return nil, errors.Wrap(err, "acpi_tables")
+		}
+		if len(options.HostOptions.AcpiTablesDir) == 0 {
+			return nil, errors.Errorf("acpi table %s: acpi tables dir of host is not set", file)
+		}
+		tablesDir, err := filepath.EvalSymlinks(options.HostOptions.AcpiTablesDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "acpi tables dir %s", options.HostOptions.AcpiTablesDir)
+		}
+		realPath, err := filepath.EvalSymlinks(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "acpi table %s", file)
+		}
+		if !strings.HasPrefix(realPath, tablesDir+"/") {
+			return nil, errors.Errorf("acpi table %s is out of %s", file, options.HostOptions.AcpiTablesDir)
+		}
+		if err := qemu.ValidateSafePath(realPath); err != nil {
+			return nil, errors.Wrap(err, "acpi_tables")
+		}
+		if err := validateAcpiTable(realPath); err != nil {
+			return nil, errors.Wrapf(err, "acpi table %s", file)
+		}
+		files = append(files, realPath)
+	}
+	return files, nil
+}
+
+// host device nodes of each char device type allowed to pass through
+var hostCharDevicePrefixes = map[string]string{
+	qemu.HOST_CHARDEV_SERIAL:   "/dev/tty",
+	qemu.HOST_CHARDEV_PARALLEL: "/dev/parport",
+}
+
+// host serial and parallel ports passed through to guest, device paths of
+// metadata host_serial_devices and host_parallel_devices separated by comma,
+// e.g. /dev/ttyS1,/dev/ttyUSB0. Only /dev/tty* and /dev/parport* nodes are
+// allowed, symlinks e.g. /dev/serial/by-id/* are resolved to them
+func (s *SKVMGuestInstance) getHostCharDevices() ([]qemu.HostCharDevice, error) {
+	devs := []qemu.HostCharDevice{}
+	for _, t := range []string{qemu.HOST_CHARDEV_SERIAL, qemu.HOST_CHARDEV_PARALLEL} {
+		for _, dev := range strings.Split(s.Desc.Metadata["host_"+t+"_devices"], ",") {
+			dev = strings.TrimSpace(dev)
+			if len(dev) == 0 {
+				continue
+			}
+			if err := qemu.ValidateSafePath(dev); err != nil {
+				return nil, errors.Wrapf(err, "host %s device", t)
+			}
+			realPath, err := filepath.EvalSymlinks(dev)
+			if err != nil {
+				return nil, errors.Wrapf(err, "host %s device %s", t, dev)
+			}
+			if !strings.HasPrefix(realPath, hostCharDevicePrefixes[t]) {
+				return nil, errors.Errorf("host %s device %s should be %s*", t, dev, hostCharDevicePrefixes[t])
+			}
+			fi, err := os.Stat(realPath)
+			if err != nil {
+				return nil, errors.Wrapf(err, "host %s device %s", t, dev)
+			}
+			if fi.Mode()&os.ModeCharDevice == 0 {
+				return nil, errors.Errorf("host %s device %s is not a character device", t, dev)
+			}
+			devs = append(devs, qemu.HostCharDevice{Type: t, Path: realPath})
+		}
+	}
+	return devs, nil
+}
+
+// trace event name patterns, e.g. virtio_blk_*
+var traceEnableReg = regexp.MustCompile(`^[A-Za-z0-9_*]+$`)
+
+// qemu trace events enabled by pattern of metadata qemu_trace_enable, e.g. virtio_blk_*,
+// and/or events file of metadata qemu_trace_events, only when host allows qemu tracing
+func (s *SKVMGuestInstance) getQemuTrace() (*qemu.TraceOption, error) {
+	trace := &qemu.TraceOption{
+		Enable: strings.TrimSpace(s.Desc.Metadata["qemu_trace_enable"]),
+		Events: strings.TrimSpace(s.Desc.Metadata["qemu_trace_events"]),
+	}
+	if len(trace.Enable) == 0 && len(trace.Events) == 0 {
+		return nil, nil
+	}
+	if !options.HostOptions.EnableQemuTrace {
+		log.Warningf("%s qemu trace is not enabled on host, ignore trace metadata", s.logPrefix())
+		return nil, nil
+	}
+	if len(trace.Enable) > 0 && !traceEnableReg.MatchString(trace.Enable) {
+		return nil, errors.Errorf("invalid qemu_trace_enable %q", trace.Enable)
+	}
+	if len(trace.Events) > 0 {
+		if err := qemu.ValidateSafePath(trace.Events); err != nil {
+			return nil, errors.Wrap(err, "qemu_trace_events")
+		}
+		if !fileutils2.IsFile(trace.Events) {
+			return nil, errors.Wrapf(errors.ErrNotFound, "trace events file %s", trace.Events)
+		}
+	}
+	trace.File = s.getQemuTracePath()
+	return trace, nil
+}
+
+// alignHugepagesMem checks memory in MB is multiple of hugepage size which
+// hugetlbfs allocates by, misaligned memory is rounded up if roundUp
+func alignHugepagesMem(memMb uint64, pageSizeKb int, roundUp bool) (uint64, error) {
+	if pageSizeKb <= 0 {
+		return 0, errors.Errorf("invalid hugepage size %dKB", pageSizeKb)
+	}
+	pageKb := uint64(pageSizeKb)
+	memKb := memMb * 1024
+	if memKb%pageKb == 0 {
+		return memMb, nil
+	}
+	if !roundUp {
+		return 0, errors.Errorf("memory %dMB is not multiple of hugepage size %dKB", memMb, pageSizeKb)
+	}
+	memKb = (memKb/pageKb + 1) * pageKb
+	return (memKb + 1023) / 1024, nil
+}
+
+// vnc listen address from host option only, an address of guest would move
+// with the guest to hosts it isn't configured on
+func (s *SKVMGuestInstance) getVncListenAddress() (string, error) {
+	addr := options.HostOptions.VncListenAddress
+	if len(addr) > 0 && net.ParseIP(addr) == nil {
+		return "", errors.Errorf("invalid vnc listen address %q", addr)
+	}
+	return addr, nil
+}
+
+// smbios type 11 oem strings in json array, values may contain comma
+func (s *SKVMGuestInstance) getSmbiosOemStrings() ([]string, error) {
+	val := s.Desc.Metadata["smbios_oem_strings"]
+	if len(val) == 0 {
+		return nil, nil
+	}
+	obj, err := jsonutils.ParseString(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse smbios_oem_strings %q", val)
+	}
+	oemStrs := []string{}
+	if err := obj.Unmarshal(&oemStrs); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal smbios_oem_strings %q", val)
+	}
+	return oemStrs, nil
+}
+
+// qemu process environment variables in json object
+func (s *SKVMGuestInstance) getQemuEnvs() (map[string]string, error) {
+	envs := map[string]string{}
+	val := s.Desc.Metadata["qemu_envs"]
+	if len(val) == 0 {
+		return envs, nil
+	}
+	obj, err := jsonutils.ParseString(val)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse qemu_envs %q", val)
+	}
+	if err := obj.Unmarshal(&envs); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal qemu_envs %q", val)
+	}
+	return envs, nil
+}
+
+// getStartQemuVersion chooses qemu version semantics of start command,
+// target_qemu_version pinned by migration orchestrator takes precedence
+// over qemu_version of source guest and host default version
+func getStartQemuVersion(data *jsonutils.JSONDict, defaultVersion string, arch qemu.Arch) (qemu.Version, error) {
+	qemuVersion := defaultVersion
+	if data.Contains("target_qemu_version") {
+		qemuVersion, _ = data.GetString("target_qemu_version")
+		if _, ok := qemu.GetCommand(qemu.Version(qemuVersion), arch); !ok {
+			return "", errors.Errorf("target qemu version %s %s not supported", qemuVersion, arch)
+		}
+		return qemu.Version(qemuVersion), nil
+	}
+	if data.Contains("qemu_version") {
+		qemuVersion, _ = data.GetString("qemu_version")
+	}
+	if qemuVersion == "latest" {
+		qemuVersion = ""
+	}
+	return qemu.Version(qemuVersion), nil
+}
+
+// host audio backend pa, alsa or none, default none
+func (s *SKVMGuestInstance) getAudioBackend() string {
+	if backend, ok := s.Desc.Metadata["audio_backend"]; ok && len(backend) > 0 {
+		return backend
+	}
+	return qemu.AUDIO_BACKEND_NONE
+}
+
+// spice tuning from guest metadata falls back to host options
+func (s *SKVMGuestInstance) getSpiceTuning() *qemu.SpiceTuning {
+	get := func(key, hostVal string) string {
+		if val := s.Desc.Metadata[key]; len(val) > 0 {
+			return val
+		}
+		return hostVal
+	}
+	return &qemu.SpiceTuning{
+		StreamingVideo:        get("spice_streaming_video", options.HostOptions.SpiceStreamingVideo),
+		ImageCompression:      get("spice_image_compression", options.HostOptions.SpiceImageCompression),
+		JpegWanCompression:    get("spice_jpeg_wan_compression", options.HostOptions.SpiceJpegWanCompression),
+		ZlibGlzWanCompression: get("spice_zlib_glz_wan_compression", options.HostOptions.SpiceZlibGlzWanCompression),
+		PlaybackCompression:   get("spice_playback_compression", options.HostOptions.SpicePlaybackCompression),
+	}
+}
+
+func (s *SKVMGuestInstance) isRealtimeMode() bool {
+	return s.Desc.Metadata["realtime_mode"] == "true"
+}
+
+var hostIsolatedCpusFile = HOST_ISOLATED_CPUS_PATH
+
+// getHostIsolatedCpus returns cpus isolated from host scheduler by isolcpus
+func getHostIsolatedCpus() ([]int, error) {
+	content, err := fileutils2.FileGetContents(hostIsolatedCpusFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %s", hostIsolatedCpusFile)
+	}
+	return parseCpuList(content)
+}
+
+func parseCpuList(cpuList string) ([]int, error) {
+	cpuList = strings.TrimSpace(cpuList)
+	cpus := []int{}
+	if len(cpuList) == 0 {
+		return cpus, nil
+	}
+	for _, idx := range strings.Split(cgrouputils.ParseCpusetStr(cpuList), ",") {
+		cpu, err := strconv.Atoi(idx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid cpu list %q", cpuList)
+		}
+		cpus = append(cpus, cpu)
+	}
+	return cpus, nil
+}
+
+// selectRealtimeCpus picks a dedicated isolated host cpu for each vcpu, cpus used
+// by other realtime guests are skipped. Cpus already assigned are kept if they
+// are still isolated and not taken by others
+func selectRealtimeCpus(isolated []int, used map[int]bool, assigned []int, vcpus int) ([]int, error) {
+	isIsolated := map[int]bool{}
+	for _, cpu := range isolated {
+		isIsolated[cpu] = true
+	}
+	if len(assigned) == vcpus {
+		valid := true
+		for _, cpu := range assigned {
+			valid = valid && isIsolated[cpu] && !used[cpu]
+		}
+		if valid {
+			return assigned, nil
+		}
+	}
+	free := []int{}
+	for _, cpu := range isolated {
+		if !used[cpu] {
+			free = append(free, cpu)
+		}
+	}
+	if len(free) < vcpus {
+		return nil, errors.Errorf("realtime guest needs %d isolated cpus, %d of %d isolated cpus of host are free",
+			vcpus, len(free), len(isolated))
+	}
+	return free[:vcpus], nil
+}
+
+// getUsedRealtimeCpus returns cpus assigned to other running realtime guests,
+// guests are started one by one by start worker so assignments don't race
+func (s *SKVMGuestInstance) getUsedRealtimeCpus() map[int]bool {
+	used := map[int]bool{}
+	s.manager.Servers.Range(func(k, v interface{}) bool {
+		guest, ok := v.(*SKVMGuestInstance)
+		if !ok || guest.Id == s.Id || guest.Desc == nil || !guest.isRealtimeMode() || !guest.IsRunning() {
+			return true
+		}
+		for _, cpu := range guest.Desc.RealtimeCpus {
+			used[cpu] = true
+		}
+		return true
+	})
+	return used
+}
+
+// getRealtimeCpus returns isolated host cpus of each vcpu, which are assigned
+// when guest starts and saved in desc, running guest keeps its assignment
+func (s *SKVMGuestInstance) getRealtimeCpus() ([]int, error) {
+	if s.IsRunning() && len(s.Desc.RealtimeCpus) == int(s.Desc.Cpu) {
+		return s.Desc.RealtimeCpus, nil
+	}
+	isolated, err := getHostIsolatedCpus()
+	if err != nil {
+		return nil, errors.Wrap(err, "getHostIsolatedCpus")
+	}
+	cpus, err := selectRealtimeCpus(isolated, s.getUsedRealtimeCpus(), s.Desc.RealtimeCpus, int(s.Desc.Cpu))
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(cpus, s.Desc.RealtimeCpus) {
+		s.Desc.RealtimeCpus = cpus
+		if err := s.SaveDesc(s.Desc); err != nil {
+			return nil, errors.Wrap(err, "save realtime cpus")
+		}
+	}
+	return cpus, nil
+}
+
+// pinRealtimeVcpus pins each vcpu thread to its own isolated host cpu
+func (s *SKVMGuestInstance) pinRealtimeVcpus(cpus []int) error {
+	threads, err := getVcpuThreads(s.GetPid())
+	if err != nil {
+		return errors.Wrap(err, "getVcpuThreads")
+	}
+	for vcpu, cpu := range cpus {
+		tid, ok := threads[vcpu]
+		if !ok {
+			return errors.Wrapf(errors.ErrNotFound, "thread of vcpu %d", vcpu)
+		}
+		set := unix.CPUSet{}
+		set.Set(cpu)
+		if err := schedSetaffinity(tid, &set); err != nil {
+			return errors.Wrapf(err, "set affinity of vcpu %d thread %d", vcpu, tid)
+		}
+	}
+	log.Infof("%s vcpus pinned to realtime cpus %v", s.logPrefix(), cpus)
+	return nil
+}
+
+var sysClocksourceDir = "/sys/devices/system/clocksource/clocksource0"
+
+func getHostClocksource() (string, error) {
+	currentFile := path.Join(sysClocksourceDir, "current_clocksource")
+	content, err := fileutils2.FileGetContents(currentFile)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %s", currentFile)
+	}
+	return strings.TrimSpace(content), nil
+}
+
+// checkRealtimeClocksource requires clocksource read from cpu counter,
+// hpet or acpi_pm which kernel falls back to for unstable tsc adds jitter
+func checkRealtimeClocksource(clocksource string, isArm bool) error {
+	stable := "tsc"
+	if isArm {
+		stable = "arch_sys_counter"
+	}
+	if clocksource != stable {
+		return errors.Errorf("host clocksource %s is not %s", clocksource, stable)
+	}
+	return nil
+}
+
+// validateRealtimeClocksource only warns unsuitable clocksource unless host
+// option realtime_require_stable_clocksource is set
+func (s *SKVMGuestInstance) validateRealtimeClocksource(isArm bool) error {
+	clocksource, err := getHostClocksource()
+	if err != nil {
+		return errors.Wrap(err, "getHostClocksource")
+	}
+	if err := checkRealtimeClocksource(clocksource, isArm); err != nil {
+		if options.HostOptions.RealtimeRequireStableClocksource {
+			return err
+		}
+		log.Warningf("%s realtime guest may suffer jitter: %s", s.logPrefix(), err)
+	}
+	return nil
+}
+
+// guest reboot handled by qemu in place (reset) or by restarting the process (restart), default reset
+func (s *SKVMGuestInstance) getRebootAction() string {
+	if s.Desc.Metadata["reboot_action"] == GUEST_REBOOT_ACTION_RESTART {
+		return GUEST_REBOOT_ACTION_RESTART
+	}
+	return GUEST_REBOOT_ACTION_RESET
+}
+
+// one shot guest, e.g. installer or conversion, powers off on guest reboot
+// so that automation can tell it's done, qemu exits by -no-reboot and is not
+// restarted
+func (s *SKVMGuestInstance) isOneShot() bool {
+	return s.Desc.Metadata["one_shot"] == "true"
+}
+
+// qemu of guest with metadata no_shutdown stays alive after guest powered off
+// for inspecting through monitor, only when host allows it for debugging,
+// stop task quits it explicitly
+func (s *SKVMGuestInstance) isNoShutdown() bool {
+	if s.Desc.Metadata["no_shutdown"] != "true" {
+		return false
+	}
+	if !options.HostOptions.AllowQemuNoShutdown {
+		log.Warningf("%s qemu no shutdown is not allowed on host, ignore no_shutdown metadata", s.logPrefix())
+		return false
+	}
+	return true
+}
+
+// validateRebootOptions checks one shot guest isn't asked to restart on reboot,
+// both exit qemu by -no-reboot but act oppositely afterwards. Guest reboot
+// with -no-reboot is a shutdown, which -no-shutdown would keep qemu alive of.
+func (s *SKVMGuestInstance) validateRebootOptions() error {
+	if s.isOneShot() && s.getRebootAction() == GUEST_REBOOT_ACTION_RESTART {
+		return errors.Errorf("one_shot and reboot_action %s are mutually exclusive", GUEST_REBOOT_ACTION_RESTART)
+	}
+	if s.isNoShutdown() && (s.isOneShot() || s.getRebootAction() == GUEST_REBOOT_ACTION_RESTART) {
+		return errors.Errorf("no_shutdown conflicts with one_shot and reboot_action %s, which exit qemu on guest reboot", GUEST_REBOOT_ACTION_RESTART)
+	}
+	return nil
+}
+
 func (s *SKVMGuestInstance) getOsDistribution() string {
 	return s.Desc.Metadata["os_distribution"]
 }
@@ -144,12 +1070,30 @@ func (s *SKVMGuestInstance) GetVdiProtocol() string {
 	return vdi
 }
 
-func (s *SKVMGuestInstance) GetPciBus() string {
+func (s *SKVMGuestInstance) getPrimaryPciBus() string {
 	if s.isQ35() || s.isVirt() {
 		return "pcie.0"
 	} else {
-		return "pci.0"
+		return qemu.PCI_BUS_PRIMARY
+	}
+}
+
+// GetPciBus is the bus of hot plugged devices, which is pci-bridge
+// once start script put overflow devices of primary bus on it
+func (s *SKVMGuestInstance) GetPciBus() string {
+	bus := s.getPrimaryPciBus()
+	if bus == qemu.PCI_BUS_PRIMARY && s.hasPciBridge() {
+		return qemu.PCI_BRIDGE_ID
 	}
+	return bus
+}
+
+func (s *SKVMGuestInstance) hasPciBridge() bool {
+	cmdline, err := s.getQemuCmdline()
+	if err != nil {
+		return false
+	}
+	return strings.Contains(cmdline, fmt.Sprintf("pci-bridge,id=%s,", qemu.PCI_BRIDGE_ID))
 }
 
 func (s *SKVMGuestInstance) disableIsaSerialDev() bool {
@@ -160,10 +1104,103 @@ func (s *SKVMGuestInstance) disablePvpanicDev() bool {
 	return s.Desc.Metadata["disable_pvpanic"] == "true"
 }
 
+// excludes guest memory from KSM merging, for guests holding sensitive data
+func (s *SKVMGuestInstance) disableMemMerge() bool {
+	return s.Desc.Metadata["disable_mem_merge"] == "true"
+}
+
 func (s *SKVMGuestInstance) GetDiskAddr(idx int) int {
+	if s.isStablePciAddress() {
+		addrs, err := s.getStablePciAddrs(0)
+		if err != nil {
+			log.Errorf("%s getStablePciAddrs: %s", s.logPrefix(), err)
+		}
+		for _, disk := range s.Desc.Disks {
+			if int(disk.Index) != idx {
+				continue
+			}
+			if addr, ok := addrs.DiskAddr(disk); ok {
+				return addr
+			}
+		}
+	}
 	return qemu.GetDiskAddr(idx, s.IsVdiSpice())
 }
 
+// getStablePciAddrs allocates pci slots to new virtio disks and nics and saves them
+// in desc, assigned devices keep their slots. Slots of guest saved nothing yet are
+// picked from cmdline it was started with. Running guest keeps autoSlots it started
+// with, as devices placed by qemu don't move until restart
+func (s *SKVMGuestInstance) getStablePciAddrs(autoSlots int) (qemu.StablePciAddrs, error) {
+	addrs, autoSlots, err := s.allocStablePciAddrs(autoSlots)
+	if err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(addrs, s.Desc.PciSlots) || autoSlots != s.Desc.PciAutoSlots {
+		s.Desc.PciSlots = addrs
+		s.Desc.PciAutoSlots = autoSlots
+		if err := s.SaveDesc(s.Desc); err != nil {
+			return nil, errors.Wrap(err, "save pci slots")
+		}
+	}
+	return addrs, nil
+}
+
+// allocStablePciAddrs works out pci slots of getStablePciAddrs without saving them
+func (s *SKVMGuestInstance) allocStablePciAddrs(autoSlots int) (qemu.StablePciAddrs, int, error) {
+	slots := s.Desc.PciSlots
+	if slots == nil {
+		slots = s.getStartedPciSlots()
+	}
+	if s.IsRunning() {
+		autoSlots = s.Desc.PciAutoSlots
+	}
+	addrs, err := qemu.AllocStablePciAddrs(slots, s.Desc.Disks, s.Desc.Nics, autoSlots, s.isQ35(), s.IsVdiSpice())
+	if err != nil {
+		return nil, 0, err
+	}
+	return addrs, autoSlots, nil
+}
+
+// getStartedPciSlots reads slots of devices from running qemu or last start script
+func (s *SKVMGuestInstance) getStartedPciSlots() qemu.StablePciAddrs {
+	var cl *qemutils.Cmdline
+	if s.IsRunning() {
+		cl, _ = s.GetRunningCmdline()
+	} else if cmdline, err := s.getQemuCmdline(); err == nil {
+		cl, _ = qemutils.NewCmdline(cmdline)
+	}
+	if cl == nil {
+		return nil
+	}
+	return s.getCmdlinePciSlots(cl)
+}
+
+func (s *SKVMGuestInstance) savePciSlotsFromCmdline(cmdline string) error {
+	cl, err := qemutils.NewCmdline(cmdline)
+	if err != nil {
+		return errors.Wrap(err, "NewCmdline")
+	}
+	s.Desc.PciSlots = s.getCmdlinePciSlots(cl)
+	return s.SaveDesc(s.Desc)
+}
+
+func (s *SKVMGuestInstance) getCmdlinePciSlots(cl *qemutils.Cmdline) qemu.StablePciAddrs {
+	devices := []string{}
+	for _, opt := range cl.GetOptions() {
+		if opt.Key == "device" {
+			devices = append(devices, opt.Value)
+		}
+	}
+	return qemu.GetStablePciAddrsFromDevices(devices, s.Desc.Disks, s.Desc.Nics)
+}
+
+// virtio disks and nics keep their pci slots across restarts and hot-plugs
+// instead of following list position
+func (s *SKVMGuestInstance) isStablePciAddress() bool {
+	return s.Desc.Metadata["stable_pci_address"] == "true"
+}
+
 func (s *SKVMGuestInstance) getNicUpScriptPath(nic *api.GuestnetworkJsonDesc) string {
 	dev := guestManager.GetHost().GetBridgeDev(nic.Bridge)
 	return path.Join(s.HomeDir(), fmt.Sprintf("if-up-%s-%s.sh", dev.Bridge(), nic.Ifname))
@@ -180,6 +1217,9 @@ func (s *SKVMGuestInstance) generateNicScripts(nic *api.GuestnetworkJsonDesc) er
 	if dev == nil {
 		return fmt.Errorf("Can't find bridge %s", bridge)
 	}
+	if err := validateNicMtu(nic, getBridgeMtu(dev.Bridge())); err != nil {
+		return errors.Wrap(err, "validateNicMtu")
+	}
 	isSlave := s.IsSlave()
 	if err := dev.GenerateIfupScripts(s.getNicUpScriptPath(nic), nic, isSlave); err != nil {
 		return errors.Wrap(err, "GenerateIfupScripts")
@@ -190,11 +1230,260 @@ func (s *SKVMGuestInstance) generateNicScripts(nic *api.GuestnetworkJsonDesc) er
 	return nil
 }
 
+// getNetdevScripts returns up script of each tap netdev in cmdline, keyed by ifname
+func getNetdevScripts(cl *qemutils.Cmdline) map[string]string {
+	scripts := map[string]string{}
+	for _, opt := range cl.GetOptions() {
+		if opt.Key != "netdev" {
+			continue
+		}
+		params := map[string]string{}
+		for _, param := range strings.Split(opt.Value, ",") {
+			if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+				params[kv[0]] = kv[1]
+			}
+		}
+		if len(params["id"]) > 0 && len(params["script"]) > 0 {
+			scripts[params["id"]] = params["script"]
+		}
+	}
+	return scripts
+}
+
+// validateRunningNicScripts refuses to regenerate scripts of nics whose bridge
+// changed on running guest, script path has bridge name in it and running
+// qemu keeps calling the old scripts, so the change takes effect on restart
+func (s *SKVMGuestInstance) validateRunningNicScripts(nics []*api.GuestnetworkJsonDesc) error {
+	if !s.IsRunning() {
+		return nil
+	}
+	cl, err := s.GetRunningCmdline()
+	if err != nil {
+		return errors.Wrap(err, "GetRunningCmdline")
+	}
+	running := getNetdevScripts(cl)
+	errs := []error{}
+	for _, nic := range nics {
+		script, ok := running[nic.Ifname]
+		if ok && script != s.getNicUpScriptPath(nic) {
+			errs = append(errs, errors.Errorf("bridge of running nic %s changed, qemu still calls %s, restart guest to apply", nic.Ifname, script))
+		}
+	}
+	return errors.NewAggregate(errs)
+}
+
+// RegenerateNicScripts rewrites if-up/if-down scripts from current desc without
+// regenerating start script, scripts of all nics are rewritten if ifname is empty.
+// Bridge change of running guest is refused, see validateRunningNicScripts
+func (s *SKVMGuestInstance) RegenerateNicScripts(ifname string) error {
+	nics := s.Desc.Nics
+	if len(ifname) > 0 {
+		nics = nil
+		for _, nic := range s.Desc.Nics {
+			if nic.Ifname == ifname {
+				nics = append(nics, nic)
+				break
+			}
+		}
+		if len(nics) == 0 {
+			return errors.Wrapf(errors.ErrNotFound, "nic %s", ifname)
+		}
+	} else if err := validateNicIfnames(nics); err != nil {
+		return errors.Wrap(err, "validateNicIfnames")
+	}
+	if err := s.validateRunningNicScripts(nics); err != nil {
+		return err
+	}
+	for _, nic := range nics {
+		if err := s.generateNicScripts(nic); err != nil {
+			return errors.Wrapf(err, "generateNicScripts for nic %s", nic.Ifname)
+		}
+	}
+	return nil
+}
+
+// ValidateDesc checks guest descriptor is well-formed before generating start script,
+// all problems are returned at once
+func (s *SKVMGuestInstance) ValidateDesc() error {
+	return validateGuestDesc(s.Desc)
+}
+
+func validateGuestDesc(desc *desc.SGuestDesc) error {
+	errs := []error{}
+	if desc.Mem <= 0 {
+		errs = append(errs, errors.Errorf("invalid memory size %dMB", desc.Mem))
+	}
+	if desc.Cpu <= 0 {
+		errs = append(errs, errors.Errorf("invalid cpu count %d", desc.Cpu))
+	}
+	for i, nic := range desc.Nics {
+		if _, err := net.ParseMAC(nic.Mac); err != nil {
+			errs = append(errs, errors.Errorf("nic %d has invalid mac %q", i, nic.Mac))
+		}
+		if len(nic.Bridge) == 0 && nic.Vpc.Provider != api.VPC_PROVIDER_OVN {
+			errs = append(errs, errors.Errorf("nic %d (mac %s) has empty bridge", i, nic.Mac))
+		}
+		if err := qemu.ValidateNicQueueSize(nic); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateNicIfnames(desc.Nics); err != nil {
+		errs = append(errs, err)
+	}
+	for i, disk := range desc.Disks {
+		if len(disk.Path) == 0 {
+			errs = append(errs, errors.Errorf("disk %d (%s) has empty path", i, disk.DiskId))
+		} else if strings.HasPrefix(disk.Path, "/") && !fileutils2.Exists(disk.Path) {
+			errs = append(errs, errors.Errorf("disk %d (%s) path %s not exists", i, disk.DiskId, disk.Path))
+		}
+		if err := qemu.ValidateDiskBlockSize(disk); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := validateMachineBios(desc.Machine, desc.Bios); err != nil {
+		errs = append(errs, err)
+	}
+	if isUsbDisabled(desc) {
+		if desc.Vdi == "spice" {
+			errs = append(errs, errors.Errorf("disable_usb conflicts with spice usb redirection"))
+		}
+		for _, dev := range desc.IsolatedDevices {
+			if dev.DevType == api.USB_TYPE {
+				errs = append(errs, errors.Errorf("usb device %s requires usb controller", dev.Id))
+			}
+		}
+	}
+	return errors.NewAggregate(errs)
+}
+
+func validateMachineBios(machine, bios string) error {
+	isUEFI := strings.EqualFold(bios, qemu.BIOS_UEFI)
+	if len(bios) > 0 && !isUEFI && !strings.EqualFold(bios, "bios") {
+		return errors.Errorf("unknown bios %q", bios)
+	}
+	switch machine {
+	case "", api.VM_MACHINE_TYPE_PC, api.VM_MACHINE_TYPE_Q35:
+	case api.VM_MACHINE_TYPE_ARM_VIRT:
+		// aarch64 has no legacy bios
+		if len(bios) > 0 && !isUEFI {
+			return errors.Errorf("machine %s requires UEFI bios", machine)
+		}
+	default:
+		return errors.Errorf("unknown machine %q", machine)
+	}
+	return nil
+}
+
+// validateNicIfnames makes sure nic ifnames are not empty and unique,
+// ifname names the tap device as well as the up and down scripts
+func validateNicIfnames(nics []*api.GuestnetworkJsonDesc) error {
+	ifnames := make(map[string]int, len(nics))
+	for i, nic := range nics {
+		if len(nic.Ifname) == 0 {
+			return errors.Errorf("nic %d (mac %s) has empty ifname", i, nic.Mac)
+		}
+		if j, ok := ifnames[nic.Ifname]; ok {
+			return errors.Errorf("nic %d and nic %d have duplicate ifname %s", j, i, nic.Ifname)
+		}
+		ifnames[nic.Ifname] = i
+	}
+	return nil
+}
+
+var tcpPortUsed = netutils2.IsTcpPortUsed
+
+type sNamedPort struct {
+	name string
+	port int
+}
+
+// getDisplayPorts lists tcp ports qemu listens on for display and monitors,
+// all of them are derived from vnc port
+func getDisplayPorts(input *qemu.GenerateStartOptionsInput) []sNamedPort {
+	ports := []sNamedPort{}
+	if input.IsVdiSpice {
+		ports = append(ports, sNamedPort{"spice", int(input.SpicePort)})
+	} else {
+		ports = append(ports, sNamedPort{"vnc", VNC_PORT_BASE + int(input.VNCPort)})
+	}
+	if input.HMPMonitor != nil {
+		ports = append(ports, sNamedPort{"hmp monitor", int(input.HMPMonitor.Port)})
+	}
+	if input.QMPMonitor != nil {
+		ports = append(ports, sNamedPort{"qmp monitor", int(input.QMPMonitor.Port)})
+	}
+	return ports
+}
+
+// validateDisplayPorts makes sure ports are distinct and, if checkFree, not listened yet
+func validateDisplayPorts(ports []sNamedPort, checkFree bool) error {
+	errs := []error{}
+	names := map[int]string{}
+	for _, p := range ports {
+		if name, ok := names[p.port]; ok {
+			errs = append(errs, errors.Errorf("%s port %d collides with %s port", p.name, p.port, name))
+			continue
+		}
+		names[p.port] = p.name
+		if checkFree && tcpPortUsed("0.0.0.0", p.port) {
+			errs = append(errs, errors.Errorf("%s port %d is in use", p.name, p.port))
+		}
+	}
+	return errors.NewAggregate(errs)
+}
+
+// validateNicBridges makes sure bridges of all nics are found on host,
+// all missing bridges are reported at once
+func validateNicBridges(nics []*api.GuestnetworkJsonDesc) error {
+	errs := []error{}
+	for i, nic := range nics {
+		if guestManager.GetHost().GetBridgeDev(nic.Bridge) == nil {
+			errs = append(errs, errors.Errorf("Can't find bridge %s of nic %d (%s)", nic.Bridge, i, nic.Ifname))
+		}
+	}
+	return errors.NewAggregate(errs)
+}
+
+func getBridgeMtu(bridge string) int {
+	inter, err := net.InterfaceByName(bridge)
+	if err != nil {
+		log.Warningf("get bridge %s mtu: %v", bridge, err)
+		return 0
+	}
+	return inter.MTU
+}
+
+// validateNicMtu makes sure frames of guest nic are not larger than the bridge could carry,
+// ovn nic is skipped as its mtu is derived from the underlay rather than the integration bridge
+func validateNicMtu(nic *api.GuestnetworkJsonDesc, bridgeMtu int) error {
+	if nic.Mtu <= 0 || bridgeMtu <= 0 || nic.Vpc.Provider == api.VPC_PROVIDER_OVN {
+		return nil
+	}
+	if nic.Mtu > bridgeMtu {
+		return errors.Errorf("nic %s mtu %d exceeds bridge %s mtu %d", nic.Ifname, nic.Mtu, nic.Bridge, bridgeMtu)
+	}
+	return nil
+}
+
 func (s *SKVMGuestInstance) getNicDeviceModel(name string) string {
 	return qemu.GetNicDeviceModel(name)
 }
 
 func (s *SKVMGuestInstance) getNicAddr(index int) int {
+	if s.isStablePciAddress() {
+		addrs, err := s.getStablePciAddrs(0)
+		if err != nil {
+			log.Errorf("%s getStablePciAddrs: %s", s.logPrefix(), err)
+		}
+		for _, nic := range s.Desc.Nics {
+			if int(nic.Index) != index {
+				continue
+			}
+			if addr, ok := addrs.NicAddr(nic); ok {
+				return addr
+			}
+		}
+	}
 	return qemu.GetNicAddr(index, len(s.Desc.Disks), len(s.Desc.IsolatedDevices), s.IsVdiSpice())
 }
 
@@ -214,7 +1503,126 @@ func (s *SKVMGuestInstance) extraOptions() string {
 	return cmd
 }
 
-func (s *SKVMGuestInstance) generateStartScript(data *jsonutils.JSONDict) (string, error) {
+// generateVncFileScript writes vnc port to vnc file, which also marks the guest as starting,
+// the leading sleep gives the tap devices released by down scripts a moment to settle
+func (s *SKVMGuestInstance) generateVncFileScript(vncPort uint) string {
+	cmd := ""
+	if options.HostOptions.StartScriptSleepBeforeLaunch {
+		cmd += "sleep 1\n"
+	}
+	cmd += fmt.Sprintf("echo %d > %s\n", vncPort, s.GetVncFilePath())
+	return cmd
+}
+
+// normalizeMacOSInput attaches disks by sata and nics by e1000 as macOS has no virtio drivers,
+// it works on copies so that desc is kept as is and every render, including the one on
+// migration destination, derives the same devices from it
+func normalizeMacOSInput(input *qemu.GenerateStartOptionsInput) {
+	disks := make([]*api.GuestdiskJsonDesc, len(input.Disks))
+	for i := range input.Disks {
+		disk := *input.Disks[i]
+		disk.Driver = DISK_DRIVER_SATA
+		disks[i] = &disk
+	}
+	input.Disks = disks
+
+	nics := make([]*api.GuestnetworkJsonDesc, len(input.Nics))
+	for i := range input.Nics {
+		nic := *input.Nics[i]
+		vectors := 0
+		nic.Vectors = &vectors
+		nic.Driver = NIC_DRIVER_E1000
+		nics[i] = &nic
+	}
+	input.Nics = nics
+}
+
+// getVMwareNicDriver picks nic driver of guest imported from vmware, vmxnet3 unless
+// nic asks for e1000 or e1000e explicitly as some images have no vmxnet3 driver
+func getVMwareNicDriver(driver string) string {
+	if utils.IsInStringArray(driver, []string{NIC_DRIVER_E1000, NIC_DRIVER_E1000E}) {
+		return driver
+	}
+	return NIC_DRIVER_VMXNET3
+}
+
+// normalizeVMwareNics applies vmware nic drivers on copies of nics, desc is kept as is
+func normalizeVMwareNics(input *qemu.GenerateStartOptionsInput) {
+	nics := make([]*api.GuestnetworkJsonDesc, len(input.Nics))
+	for i := range input.Nics {
+		nic := *input.Nics[i]
+		nic.Driver = getVMwareNicDriver(nic.Driver)
+		nics[i] = &nic
+	}
+	input.Nics = nics
+}
+
+// copyNicDescs copies nics so that rendering start options leaves desc untouched
+func copyNicDescs(nics []*api.GuestnetworkJsonDesc) []*api.GuestnetworkJsonDesc {
+	ret := make([]*api.GuestnetworkJsonDesc, len(nics))
+	for i := range nics {
+		nic := *nics[i]
+		ret[i] = &nic
+	}
+	return ret
+}
+
+// applyDefaultNicDriver sets driver of nics not specifying one on copies of them,
+// os specific drivers of macOS and vmware guests take precedence over the default
+func applyDefaultNicDriver(nics []*api.GuestnetworkJsonDesc, driver string) []*api.GuestnetworkJsonDesc {
+	if len(driver) == 0 {
+		driver = NIC_DRIVER_VIRTIO
+	}
+	ret := make([]*api.GuestnetworkJsonDesc, len(nics))
+	for i := range nics {
+		ret[i] = nics[i]
+		if len(nics[i].Driver) == 0 {
+			nic := *nics[i]
+			nic.Driver = driver
+			ret[i] = &nic
+		}
+	}
+	return ret
+}
+
+// normalizeAndroidNics keeps the first nic only as android guest works with single nic,
+// it works on a copy of nics and returns the dropped ones for caller to log or reconcile
+func normalizeAndroidNics(nics []*api.GuestnetworkJsonDesc) ([]*api.GuestnetworkJsonDesc, []*api.GuestnetworkJsonDesc) {
+	if len(nics) == 0 {
+		return nil, nil
+	}
+	nic := *nics[0]
+	dropped := make([]*api.GuestnetworkJsonDesc, len(nics)-1)
+	copy(dropped, nics[1:])
+	return []*api.GuestnetworkJsonDesc{&nic}, dropped
+}
+
+// startScriptHost is what start script builder looks up on host, tests inject a fake one
+type startScriptHost interface {
+	hostutils.HostCapabilities
+	GetDiskByPath(diskPath string) (storageman.IDisk, error)
+}
+
+type sStartScriptHost struct {
+	hostutils.HostCapabilities
+}
+
+func (h sStartScriptHost) GetDiskByPath(diskPath string) (storageman.IDisk, error) {
+	return storageman.GetManager().GetDiskByPath(diskPath)
+}
+
+// generateStartScript renders start script of guest on host with capabilities of host,
+// files, ports and desc state the script relies on are prepared along the way
+func (s *SKVMGuestInstance) generateStartScript(data *jsonutils.JSONDict, host startScriptHost) (string, error) {
+	defer func(generateAt time.Time) {
+		guestGenerateScriptDuration.Observe(time.Since(generateAt).Seconds())
+	}(time.Now())
+	return s.buildStartScript(data, host, false)
+}
+
+// buildStartScript renders start script of guest, with dryRun it is pure: no file
+// is written, no port is reserved and desc is left untouched
+func (s *SKVMGuestInstance) buildStartScript(data *jsonutils.JSONDict, host startScriptHost, dryRun bool) (string, error) {
 	// initial data
 	var input = &qemu.GenerateStartOptionsInput{
 		UUID:                 s.Desc.Uuid,
@@ -222,31 +1630,43 @@ func (s *SKVMGuestInstance) generateStartScript(data *jsonutils.JSONDict) (strin
 		Cpu:                  uint(s.Desc.Cpu),
 		Name:                 s.Desc.Name,
 		OsName:               s.getOsname(),
-		Nics:                 s.Desc.Nics,
+		Nics:                 copyNicDescs(s.Desc.Nics),
 		Disks:                s.Desc.Disks,
 		OVNIntegrationBridge: options.HostOptions.OvnIntegrationBridge,
 		HomeDir:              s.HomeDir(),
-		HugepagesEnabled:     s.manager.host.IsHugepagesEnabled(),
+		HugepagesEnabled:     host.IsHugepagesEnabled(),
 		EnableMemfd:          s.isMemcleanEnabled(),
 		PidFilePath:          s.GetPidFilePath(),
 		BIOS:                 s.getBios(),
 	}
 
-	if data.Contains("encrypt_key") {
+	if dryRun {
+		// storage type of disks is filled in while rendering disk setup scripts
+		input.Disks = make([]*api.GuestdiskJsonDesc, len(s.Desc.Disks))
+		for i := range s.Desc.Disks {
+			disk := *s.Desc.Disks[i]
+			input.Disks[i] = &disk
+		}
+	}
+
+	if data.Contains("encrypt_key") && !dryRun {
 		key, _ := data.GetString("encrypt_key")
 		if err := s.saveEncryptKeyFile(key); err != nil {
 			return "", errors.Wrap(err, "save encrypt key file")
 		}
 		input.EncryptKeyPath = s.getEncryptKeyPath()
+	} else if dryRun && fileutils2.Exists(s.getEncryptKeyPath()) {
+		input.EncryptKeyPath = s.getEncryptKeyPath()
 	}
 
 	cmd := ""
 
 	// inject machine and bios
 	if input.OsName == OS_NAME_MACOS {
-		s.Desc.Machine = api.VM_MACHINE_TYPE_Q35
-		input.Machine = api.VM_MACHINE_TYPE_Q35
-		s.Desc.Bios = qemu.BIOS_UEFI
+		if !dryRun {
+			s.Desc.Machine = api.VM_MACHINE_TYPE_Q35
+			s.Desc.Bios = qemu.BIOS_UEFI
+		}
 		input.BIOS = qemu.BIOS_UEFI
 	}
 
@@ -254,21 +1674,18 @@ func (s *SKVMGuestInstance) generateStartScript(data *jsonutils.JSONDict) (strin
 	vncPort, _ := data.Int("vnc_port")
 	input.VNCPort = uint(vncPort)
 
-	// inject qemu version and arch
-	qemuVersion := options.HostOptions.DefaultQemuVersion
-	if data.Contains("qemu_version") {
-		qemuVersion, _ = data.GetString("qemu_version")
-	}
-	if qemuVersion == "latest" {
-		qemuVersion = ""
-	}
-	input.QemuVersion = qemu.Version(qemuVersion)
 	// inject qemu arch
-	if s.manager.host.IsAarch64() {
+	if host.IsAarch64() {
 		input.QemuArch = qemu.Arch_aarch64
 	} else {
 		input.QemuArch = qemu.Arch_x86_64
 	}
+	// inject qemu version
+	qemuVersion, err := getStartQemuVersion(data, options.HostOptions.DefaultQemuVersion, input.QemuArch)
+	if err != nil {
+		return "", errors.Wrap(err, "getStartQemuVersion")
+	}
+	input.QemuVersion = qemuVersion
 
 	// inject isolatedDevices
 	var devAddrs = []string{}
@@ -276,24 +1693,65 @@ func (s *SKVMGuestInstance) generateStartScript(data *jsonutils.JSONDict) (strin
 	for _, params := range isolatedParams {
 		devAddrs = append(devAddrs, params.Addr)
 	}
-	isolatedDevsParams := s.manager.GetHost().GetIsolatedDeviceManager().GetQemuParams(devAddrs)
-	input.IsolatedDevicesParams = isolatedDevsParams
+	if len(devAddrs) > 0 {
+		input.IsolatedDevicesParams = s.manager.GetHost().GetIsolatedDeviceManager().GetQemuParams(devAddrs)
+	}
+
+	// inject nic and disks
+	for i := 0; i < len(input.Nics); i++ {
+		if input.Nics[i].NumQueues > 1 {
+			vectors := input.Nics[i].NumQueues * 2
+			input.Nics[i].Vectors = &vectors
+		}
+	}
+
+	if input.OsName != OS_NAME_MACOS && input.OsName != OS_NAME_VMWARE {
+		input.Nics = applyDefaultNicDriver(input.Nics, options.HostOptions.DefaultNicDriver)
+	}
+	if input.OsName == OS_NAME_MACOS {
+		normalizeMacOSInput(input)
+	} else if input.OsName == OS_NAME_VMWARE {
+		normalizeVMwareNics(input)
+	} else if input.OsName == OS_NAME_ANDROID {
+		var dropped []*api.GuestnetworkJsonDesc
+		input.Nics, dropped = normalizeAndroidNics(input.Nics)
+		for _, nic := range dropped {
+			log.Warningf("%s is android which supports single nic only, nic %s(%s) is not attached", s.logPrefix(), nic.Ifname, nic.Mac)
+		}
+	}
 
+	// only nics rendered after normalization need their bridges
+	if err := validateNicBridges(input.Nics); err != nil {
+		return "", errors.Wrap(err, "validateNicBridges")
+	}
+	if err := validateNicIfnames(input.Nics); err != nil {
+		return "", errors.Wrap(err, "validateNicIfnames")
+	}
+	downscripts := make([]string, 0, len(input.Nics))
 	for _, nic := range input.Nics {
 		downscript := s.getNicDownScriptPath(nic)
-		cmd += fmt.Sprintf("%s %s\n", downscript, nic.Ifname)
+		downscripts = append(downscripts, fmt.Sprintf("%s %s", downscript, nic.Ifname))
 	}
+	cmd += generateParallelScripts(downscripts, NIC_DOWNSCRIPT_PARALLELISM)
+	cmd += generateMultiQueueTapScripts(input.Nics)
 
 	if input.HugepagesEnabled {
+		mem, err := alignHugepagesMem(input.Mem, host.HugepageSizeKb(), options.HostOptions.HugepagesMemRoundUp)
+		if err != nil {
+			return "", errors.Wrap(err, "alignHugepagesMem")
+		}
+		if mem != input.Mem {
+			log.Warningf("%s memory %dMB rounded up to %dMB to align hugepages", s.logPrefix(), input.Mem, mem)
+			input.Mem = mem
+		}
 		cmd += fmt.Sprintf("mkdir -p /dev/hugepages/%s\n", input.UUID)
 		cmd += fmt.Sprintf("mount -t hugetlbfs -o pagesize=%dK,size=%dM hugetlbfs-%s /dev/hugepages/%s\n",
-			s.manager.host.HugepageSizeKb(), input.Mem, input.UUID, input.UUID)
+			host.HugepageSizeKb(), input.Mem, input.UUID, input.UUID)
 	}
 
-	cmd += "sleep 1\n"
-	cmd += fmt.Sprintf("echo %d > %s\n", input.VNCPort, s.GetVncFilePath())
+	cmd += s.generateVncFileScript(input.VNCPort)
 
-	diskScripts, err := s.generateDiskSetupScripts(input.Disks)
+	diskScripts, err := s.generateDiskSetupScripts(host, input.Disks)
 	if err != nil {
 		return "", errors.Wrap(err, "generateDiskSetupScripts")
 	}
@@ -328,9 +1786,9 @@ func (s *SKVMGuestInstance) generateStartScript(data *jsonutils.JSONDict) (strin
 	 * cmd += "fi\n"
 	 */
 	cmd += "QEMU_CMD=$DEFAULT_QEMU_CMD\n"
-	if s.IsKvmSupport() && !options.HostOptions.DisableKVM {
+	if host.IsKvmSupport() && !options.HostOptions.DisableKVM {
 		cmd += "QEMU_CMD_KVM_ARG=-enable-kvm\n"
-	} else if utils.IsInStringArray(s.manager.host.GetCpuArchitecture(), apis.ARCH_X86) {
+	} else if utils.IsInStringArray(host.GetCpuArchitecture(), apis.ARCH_X86) {
 		// -no-kvm仅x86适用，且将在qemu 5.2之后移除
 		// https://gitlab.com/qemu-project/qemu/-/blob/master/docs/about/removed-features.rst
 		cmd += "QEMU_CMD_KVM_ARG=-no-kvm\n"
@@ -363,17 +1821,31 @@ function nic_mtu() {
 	cmd += `CMD="$QEMU_CMD $QEMU_CMD_KVM_ARG`
 
 	// inject cpu info
-	if s.IsKvmSupport() && !options.HostOptions.DisableKVM {
+	if host.IsKvmSupport() && !options.HostOptions.DisableKVM {
 		input.EnableKVM = true
 		input.HostCPUPassthrough = options.HostOptions.HostCpuPassthrough
-		input.IsCPUIntel = sysutils.IsProcessorIntel()
-		input.IsCPUAMD = sysutils.IsProcessorAmd()
-		input.EnableNested = guestManager.GetHost().IsNestedVirtualization()
+		input.IsCPUIntel = host.IsProcessorIntel()
+		input.IsCPUAMD = host.IsProcessorAmd()
+		input.EnableNested = host.IsNestedVirtualization()
+		if err := s.validateCpuMigratable(jsonutils.QueryBoolean(data, "need_migrate", false)); err != nil {
+			return "", err
+		}
+		input.HostCPUMigratable, _ = s.getCpuMigratable()
+		input.HostCPUMaskedFeatures = s.getCpuMaskedFeatures()
 	}
+	input.CPUModel = s.getCpuModel()
+	input.CPUFeatures = s.getCpuFeatures()
 
 	if options.HostOptions.LogLevel == "debug" {
 		input.EnableLog = true
 		input.LogPath = s.getQemuLogPath()
+		if options.HostOptions.QemuLogGuestErrors {
+			input.LogItem = qemu.LOG_ITEM_GUEST_ERRORS
+		}
+	}
+	input.Trace, err = s.getQemuTrace()
+	if err != nil {
+		return "", errors.Wrap(err, "getQemuTrace")
 	}
 
 	// inject monitor
@@ -391,14 +1863,38 @@ function nic_mtu() {
 	}
 
 	input.EnableUUID = options.HostOptions.EnableVmUuid
+	if options.HostOptions.EnableQemuProcessTitle {
+		input.ProcessName = s.Desc.Uuid
+	}
+	if runas := options.HostOptions.QemuRunasUser; len(runas) > 0 {
+		if _, _, err := lookupRunAsUser(runas); err != nil {
+			return "", errors.Wrapf(err, "qemu runas user %s", runas)
+		}
+		input.RunAsUser = runas
+	}
 	// inject machine
 	input.Machine = s.getMachine()
+	if input.OsName == OS_NAME_MACOS {
+		input.Machine = api.VM_MACHINE_TYPE_Q35
+	}
+	input.DumpGuestCore = options.HostOptions.QemuDumpGuestCore
+	input.DisableMemMerge = s.disableMemMerge()
 
 	// inject bootOrder and cdrom
 	input.BootOrder = s.Desc.BootOrder
 	if s.Desc.Cdrom != nil && s.Desc.Cdrom.Path != "" {
 		input.CdromPath = s.Desc.Cdrom.Path
 	}
+	input.BootMenu = s.isBootMenuEnabled()
+	input.BootStrict = s.isBootStrict()
+	input.BootMenuSplashTime, err = s.getBootMenuSplashTime()
+	if err != nil {
+		return "", errors.Wrap(err, "getBootMenuSplashTime")
+	}
+	input.BootSplash, err = s.getBootSplash()
+	if err != nil {
+		return "", errors.Wrap(err, "getBootSplash")
+	}
 
 	// UEFI ovmf file path
 	if input.QemuArch == qemu.Arch_aarch64 {
@@ -412,75 +1908,57 @@ function nic_mtu() {
 		}
 	}
 
-	// inject nic and disks
-	for i := 0; i < len(input.Nics); i++ {
-		if input.Nics[i].NumQueues > 1 {
-			vectors := input.Nics[i].NumQueues * 2
-			input.Nics[i].Vectors = &vectors
-		}
-	}
-
-	if input.OsName == OS_NAME_MACOS {
-		for i := 0; i < len(input.Disks); i++ {
-			input.Disks[i].Driver = DISK_DRIVER_SATA
-		}
-		for i := 0; i < len(input.Nics); i++ {
-			vectors := 0
-			input.Nics[i].Vectors = &vectors
-			input.Nics[i].Driver = "e1000"
-		}
-	} else if input.OsName == OS_NAME_ANDROID {
-		if len(input.Nics) > 1 {
-			s.Desc.Nics = input.Nics[:1]
-		}
-		input.Nics = s.Desc.Nics
-	}
-
 	// inject devices
+	input.DisableUsb = s.disableUsb()
+	maxOutputs, err := s.getDisplayMaxOutputs()
+	if err != nil {
+		return "", errors.Wrap(err, "getDisplayMaxOutputs")
+	}
 	if input.QemuArch == qemu.Arch_aarch64 {
-		input.Devices = append(input.Devices,
-			"qemu-xhci,p2=8,p3=8,id=usb1",
-			"usb-tablet,id=input0,bus=usb1.0,port=1",
-			"usb-kbd,id=input1,bus=usb1.0,port=2",
-			"virtio-gpu-pci,id=video1,max_outputs=1",
-		)
+		input.Devices = append(input.Devices, s.getAarch64Devices(maxOutputs)...)
 	} else {
-		if !utils.IsInStringArray(s.getOsDistribution(), []string{OS_NAME_OPENWRT, OS_NAME_CIRROS}) &&
-			!s.isOldWindows() && !s.isWindows10() &&
-			!s.disableUsbKbd() {
-			input.Devices = append(input.Devices, "usb-kbd")
-		}
-		if input.OsName == OS_NAME_ANDROID {
-			input.Devices = append(input.Devices, "usb-mouse")
-		} else if !s.isOldWindows() {
-			input.Devices = append(input.Devices, "usb-tablet")
-		}
+		input.Devices = append(input.Devices, s.getX86InputDevices()...)
 	}
 
 	// inject spice and vnc display
 	input.IsVdiSpice = s.IsVdiSpice()
 	input.SpicePort = uint(5900 + vncPort)
-	input.PCIBus = s.GetPciBus()
+	if input.IsVdiSpice {
+		input.SpiceTuning = s.getSpiceTuning()
+	}
+	input.PCIBus = s.getPrimaryPciBus()
 	if input.QemuArch != qemu.Arch_aarch64 {
 		vga := s.Desc.Vga
 		if vga == "" {
 			vga = "std"
 		}
 		input.VGA = vga
+	} else if s.getAarch64Vga() == "none" {
+		// display of aarch64 is virtio gpu device, headless guest has none
+		input.VGA = "none"
 	}
 	input.VNCPassword = options.HostOptions.SetVncPassword
+	input.VNCListen, err = s.getVncListenAddress()
+	if err != nil {
+		return "", errors.Wrap(err, "getVncListenAddress")
+	}
+	if input.VNCPort > 0 {
+		// ports of running guest are held by its own qemu
+		if err := validateDisplayPorts(getDisplayPorts(input), !s.IsRunning()); err != nil {
+			return "", errors.Wrap(err, "validateDisplayPorts")
+		}
+	}
 
 	// reinject nics
-	input.IsKVMSupport = s.IsKvmSupport()
+	input.IsKVMSupport = host.IsKvmSupport()
 	for i := 0; i < len(input.Nics); i++ {
-		if input.OsName == OS_NAME_VMWARE {
-			input.Nics[i].Driver = "vmxnet3"
-		}
-		if err := s.generateNicScripts(input.Nics[i]); err != nil {
-			return "", errors.Wrapf(err, "generateNicScripts for nic: %v", input.Nics[i])
+		if !dryRun {
+			if err := s.generateNicScripts(input.Nics[i]); err != nil {
+				return "", errors.Wrapf(err, "generateNicScripts for nic: %v", input.Nics[i])
+			}
 		}
 		input.Nics[i].UpscriptPath = s.getNicUpScriptPath(input.Nics[i])
-		input.Nics[i].DownscriptPath = s.getNicDownScriptPath(input.Nics[i])
+		input.Nics[i].DownscriptPath = s.getNicQemuDownScript(input.Nics[i])
 	}
 
 	input.ExtraOptions = append(input.ExtraOptions, s.extraOptions())
@@ -494,21 +1972,30 @@ function nic_mtu() {
 	if options.HostOptions.EnableVirtioRngDevice {
 		input.EnableRNGRandom = true
 	}
+	input.EnableBalloon = s.isBalloonEnabled()
 
 	// add serial device
 	if !s.disableIsaSerialDev() {
 		input.EnableSerialDevice = true
 	}
+	input.HostCharDevices, err = s.getHostCharDevices()
+	if err != nil {
+		return "", errors.Wrap(err, "getHostCharDevices")
+	}
 
-	if jsonutils.QueryBoolean(data, "need_migrate", false) {
+	if jsonutils.QueryBoolean(data, "need_migrate", false) && !dryRun {
 		input.NeedMigrate = true
-		migratePort := s.manager.GetFreePortByBase(LIVE_MIGRATE_PORT_BASE)
-		s.LiveMigrateDestPort = &migratePort
+		migratePort := s.manager.ReserveMigratePort(s.Id)
+		s.setLiveMigrateDestPort(migratePort)
 		input.LiveMigratePort = uint(migratePort)
 		if jsonutils.QueryBoolean(data, "live_migrate_use_tls", false) {
 			s.LiveMigrateUseTls = true
 			input.LiveMigrateUseTLS = true
 		}
+		// tls creds must be set up before listening, so tls always defers incoming
+		s.LiveMigrateDeferIncoming = s.LiveMigrateUseTls ||
+			jsonutils.QueryBoolean(data, "live_migrate_defer_incoming", options.HostOptions.LiveMigrateDeferIncoming)
+		input.DeferIncoming = s.LiveMigrateDeferIncoming
 	} else if s.Desc.IsSlave {
 		input.IsSlave = true
 		input.LiveMigratePort = uint(s.manager.GetFreePortByBase(LIVE_MIGRATE_PORT_BASE))
@@ -519,6 +2006,77 @@ function nic_mtu() {
 	if !s.disablePvpanicDev() {
 		input.EnablePvpanic = true
 	}
+	if err := s.validateRebootOptions(); err != nil {
+		return "", err
+	}
+	if s.getRebootAction() == GUEST_REBOOT_ACTION_RESTART || s.isOneShot() {
+		input.NoReboot = true
+	}
+	input.NoShutdown = s.isNoShutdown()
+	if s.isOvercommitMemLock() {
+		if err := validateMemLock(input.Mem); err != nil {
+			return "", errors.Wrap(err, "validateMemLock")
+		}
+		input.OvercommitMemLock = true
+	}
+	input.OvercommitCpuPm = s.isOvercommitCpuPm()
+	input.GlobalProperties, err = s.getGlobalProperties()
+	if err != nil {
+		return "", errors.Wrap(err, "getGlobalProperties")
+	}
+	resolutionProps, err := s.getDisplayResolutionProperties(input.QemuArch == qemu.Arch_aarch64)
+	if err != nil {
+		return "", errors.Wrap(err, "getDisplayResolutionProperties")
+	}
+	input.GlobalProperties = append(input.GlobalProperties, resolutionProps...)
+	if input.QemuArch != qemu.Arch_aarch64 {
+		input.GlobalProperties = append(input.GlobalProperties, s.getDisplayMaxOutputsProperties(maxOutputs)...)
+	}
+	input.AcpiTables, err = s.getAcpiTables()
+	if err != nil {
+		return "", errors.Wrap(err, "getAcpiTables")
+	}
+	input.AudioBackend = s.getAudioBackend()
+	input.WatchdogModel = s.Desc.Metadata["watchdog_model"]
+	input.WatchdogAction = s.Desc.Metadata["watchdog_action"]
+	input.ScsiController = s.Desc.ScsiController
+	input.ScsiControllerCount = s.Desc.ScsiControllerCount
+	input.SmbiosOemStrings, err = s.getSmbiosOemStrings()
+	if err != nil {
+		return "", errors.Wrap(err, "getSmbiosOemStrings")
+	}
+	// hostname of desc is passed to guest by channel of metadata hostname_channel, smbios or fw_cfg
+	input.HostnameChannel = s.Desc.Metadata["hostname_channel"]
+	input.Hostname = s.Desc.Hostname
+	if s.isRealtimeMode() {
+		if !dryRun {
+			if _, err := s.getRealtimeCpus(); err != nil {
+				return "", errors.Wrap(err, "getRealtimeCpus")
+			}
+		}
+		if err := s.validateRealtimeClocksource(input.QemuArch == qemu.Arch_aarch64); err != nil {
+			return "", errors.Wrap(err, "validateRealtimeClocksource")
+		}
+		if err := validateMemLock(input.Mem); err != nil {
+			return "", errors.Wrap(err, "validateMemLock")
+		}
+		input.RealtimeMode = true
+	}
+	numaNodes, err := s.getNumaNodes(input.Mem)
+	if err != nil {
+		return "", errors.Wrap(err, "getNumaNodes")
+	}
+	input.NumaNodes = getNumaNodeOptions(numaNodes)
+	if s.isStablePciAddress() {
+		if dryRun {
+			input.StablePciAddrs, _, err = s.allocStablePciAddrs(qemu.CountAutoPciDevices(input))
+		} else {
+			input.StablePciAddrs, err = s.getStablePciAddrs(qemu.CountAutoPciDevices(input))
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "getStablePciAddrs")
+		}
+	}
 
 	qemuOpts, err := qemu.GenerateStartOptions(input)
 	if err != nil {
@@ -527,17 +2085,86 @@ function nic_mtu() {
 	cmd = fmt.Sprintf("%s %s", cmd, qemuOpts)
 	cmd += "\"\n"
 
+	envs, err := s.getQemuEnvs()
+	if err != nil {
+		return "", errors.Wrap(err, "getQemuEnvs")
+	}
+	envScript, err := generateEnvScript(envs)
+	if err != nil {
+		return "", errors.Wrap(err, "generateEnvScript")
+	}
+	cmd += envScript
+
 	cmd += `
 if [ ! -z "$STATE_FILE" ] && [ -d "$STATE_FILE" ] && [ -f "$STATE_FILE/content" ]; then
     CMD="$CMD --incoming \"exec: cat $STATE_FILE/content\""
 elif [ ! -z "$STATE_FILE" ] && [ -f "$STATE_FILE" ]; then
     CMD="$CMD --incoming \"exec: cat $STATE_FILE\""
 fi
-eval $CMD`
+`
+	cmd += s.generateHookScript(options.HostOptions.GuestPreStartHook, GUEST_HOOK_PRE_START, true)
+	cmd += s.getSecurityLaunchScript()
+	cmd += "eval $CMD"
 
 	return cmd, nil
 }
 
+var (
+	lookupUser = user.Lookup
+	chownPath  = os.Chown
+)
+
+func lookupRunAsUser(name string) (int, int, error) {
+	u, err := lookupUser(name)
+	if err != nil {
+		return 0, 0, errors.Wrap(err, "lookup user")
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parse uid %s", u.Uid)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return 0, 0, errors.Wrapf(err, "parse gid %s", u.Gid)
+	}
+	return uid, gid, nil
+}
+
+// prepareRunAsUser hands over files qemu accesses after dropping privileges
+// to runas user right before launching: guest home dir for pid, state and
+// snapshot files and encrypt key file. Disks and sockets are opened before
+// dropping privileges, hotplugged disks and migration targets must be
+// accessible to user as well
+func (s *SKVMGuestInstance) prepareRunAsUser() error {
+	name := options.HostOptions.QemuRunasUser
+	if len(name) == 0 {
+		return nil
+	}
+	uid, gid, err := lookupRunAsUser(name)
+	if err != nil {
+		return errors.Wrapf(err, "qemu runas user %s", name)
+	}
+	for _, p := range []string{s.HomeDir(), s.getEncryptKeyPath()} {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			continue
+		}
+		if err := chownPath(p, uid, gid); err != nil {
+			return errors.Wrapf(err, "chown %s", p)
+		}
+	}
+	return nil
+}
+
+// getNicQemuDownScript returns downscript qemu runs when tap is closed. Qemu
+// dropped privileges by -runas can't detach tap from bridge, so it runs none
+// and down scripts are left to stop script and nic unplug of host agent
+func (s *SKVMGuestInstance) getNicQemuDownScript(nic *api.GuestnetworkJsonDesc) string {
+	if len(options.HostOptions.QemuRunasUser) > 0 {
+		return "no"
+	}
+	return s.getNicDownScriptPath(nic)
+}
+
 func (s *SKVMGuestInstance) parseCmdline(input string) (*qemutils.Cmdline, []qemutils.Option, error) {
 	cl, err := qemutils.NewCmdline(input)
 	if err != nil {
@@ -609,61 +2236,284 @@ func (s *SKVMGuestInstance) unifyMigrateQemuCmdline(cur string, src string) (str
 	return unifyCl.ToString(), nil
 }
 
+var (
+	// plain variable assignments of start script, e.g. DISK_0=/path/to/disk
+	scriptVarReg    = regexp.MustCompile("(?m)^([A-Z][A-Z0-9_]*)=([^$`\n]*)$")
+	scriptVarRefReg = regexp.MustCompile(`\$([A-Z][A-Z0-9_]*)`)
+	// shell substitutions of start script helpers, e.g. $(nic_speed 1000)
+	scriptSubstitutionReg = regexp.MustCompile(`\$\([^)]*\)`)
+	// device params appended by start script helpers when qemu supports them
+	scriptRuntimeParams = []string{"speed", "host_mtu"}
+)
+
+// DiffCmdline compares cmdline generated from current desc with cmdline of running qemu,
+// options only running qemu has are reported as added, options it lacks as removed
+func (s *SKVMGuestInstance) DiffCmdline() ([]string, error) {
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(s.GetQemuVersionStr()))
+	data.Set("vnc_port", jsonutils.NewInt(int64(s.GetVncPort())))
+	startScript, err := s.buildStartScript(data, sStartScriptHost{s.manager.host}, true)
+	if err != nil {
+		return nil, errors.Wrap(err, "buildStartScript")
+	}
+	generated, err := s.getQemuCmdlineFromContent(startScript)
+	if err != nil {
+		return nil, errors.Wrap(err, "getQemuCmdlineFromContent")
+	}
+	generated = expandStartScriptVars(startScript, generated)
+	running, err := s.GetRunningCmdline()
+	if err != nil {
+		return nil, errors.Wrap(err, "GetRunningCmdline")
+	}
+	return s.diffCmdline(generated, running.ToString())
+}
+
+func (s *SKVMGuestInstance) diffCmdline(generated, running string) ([]string, error) {
+	genCl, _, err := s.parseCmdline(generated)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parseCmdline generated %q", generated)
+	}
+	runCl, _, err := s.parseCmdline(running)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parseCmdline running %q", running)
+	}
+	// first option is qemu binary, which is a variable in start script
+	genOpts := genCl.GetOptions()[1:]
+	runOpts := runCl.GetOptions()[1:]
+	for i := range genOpts {
+		genOpts[i].Value = strings.TrimSpace(scriptSubstitutionReg.ReplaceAllString(genOpts[i].Value, ""))
+	}
+	for i := range runOpts {
+		runOpts[i].Value = removeOptionParams(runOpts[i].Value, scriptRuntimeParams)
+	}
+
+	keyCount := map[string]int{}
+	for _, opts := range [][]qemutils.Option{genOpts, runOpts} {
+		cnt := map[string]int{}
+		for _, o := range opts {
+			cnt[o.Key] += 1
+			if cnt[o.Key] > keyCount[o.Key] {
+				keyCount[o.Key] = cnt[o.Key]
+			}
+		}
+	}
+	// options are matched by id param, options without id by key if key is unique
+	identity := func(o qemutils.Option) string {
+		if id := getOptionParam(o.Value, "id"); len(id) > 0 {
+			return fmt.Sprintf("-%s id=%s", o.Key, id)
+		}
+		if keyCount[o.Key] <= 1 {
+			return "-" + o.Key
+		}
+		return "-" + o.ToString()
+	}
+
+	runById := map[string]qemutils.Option{}
+	for _, o := range runOpts {
+		runById[identity(o)] = o
+	}
+	genById := map[string]qemutils.Option{}
+	diffs := []string{}
+	for _, o := range genOpts {
+		id := identity(o)
+		genById[id] = o
+		runO, ok := runById[id]
+		if !ok {
+			diffs = append(diffs, "removed -"+o.ToString())
+		} else if runO.Value != o.Value {
+			diffs = append(diffs, fmt.Sprintf("changed -%s %s -> %s", o.Key, o.Value, runO.Value))
+		}
+	}
+	for _, o := range runOpts {
+		if _, ok := genById[identity(o)]; !ok {
+			diffs = append(diffs, "added -"+o.ToString())
+		}
+	}
+	return diffs, nil
+}
+
+// expandStartScriptVars replaces references of plain variables defined in start script
+func expandStartScriptVars(script, cmdline string) string {
+	vars := map[string]string{}
+	for _, m := range scriptVarReg.FindAllStringSubmatch(script, -1) {
+		vars[m[1]] = m[2]
+	}
+	return scriptVarRefReg.ReplaceAllStringFunc(cmdline, func(ref string) string {
+		if val, ok := vars[ref[1:]]; ok {
+			return val
+		}
+		return ref
+	})
+}
+
+// getOptionParam returns value of param key in comma separated option value
+func getOptionParam(value, key string) string {
+	for _, param := range strings.Split(value, ",") {
+		if strings.HasPrefix(param, key+"=") {
+			return param[len(key)+1:]
+		}
+	}
+	return ""
+}
+
+func removeOptionParams(value string, keys []string) string {
+	params := []string{}
+	for _, param := range strings.Split(value, ",") {
+		if k := strings.SplitN(param, "=", 2); len(k) == 2 && utils.IsInStringArray(k[0], keys) {
+			continue
+		}
+		params = append(params, param)
+	}
+	return strings.Join(params, ",")
+}
+
+var diskDeviceReg = regexp.MustCompile(`-device\s+([\w-]+),(?:[^\s]*,)?drive=(drive_\d+)\b`)
+
+// getCmdlineDiskDevices maps disk drive id to its device model in qemu cmdline
+func getCmdlineDiskDevices(cmdline string) map[string]string {
+	devices := map[string]string{}
+	for _, match := range diskDeviceReg.FindAllStringSubmatch(cmdline, -1) {
+		devices[match[2]] = match[1]
+	}
+	return devices
+}
+
+// verifyMigrateDiskDevices makes sure destination attaches every disk by the same device model
+// as source does, guest loses its disks after migration otherwise, e.g. sata disks of macOS
+func verifyMigrateDiskDevices(cur, src string) error {
+	curDevices := getCmdlineDiskDevices(cur)
+	for drive, srcDev := range getCmdlineDiskDevices(src) {
+		if curDev, ok := curDevices[drive]; ok && curDev != srcDev {
+			return errors.Errorf("disk %s is attached by %s on source but %s on destination", drive, srcDev, curDev)
+		}
+	}
+	return nil
+}
+
 func (s *SKVMGuestInstance) generateStopScript(data *jsonutils.JSONDict) string {
 	var (
 		uuid = s.Desc.Uuid
 		nics = s.Desc.Nics
 	)
+	if s.getOsname() == OS_NAME_ANDROID {
+		// dropped nics are never attached, so there are no down scripts of them
+		nics, _ = normalizeAndroidNics(nics)
+	}
+
+	cmd := s.generateStopProcessScript()
+
+	cmd += fmt.Sprintf("for d in $(ls -d /dev/hugepages/%s*)\n", uuid)
+	cmd += fmt.Sprintf("do\n")
+	cmd += fmt.Sprintf("  if [ -d $d ]; then\n")
+	cmd += fmt.Sprintf("    umount $d\n")
+	cmd += fmt.Sprintf("    rm -rf $d\n")
+	cmd += fmt.Sprintf("  fi\n")
+	cmd += fmt.Sprintf("done\n")
+
+	for _, nic := range nics {
+		downscript := s.getNicDownScriptPath(nic)
+		cmd += fmt.Sprintf("%s %s\n", downscript, nic.Ifname)
+		if qemu.IsNicMultiQueue(nic) {
+			cmd += fmt.Sprintf("ip tuntap del dev %s mode tap multi_queue > /dev/null 2>&1\n", nic.Ifname)
+		}
+	}
+	cmd += s.generateHookScript(options.HostOptions.GuestPostStopHook, GUEST_HOOK_POST_STOP, false)
+	return cmd
+}
+
+const (
+	// quit qemu through monitor at once, for internal cleanup of failed
+	// starts, lost monitors and migrated sources
+	STOP_SCRIPT_ARG_QUIT = "--quit"
+	// caller has tried powerdown already, SIGTERM and then SIGKILL
+	STOP_SCRIPT_ARG_NO_POWERDOWN = "--no-powerdown"
+	// SIGKILL directly
+	STOP_SCRIPT_ARG_FORCE = "--force"
+)
+
+// generateMonitorCommandScript sends command to monitor of qemu listening on
+// port of $VNC, qmp monitor is preferred when enabled
+func (s *SKVMGuestInstance) generateMonitorCommandScript(command string) string {
+	if options.HostOptions.EnableQmpMonitor {
+		return fmt.Sprintf("printf '{\"execute\":\"qmp_capabilities\"}\\n{\"execute\":\"%s\"}\\n' | nc -w 1 127.0.0.1 $(($VNC + %d)) > /dev/null 2>&1",
+			command, MONITOR_PORT_BASE+200)
+	}
+	return fmt.Sprintf("echo %s | nc -w 1 127.0.0.1 $(($VNC + %d)) > /dev/null 2>&1", command, MONITOR_PORT_BASE)
+}
 
+// generateStopProcessScript stops qemu in stages without argument: powerdown
+// via monitor, SIGTERM after grace period and SIGKILL at last. Arguments
+// STOP_SCRIPT_ARG_* skip stages
+func (s *SKVMGuestInstance) generateStopProcessScript() string {
 	cmd := ""
 	cmd += fmt.Sprintf("VNC_FILE=%s\n", s.GetVncFilePath())
 	cmd += fmt.Sprintf("PID_FILE=%s\n", s.GetPidFilePath())
-	cmd += "if [ \"$1\" != \"--force\" ] && [ -f $VNC_FILE ]; then\n"
+	cmd += "MODE=$1\n"
+	cmd += "MON_SENT=0\n"
+	// defunct qemu is listed by ps but can't be killed
+	cmd += "function pid_alive() {\n"
+	cmd += "  local state=$(ps -o stat= -p $1)\n"
+	cmd += "  [ -n \"$state\" ] && [ \"${state:0:1}\" != \"Z\" ]\n"
+	cmd += "}\n"
+	cmd += "function wait_pid_exit() {\n"
+	cmd += "  for ((i = 0; i < $2 * 10; i++)); do\n"
+	cmd += "    pid_alive $1 || return 0\n"
+	cmd += "    sleep 0.1\n"
+	cmd += "  done\n"
+	cmd += "  return 1\n"
+	cmd += "}\n"
+	cmd += fmt.Sprintf("if [ \"$MODE\" != \"%s\" ] && [ -f $VNC_FILE ]; then\n", STOP_SCRIPT_ARG_FORCE)
 	cmd += "  VNC=`cat $VNC_FILE`\n"
-
-	// TODO, replace with qmp monitor
-	cmd += fmt.Sprintf("  MON=$(($VNC + %d))\n", MONITOR_PORT_BASE)
-	cmd += "  echo quit | nc -w 1 127.0.0.1 $MON > /dev/null\n"
-	cmd += "  sleep 1\n"
+	cmd += fmt.Sprintf("  if [ \"$MODE\" == \"%s\" ]; then\n", STOP_SCRIPT_ARG_QUIT)
+	cmd += fmt.Sprintf("    %s && MON_SENT=1\n", s.generateMonitorCommandScript("quit"))
+	cmd += "  elif [ -z \"$MODE\" ]; then\n"
+	cmd += fmt.Sprintf("    %s && MON_SENT=1\n", s.generateMonitorCommandScript("system_powerdown"))
+	cmd += "  fi\n"
 	cmd += "  echo \"Remove VNC $VNC_FILE\"\n"
 	cmd += "  rm -f $VNC_FILE\n"
 	cmd += "fi\n"
 	cmd += "if [ -f $PID_FILE ]; then\n"
 	cmd += "  PID=`cat $PID_FILE`\n"
-	cmd += "  ps -p $PID > /dev/null\n"
-	cmd += "  if [ $? -eq 0 ]; then\n"
+	cmd += "  case \"$MODE\" in\n"
+	cmd += fmt.Sprintf("  %s)\n", STOP_SCRIPT_ARG_FORCE)
+	cmd += "    ;;\n"
+	cmd += fmt.Sprintf("  %s)\n", STOP_SCRIPT_ARG_QUIT)
+	cmd += "    [ $MON_SENT -eq 1 ] && wait_pid_exit $PID 1\n"
+	cmd += "    ;;\n"
+	cmd += "  *)\n"
+	cmd += fmt.Sprintf("    if [ $MON_SENT -ne 1 ] || ! wait_pid_exit $PID %d; then\n", options.HostOptions.GuestStopGraceSeconds)
+	cmd += "      if pid_alive $PID; then\n"
+	cmd += "        echo \"Terminate process $PID\"\n"
+	cmd += "        kill -15 $PID > /dev/null 2>&1\n"
+	cmd += fmt.Sprintf("        wait_pid_exit $PID %d\n", options.HostOptions.GuestStopTermSeconds)
+	cmd += "      fi\n"
+	cmd += "    fi\n"
+	cmd += "    ;;\n"
+	cmd += "  esac\n"
+	cmd += "  if pid_alive $PID; then\n"
 	cmd += "    echo \"Kill process $PID\"\n"
 	cmd += "    kill -9 $PID > /dev/null 2>&1\n"
 	cmd += "  fi\n"
 	cmd += "  echo \"Remove PID $PID_FILE\"\n"
 	cmd += "  rm -f $PID_FILE\n"
 	cmd += "fi\n"
-
-	cmd += fmt.Sprintf("for d in $(ls -d /dev/hugepages/%s*)\n", uuid)
-	cmd += fmt.Sprintf("do\n")
-	cmd += fmt.Sprintf("  if [ -d $d ]; then\n")
-	cmd += fmt.Sprintf("    umount $d\n")
-	cmd += fmt.Sprintf("    rm -rf $d\n")
-	cmd += fmt.Sprintf("  fi\n")
-	cmd += fmt.Sprintf("done\n")
-
-	for _, nic := range nics {
-		downscript := s.getNicDownScriptPath(nic)
-		cmd += fmt.Sprintf("%s %s\n", downscript, nic.Ifname)
-	}
 	return cmd
 }
 
 func (s *SKVMGuestInstance) presendArpForNic(nic *api.GuestnetworkJsonDesc) {
+	if len(nic.Ip) == 0 {
+		// ipv6 only nic, arp is ipv4 only
+		return
+	}
 	ifi, err := net.InterfaceByName(nic.Ifname)
 	if err != nil {
-		log.Errorf("InterfaceByName error %s", nic.Ifname)
+		log.Errorf("%s presend arp InterfaceByName %s error %s", s.logPrefix(), nic.Ifname, err)
 		return
 	}
 
 	cli, err := arp.Dial(ifi)
 	if err != nil {
-		log.Errorf("arp Dial error %s", err)
+		log.Errorf("%s presend arp dial %s error %s", s.logPrefix(), nic.Ifname, err)
 		return
 	}
 	defer cli.Close()
@@ -677,34 +2527,152 @@ func (s *SKVMGuestInstance) presendArpForNic(nic *api.GuestnetworkJsonDesc) {
 	)
 	srcMac, err := net.ParseMAC(sSrcMac)
 	if err != nil {
-		log.Errorf("Send arp parse mac error: %s", err)
+		log.Errorf("%s presend arp parse mac error: %s", s.logPrefix(), err)
 		return
 	}
 
 	pkt, err := arp.NewPacket(arp.OperationRequest, srcMac, srcIp, dstMac, dstIp)
 	if err != nil {
-		log.Errorf("New arp packet error %s", err)
+		log.Errorf("%s presend arp new packet error %s", s.logPrefix(), err)
 		return
 	}
 	if err := cli.WriteTo(pkt, ethernet.Broadcast); err != nil {
-		log.Errorf("Send arp packet error %s ", err)
+		log.Errorf("%s presend arp send packet on %s error %s", s.logPrefix(), nic.Ifname, err)
 		return
 	}
 }
 
+type SWatchdogStatus struct {
+	Model  string `json:"model"`
+	Action string `json:"action"`
+	// guest agent responds to ping
+	GuestAgent  bool      `json:"guest_agent"`
+	LastFiredAt time.Time `json:"last_fired_at,omitempty"`
+	LastFired   string    `json:"last_fired_action,omitempty"`
+	// watchdog never expired since qemu started and guest agent alive
+	Serviced bool `json:"serviced"`
+}
+
+// GetWatchdogStatus tells whether guest watchdog is being serviced,
+// a hung guest stops petting watchdog while qemu is still alive
+func (s *SKVMGuestInstance) GetWatchdogStatus() *SWatchdogStatus {
+	status := &SWatchdogStatus{
+		Model:       s.Desc.Metadata["watchdog_model"],
+		Action:      s.Desc.Metadata["watchdog_action"],
+		LastFiredAt: s.watchdogFiredAt,
+		LastFired:   s.watchdogAction,
+	}
+	if len(status.Model) == 0 {
+		return status
+	}
+	if len(status.Action) == 0 {
+		status.Action = qemu.WATCHDOG_ACTION_RESET
+	}
+	status.GuestAgent = s.guestAgent.GuestPing() == nil
+	status.Serviced = status.GuestAgent && s.watchdogFiredAt.IsZero()
+	return status
+}
+
+// SyncGuestTime sets guest clock to host time through guest agent,
+// falls back to rtc-reset-reinjection of qmp monitor if agent not available
+func (s *SKVMGuestInstance) SyncGuestTime() error {
+	err := s.guestAgent.GuestSetTime(time.Now())
+	if err == nil {
+		log.Infof("%s time synced by guest agent", s.logPrefix())
+		return nil
+	}
+	log.Warningf("%s guest-set-time failed: %s", s.logPrefix(), err)
+	if s.Monitor == nil {
+		return errors.Wrap(err, "guest-set-time and monitor not connected")
+	}
+	e := s.Monitor.QemuMonitorCommand(`{"execute":"rtc-reset-reinjection"}`, func(res string) {
+		log.Infof("%s rtc-reset-reinjection: %s", s.logPrefix(), res)
+	})
+	if e != nil {
+		return errors.Wrapf(e, "rtc-reset-reinjection after guest-set-time failed: %s", err)
+	}
+	return nil
+}
+
+// GuestFsTrim discards unused blocks of guest filesystems through guest agent
+// so that thin provisioned disks with discard on reclaim free space, guest
+// without agent running is not trimmed and ErrNotSupported is returned
+func (s *SKVMGuestInstance) GuestFsTrim(minimum int64) ([]monitor.GuestFilesystemTrimResult, error) {
+	if err := s.guestAgent.GuestPing(); err != nil {
+		log.Warningf("%s guest agent not available, skip fstrim: %s", s.logPrefix(), err)
+		return nil, errors.Wrapf(errors.ErrNotSupported, "guest agent not available: %s", err)
+	}
+	results, err := s.guestAgent.GuestFsTrim(minimum)
+	if err != nil {
+		return nil, errors.Wrap(err, "guest-fstrim")
+	}
+	for _, r := range results {
+		if len(r.Error) > 0 {
+			log.Warningf("%s fstrim %s failed: %s", s.logPrefix(), r.Path, r.Error)
+		} else {
+			log.Infof("%s fstrim %s trimmed %d bytes", s.logPrefix(), r.Path, r.Trimmed)
+		}
+	}
+	return results, nil
+}
+
+// interval of checking whether guest has reset after asked to reboot
+var gracefulRebootPollInterval = time.Second
+
+// GracefulReboot asks guest os to reboot through guest agent so that it flushes and restarts cleanly,
+// guest is reset by qmp system_reset if agent is absent or guest doesn't reset within timeout
+func (s *SKVMGuestInstance) GracefulReboot(timeout time.Duration) error {
+	requestAt := time.Now()
+	err := s.guestAgent.GuestShutdown(monitor.QGA_SHUTDOWN_MODE_REBOOT)
+	if err == nil {
+		if s.waitGuestReset(requestAt, timeout) {
+			log.Infof("%s rebooted by guest agent", s.logPrefix())
+			return nil
+		}
+		log.Warningf("%s not reset in %s after guest-shutdown reboot, force reset", s.logPrefix(), timeout)
+	} else {
+		log.Warningf("%s guest-shutdown reboot failed: %s", s.logPrefix(), err)
+	}
+	if s.Monitor == nil {
+		return errors.Errorf("guest %s not rebooted and monitor not connected", s.GetName())
+	}
+	s.Monitor.SimpleCommand("system_reset", func(res string) {
+		log.Infof("%s system_reset: %s", s.logPrefix(), res)
+	})
+	return nil
+}
+
+// waitGuestReset waits the RESET event of qmp monitor which comes after since
+func (s *SKVMGuestInstance) waitGuestReset(since time.Time, timeout time.Duration) bool {
+	deadline := since.Add(timeout)
+	for {
+		if lastResetAt, _ := s.getResetState(false); lastResetAt.After(since) {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(gracefulRebootPollInterval)
+	}
+}
+
+// interval between rounds of gratuitous arp after guest started or migrated
+var presendArpInterval = time.Second
+
 func (s *SKVMGuestInstance) StartPresendArp() {
-	go func() {
+	go func(interval time.Duration) {
 		for i := 0; i < 5; i++ {
 			for _, nic := range s.Desc.Nics {
 				s.presendArpForNic(nic)
 			}
-			time.Sleep(1 * time.Second)
+			guestArpPresendCounter.Inc()
+			time.Sleep(interval)
 		}
-	}()
+	}(presendArpInterval)
 }
 
 func (s *SKVMGuestInstance) getPKIDirPath() string {
-	return path.Join(s.HomeDir(), "pki")
+	return s.Paths().PKIDir
 }
 
 func (s *SKVMGuestInstance) makePKIDir() error {
@@ -749,8 +2717,9 @@ func (s *SKVMGuestInstance) startMemCleaner() error {
 		"--log-dir", s.HomeDir(),
 	).Run()
 	if err != nil {
-		log.Errorf("failed start memcleaner: %s", err)
+		log.Errorf("%s failed start memcleaner: %s", s.logPrefix(), err)
 		return errors.Wrap(err, "start memclean")
 	}
+	guestMemCleanerCounter.Inc()
 	return nil
 }
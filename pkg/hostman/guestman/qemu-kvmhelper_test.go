@@ -0,0 +1,3643 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/onecloud/pkg/apis"
+	api "yunion.io/x/onecloud/pkg/apis/compute"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/desc"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
+	"yunion.io/x/onecloud/pkg/hostman/hostinfo/hostbridge"
+	"yunion.io/x/onecloud/pkg/hostman/monitor"
+	"yunion.io/x/onecloud/pkg/hostman/options"
+	"yunion.io/x/onecloud/pkg/hostman/storageman"
+	"yunion.io/x/onecloud/pkg/util/qemutils"
+)
+
+func newTestGuest(metadata map[string]string) *SKVMGuestInstance {
+	return newTestGuestWithServersPath("/opt/cloud/workspace/servers", metadata)
+}
+
+func newTestGuestWithServersPath(serversPath string, metadata map[string]string) *SKVMGuestInstance {
+	s := NewKVMGuestInstance("test-guest", &SGuestManager{ServersPath: serversPath})
+	s.Desc = &desc.SGuestDesc{
+		Metadata: metadata,
+	}
+	return s
+}
+
+func TestSKVMGuestInstance_getAarch64Devices(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		want     []string
+	}{
+		{
+			name:     "default usb devices",
+			metadata: map[string]string{},
+			want: []string{
+				"qemu-xhci,p2=8,p3=8,id=usb1",
+				"usb-tablet,id=input0,bus=usb1.0,port=1",
+				"usb-kbd,id=input1,bus=usb1.0,port=2",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "disable usb kbd",
+			metadata: map[string]string{"disable_usb_kbd": "true"},
+			want: []string{
+				"qemu-xhci,p2=8,p3=8,id=usb1",
+				"usb-tablet,id=input0,bus=usb1.0,port=1",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "disable usb tablet",
+			metadata: map[string]string{"disable_usb_tablet": "true"},
+			want: []string{
+				"qemu-xhci,p2=8,p3=8,id=usb1",
+				"usb-kbd,id=input1,bus=usb1.0,port=2",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "disable all usb devices",
+			metadata: map[string]string{"disable_usb_kbd": "true", "disable_usb_tablet": "true"},
+			want: []string{
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "virtio input devices",
+			metadata: map[string]string{"input_device_type": "virtio"},
+			want: []string{
+				"virtio-tablet-pci,id=input0",
+				"virtio-keyboard-pci,id=input1",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "virtio input devices disable kbd",
+			metadata: map[string]string{"input_device_type": "virtio", "disable_usb_kbd": "true"},
+			want: []string{
+				"virtio-tablet-pci,id=input0",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "virtio input devices disable tablet",
+			metadata: map[string]string{"input_device_type": "virtio", "disable_usb_tablet": "true"},
+			want: []string{
+				"virtio-keyboard-pci,id=input1",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "disable usb",
+			metadata: map[string]string{"disable_usb": "true"},
+			want: []string{
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+		{
+			name:     "disable usb keeps virtio input devices",
+			metadata: map[string]string{"disable_usb": "true", "input_device_type": "virtio", "disable_usb_kbd": "true"},
+			want: []string{
+				"virtio-tablet-pci,id=input0",
+				"virtio-gpu-pci,id=video1,max_outputs=1",
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, newTestGuest(c.metadata).getAarch64Devices(1))
+		})
+	}
+}
+
+func TestSKVMGuestInstance_getX86InputDevices(t *testing.T) {
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		want     []string
+	}{
+		{
+			name:     "default usb devices",
+			metadata: map[string]string{},
+			want:     []string{"usb-kbd", "usb-tablet"},
+		},
+		{
+			name:     "android usb devices",
+			metadata: map[string]string{"os_name": OS_NAME_ANDROID},
+			want:     []string{"usb-kbd", "usb-mouse"},
+		},
+		{
+			name:     "virtio input devices",
+			metadata: map[string]string{"input_device_type": "virtio"},
+			want:     []string{"virtio-keyboard-pci", "virtio-tablet-pci"},
+		},
+		{
+			name:     "android virtio input devices",
+			metadata: map[string]string{"os_name": OS_NAME_ANDROID, "input_device_type": "virtio"},
+			want:     []string{"virtio-keyboard-pci", "virtio-mouse-pci"},
+		},
+		{
+			name:     "virtio input devices disable kbd and tablet",
+			metadata: map[string]string{"input_device_type": "virtio", "disable_usb_kbd": "true", "disable_usb_tablet": "true"},
+			want:     []string{},
+		},
+		{
+			name:     "old windows",
+			metadata: map[string]string{"os_name": OS_NAME_WINDOWS, "os_version": "5.1", "input_device_type": "virtio"},
+			want:     []string{},
+		},
+		{
+			name:     "disable usb",
+			metadata: map[string]string{"disable_usb": "true"},
+			want:     []string{},
+		},
+		{
+			name:     "disable usb keeps virtio input devices",
+			metadata: map[string]string{"disable_usb": "true", "input_device_type": "virtio", "disable_usb_tablet": "true"},
+			want:     []string{"virtio-keyboard-pci"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, newTestGuest(c.metadata).getX86InputDevices())
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateVncFileScript(t *testing.T) {
+	s := newTestGuest(map[string]string{})
+	defer func(sleep bool) {
+		options.HostOptions.StartScriptSleepBeforeLaunch = sleep
+	}(options.HostOptions.StartScriptSleepBeforeLaunch)
+
+	options.HostOptions.StartScriptSleepBeforeLaunch = true
+	assert.Equal(t, "sleep 1\necho 5 > /opt/cloud/workspace/servers/test-guest/vnc\n", s.generateVncFileScript(5))
+
+	options.HostOptions.StartScriptSleepBeforeLaunch = false
+	assert.Equal(t, "echo 5 > /opt/cloud/workspace/servers/test-guest/vnc\n", s.generateVncFileScript(5))
+}
+
+func Test_generateParallelScripts(t *testing.T) {
+	cmds := []string{
+		"/servers/a/if-down-br0-vnet1.sh vnet1",
+		"/servers/a/if-down-br0-vnet2.sh vnet2",
+		"/servers/a/if-down-br0-vnet3.sh vnet3",
+	}
+	cases := []struct {
+		parallel int
+		want     string
+	}{
+		{
+			parallel: 8,
+			want: "/servers/a/if-down-br0-vnet1.sh vnet1 &\n" +
+				"/servers/a/if-down-br0-vnet2.sh vnet2 &\n" +
+				"/servers/a/if-down-br0-vnet3.sh vnet3 &\n" +
+				"wait\n",
+		},
+		{
+			parallel: 2,
+			want: "/servers/a/if-down-br0-vnet1.sh vnet1 &\n" +
+				"/servers/a/if-down-br0-vnet2.sh vnet2 &\n" +
+				"wait\n" +
+				"/servers/a/if-down-br0-vnet3.sh vnet3 &\n" +
+				"wait\n",
+		},
+		{
+			parallel: 0,
+			want: "/servers/a/if-down-br0-vnet1.sh vnet1 &\n" +
+				"wait\n" +
+				"/servers/a/if-down-br0-vnet2.sh vnet2 &\n" +
+				"wait\n" +
+				"/servers/a/if-down-br0-vnet3.sh vnet3 &\n" +
+				"wait\n",
+		},
+	}
+	for _, c := range cases {
+		script := generateParallelScripts(cmds, c.parallel)
+		assert.Equal(t, c.want, script)
+		for _, cmd := range cmds {
+			assert.Contains(t, script, cmd)
+		}
+	}
+	assert.Equal(t, "", generateParallelScripts(nil, 8))
+}
+
+func Test_validateNicIfnames(t *testing.T) {
+	assert.NoError(t, validateNicIfnames(nil))
+	assert.NoError(t, validateNicIfnames([]*api.GuestnetworkJsonDesc{
+		{Ifname: "vnet1"},
+		{Ifname: "vnet2"},
+	}))
+
+	err := validateNicIfnames([]*api.GuestnetworkJsonDesc{
+		{Ifname: "vnet1"},
+		{Ifname: "vnet2"},
+		{Ifname: "vnet1"},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "duplicate ifname vnet1")
+	}
+
+	err = validateNicIfnames([]*api.GuestnetworkJsonDesc{
+		{Ifname: "vnet1"},
+		{Ifname: "", Mac: "00:22:00:00:00:02"},
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "empty ifname")
+	}
+}
+
+func Test_validateNicMtu(t *testing.T) {
+	cases := []struct {
+		name      string
+		nic       *api.GuestnetworkJsonDesc
+		bridgeMtu int
+		wantErr   bool
+	}{
+		{
+			name:      "valid mtu",
+			nic:       &api.GuestnetworkJsonDesc{Ifname: "vnet1", Bridge: "br0", Mtu: 1500},
+			bridgeMtu: 1500,
+		},
+		{
+			name:      "valid jumbo mtu",
+			nic:       &api.GuestnetworkJsonDesc{Ifname: "vnet1", Bridge: "br0", Mtu: 9000},
+			bridgeMtu: 9000,
+		},
+		{
+			name:      "over mtu",
+			nic:       &api.GuestnetworkJsonDesc{Ifname: "vnet1", Bridge: "br0", Mtu: 9000},
+			bridgeMtu: 1500,
+			wantErr:   true,
+		},
+		{
+			name:      "mtu not set",
+			nic:       &api.GuestnetworkJsonDesc{Ifname: "vnet1", Bridge: "br0"},
+			bridgeMtu: 1500,
+		},
+		{
+			name:      "bridge mtu unknown",
+			nic:       &api.GuestnetworkJsonDesc{Ifname: "vnet1", Bridge: "br0", Mtu: 9000},
+			bridgeMtu: 0,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := validateNicMtu(c.nic, c.bridgeMtu)
+			if c.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	ovnNic := &api.GuestnetworkJsonDesc{Ifname: "vnet1", Bridge: "brvpc", Mtu: 8942}
+	ovnNic.Vpc.Provider = api.VPC_PROVIDER_OVN
+	assert.NoError(t, validateNicMtu(ovnNic, 1500))
+}
+
+func TestSKVMGuestInstance_getBootMenuSplashTime(t *testing.T) {
+	s := newTestGuest(map[string]string{})
+	splashTime, err := s.getBootMenuSplashTime()
+	assert.NoError(t, err)
+	assert.Equal(t, uint(0), splashTime)
+
+	s = newTestGuest(map[string]string{"boot_splash_time": "5000"})
+	splashTime, err = s.getBootMenuSplashTime()
+	assert.NoError(t, err)
+	assert.Equal(t, uint(5000), splashTime)
+
+	s = newTestGuest(map[string]string{"boot_splash_time": "5s"})
+	_, err = s.getBootMenuSplashTime()
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_generateStartScriptBootSplash(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	tmpDir := t.TempDir()
+	bmp := path.Join(tmpDir, "splash.bmp")
+	if err := ioutil.WriteFile(bmp, []byte("BM\x36\x00"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	png := path.Join(tmpDir, "splash.png")
+	if err := ioutil.WriteFile(png, []byte("\x89PNG"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		want     string
+		wantErr  string
+	}{
+		{
+			name:     "splash",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": bmp, "boot_splash_time": "3000"},
+			want:     " -boot order=cdn,menu=on,splash='" + bmp + "',splash-time=3000 ",
+		},
+		{
+			name:     "splash without time",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": bmp},
+			want:     " -boot order=cdn,menu=on,splash='" + bmp + "' ",
+		},
+		{
+			name:     "without boot menu",
+			metadata: map[string]string{"boot_splash": bmp},
+			wantErr:  "boot splash requires boot menu enabled",
+		},
+		{
+			name:     "not bmp",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": png},
+			wantErr:  "is not a bmp picture",
+		},
+		{
+			name:     "not exists",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": path.Join(tmpDir, "missing.bmp")},
+			wantErr:  "open boot_splash",
+		},
+		{
+			name:     "relative path",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": "splash.bmp"},
+			wantErr:  "should be absolute",
+		},
+		{
+			name:     "shell command in path",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": bmp + "$(reboot)"},
+			wantErr:  "should be absolute and consist of",
+		},
+		{
+			name:     "splash time out of range",
+			metadata: map[string]string{"boot_menu": "true", "boot_splash": bmp, "boot_splash_time": "70000"},
+			wantErr:  "out of range",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			s.Desc.BootOrder = "cdn"
+			for k, v := range c.metadata {
+				s.Desc.Metadata[k] = v
+			}
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if len(c.wantErr) > 0 {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			assert.Contains(t, script, c.want)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_getRebootAction(t *testing.T) {
+	assert.Equal(t, GUEST_REBOOT_ACTION_RESET, newTestGuest(map[string]string{}).getRebootAction())
+	assert.Equal(t, GUEST_REBOOT_ACTION_RESET, newTestGuest(map[string]string{"reboot_action": "bogus"}).getRebootAction())
+	assert.Equal(t, GUEST_REBOOT_ACTION_RESTART, newTestGuest(map[string]string{"reboot_action": "restart"}).getRebootAction())
+}
+
+func TestSKVMGuestInstance_generateStartScriptNoReboot(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	cases := []struct {
+		name     string
+		metadata map[string]string
+		want     bool
+		wantErr  string
+	}{
+		{name: "default", metadata: map[string]string{}},
+		{name: "one shot", metadata: map[string]string{"one_shot": "true"}, want: true},
+		{name: "restart on reboot", metadata: map[string]string{"reboot_action": "restart"}, want: true},
+		{
+			name:     "one shot and restart",
+			metadata: map[string]string{"one_shot": "true", "reboot_action": "restart"},
+			wantErr:  "mutually exclusive",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			for k, v := range c.metadata {
+				s.Desc.Metadata[k] = v
+			}
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if len(c.wantErr) > 0 {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			if c.want {
+				assert.Contains(t, script, " -no-reboot ")
+			} else {
+				assert.NotContains(t, script, "-no-reboot")
+			}
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptNoShutdown(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedAllow := options.HostOptions.AllowQemuNoShutdown
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.AllowQemuNoShutdown = savedAllow
+	}()
+
+	render := func(metadata map[string]string) (string, error) {
+		s := newTestStartGuest()
+		for k, v := range metadata {
+			s.Desc.Metadata[k] = v
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		return s.generateStartScript(data, host)
+	}
+
+	// not allowed by host
+	options.HostOptions.AllowQemuNoShutdown = false
+	script, err := render(map[string]string{"no_shutdown": "true"})
+	assert.NoError(t, err)
+	assert.NotContains(t, script, "-no-shutdown")
+
+	options.HostOptions.AllowQemuNoShutdown = true
+	script, err = render(map[string]string{"no_shutdown": "true"})
+	assert.NoError(t, err)
+	assert.Contains(t, script, " -no-shutdown ")
+	assert.NotContains(t, script, "-no-reboot")
+
+	_, err = render(map[string]string{"no_shutdown": "true", "reboot_action": "restart"})
+	assert.Error(t, err)
+	_, err = render(map[string]string{"no_shutdown": "true", "one_shot": "true"})
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_quitNoShutdownQemu(t *testing.T) {
+	savedAllow := options.HostOptions.AllowQemuNoShutdown
+	defer func() { options.HostOptions.AllowQemuNoShutdown = savedAllow }()
+	options.HostOptions.AllowQemuNoShutdown = true
+
+	s := newTestGuest(map[string]string{"no_shutdown": "true"})
+	mon := &fakeMonitor{}
+	s.Monitor = mon
+
+	// guest not powered off yet
+	assert.False(t, s.quitNoShutdownQemu())
+	assert.Len(t, mon.Commands(), 0)
+
+	s.eventGuestShutdown(&monitor.Event{Data: map[string]interface{}{"reason": "guest-shutdown"}})
+	assert.True(t, s.quitNoShutdownQemu())
+	assert.Equal(t, []string{"quit"}, mon.Commands())
+	assert.Nil(t, s.Monitor)
+
+	// qemu of guest without no_shutdown exits by itself
+	s = newTestGuest(map[string]string{})
+	mon = &fakeMonitor{}
+	s.Monitor = mon
+	s.eventGuestShutdown(&monitor.Event{Data: map[string]interface{}{"reason": "guest-shutdown"}})
+	assert.False(t, s.quitNoShutdownQemu())
+	assert.Len(t, mon.Commands(), 0)
+}
+
+func Test_getRebootLifecycle(t *testing.T) {
+	now := time.Now()
+	for _, c := range []struct {
+		name           string
+		processAlive   bool
+		lastResetAt    time.Time
+		shutdownReason string
+		want           string
+	}{
+		{"in place reset keeps files", true, now, "", GUEST_REBOOT_ACTION_RESET},
+		{"reset long ago", true, now.Add(-2 * GUEST_RESET_GRACE_PERIOD), "", ""},
+		{"alive without reset", true, time.Time{}, "", ""},
+		{"exited on guest reboot", false, time.Time{}, QMP_SHUTDOWN_REASON_GUEST_RESET, GUEST_REBOOT_ACTION_RESTART},
+		{"exited after reset", false, now, "", ""},
+		{"guest poweroff", false, time.Time{}, "guest-shutdown", ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.want, getRebootLifecycle(c.processAlive, c.lastResetAt, c.shutdownReason))
+		})
+	}
+}
+
+func TestSKVMGuestInstance_eventGuestReset(t *testing.T) {
+	s := newTestGuest(map[string]string{})
+	s.eventGuestShutdown(&monitor.Event{Data: map[string]interface{}{"reason": QMP_SHUTDOWN_REASON_GUEST_RESET}})
+	_, shutdownReason := s.getResetState(false)
+	assert.Equal(t, QMP_SHUTDOWN_REASON_GUEST_RESET, shutdownReason)
+	s.eventGuestReset(&monitor.Event{Data: map[string]interface{}{"reason": "guest-reset"}})
+	lastResetAt, shutdownReason := s.getResetState(true)
+	assert.Equal(t, "", shutdownReason)
+	assert.False(t, lastResetAt.IsZero())
+	assert.Equal(t, GUEST_REBOOT_ACTION_RESET, getRebootLifecycle(true, lastResetAt, shutdownReason))
+	lastResetAt, _ = s.getResetState(false)
+	assert.True(t, lastResetAt.IsZero())
+}
+
+func Test_checkMemLockLimit(t *testing.T) {
+	assert.NoError(t, checkMemLockLimit(4096, &unix.Rlimit{Cur: unix.RLIM_INFINITY, Max: unix.RLIM_INFINITY}))
+	assert.NoError(t, checkMemLockLimit(1024, &unix.Rlimit{Cur: 1024 * 1024 * 1024, Max: unix.RLIM_INFINITY}))
+	assert.Error(t, checkMemLockLimit(1025, &unix.Rlimit{Cur: 1024 * 1024 * 1024, Max: unix.RLIM_INFINITY}))
+	// default 64KB limit of unprivileged process
+	assert.Error(t, checkMemLockLimit(512, &unix.Rlimit{Cur: 64 * 1024, Max: 64 * 1024}))
+}
+
+func Test_parseCpuList(t *testing.T) {
+	cpus, err := parseCpuList("2-4,8\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3, 4, 8}, cpus)
+
+	cpus, err = parseCpuList("\n")
+	assert.NoError(t, err)
+	assert.Equal(t, []int{}, cpus)
+
+	_, err = parseCpuList("2,x")
+	assert.Error(t, err)
+}
+
+func Test_selectRealtimeCpus(t *testing.T) {
+	cpus, err := selectRealtimeCpus([]int{2, 3, 4, 8}, nil, nil, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+
+	// cpus of other realtime guests are skipped
+	cpus, err = selectRealtimeCpus([]int{2, 3, 4, 8}, map[int]bool{2: true, 3: true}, nil, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{4, 8}, cpus)
+
+	// assigned cpus are kept unless no longer isolated or taken
+	cpus, err = selectRealtimeCpus([]int{2, 3, 4, 8}, map[int]bool{2: true}, []int{8, 4}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{8, 4}, cpus)
+	cpus, err = selectRealtimeCpus([]int{2, 3, 4, 8}, map[int]bool{8: true}, []int{8, 4}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+	cpus, err = selectRealtimeCpus([]int{2, 3, 4}, nil, []int{8, 4}, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+
+	// no isolcpus on host
+	_, err = selectRealtimeCpus([]int{}, nil, nil, 1)
+	assert.Error(t, err)
+	_, err = selectRealtimeCpus([]int{2, 3}, nil, nil, 4)
+	assert.Error(t, err)
+	if _, err = selectRealtimeCpus([]int{2, 3, 4}, map[int]bool{2: true, 5: true}, nil, 3); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "2 of 3 isolated cpus of host are free")
+	}
+}
+
+func TestSKVMGuestInstance_getRealtimeCpus(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir, savedIsolated, savedSetaffinity := procDir, hostIsolatedCpusFile, schedSetaffinity
+	defer func() {
+		procDir, hostIsolatedCpusFile, schedSetaffinity = savedProcDir, savedIsolated, savedSetaffinity
+	}()
+	procDir = path.Join(tmpDir, "proc")
+	hostIsolatedCpusFile = path.Join(tmpDir, "isolated")
+	if err := ioutil.WriteFile(hostIsolatedCpusFile, []byte("2-5\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	manager := &SGuestManager{ServersPath: tmpDir, Servers: new(sync.Map)}
+	newGuest := func(id, uuid string) *SKVMGuestInstance {
+		s := NewKVMGuestInstance(id, manager)
+		s.Desc = &desc.SGuestDesc{Metadata: map[string]string{"realtime_mode": "true"}}
+		s.Desc.Uuid = uuid
+		s.Desc.Cpu = 2
+		if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		manager.Servers.Store(id, s)
+		return s
+	}
+	run := func(s *SKVMGuestInstance, pid int, vcpuTids ...int) {
+		if err := ioutil.WriteFile(s.GetPidFilePath(), []byte(fmt.Sprintf("%d\n", pid)), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		pidDir := path.Join(procDir, strconv.Itoa(pid))
+		for vcpu, tid := range vcpuTids {
+			dir := path.Join(pidDir, "task", strconv.Itoa(tid))
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("MkdirAll: %v", err)
+			}
+			if err := ioutil.WriteFile(path.Join(dir, "comm"), []byte(fmt.Sprintf("CPU %d/KVM\n", vcpu)), 0644); err != nil {
+				t.Fatalf("WriteFile: %v", err)
+			}
+		}
+		cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00" + s.Desc.Uuid + "\x00"
+		if err := ioutil.WriteFile(path.Join(pidDir, "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	s1 := newGuest("guest-1", "uuid-1111")
+	s2 := newGuest("guest-2", "uuid-2222")
+	cpus, err := s1.getRealtimeCpus()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+	// stopped guest doesn't hold its cpus
+	cpus, err = s2.getRealtimeCpus()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+
+	run(s1, 1001, 1011, 1012)
+	cpus, err = s2.getRealtimeCpus()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{4, 5}, cpus)
+	run(s2, 1002, 1021, 1022)
+
+	// third guest finds no free isolated cpus
+	s3 := newGuest("guest-3", "uuid-3333")
+	_, err = s3.getRealtimeCpus()
+	assert.Error(t, err)
+
+	// assignment is saved and kept while running
+	s1.Desc = nil
+	assert.NoError(t, s1.LoadDesc())
+	assert.Equal(t, []int{2, 3}, s1.Desc.RealtimeCpus)
+	cpus, err = s1.getRealtimeCpus()
+	assert.NoError(t, err)
+	assert.Equal(t, []int{2, 3}, cpus)
+
+	pinned := map[int][]int{}
+	schedSetaffinity = func(tid int, set *unix.CPUSet) error {
+		for cpu := 0; cpu < 16; cpu++ {
+			if set.IsSet(cpu) {
+				pinned[tid] = append(pinned[tid], cpu)
+			}
+		}
+		return nil
+	}
+	assert.NoError(t, s2.pinRealtimeVcpus([]int{4, 5}))
+	assert.Equal(t, map[int][]int{1021: {4}, 1022: {5}}, pinned)
+	assert.Error(t, s2.pinRealtimeVcpus([]int{4, 5, 2}))
+}
+
+func TestSKVMGuestInstance_validateRealtimeClocksource(t *testing.T) {
+	savedDir, savedStrict := sysClocksourceDir, options.HostOptions.RealtimeRequireStableClocksource
+	defer func() {
+		sysClocksourceDir = savedDir
+		options.HostOptions.RealtimeRequireStableClocksource = savedStrict
+	}()
+	sysClocksourceDir = t.TempDir()
+	setClocksource := func(clocksource string) {
+		if err := ioutil.WriteFile(path.Join(sysClocksourceDir, "current_clocksource"), []byte(clocksource+"\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	s := newTestGuest(map[string]string{"realtime_mode": "true"})
+
+	options.HostOptions.RealtimeRequireStableClocksource = true
+	assert.Error(t, s.validateRealtimeClocksource(false))
+
+	setClocksource("tsc")
+	assert.NoError(t, s.validateRealtimeClocksource(false))
+	if err := s.validateRealtimeClocksource(true); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "host clocksource tsc is not arch_sys_counter")
+	}
+
+	setClocksource("hpet")
+	if err := s.validateRealtimeClocksource(false); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "host clocksource hpet is not tsc")
+	}
+	// only warned
+	options.HostOptions.RealtimeRequireStableClocksource = false
+	assert.NoError(t, s.validateRealtimeClocksource(false))
+
+	setClocksource("arch_sys_counter")
+	assert.NoError(t, s.validateRealtimeClocksource(true))
+}
+
+func TestSKVMGuestInstance_ValidateDesc(t *testing.T) {
+	diskFile, err := ioutil.TempFile("", "disk")
+	assert.NoError(t, err)
+	diskFile.Close()
+	defer os.Remove(diskFile.Name())
+
+	newDesc := func() *desc.SGuestDesc {
+		gd := &desc.SGuestDesc{}
+		gd.Cpu = 2
+		gd.Mem = 1024
+		gd.Nics = []*api.GuestnetworkJsonDesc{
+			{Mac: "00:22:11:33:44:55", Bridge: "br0", Ifname: "vnet0-0"},
+		}
+		gd.Disks = []*api.GuestdiskJsonDesc{
+			{DiskId: "disk0", Path: diskFile.Name()},
+			{DiskId: "disk1", Path: "rbd:pool/disk1"},
+		}
+		return gd
+	}
+	ovnNic := &api.GuestnetworkJsonDesc{Mac: "00:22:11:33:44:56", Ifname: "vnet0-1"}
+	ovnNic.Vpc.Provider = api.VPC_PROVIDER_OVN
+
+	for _, c := range []struct {
+		name   string
+		modify func(gd *desc.SGuestDesc)
+		errs   []string
+	}{
+		{"valid", func(gd *desc.SGuestDesc) {}, nil},
+		{"zero memory", func(gd *desc.SGuestDesc) { gd.Mem = 0 }, []string{"invalid memory size"}},
+		{"negative memory", func(gd *desc.SGuestDesc) { gd.Mem = -1 }, []string{"invalid memory size"}},
+		{"zero cpu", func(gd *desc.SGuestDesc) { gd.Cpu = 0 }, []string{"invalid cpu count"}},
+		{"bad mac", func(gd *desc.SGuestDesc) { gd.Nics[0].Mac = "00:22:11" }, []string{"invalid mac"}},
+		{"empty bridge", func(gd *desc.SGuestDesc) { gd.Nics[0].Bridge = "" }, []string{"empty bridge"}},
+		{"ovn nic without bridge", func(gd *desc.SGuestDesc) { gd.Nics = append(gd.Nics, ovnNic) }, nil},
+		{"empty ifname", func(gd *desc.SGuestDesc) { gd.Nics[0].Ifname = "" }, []string{"empty ifname"}},
+		{"nic queue size", func(gd *desc.SGuestDesc) { gd.Nics[0].RxQueueSize, gd.Nics[0].TxQueueSize = 1024, 512 }, nil},
+		{"bad nic queue size", func(gd *desc.SGuestDesc) { gd.Nics[0].RxQueueSize = 300 }, []string{"invalid rx_queue_size 300"}},
+		{"empty disk path", func(gd *desc.SGuestDesc) { gd.Disks[0].Path = "" }, []string{"empty path"}},
+		{"missing disk path", func(gd *desc.SGuestDesc) { gd.Disks[0].Path = "/nonexistent/disk0" }, []string{"not exists"}},
+		{"q35 uefi", func(gd *desc.SGuestDesc) { gd.Machine, gd.Bios = "q35", "UEFI" }, nil},
+		{"virt uefi", func(gd *desc.SGuestDesc) { gd.Machine, gd.Bios = "virt", "UEFI" }, nil},
+		{"virt legacy bios", func(gd *desc.SGuestDesc) { gd.Machine, gd.Bios = "virt", "BIOS" }, []string{"requires UEFI"}},
+		{"unknown machine", func(gd *desc.SGuestDesc) { gd.Machine = "isapc" }, []string{"unknown machine"}},
+		{"unknown bios", func(gd *desc.SGuestDesc) { gd.Bios = "coreboot" }, []string{"unknown bios"}},
+		{"disable usb", func(gd *desc.SGuestDesc) { gd.Metadata = map[string]string{"disable_usb": "true"} }, nil},
+		{"disable usb with spice", func(gd *desc.SGuestDesc) {
+			gd.Metadata = map[string]string{"disable_usb": "true"}
+			gd.Vdi = "spice"
+		}, []string{"spice usb redirection"}},
+		{"disable usb with usb device", func(gd *desc.SGuestDesc) {
+			gd.Metadata = map[string]string{"disable_usb": "true"}
+			gd.IsolatedDevices = []*api.IsolatedDeviceJsonDesc{{Id: "dev0", DevType: api.USB_TYPE}}
+		}, []string{"usb device dev0 requires usb controller"}},
+		{"all problems at once", func(gd *desc.SGuestDesc) {
+			gd.Mem, gd.Cpu = 0, 0
+			gd.Nics[0].Mac = ""
+		}, []string{"invalid memory size", "invalid cpu count", "invalid mac"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestGuest(map[string]string{})
+			s.Desc = newDesc()
+			c.modify(s.Desc)
+			err := s.ValidateDesc()
+			if len(c.errs) == 0 {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.Error(t, err) {
+				for _, msg := range c.errs {
+					assert.Contains(t, err.Error(), msg)
+				}
+			}
+		})
+	}
+}
+
+func TestSKVMGuestInstance_getGlobalProperties(t *testing.T) {
+	props, err := newTestGuest(map[string]string{}).getGlobalProperties()
+	assert.NoError(t, err)
+	assert.Len(t, props, 0)
+
+	props, err = newTestGuest(map[string]string{
+		"qemu_global_properties": "PIIX4_PM.disable_s3=1, PIIX4_PM.disable_s4=1",
+	}).getGlobalProperties()
+	assert.NoError(t, err)
+	assert.Equal(t, []qemu.GlobalProperty{
+		{Driver: "PIIX4_PM", Property: "disable_s3", Value: "1"},
+		{Driver: "PIIX4_PM", Property: "disable_s4", Value: "1"},
+	}, props)
+
+	_, err = newTestGuest(map[string]string{
+		"qemu_global_properties": "PIIX4_PM.disable_s3=1 -S",
+	}).getGlobalProperties()
+	assert.Error(t, err)
+}
+
+// newAcpiTable returns content of acpi table of signature with valid header
+func newAcpiTable(signature string, size int) []byte {
+	table := make([]byte, size)
+	copy(table, signature)
+	binary.LittleEndian.PutUint32(table[4:8], uint32(size))
+	return table
+}
+
+func TestSKVMGuestInstance_getAcpiTables(t *testing.T) {
+	savedDir := options.HostOptions.AcpiTablesDir
+	defer func() { options.HostOptions.AcpiTablesDir = savedDir }()
+
+	tmpDir := t.TempDir()
+	tablesDir := path.Join(tmpDir, "acpi")
+	assert.NoError(t, os.MkdirAll(tablesDir, 0755))
+	options.HostOptions.AcpiTablesDir = tablesDir
+	writeFile := func(p string, content []byte) string {
+		if err := ioutil.WriteFile(p, content, 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return p
+	}
+	table := writeFile(path.Join(tablesDir, "slic.bin"), newAcpiTable("SLIC", 374))
+
+	files, err := newTestGuest(map[string]string{"acpi_tables": table}).getAcpiTables()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{table}, files)
+
+	// symlink in tables dir is resolved
+	link := path.Join(tablesDir, "link.bin")
+	assert.NoError(t, os.Symlink(table, link))
+	files, err = newTestGuest(map[string]string{"acpi_tables": link}).getAcpiTables()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{table}, files)
+
+	outside := writeFile(path.Join(tmpDir, "slic.bin"), newAcpiTable("SLIC", 374))
+	escape := path.Join(tablesDir, "escape.bin")
+	assert.NoError(t, os.Symlink("/etc/passwd", escape))
+	for _, file := range []string{
+		"/etc/shadow",
+		outside,
+		escape,
+		tablesDir + "/../slic.bin",
+		table + ",/nonexistent/slic.bin",
+		writeFile(path.Join(tablesDir, "short.bin"), []byte("SLIC")),
+		writeFile(path.Join(tablesDir, "badsig.bin"), newAcpiTable("sl c", 36)),
+		writeFile(path.Join(tablesDir, "badlen.bin"), append(newAcpiTable("SLIC", 36), 0)),
+		"slic.bin",
+		table + " $(reboot)",
+		table + ";reboot",
+	} {
+		_, err = newTestGuest(map[string]string{"acpi_tables": file}).getAcpiTables()
+		assert.Error(t, err, file)
+	}
+
+	options.HostOptions.AcpiTablesDir = ""
+	_, err = newTestGuest(map[string]string{"acpi_tables": table}).getAcpiTables()
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_getSmbiosOemStrings(t *testing.T) {
+	oemStrs, err := newTestGuest(map[string]string{}).getSmbiosOemStrings()
+	assert.NoError(t, err)
+	assert.Len(t, oemStrs, 0)
+
+	oemStrs, err = newTestGuest(map[string]string{
+		"smbios_oem_strings": `["io.systemd.credential:hostname=vm1", "ds=nocloud;s=http://10.0.0.1/,a"]`,
+	}).getSmbiosOemStrings()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"io.systemd.credential:hostname=vm1", "ds=nocloud;s=http://10.0.0.1/,a"}, oemStrs)
+
+	_, err = newTestGuest(map[string]string{"smbios_oem_strings": `{"hostname": "vm1"}`}).getSmbiosOemStrings()
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_generateStartScriptHostname(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	render := func(hostname, channel string) (string, error) {
+		s := newTestStartGuest()
+		s.Desc.Hostname = hostname
+		if len(channel) > 0 {
+			s.Desc.Metadata["hostname_channel"] = channel
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		script, err := s.generateStartScript(data, host)
+		if err != nil {
+			return "", err
+		}
+		return s.getQemuCmdlineFromContent(script)
+	}
+
+	cmdline, err := render("vm1.example.com", "")
+	assert.NoError(t, err)
+	assert.NotContains(t, cmdline, "vm1.example.com")
+
+	cmdline, err = render("vm1.example.com", "fw_cfg")
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -fw_cfg name=opt/hostname,string=vm1.example.com ")
+
+	cmdline, err = render("vm1", "smbios")
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -smbios type=1,sku=vm1 ")
+
+	_, err = render("vm1;reboot", "fw_cfg")
+	assert.Error(t, err)
+	_, err = render("", "smbios")
+	assert.Error(t, err)
+}
+
+func Test_generateEnvScript(t *testing.T) {
+	script, err := generateEnvScript(map[string]string{
+		"QEMU_AUDIO_DRV":        "none",
+		"LIBGL_ALWAYS_SOFTWARE": "1",
+		"MSG":                   "it's $HOME `id` \"x\"",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "export LIBGL_ALWAYS_SOFTWARE='1'\n"+
+		"export MSG='it'\\''s $HOME `id` \"x\"'\n"+
+		"export QEMU_AUDIO_DRV='none'\n", script)
+
+	// values reach the shell verbatim
+	out, err := exec.Command("bash", "-c", script+`printf '%s' "$MSG"`).Output()
+	assert.NoError(t, err)
+	assert.Equal(t, "it's $HOME `id` \"x\"", string(out))
+
+	script, err = generateEnvScript(map[string]string{})
+	assert.NoError(t, err)
+	assert.Equal(t, "", script)
+
+	for _, name := range []string{"", "1ABC", "A-B", "A B", "A=B", "A;reboot", "CMD", "QEMU_CMD", "STATE_FILE", "DISK_0"} {
+		_, err := generateEnvScript(map[string]string{name: "x"})
+		assert.Error(t, err, name)
+	}
+}
+
+func Test_getStartQemuVersion(t *testing.T) {
+	assert := assert.New(t)
+
+	data := jsonutils.NewDict()
+	ver, err := getStartQemuVersion(data, "4.2.0", qemu.Arch_x86_64)
+	assert.NoError(err)
+	assert.Equal(qemu.Version_4_2_0, ver)
+
+	data.Set("qemu_version", jsonutils.NewString("latest"))
+	ver, err = getStartQemuVersion(data, "4.2.0", qemu.Arch_x86_64)
+	assert.NoError(err)
+	assert.Equal(qemu.Version(""), ver)
+
+	// destination pinned to an older qemu than source
+	data.Set("qemu_version", jsonutils.NewString("4.2.0"))
+	data.Set("target_qemu_version", jsonutils.NewString("2.12.1"))
+	ver, err = getStartQemuVersion(data, "4.2.0", qemu.Arch_x86_64)
+	assert.NoError(err)
+	assert.Equal(qemu.Version_2_12_1, ver)
+
+	cmd, err := qemu.GenerateStartOptions(&qemu.GenerateStartOptionsInput{
+		QemuVersion: ver,
+		QemuArch:    qemu.Arch_x86_64,
+		Mem:         1024,
+		Cpu:         2,
+		Name:        "test-vm",
+		OsName:      qemu.OS_NAME_LINUX,
+		HomeDir:     "/opt/cloud/workspace/servers/sid",
+		PidFilePath: "/opt/cloud/workspace/servers/sid/pid",
+	})
+	assert.NoError(err)
+	assert.Contains(cmd, " -nodefconfig ")
+	assert.Contains(cmd, " -no-kvm-pit-reinjection ")
+
+	data.Set("target_qemu_version", jsonutils.NewString("1.0.0"))
+	_, err = getStartQemuVersion(data, "4.2.0", qemu.Arch_x86_64)
+	assert.Error(err)
+}
+
+type fakeHostCapabilities struct {
+	arch           string
+	kvm            bool
+	nested         bool
+	intel          bool
+	hugepages      bool
+	hugepageSizeKb int
+	disks          map[string]storageman.IDisk
+}
+
+func (h *fakeHostCapabilities) GetCpuArchitecture() string   { return h.arch }
+func (h *fakeHostCapabilities) IsAarch64() bool              { return h.arch == apis.OS_ARCH_AARCH64 }
+func (h *fakeHostCapabilities) IsHugepagesEnabled() bool     { return h.hugepages }
+func (h *fakeHostCapabilities) IsKvmSupport() bool           { return h.kvm }
+func (h *fakeHostCapabilities) IsNestedVirtualization() bool { return h.nested }
+func (h *fakeHostCapabilities) IsProcessorIntel() bool       { return h.intel }
+func (h *fakeHostCapabilities) IsProcessorAmd() bool         { return !h.intel }
+
+func (h *fakeHostCapabilities) HugepageSizeKb() int {
+	if h.hugepageSizeKb > 0 {
+		return h.hugepageSizeKb
+	}
+	return 2048
+}
+
+func (h *fakeHostCapabilities) GetDiskByPath(diskPath string) (storageman.IDisk, error) {
+	if disk, ok := h.disks[diskPath]; ok {
+		return disk, nil
+	}
+	return nil, errors.Wrap(errors.ErrNotFound, diskPath)
+}
+
+func newTestStartGuest() *SKVMGuestInstance {
+	s := newTestGuest(map[string]string{})
+	s.Desc.Name = "test-vm"
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	s.Desc.Mem = 1024
+	s.Desc.Cpu = 2
+	return s
+}
+
+func TestSKVMGuestInstance_generateStartScriptHostCapabilities(t *testing.T) {
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() { options.HostOptions.OvmfPath = ovmfPath }()
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	cases := []struct {
+		name     string
+		host     *fakeHostCapabilities
+		contains []string
+	}{
+		{
+			name:     "x86 kvm",
+			host:     &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true},
+			contains: []string{"QEMU_CMD_KVM_ARG=-enable-kvm\n", " -machine pc,accel=kvm,dump-guest-core=off "},
+		},
+		{
+			name:     "x86 tcg",
+			host:     &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64},
+			contains: []string{"QEMU_CMD_KVM_ARG=-no-kvm\n", " -machine pc,accel=tcg,dump-guest-core=off "},
+		},
+		{
+			name:     "aarch64 kvm",
+			host:     &fakeHostCapabilities{arch: apis.OS_ARCH_AARCH64, kvm: true},
+			contains: []string{"QEMU_CMD_KVM_ARG=-enable-kvm\n", " -machine virt,accel=kvm,gic-version=3,dump-guest-core=off "},
+		},
+		{
+			name:     "aarch64 tcg",
+			host:     &fakeHostCapabilities{arch: apis.OS_ARCH_AARCH64},
+			contains: []string{"QEMU_CMD_KVM_ARG=\n", " -machine virt,accel=tcg,gic-version=3,dump-guest-core=off "},
+		},
+		{
+			name:     "x86 hugepages",
+			host:     &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, hugepages: true},
+			contains: []string{"mount -t hugetlbfs -o pagesize=2048K,size=1024M", ",mem-path=/dev/hugepages/uuid-xxxx-xxxx,"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			script, err := s.generateStartScript(data, c.host)
+			assert.NoError(t, err)
+			for _, sub := range c.contains {
+				assert.Contains(t, script, sub)
+			}
+		})
+	}
+}
+
+// scriptBridge writes nic scripts recording what they were rendered from
+type scriptBridge struct {
+	fakeBridge
+}
+
+func (b *scriptBridge) writeScript(scriptPath, kind string, nic *api.GuestnetworkJsonDesc) error {
+	content := fmt.Sprintf("%s %s %s vlan=%d\n", kind, b.name, nic.Ifname, nic.Vlan)
+	return ioutil.WriteFile(scriptPath, []byte(content), 0755)
+}
+
+func (b *scriptBridge) GenerateIfupScripts(scriptPath string, nic *api.GuestnetworkJsonDesc, isSlave bool) error {
+	return b.writeScript(scriptPath, "up", nic)
+}
+
+func (b *scriptBridge) GenerateIfdownScripts(scriptPath string, nic *api.GuestnetworkJsonDesc, isSlave bool) error {
+	return b.writeScript(scriptPath, "down", nic)
+}
+
+type scriptBridgeHost struct {
+	fakeHost
+}
+
+func (h *scriptBridgeHost) GetBridgeDev(bridge string) hostbridge.IBridgeDriver {
+	return &scriptBridge{fakeBridge{name: bridge}}
+}
+
+func readNicScripts(t *testing.T, s *SKVMGuestInstance) map[string]string {
+	scripts := map[string]string{}
+	for _, nic := range s.Desc.Nics {
+		for _, scriptPath := range []string{s.getNicUpScriptPath(nic), s.getNicDownScriptPath(nic)} {
+			content, err := ioutil.ReadFile(scriptPath)
+			if err != nil {
+				t.Fatalf("read %s: %v", scriptPath, err)
+			}
+			scripts[scriptPath] = string(content)
+		}
+	}
+	return scripts
+}
+
+func TestSKVMGuestInstance_RegenerateNicScripts(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &scriptBridgeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	serversPath, err := ioutil.TempDir("", "servers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(serversPath)
+
+	s := newTestGuestWithServersPath(serversPath, map[string]string{})
+	s.Desc.Name = "test-vm"
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	s.Desc.Mem = 1024
+	s.Desc.Cpu = 2
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio"), newGoldenNic(1, "virtio")}
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	if _, err := s.generateStartScript(data, host); err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	startScripts := readNicScripts(t, s)
+	assert.Len(t, startScripts, 4)
+
+	t.Run("all nics unchanged", func(t *testing.T) {
+		assert.NoError(t, s.RegenerateNicScripts(""))
+		assert.Equal(t, startScripts, readNicScripts(t, s))
+	})
+
+	t.Run("specified nic", func(t *testing.T) {
+		s.Desc.Nics[1].Vlan = 100
+		defer func() { s.Desc.Nics[1].Vlan = 0 }()
+		assert.NoError(t, s.RegenerateNicScripts("vnet1"))
+		scripts := readNicScripts(t, s)
+		nic0, nic1 := s.Desc.Nics[0], s.Desc.Nics[1]
+		assert.Equal(t, startScripts[s.getNicUpScriptPath(nic0)], scripts[s.getNicUpScriptPath(nic0)])
+		assert.Equal(t, "up br0 vnet1 vlan=100\n", scripts[s.getNicUpScriptPath(nic1)])
+		assert.Equal(t, "down br0 vnet1 vlan=100\n", scripts[s.getNicDownScriptPath(nic1)])
+	})
+
+	t.Run("unknown nic", func(t *testing.T) {
+		err := s.RegenerateNicScripts("vnet9")
+		assert.Equal(t, errors.ErrNotFound, errors.Cause(err))
+	})
+
+	t.Run("bridge change of running guest", func(t *testing.T) {
+		savedProcDir := procDir
+		defer func() { procDir = savedProcDir }()
+		procDir = path.Join(serversPath, "proc")
+		if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		defer os.Remove(s.GetPidFilePath())
+		if err := os.MkdirAll(path.Join(procDir, "1234"), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		args := []string{"/usr/bin/qemu-system-x86_64", "-uuid", "uuid-xxxx-xxxx"}
+		for _, nic := range s.Desc.Nics {
+			args = append(args, "-netdev", fmt.Sprintf("type=tap,id=%s,ifname=%s,script=%s,downscript=%s",
+				nic.Ifname, nic.Ifname, s.getNicUpScriptPath(nic), s.getNicDownScriptPath(nic)))
+		}
+		cmdline := strings.Join(args, "\x00") + "\x00"
+		if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+
+		assert.NoError(t, s.RegenerateNicScripts(""))
+
+		oldUp := s.getNicUpScriptPath(s.Desc.Nics[1])
+		s.Desc.Nics[1].Bridge = "br1"
+		defer func() { s.Desc.Nics[1].Bridge = "br0" }()
+		err := s.RegenerateNicScripts("")
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "bridge of running nic vnet1 changed, qemu still calls "+oldUp)
+		}
+		// nothing is written for the new bridge, running qemu never calls it
+		assert.NoFileExists(t, s.getNicUpScriptPath(s.Desc.Nics[1]))
+		assert.Error(t, s.RegenerateNicScripts("vnet1"))
+		assert.NoError(t, s.RegenerateNicScripts("vnet0"))
+	})
+}
+
+func TestSKVMGuestInstance_generateStartScriptMacOSMigrate(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() { options.HostOptions.OvmfPath = ovmfPath }()
+
+	s := newTestStartGuest()
+	s.Desc.Metadata["os_name"] = OS_NAME_MACOS
+	s.Desc.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "virtio"), newGoldenDisk(1, "scsi")}
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio")}
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true, disks: map[string]storageman.IDisk{}}
+	for _, disk := range s.Desc.Disks {
+		host.disks[disk.Path] = &fakeDisk{path: disk.Path}
+	}
+
+	render := func(data *jsonutils.JSONDict) string {
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		script, err := s.generateStartScript(data, host)
+		if err != nil {
+			t.Fatalf("generateStartScript: %v", err)
+		}
+		cmdline, err := s.getQemuCmdlineFromContent(script)
+		if err != nil {
+			t.Fatalf("getQemuCmdlineFromContent: %v", err)
+		}
+		return cmdline
+	}
+	srcCmdline := render(jsonutils.NewDict())
+	destData := jsonutils.NewDict()
+	destData.Set("need_migrate", jsonutils.JSONTrue)
+	destCmdline := render(destData)
+
+	for _, cmdline := range []string{srcCmdline, destCmdline} {
+		assert.Equal(t, map[string]string{"drive_0": "ide-drive", "drive_1": "ide-drive"}, getCmdlineDiskDevices(cmdline))
+		assert.Contains(t, cmdline, "-device e1000-82545em,")
+	}
+	assert.NoError(t, verifyMigrateDiskDevices(destCmdline, srcCmdline))
+	assert.Equal(t, "virtio", s.Desc.Disks[0].Driver)
+	assert.Equal(t, "scsi", s.Desc.Disks[1].Driver)
+	assert.Equal(t, "virtio", s.Desc.Nics[0].Driver)
+}
+
+func Test_verifyMigrateDiskDevices(t *testing.T) {
+	src := "-drive file=$DISK_0,if=none,id=drive_0 -device ide-drive,drive=drive_0,bus=ide.0,id=drive_0"
+	assert.NoError(t, verifyMigrateDiskDevices(src, src))
+	cur := "-drive file=$DISK_0,if=none,id=drive_0 -device virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x7,id=drive_0"
+	assert.Error(t, verifyMigrateDiskDevices(cur, src))
+}
+
+func TestSKVMGuestInstance_generateStartScriptAndroidNics(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	s := newTestStartGuest()
+	s.Desc.Metadata["os_name"] = OS_NAME_ANDROID
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio"), newGoldenNic(1, "virtio"), newGoldenNic(2, "virtio")}
+
+	kept, dropped := normalizeAndroidNics(s.Desc.Nics)
+	assert.Len(t, kept, 1)
+	assert.Equal(t, "vnet0", kept[0].Ifname)
+	assert.Len(t, dropped, 2)
+	assert.Equal(t, "vnet1", dropped[0].Ifname)
+	assert.Equal(t, "vnet2", dropped[1].Ifname)
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	script, err := s.generateStartScript(data, host)
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	cmdline, err := s.getQemuCmdlineFromContent(script)
+	if err != nil {
+		t.Fatalf("getQemuCmdlineFromContent: %v", err)
+	}
+	assert.Equal(t, 1, strings.Count(cmdline, "-netdev "))
+	assert.Contains(t, cmdline, "ifname=vnet0,")
+	assert.Len(t, s.Desc.Nics, 3)
+	assert.Empty(t, s.Desc.Nics[0].UpscriptPath)
+	assert.NotContains(t, s.generateStopScript(data), "vnet1")
+}
+
+func TestSKVMGuestInstance_generateStartScriptVMwareNics(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	s := newTestStartGuest()
+	s.Desc.Metadata["os_name"] = OS_NAME_VMWARE
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{
+		newGoldenNic(0, NIC_DRIVER_VIRTIO),
+		newGoldenNic(1, NIC_DRIVER_E1000),
+		newGoldenNic(2, NIC_DRIVER_E1000E),
+		newGoldenNic(3, NIC_DRIVER_VMXNET3),
+	}
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	script, err := s.generateStartScript(data, host)
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	for _, sub := range []string{
+		"-device vmxnet3,id=netdev-vnet0,",
+		"-device e1000-82545em,id=netdev-vnet1,",
+		"-device e1000e,id=netdev-vnet2,",
+		"-device vmxnet3,id=netdev-vnet3,",
+	} {
+		assert.Contains(t, script, sub)
+	}
+	assert.Equal(t, NIC_DRIVER_VIRTIO, s.Desc.Nics[0].Driver)
+}
+
+func TestSKVMGuestInstance_generateStartScriptDebugLog(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedLogLevel := options.HostOptions.LogLevel
+	savedGuestErrors := options.HostOptions.QemuLogGuestErrors
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.LogLevel = savedLogLevel
+		options.HostOptions.QemuLogGuestErrors = savedGuestErrors
+	}()
+
+	cases := []struct {
+		name        string
+		logLevel    string
+		guestErrors bool
+		want        []string
+		notWant     []string
+	}{
+		{
+			name:     "info",
+			logLevel: "info",
+			notWant:  []string{"-msg timestamp=on", " -D ", " -d "},
+		},
+		{
+			name:     "debug",
+			logLevel: "debug",
+			want:     []string{"-msg timestamp=on", "-d all"},
+			notWant:  []string{"-d guest_errors"},
+		},
+		{
+			name:        "debug guest errors",
+			logLevel:    "debug",
+			guestErrors: true,
+			want:        []string{"-msg timestamp=on", "-d guest_errors"},
+			notWant:     []string{"-d all"},
+		},
+		{
+			name:        "guest errors without debug",
+			logLevel:    "info",
+			guestErrors: true,
+			notWant:     []string{"-msg timestamp=on", " -D ", " -d "},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.LogLevel = c.logLevel
+			options.HostOptions.QemuLogGuestErrors = c.guestErrors
+
+			s := newTestStartGuest()
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			cmdline, err := s.getQemuCmdlineFromContent(script)
+			if err != nil {
+				t.Fatalf("getQemuCmdlineFromContent: %v", err)
+			}
+			for _, sub := range c.want {
+				assert.Contains(t, cmdline, sub)
+			}
+			for _, sub := range c.notWant {
+				assert.NotContains(t, cmdline, sub)
+			}
+			if len(c.want) > 0 {
+				assert.Contains(t, cmdline, "-D "+s.getQemuLogPath())
+			}
+		})
+	}
+}
+
+func Test_parseProcCmdline(t *testing.T) {
+	cl, err := parseProcCmdline([]byte("/usr/bin/qemu-system-x86_64\x00-name\x00test-guest\x00-S\x00-m\x00size=1024M\x00"))
+	if err != nil {
+		t.Fatalf("parseProcCmdline: %v", err)
+	}
+	assert.Equal(t, "/usr/bin/qemu-system-x86_64 -name test-guest -S -m size=1024M", cl.ToString())
+
+	// value with spaces stays in one option
+	cl, err = parseProcCmdline([]byte("/usr/bin/qemu-system-x86_64\x00-name\x00my guest -S,debug-threads=on\x00-m\x001024M\x00"))
+	if err != nil {
+		t.Fatalf("parseProcCmdline: %v", err)
+	}
+	opts := cl.GetOptions()
+	if assert.Len(t, opts, 3) {
+		assert.Equal(t, qemutils.Option{Key: "name", Value: "my guest -S,debug-threads=on"}, opts[1])
+	}
+
+	_, err = parseProcCmdline([]byte("\x00"))
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_GetRunningCmdline(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "running-cmdline")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	savedProcDir := procDir
+	procDir = fmt.Sprintf("%s/proc", tmpDir)
+	defer func() { procDir = savedProcDir }()
+
+	s := newTestGuestWithServersPath(tmpDir, map[string]string{"__origin_id": "origin-uuid"})
+	_, err = s.GetRunningCmdline()
+	assert.True(t, errors.Cause(err) == errors.ErrNotFound)
+
+	if err := os.MkdirAll(fmt.Sprintf("%s/1234", procDir), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00origin-uuid\x00-smp\x00cpus=2\x00-device\x00virtio-blk-pci,drive=drive_0\x00"
+	if err := ioutil.WriteFile(fmt.Sprintf("%s/1234/cmdline", procDir), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	cl, err := s.GetRunningCmdline()
+	if err != nil {
+		t.Fatalf("GetRunningCmdline: %v", err)
+	}
+	assert.Equal(t, "/usr/bin/qemu-system-x86_64 -uuid origin-uuid -smp cpus=2 -device virtio-blk-pci,drive=drive_0", cl.ToString())
+}
+
+func TestSKVMGuestInstance_diffCmdline(t *testing.T) {
+	generated := `$QEMU_CMD -enable-kvm -cpu host -chardev socket,id=hmqmondev,port=55901,host=127.0.0.1,nodelay,server,nowait -m 1024M,slots=4,maxmem=262144M -device virtio-serial -device usb-tablet -vnc :1 -drive file=/opt/cloud/workspace/disks/0,if=none,id=drive_0 -device virtio-blk-pci,drive=drive_0,id=drive_0 -device virtio-net-pci,id=netdev-vnet0,netdev=vnet0,mac=00:22:0a:00:00:00$(nic_speed 1000)$(nic_mtu "br0")`
+	cases := []struct {
+		name    string
+		running string
+		want    []string
+	}{
+		{
+			name:    "no drift",
+			running: `/usr/bin/qemu-system-x86_64 -enable-kvm -cpu host -chardev socket,id=hmqmondev,port=55911,host=127.0.0.1,nodelay,server,nowait -m 1024M,slots=4,maxmem=262144M -device virtio-serial -device usb-tablet -vnc :11 -drive file=/opt/cloud/workspace/disks/0,if=none,id=drive_0 -device virtio-blk-pci,drive=drive_0,id=drive_0 -device virtio-net-pci,id=netdev-vnet0,netdev=vnet0,mac=00:22:0a:00:00:00,speed=1000,host_mtu=1500`,
+			want:    []string{},
+		},
+		{
+			name:    "extra device and changed mem",
+			running: `/usr/bin/qemu-system-x86_64 -enable-kvm -cpu host -m 2048M,slots=4,maxmem=262144M -device virtio-serial -device usb-tablet -device usb-kbd -drive file=/opt/cloud/workspace/disks/0,if=none,id=drive_0 -device virtio-blk-pci,drive=drive_0,id=drive_0 -device virtio-net-pci,id=netdev-vnet0,netdev=vnet0,mac=00:22:0a:00:00:00 -device virtio-net-pci,id=netdev-vnet1,netdev=vnet1,mac=00:22:0a:00:00:01`,
+			want: []string{
+				"changed -m 1024M,slots=4,maxmem=262144M -> 2048M,slots=4,maxmem=262144M",
+				"added -device usb-kbd",
+				"added -device virtio-net-pci,id=netdev-vnet1,netdev=vnet1,mac=00:22:0a:00:00:01",
+			},
+		},
+		{
+			name:    "removed and changed device",
+			running: `/usr/bin/qemu-system-x86_64 -cpu host -m 1024M,slots=4,maxmem=262144M -device virtio-serial -drive file=/opt/cloud/workspace/disks/1,if=none,id=drive_0 -device scsi-hd,drive=drive_0,id=drive_0 -device virtio-net-pci,id=netdev-vnet0,netdev=vnet0,mac=00:22:0a:00:00:00`,
+			want: []string{
+				"removed -enable-kvm",
+				"removed -device usb-tablet",
+				"changed -drive file=/opt/cloud/workspace/disks/0,if=none,id=drive_0 -> file=/opt/cloud/workspace/disks/1,if=none,id=drive_0",
+				"changed -device virtio-blk-pci,drive=drive_0,id=drive_0 -> scsi-hd,drive=drive_0,id=drive_0",
+			},
+		},
+	}
+	s := newTestGuest(map[string]string{})
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := s.diffCmdline(generated, c.running)
+			if err != nil {
+				t.Fatalf("diffCmdline: %v", err)
+			}
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_buildStartScriptDryRun(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &scriptBridgeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	savedPortUsed := tcpPortUsed
+	tcpPortUsed = func(string, int) bool { return false }
+	defer func() { tcpPortUsed = savedPortUsed }()
+
+	savedOptions := options.HostOptions
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() { options.HostOptions = savedOptions }()
+
+	s := newTestGuestWithServersPath(t.TempDir(), map[string]string{
+		"os_name":            OS_NAME_MACOS,
+		"stable_pci_address": "true",
+	})
+	s.Desc.Uuid = "00000000-0000-0000-0000-000000000001"
+	s.Desc.Mem = 1024
+	s.Desc.Cpu = 2
+	s.Desc.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "virtio")}
+	nic := newGoldenNic(0, "virtio")
+	nic.NumQueues = 2
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{nic}
+	saved := jsonutils.Marshal(s.Desc).String()
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	caps := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	caps.disks = map[string]storageman.IDisk{s.Desc.Disks[0].Path: &fakeDisk{path: s.Desc.Disks[0].Path}}
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	data.Set("vnc_port", jsonutils.NewInt(11))
+	script, err := s.buildStartScript(data, caps, true)
+	if err != nil {
+		t.Fatalf("buildStartScript: %v", err)
+	}
+	assert.Contains(t, script, "-vnc :11")
+	assert.Contains(t, script, "script="+s.getNicUpScriptPath(nic))
+	assert.Contains(t, script, "-machine q35")
+	assert.NoFileExists(t, s.getNicUpScriptPath(nic))
+	assert.Equal(t, saved, jsonutils.Marshal(s.Desc).String(), "desc changed")
+	assert.NoFileExists(t, s.GetDescFilePath())
+
+	if _, err := s.generateStartScript(data, caps); err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	assert.FileExists(t, s.getNicUpScriptPath(nic))
+	assert.Equal(t, api.VM_MACHINE_TYPE_Q35, s.Desc.Machine)
+}
+
+func Test_expandStartScriptVars(t *testing.T) {
+	script := "DISK_1=/opt/cloud/workspace/disks/1\nDISK_10=/opt/cloud/workspace/disks/10\nQEMU_CMD=$DEFAULT_QEMU_CMD\nQEMU_CMD_KVM_ARG=-enable-kvm\n"
+	got := expandStartScriptVars(script, "$QEMU_CMD $QEMU_CMD_KVM_ARG -drive file=$DISK_1 -drive file=$DISK_10")
+	assert.Equal(t, "$QEMU_CMD -enable-kvm -drive file=/opt/cloud/workspace/disks/1 -drive file=/opt/cloud/workspace/disks/10", got)
+}
+
+func TestSKVMGuestInstance_generateStartScriptRunAs(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedRunas := options.HostOptions.QemuRunasUser
+	savedLookup, savedChown := lookupUser, chownPath
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.QemuRunasUser = savedRunas
+		lookupUser, chownPath = savedLookup, savedChown
+	}()
+
+	tmpDir, err := ioutil.TempDir("", "runas")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	lookupUser = func(name string) (*user.User, error) {
+		if name != "qemu" {
+			return nil, user.UnknownUserError(name)
+		}
+		return &user.User{Username: name, Uid: "107", Gid: "108"}, nil
+	}
+	chowned := map[string]string{}
+	chownPath = func(p string, uid, gid int) error {
+		chowned[p] = fmt.Sprintf("%d:%d", uid, gid)
+		return nil
+	}
+
+	render := func() (string, *SKVMGuestInstance, error) {
+		s := newTestStartGuest()
+		s.manager.ServersPath = tmpDir
+		s.Desc.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio")}
+		if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		script, err := s.generateStartScript(data, host)
+		return script, s, err
+	}
+
+	options.HostOptions.QemuRunasUser = ""
+	script, s, err := render()
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	assert.NotContains(t, script, "-runas")
+	assert.Contains(t, script, ",downscript="+s.getNicDownScriptPath(s.Desc.Nics[0]))
+	assert.NoError(t, s.prepareRunAsUser())
+	assert.Len(t, chowned, 0)
+
+	options.HostOptions.QemuRunasUser = "qemu"
+	script, s, err = render()
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	assert.Contains(t, script, " -runas qemu ")
+	// qemu without privileges leaves down scripts to host agent
+	assert.Contains(t, script, ",downscript=no")
+	// files are handed over on launch, not when rendering
+	assert.Len(t, chowned, 0)
+	assert.NoError(t, s.prepareRunAsUser())
+	// key file does not exist without encrypt key
+	assert.Equal(t, map[string]string{s.HomeDir(): "107:108"}, chowned)
+
+	options.HostOptions.QemuRunasUser = "nobody-here"
+	_, s, err = render()
+	assert.Error(t, err)
+	assert.Error(t, s.prepareRunAsUser())
+}
+
+func TestSKVMGuestInstance_generateStartScriptMissingBridge(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{bridges: []string{"br0"}}}
+	defer func() { guestManager = savedManager }()
+
+	s := newTestStartGuest()
+	missing := newGoldenNic(1, NIC_DRIVER_VIRTIO)
+	missing.Bridge = "br1"
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, NIC_DRIVER_VIRTIO), missing}
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	_, err := s.generateStartScript(data, host)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Can't find bridge br1 of nic 1 (vnet1)")
+		assert.NotContains(t, err.Error(), "br0")
+	}
+
+	// every missing bridge is reported
+	s.Desc.Nics[0].Bridge = "br2"
+	_, err = s.generateStartScript(data, host)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Can't find bridge br2 of nic 0 (vnet0)")
+		assert.Contains(t, err.Error(), "Can't find bridge br1 of nic 1 (vnet1)")
+	}
+
+	// nic dropped by android normalization is not rendered, nor validated
+	s.Desc.Nics[0].Bridge = "br0"
+	s.Desc.Metadata["os_name"] = OS_NAME_ANDROID
+	script, err := s.generateStartScript(data, host)
+	if assert.NoError(t, err) {
+		assert.Contains(t, script, "netdev=vnet0")
+		assert.NotContains(t, script, "vnet1")
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptDefaultNicDriver(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedDriver := options.HostOptions.DefaultNicDriver
+	ovmfPath := options.HostOptions.OvmfPath
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.DefaultNicDriver = savedDriver
+		options.HostOptions.OvmfPath = ovmfPath
+	}()
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+
+	cases := []struct {
+		name          string
+		osName        string
+		defaultDriver string
+		want          []string
+	}{
+		{
+			name:          "no default",
+			osName:        OS_NAME_LINUX,
+			defaultDriver: "",
+			want:          []string{"-device virtio-net-pci,id=netdev-vnet0,", "-device e1000e,id=netdev-vnet1,"},
+		},
+		{
+			name:          "default e1000",
+			osName:        OS_NAME_LINUX,
+			defaultDriver: NIC_DRIVER_E1000,
+			want:          []string{"-device e1000-82545em,id=netdev-vnet0,", "-device e1000e,id=netdev-vnet1,"},
+		},
+		{
+			name:          "vmware forces vmxnet3",
+			osName:        OS_NAME_VMWARE,
+			defaultDriver: NIC_DRIVER_E1000,
+			want:          []string{"-device vmxnet3,id=netdev-vnet0,", "-device e1000e,id=netdev-vnet1,"},
+		},
+		{
+			name:          "macOS forces e1000",
+			osName:        OS_NAME_MACOS,
+			defaultDriver: NIC_DRIVER_VIRTIO,
+			want:          []string{"-device e1000-82545em,id=netdev-vnet0,", "-device e1000-82545em,id=netdev-vnet1,"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.DefaultNicDriver = c.defaultDriver
+			s := newTestStartGuest()
+			s.Desc.Metadata["os_name"] = c.osName
+			s.Desc.Nics = []*api.GuestnetworkJsonDesc{
+				newGoldenNic(0, ""),
+				newGoldenNic(1, NIC_DRIVER_E1000E),
+			}
+
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			for _, sub := range c.want {
+				assert.Contains(t, script, sub)
+			}
+			assert.Equal(t, "", s.Desc.Nics[0].Driver)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptDisplayPorts(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedPortUsed := tcpPortUsed
+	defer func() {
+		guestManager = savedManager
+		tcpPortUsed = savedPortUsed
+	}()
+	used := map[int]bool{}
+	tcpPortUsed = func(addr string, port int) bool { return used[port] }
+
+	render := func(vncPort int) error {
+		s := newTestStartGuest()
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		data.Set("vnc_port", jsonutils.NewInt(int64(vncPort)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		_, err := s.generateStartScript(data, host)
+		return err
+	}
+
+	assert.NoError(t, render(1))
+
+	used[MONITOR_PORT_BASE+1] = true
+	err := render(1)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), fmt.Sprintf("hmp monitor port %d is in use", MONITOR_PORT_BASE+1))
+	}
+
+	// vnc port held by another process
+	used = map[int]bool{VNC_PORT_BASE + 2: true}
+	err = render(2)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), fmt.Sprintf("vnc port %d is in use", VNC_PORT_BASE+2))
+	}
+}
+
+func Test_validateDisplayPorts(t *testing.T) {
+	err := validateDisplayPorts([]sNamedPort{
+		{"spice", 5901}, {"hmp monitor", 55901}, {"qmp monitor", 5901},
+	}, false)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "qmp monitor port 5901 collides with spice port")
+	}
+	assert.NoError(t, validateDisplayPorts([]sNamedPort{{"vnc", 5901}, {"hmp monitor", 55901}}, false))
+}
+
+func TestSKVMGuestInstance_generateStartScriptSpiceTuning(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedStreaming := options.HostOptions.SpiceStreamingVideo
+	savedImage := options.HostOptions.SpiceImageCompression
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.SpiceStreamingVideo = savedStreaming
+		options.HostOptions.SpiceImageCompression = savedImage
+	}()
+	options.HostOptions.SpiceStreamingVideo = "all"
+	options.HostOptions.SpiceImageCompression = "auto_glz"
+
+	render := func(metadata map[string]string) (string, error) {
+		s := newTestStartGuest()
+		s.Desc.Vdi = "spice"
+		for k, v := range metadata {
+			s.Desc.Metadata[k] = v
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		data.Set("vnc_port", jsonutils.NewInt(1))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		savedPortUsed := tcpPortUsed
+		tcpPortUsed = func(string, int) bool { return false }
+		defer func() { tcpPortUsed = savedPortUsed }()
+		return s.generateStartScript(data, host)
+	}
+
+	script, err := render(map[string]string{
+		"spice_streaming_video":          "filter",
+		"spice_jpeg_wan_compression":     "always",
+		"spice_zlib_glz_wan_compression": "never",
+		"spice_playback_compression":     "off",
+	})
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	assert.Contains(t, script, " -spice port=5901,disable-ticketing=off,seamless-migration=on,streaming-video=filter,image-compression=auto_glz,jpeg-wan-compression=always,zlib-glz-wan-compression=never,playback-compression=off ")
+
+	_, err = render(map[string]string{"spice_streaming_video": "sometimes", "spice_playback_compression": "auto"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `invalid spice streaming-video "sometimes"`)
+		assert.Contains(t, err.Error(), `invalid spice playback-compression "auto"`)
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptAudio(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	render := func(backend, vdi string) (string, error) {
+		s := newTestStartGuest()
+		s.Desc.Vdi = vdi
+		s.Desc.Metadata["audio_backend"] = backend
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		data.Set("vnc_port", jsonutils.NewInt(1))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		return s.generateStartScript(data, host)
+	}
+
+	script, err := render(qemu.AUDIO_BACKEND_PA, "")
+	assert.NoError(t, err)
+	assert.Contains(t, script, " -audiodev pa,id=audio0 ")
+
+	// sound of spice vdi goes through spice already
+	_, err = render(qemu.AUDIO_BACKEND_PA, "spice")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "conflicts with spice vdi")
+	}
+	for _, vdi := range []string{"", "spice"} {
+		_, err = render("spice", vdi)
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), `unsupported audio backend "spice"`)
+		}
+	}
+}
+
+func Test_retryStart(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedPortUsed := tcpPortUsed
+	savedBackoff := startRetryBackoff
+	defer func() {
+		guestManager = savedManager
+		tcpPortUsed = savedPortUsed
+		startRetryBackoff = savedBackoff
+	}()
+	startRetryBackoff = func(int) time.Duration { return 0 }
+
+	render := func(s *SKVMGuestInstance) error {
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		data.Set("vnc_port", jsonutils.NewInt(1))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		_, err := s.generateStartScript(data, host)
+		return err
+	}
+
+	// vnc port taken on the first try only, the regenerated script succeeds
+	tries := 0
+	tcpPortUsed = func(addr string, port int) bool { return tries == 1 && port == VNC_PORT_BASE+1 }
+	s := newTestStartGuest()
+	err := retryStart(s.logPrefix(), func() error {
+		tries += 1
+		return render(s)
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, tries)
+
+	// vnc port never freed, gives up after MAX_TRY
+	tries = 0
+	tcpPortUsed = func(addr string, port int) bool { return port == VNC_PORT_BASE+1 }
+	err = retryStart(s.logPrefix(), func() error {
+		tries += 1
+		return render(s)
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is in use")
+	}
+	assert.Equal(t, MAX_TRY, tries)
+
+	// bad metadata fails fast
+	tries = 0
+	tcpPortUsed = func(addr string, port int) bool { return false }
+	s = newTestStartGuest()
+	s.Desc.Metadata["boot_splash_time"] = "5s"
+	err = retryStart(s.logPrefix(), func() error {
+		tries += 1
+		return render(s)
+	})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "invalid boot_splash_time")
+	}
+	assert.Equal(t, 1, tries)
+}
+
+func Test_isRetryableStartError(t *testing.T) {
+	for _, c := range []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{errors.Errorf("vnc port 5901 is in use"), true},
+		{errors.Errorf("Start VM Failed qemu: -vnc :1: Failed to start VNC server: Address already in use"), true},
+		{errors.Errorf("Start VM Failed could not open /dev/vfio/12: Device or resource busy"), true},
+		{errors.Errorf(`Start VM Failed Failed to get "write" lock`), true},
+		{errors.Errorf("unknown machine \"isapc\""), false},
+		{errors.Errorf("spice port 5901 collides with qmp monitor port"), false},
+	} {
+		assert.Equal(t, c.want, isRetryableStartError(c.err), "%v", c.err)
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptDumpGuestCore(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedDumpGuestCore := options.HostOptions.QemuDumpGuestCore
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.QemuDumpGuestCore = savedDumpGuestCore
+		options.HostOptions.OvmfPath = ovmfPath
+	}()
+
+	cases := []struct {
+		name          string
+		arch          string
+		dumpGuestCore bool
+		want          string
+	}{
+		{"x86 default", apis.OS_ARCH_X86_64, false, " -machine pc,accel=kvm,dump-guest-core=off "},
+		{"x86 dump guest core", apis.OS_ARCH_X86_64, true, " -machine pc,accel=kvm "},
+		{"aarch64 default", apis.OS_ARCH_AARCH64, false, " -machine virt,accel=kvm,gic-version=3,dump-guest-core=off "},
+		{"aarch64 dump guest core", apis.OS_ARCH_AARCH64, true, " -machine virt,accel=kvm,gic-version=3 "},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.QemuDumpGuestCore = c.dumpGuestCore
+
+			s := newTestStartGuest()
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: c.arch, kvm: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			assert.Contains(t, script, c.want)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptMemMerge(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedDumpGuestCore := options.HostOptions.QemuDumpGuestCore
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.QemuDumpGuestCore = savedDumpGuestCore
+	}()
+
+	cases := []struct {
+		name          string
+		metadata      map[string]string
+		dumpGuestCore bool
+		want          string
+	}{
+		{"default", map[string]string{}, false, " -machine pc,accel=kvm,dump-guest-core=off "},
+		{"disable mem merge", map[string]string{"disable_mem_merge": "true"}, false, " -machine pc,accel=kvm,dump-guest-core=off,mem-merge=off "},
+		{"disable mem merge dump guest core", map[string]string{"disable_mem_merge": "true"}, true, " -machine pc,accel=kvm,mem-merge=off "},
+		{"enable mem merge", map[string]string{"disable_mem_merge": "false"}, true, " -machine pc,accel=kvm "},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.QemuDumpGuestCore = c.dumpGuestCore
+
+			s := newTestStartGuest()
+			s.Desc.Metadata = c.metadata
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			assert.Contains(t, script, c.want)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptDeferIncoming(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedPortUsed := migratePortUsed
+	savedDefer := options.HostOptions.LiveMigrateDeferIncoming
+	defer func() {
+		guestManager = savedManager
+		migratePortUsed = savedPortUsed
+		options.HostOptions.LiveMigrateDeferIncoming = savedDefer
+	}()
+	migratePortUsed = func(port int) bool { return false }
+
+	cases := []struct {
+		name      string
+		hostDefer bool
+		params    map[string]bool
+		want      string
+		deferred  bool
+	}{
+		{"listen on start", false, map[string]bool{}, fmt.Sprintf(" -incoming tcp:0:%d", LIVE_MIGRATE_PORT_BASE+1), false},
+		{"host defers", true, map[string]bool{}, " -incoming defer", true},
+		{"request defers", false, map[string]bool{"live_migrate_defer_incoming": true}, " -incoming defer", true},
+		{"request listens on start", true, map[string]bool{"live_migrate_defer_incoming": false}, fmt.Sprintf(" -incoming tcp:0:%d", LIVE_MIGRATE_PORT_BASE+1), false},
+		{"tls always defers", false, map[string]bool{"live_migrate_use_tls": true, "live_migrate_defer_incoming": false}, " -incoming defer", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.LiveMigrateDeferIncoming = c.hostDefer
+
+			s := newTestStartGuest()
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			data.Set("need_migrate", jsonutils.JSONTrue)
+			for k, v := range c.params {
+				data.Set(k, jsonutils.NewBool(v))
+			}
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			assert.Contains(t, script, c.want)
+			assert.Equal(t, c.deferred, s.LiveMigrateDeferIncoming)
+			assert.Equal(t, LIVE_MIGRATE_PORT_BASE+1, *s.LiveMigrateDestPort)
+		})
+	}
+}
+
+// fakeLogHook collects errors and warnings logged
+type fakeLogHook struct {
+	messages []string
+}
+
+func (h *fakeLogHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel}
+}
+
+func (h *fakeLogHook) Fire(entry *logrus.Entry) error {
+	h.messages = append(h.messages, entry.Message)
+	return nil
+}
+
+func TestSKVMGuestInstance_logPrefix(t *testing.T) {
+	s := NewKVMGuestInstance("uuid-xxxx-xxxx", &SGuestManager{})
+	assert.Equal(t, "[guest uuid-xxxx-xxxx]", s.logPrefix())
+	s.Desc = &desc.SGuestDesc{Name: "test-vm"}
+	assert.Equal(t, "[guest uuid-xxxx-xxxx test-vm]", s.logPrefix())
+
+	hook := &fakeLogHook{}
+	savedHooks := log.Logger().ReplaceHooks(make(logrus.LevelHooks))
+	log.Logger().AddHook(hook)
+	defer log.Logger().ReplaceHooks(savedHooks)
+
+	s.presendArpForNic(&api.GuestnetworkJsonDesc{Ip: "10.0.0.2", Ifname: "vnet-not-exists"})
+	s.startMemCleaner()
+	if assert.Len(t, hook.messages, 2) {
+		for _, msg := range hook.messages {
+			assert.True(t, strings.HasPrefix(msg, "[guest uuid-xxxx-xxxx test-vm] "), msg)
+		}
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptTrace(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedEnableTrace := options.HostOptions.EnableQemuTrace
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.EnableQemuTrace = savedEnableTrace
+	}()
+
+	eventsFile := path.Join(t.TempDir(), "events")
+	if err := ioutil.WriteFile(eventsFile, []byte("virtio_blk_req_complete\n"), 0644); err != nil {
+		t.Fatalf("write events file: %v", err)
+	}
+
+	cases := []struct {
+		name        string
+		enableTrace bool
+		metadata    map[string]string
+		want        string
+		wantErr     bool
+	}{
+		{
+			name:        "no trace metadata",
+			enableTrace: true,
+			metadata:    map[string]string{},
+		},
+		{
+			name:     "trace not enabled on host",
+			metadata: map[string]string{"qemu_trace_enable": "virtio_*"},
+		},
+		{
+			name:        "trace pattern",
+			enableTrace: true,
+			metadata:    map[string]string{"qemu_trace_enable": "virtio_*"},
+			want:        "-trace enable=virtio_*,file='",
+		},
+		{
+			name:        "trace events file",
+			enableTrace: true,
+			metadata:    map[string]string{"qemu_trace_events": eventsFile},
+			want:        "-trace events='" + eventsFile + "',file='",
+		},
+		{
+			name:        "trace pattern with shell command",
+			enableTrace: true,
+			metadata:    map[string]string{"qemu_trace_enable": "virtio_*;reboot"},
+			wantErr:     true,
+		},
+		{
+			name:        "trace events file with shell command",
+			enableTrace: true,
+			metadata:    map[string]string{"qemu_trace_events": eventsFile + "$(reboot)"},
+			wantErr:     true,
+		},
+		{
+			name:        "relative trace events file",
+			enableTrace: true,
+			metadata:    map[string]string{"qemu_trace_events": "events"},
+			wantErr:     true,
+		},
+		{
+			name:        "missing trace events file",
+			enableTrace: true,
+			metadata:    map[string]string{"qemu_trace_events": eventsFile + ".missing"},
+			wantErr:     true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.EnableQemuTrace = c.enableTrace
+
+			s := newTestStartGuest()
+			s.Desc.Metadata = c.metadata
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			cmdline, err := s.getQemuCmdlineFromContent(script)
+			if err != nil {
+				t.Fatalf("getQemuCmdlineFromContent: %v", err)
+			}
+			if len(c.want) == 0 {
+				assert.NotContains(t, cmdline, "-trace ")
+				return
+			}
+			assert.Contains(t, cmdline, c.want+s.getQemuTracePath()+"'")
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptMultiQueueNic(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	s := newTestStartGuest()
+	mqNic := newGoldenNic(0, NIC_DRIVER_VIRTIO)
+	mqNic.NumQueues = 4
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{
+		mqNic,
+		newGoldenNic(1, NIC_DRIVER_VIRTIO),
+	}
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+	script, err := s.generateStartScript(data, host)
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	assert.Contains(t, script, "ip tuntap add dev vnet0 mode tap multi_queue\n")
+	assert.NotContains(t, script, "ip tuntap add dev vnet1 ")
+	cmdline, err := s.getQemuCmdlineFromContent(script)
+	if err != nil {
+		t.Fatalf("getQemuCmdlineFromContent: %v", err)
+	}
+	assert.Contains(t, cmdline, "-netdev type=tap,id=vnet0,ifname=vnet0,vhost=on,vhostforce=off,queues=4,")
+	assert.Contains(t, cmdline, ",mq=on,vectors=8")
+	assert.NotContains(t, cmdline, "ifname=vnet1,vhost=on,vhostforce=off,queues=")
+
+	stopScript := s.generateStopScript(data)
+	assert.Contains(t, stopScript, "ip tuntap del dev vnet0 mode tap multi_queue")
+	assert.NotContains(t, stopScript, "ip tuntap del dev vnet1 ")
+}
+
+func TestSKVMGuestInstance_SetNicLink(t *testing.T) {
+	s := newTestStartGuest()
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{
+		newGoldenNic(0, NIC_DRIVER_VIRTIO),
+		newGoldenNic(1, NIC_DRIVER_VIRTIO),
+	}
+
+	// monitor not connected
+	assert.Error(t, s.SetNicLink("vnet0", false))
+
+	mon := &fakeMonitor{}
+	s.Monitor = mon
+	assert.NoError(t, s.SetNicLink("vnet0", false))
+	assert.NoError(t, s.SetNicLink("00:22:0a:00:00:01", false))
+	assert.Equal(t, []string{"set_link netdev-vnet0 false", "set_link netdev-vnet1 false"}, mon.Commands())
+	up, err := s.GetNicLink("vnet0")
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	assert.NoError(t, s.SetNicLink("vnet0", true))
+	assert.Equal(t, "set_link netdev-vnet0 true", mon.Commands()[2])
+	up, err = s.GetNicLink("vnet0")
+	assert.NoError(t, err)
+	assert.True(t, up)
+	up, err = s.GetNicLink("vnet1")
+	assert.NoError(t, err)
+	assert.False(t, up)
+
+	// unknown nic is refused before reaching monitor
+	err = s.SetNicLink("vnet9", false)
+	assert.True(t, errors.Cause(err) == errors.ErrNotFound)
+	_, err = s.GetNicLink("vnet9")
+	assert.Error(t, err)
+	assert.Len(t, mon.Commands(), 3)
+
+	// links set concurrently from api
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func(up bool) {
+			defer wg.Done()
+			assert.NoError(t, s.SetNicLink("vnet1", up))
+		}(i%2 == 0)
+		go func() {
+			defer wg.Done()
+			_, err := s.GetNicLink("vnet1")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+	commands := mon.Commands()
+	up, _ = s.GetNicLink("vnet1")
+	assert.Equal(t, fmt.Sprintf("set_link netdev-vnet1 %v", up), commands[len(commands)-1])
+}
+
+func TestSKVMGuestInstance_generateHookScript(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedPreStart := options.HostOptions.GuestPreStartHook
+	savedPostStop := options.HostOptions.GuestPostStopHook
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.GuestPreStartHook = savedPreStart
+		options.HostOptions.GuestPostStopHook = savedPostStop
+	}()
+
+	dir := t.TempDir()
+	envFile := path.Join(dir, "env")
+	writeHook := func(name string, exitCode int) string {
+		hook := path.Join(dir, name)
+		content := fmt.Sprintf("#!/bin/sh\necho \"$GUEST_ID $GUEST_UUID $GUEST_NAME\" > %s\nexit %d\n", envFile, exitCode)
+		if err := ioutil.WriteFile(hook, []byte(content), 0755); err != nil {
+			t.Fatalf("write hook: %v", err)
+		}
+		return hook
+	}
+	runScript := func(script string) (string, error) {
+		out, err := exec.Command("bash", "-c", script+"echo launched\n").CombinedOutput()
+		return string(out), err
+	}
+
+	s := newTestStartGuest()
+	s.Desc.Name = "it's-vm"
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+
+	// hooks are optional
+	script, err := s.generateStartScript(data, host)
+	assert.NoError(t, err)
+	assert.NotContains(t, script, "hook")
+	assert.NotContains(t, s.generateStopScript(data), "hook")
+
+	t.Run("pre-start hook succeeded", func(t *testing.T) {
+		options.HostOptions.GuestPreStartHook = writeHook("pre-start-ok", 0)
+		script, err := s.generateStartScript(data, host)
+		assert.NoError(t, err)
+		hookScript := s.generateHookScript(options.HostOptions.GuestPreStartHook, GUEST_HOOK_PRE_START, true)
+		assert.True(t, strings.HasSuffix(script, hookScript+"eval $CMD"))
+
+		out, err := runScript(hookScript)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "launched")
+		env, _ := ioutil.ReadFile(envFile)
+		assert.Equal(t, "test-guest uuid-xxxx-xxxx it's-vm\n", string(env))
+	})
+
+	t.Run("pre-start hook failure aborts start", func(t *testing.T) {
+		hook := writeHook("pre-start-fail", 3)
+		out, err := runScript(s.generateHookScript(hook, GUEST_HOOK_PRE_START, true))
+		assert.Error(t, err)
+		assert.Contains(t, out, "pre-start hook "+hook+" failed")
+		assert.NotContains(t, out, "launched")
+	})
+
+	t.Run("post-stop hook failure ignored", func(t *testing.T) {
+		options.HostOptions.GuestPostStopHook = writeHook("post-stop-fail", 1)
+		stopScript := s.generateStopScript(data)
+		hookScript := s.generateHookScript(options.HostOptions.GuestPostStopHook, GUEST_HOOK_POST_STOP, false)
+		assert.True(t, strings.HasSuffix(stopScript, hookScript))
+
+		out, err := runScript(hookScript)
+		assert.NoError(t, err)
+		assert.Contains(t, out, "post-stop hook")
+		assert.Contains(t, out, "launched")
+	})
+}
+
+func TestSKVMGuestInstance_runPostStartHook(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	savedHook := options.HostOptions.GuestPostStartHook
+	defer func() {
+		procDir = savedProcDir
+		options.HostOptions.GuestPostStartHook = savedHook
+	}()
+	procDir = path.Join(tmpDir, "proc")
+
+	s := newTestGuestWithServersPath(tmpDir, nil)
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	s.Desc.Name = "vm1"
+	options.HostOptions.GuestPostStartHook = ""
+	assert.NoError(t, s.runPostStartHook())
+
+	// simulate running qemu
+	for _, dir := range []string{s.HomeDir(), path.Join(procDir, "1234")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	cmdline := fmt.Sprintf("/usr/bin/qemu-system-x86_64\x00-uuid\x00%s\x00", s.Desc.Uuid)
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetVncFilePath(), []byte("5901\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	envFile := path.Join(tmpDir, "env")
+	writeHook := func(name string, exitCode int) string {
+		hook := path.Join(tmpDir, name)
+		content := fmt.Sprintf("#!/bin/sh\necho \"$GUEST_UUID $GUEST_NAME $GUEST_PID $GUEST_VNC_PORT\" > %s\necho hook-output\nexit %d\n", envFile, exitCode)
+		if err := ioutil.WriteFile(hook, []byte(content), 0755); err != nil {
+			t.Fatalf("write hook: %v", err)
+		}
+		return hook
+	}
+
+	options.HostOptions.GuestPostStartHook = writeHook("post-start-ok", 0)
+	assert.NoError(t, s.runPostStartHook())
+	env, _ := ioutil.ReadFile(envFile)
+	assert.Equal(t, "uuid-xxxx-xxxx vm1 1234 5901\n", string(env))
+
+	options.HostOptions.GuestPostStartHook = writeHook("post-start-fail", 2)
+	err := s.runPostStartHook()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "post-start hook")
+		assert.Contains(t, err.Error(), "hook-output")
+	}
+}
+
+func TestSKVMGuestInstance_generateStopProcessScript(t *testing.T) {
+	savedGrace := options.HostOptions.GuestStopGraceSeconds
+	savedTerm := options.HostOptions.GuestStopTermSeconds
+	savedQmp := options.HostOptions.EnableQmpMonitor
+	defer func() {
+		options.HostOptions.GuestStopGraceSeconds = savedGrace
+		options.HostOptions.GuestStopTermSeconds = savedTerm
+		options.HostOptions.EnableQmpMonitor = savedQmp
+	}()
+	options.HostOptions.GuestStopGraceSeconds = 1
+	options.HostOptions.GuestStopTermSeconds = 1
+	options.HostOptions.EnableQmpMonitor = true
+
+	s := newTestGuestWithServersPath(t.TempDir(), nil)
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	script := s.generateStopProcessScript()
+
+	// fakeQemu starts a process standing in for qemu which ignores the given
+	// signals, returned channel is closed once it exits
+	fakeQemu := func(ignored string) (int, chan struct{}) {
+		cmd := exec.Command("bash", "-c", fmt.Sprintf("trap '' %s; exec sleep 30", ignored))
+		if err := cmd.Start(); err != nil {
+			t.Fatalf("start fake qemu: %v", err)
+		}
+		exited := make(chan struct{})
+		go func() {
+			cmd.Wait()
+			close(exited)
+		}()
+		// wait until signal dispositions are settled
+		for i := 0; i < 50; i++ {
+			cmdline, _ := ioutil.ReadFile(fmt.Sprintf("/proc/%d/cmdline", cmd.Process.Pid))
+			if strings.HasPrefix(string(cmdline), "sleep") {
+				break
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+		if err := ioutil.WriteFile(s.GetPidFilePath(), []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		return cmd.Process.Pid, exited
+	}
+	// fake nc records monitor commands and exits qemu as powerdown or quit does
+	binDir := path.Join(t.TempDir(), "bin")
+	ncLog := path.Join(binDir, "nc.log")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	fakeNc := fmt.Sprintf("#!/bin/bash\necho \"$* $(cat)\" >> %s\nkill -9 $(cat %s)\n", ncLog, s.GetPidFilePath())
+	if err := ioutil.WriteFile(path.Join(binDir, "nc"), []byte(fakeNc), 0755); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	readNcLog := func() string {
+		content, _ := ioutil.ReadFile(ncLog)
+		os.Remove(ncLog)
+		return string(content)
+	}
+	writeVncFile := func() {
+		if err := ioutil.WriteFile(s.GetVncFilePath(), []byte("5901"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	runStop := func(args ...string) string {
+		cmd := exec.Command("bash", append([]string{"-c", script, "stop"}, args...)...)
+		cmd.Env = append(os.Environ(), "PATH="+binDir+":"+os.Getenv("PATH"))
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("run stop script: %v, %s", err, out)
+		}
+		return string(out)
+	}
+	assertExited := func(exited chan struct{}) {
+		select {
+		case <-exited:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("fake qemu still running")
+		}
+		_, err := os.Stat(s.GetPidFilePath())
+		assert.True(t, os.IsNotExist(err))
+	}
+
+	t.Run("powered down", func(t *testing.T) {
+		pid, exited := fakeQemu("TERM")
+		writeVncFile()
+		out := runStop()
+		assertExited(exited)
+		assert.NotContains(t, out, fmt.Sprintf("Terminate process %d", pid))
+		assert.NotContains(t, out, "Kill process")
+		qmpPort := 5901 + MONITOR_PORT_BASE + 200
+		assert.Equal(t, fmt.Sprintf("-w 1 127.0.0.1 %d {\"execute\":\"qmp_capabilities\"}\n{\"execute\":\"system_powerdown\"}\n", qmpPort), readNcLog())
+		assert.NoFileExists(t, s.GetVncFilePath())
+	})
+
+	t.Run("quit for internal cleanup", func(t *testing.T) {
+		_, exited := fakeQemu("TERM")
+		writeVncFile()
+		start := time.Now()
+		out := runStop(STOP_SCRIPT_ARG_QUIT)
+		assertExited(exited)
+		assert.NotContains(t, out, "Terminate process")
+		assert.Contains(t, readNcLog(), `{"execute":"quit"}`)
+		assert.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("quit without monitor kills", func(t *testing.T) {
+		pid, exited := fakeQemu("TERM")
+		start := time.Now()
+		out := runStop(STOP_SCRIPT_ARG_QUIT)
+		assertExited(exited)
+		assert.NotContains(t, out, "Terminate process")
+		assert.Contains(t, out, fmt.Sprintf("Kill process %d", pid))
+		assert.True(t, time.Since(start) < time.Second)
+	})
+
+	t.Run("powerdown tried by caller", func(t *testing.T) {
+		pid, exited := fakeQemu("HUP")
+		writeVncFile()
+		out := runStop(STOP_SCRIPT_ARG_NO_POWERDOWN)
+		assertExited(exited)
+		assert.Contains(t, out, fmt.Sprintf("Terminate process %d", pid))
+		assert.Empty(t, readNcLog())
+		assert.NoFileExists(t, s.GetVncFilePath())
+	})
+
+	t.Run("terminated", func(t *testing.T) {
+		pid, exited := fakeQemu("HUP")
+		out := runStop()
+		assertExited(exited)
+		assert.Contains(t, out, fmt.Sprintf("Terminate process %d", pid))
+		assert.NotContains(t, out, "Kill process")
+	})
+
+	t.Run("SIGTERM ignored escalates to SIGKILL", func(t *testing.T) {
+		pid, exited := fakeQemu("TERM")
+		start := time.Now()
+		out := runStop()
+		assertExited(exited)
+		assert.Contains(t, out, fmt.Sprintf("Terminate process %d", pid))
+		assert.Contains(t, out, fmt.Sprintf("Kill process %d", pid))
+		assert.True(t, time.Since(start) >= time.Second)
+	})
+
+	t.Run("force kills directly", func(t *testing.T) {
+		pid, exited := fakeQemu("TERM")
+		out := runStop("--force")
+		assertExited(exited)
+		assert.NotContains(t, out, "Terminate process")
+		assert.Contains(t, out, fmt.Sprintf("Kill process %d", pid))
+	})
+
+	t.Run("defunct", func(t *testing.T) {
+		cmd := newZombie(t)
+		defer cmd.Wait()
+		if err := ioutil.WriteFile(s.GetPidFilePath(), []byte(fmt.Sprintf("%d\n", cmd.Process.Pid)), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+		start := time.Now()
+		out := runStop()
+		assert.NotContains(t, out, "Terminate process")
+		assert.NotContains(t, out, "Kill process")
+		assert.True(t, time.Since(start) < time.Second)
+	})
+}
+
+func TestSKVMGuestInstance_generateMonitorCommandScript(t *testing.T) {
+	savedQmp := options.HostOptions.EnableQmpMonitor
+	defer func() { options.HostOptions.EnableQmpMonitor = savedQmp }()
+
+	s := newTestGuest(nil)
+	options.HostOptions.EnableQmpMonitor = true
+	assert.Equal(t, `printf '{"execute":"qmp_capabilities"}\n{"execute":"quit"}\n' | nc -w 1 127.0.0.1 $(($VNC + 56100)) > /dev/null 2>&1`,
+		s.generateMonitorCommandScript("quit"))
+	options.HostOptions.EnableQmpMonitor = false
+	assert.Equal(t, "echo quit | nc -w 1 127.0.0.1 $(($VNC + 55900)) > /dev/null 2>&1", s.generateMonitorCommandScript("quit"))
+}
+
+// newZombie returns a killed child process not waited yet
+func newZombie(t *testing.T) *exec.Cmd {
+	cmd := exec.Command("sleep", "30")
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("start process: %v", err)
+	}
+	cmd.Process.Kill()
+	pid := fmt.Sprintf("%d", cmd.Process.Pid)
+	for i := 0; i < 50; i++ {
+		if state, _ := readProcState(pid); state == "Z" {
+			return cmd
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatalf("process %s not defunct", pid)
+	return nil
+}
+
+func TestSKVMGuestInstance_defunctQemu(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	defer func() { procDir = savedProcDir }()
+	procDir = path.Join(tmpDir, "proc")
+
+	s := newTestGuestWithServersPath(tmpDir, nil)
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	for _, dir := range []string{s.HomeDir(), path.Join(procDir, "1234")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	writeStat := func(state string) {
+		stat := fmt.Sprintf("1234 (qemu-kvm x86) %s 1 1234 1234 0 -1 4194560\n", state)
+		if err := ioutil.WriteFile(path.Join(procDir, "1234", "stat"), []byte(stat), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+
+	writeStat("S")
+	state, err := readProcState("1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "S", state)
+	assert.True(t, s.IsRunning())
+
+	writeStat("Z")
+	assert.False(t, s.IsRunning())
+}
+
+// fakeScriptHost renders start scripts through saveScripts
+type fakeScriptHost struct {
+	fakeHost
+	*fakeHostCapabilities
+}
+
+func TestSKVMGuestInstance_SyncConfigRename(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	tmpDir := t.TempDir()
+	savedProcDir, savedQemuVersion := procDir, options.HostOptions.DefaultQemuVersion
+	defer func() {
+		guestManager = savedManager
+		procDir = savedProcDir
+		options.HostOptions.DefaultQemuVersion = savedQemuVersion
+	}()
+	procDir = path.Join(tmpDir, "proc")
+	options.HostOptions.DefaultQemuVersion = string(qemu.Version_4_2_0)
+
+	s := newTestStartGuest()
+	s.manager.ServersPath = tmpDir
+	s.manager.host = &fakeScriptHost{fakeHostCapabilities: &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}}
+	s.Desc.Name = "vm1"
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.MkdirAll(path.Join(procDir, "1234"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	newDesc := *s.Desc
+	newDesc.Name = "vm2"
+	_, err := s.SyncConfig(context.Background(), &newDesc, true)
+	assert.NoError(t, err)
+	assert.Equal(t, "[guest test-guest vm2]", s.logPrefix())
+
+	content, err := ioutil.ReadFile(s.GetDescFilePath())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	assert.Contains(t, string(content), `"name":"vm2"`)
+	script, err := ioutil.ReadFile(s.GetStartScriptPath())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	assert.Contains(t, string(script), " -name 'vm2'")
+}
+
+func TestSKVMGuestInstance_generateStartScriptVncListen(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedListen := options.HostOptions.VncListenAddress
+	savedPortUsed := tcpPortUsed
+	tcpPortUsed = func(string, int) bool { return false }
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.VncListenAddress = savedListen
+		tcpPortUsed = savedPortUsed
+	}()
+
+	render := func(hostListen string, metadata map[string]string) (string, error) {
+		options.HostOptions.VncListenAddress = hostListen
+		s := newTestStartGuest()
+		for k, v := range metadata {
+			s.Desc.Metadata[k] = v
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		data.Set("vnc_port", jsonutils.NewInt(3))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		script, err := s.generateStartScript(data, host)
+		if err != nil {
+			return "", err
+		}
+		return s.getQemuCmdlineFromContent(script)
+	}
+
+	cmdline, err := render("", nil)
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -vnc :3 ")
+
+	cmdline, err = render("10.168.0.2", nil)
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -vnc 10.168.0.2:3 ")
+
+	cmdline, err = render("fd00::2", nil)
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -vnc [fd00::2]:3 ")
+
+	// address of guest metadata is ignored
+	cmdline, err = render("10.168.0.2", map[string]string{"vnc_listen_address": "10.168.0.3"})
+	assert.NoError(t, err)
+	assert.Contains(t, cmdline, " -vnc 10.168.0.2:3 ")
+
+	_, err = render("mgmt0", nil)
+	assert.Error(t, err)
+
+	// vnc option with dynamic port is not compared when migrating
+	s := newTestStartGuest()
+	cl, filtered, err := s.parseCmdline("$QEMU_CMD -vnc 10.168.0.2:3,password -m 1024M")
+	if err != nil {
+		t.Fatalf("parseCmdline: %v", err)
+	}
+	assert.NotContains(t, cl.ToString(), "-vnc")
+	if assert.Len(t, filtered, 1) {
+		assert.Equal(t, "10.168.0.2:3,password", filtered[0].Value)
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptDisableUsb(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.OvmfPath = ovmfPath
+	}()
+
+	cases := []struct {
+		name     string
+		arch     string
+		metadata map[string]string
+		want     []string
+	}{
+		{
+			name:     "x86",
+			arch:     apis.OS_ARCH_X86_64,
+			metadata: map[string]string{"disable_usb": "true"},
+		},
+		{
+			name:     "x86 virtio input devices",
+			arch:     apis.OS_ARCH_X86_64,
+			metadata: map[string]string{"disable_usb": "true", "input_device_type": "virtio"},
+			want:     []string{"-device virtio-keyboard-pci", "-device virtio-tablet-pci"},
+		},
+		{
+			name:     "aarch64",
+			arch:     apis.OS_ARCH_AARCH64,
+			metadata: map[string]string{"disable_usb": "true"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			for k, v := range c.metadata {
+				s.Desc.Metadata[k] = v
+			}
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: c.arch, kvm: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			cmdline, err := s.getQemuCmdlineFromContent(script)
+			if err != nil {
+				t.Fatalf("getQemuCmdlineFromContent: %v", err)
+			}
+			assert.NotContains(t, cmdline, "-usb ")
+			assert.NotContains(t, cmdline, "xhci")
+			assert.NotContains(t, cmdline, "usb-")
+			for _, want := range c.want {
+				assert.Contains(t, cmdline, want)
+			}
+		})
+	}
+}
+
+func Test_alignHugepagesMem(t *testing.T) {
+	cases := []struct {
+		name       string
+		memMb      uint64
+		pageSizeKb int
+		roundUp    bool
+		want       uint64
+		wantErr    bool
+	}{
+		{"aligned 2M", 1024, 2048, false, 1024, false},
+		{"aligned 1G", 4096, 1048576, false, 4096, false},
+		{"64K pages always aligned", 1025, 64, false, 1025, false},
+		{"misaligned 2M round up", 1025, 2048, true, 1026, false},
+		{"misaligned 1G round up", 1536, 1048576, true, 2048, false},
+		{"misaligned 2M error", 1025, 2048, false, 0, true},
+		{"misaligned 1G error", 1536, 1048576, false, 0, true},
+		{"invalid page size", 1024, 0, true, 0, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := alignHugepagesMem(c.memMb, c.pageSizeKb, c.roundUp)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptHugepagesMem(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedRoundUp := options.HostOptions.HugepagesMemRoundUp
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.HugepagesMemRoundUp = savedRoundUp
+	}()
+
+	cases := []struct {
+		name    string
+		mem     int64
+		roundUp bool
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "aligned",
+			mem:  2048,
+			want: []string{"pagesize=1048576K,size=2048M ", " -m 2048M,"},
+		},
+		{
+			name:    "misaligned round up",
+			mem:     1536,
+			roundUp: true,
+			want:    []string{"pagesize=1048576K,size=2048M ", " -m 2048M,"},
+		},
+		{
+			name:    "misaligned error",
+			mem:     1536,
+			wantErr: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			options.HostOptions.HugepagesMemRoundUp = c.roundUp
+			s := newTestStartGuest()
+			s.Desc.Mem = c.mem
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true, hugepages: true, hugepageSizeKb: 1048576}
+			script, err := s.generateStartScript(data, host)
+			if c.wantErr {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), "not multiple of hugepage size")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			for _, want := range c.want {
+				assert.Contains(t, script, want)
+			}
+			// desc keeps the requested memory
+			assert.Equal(t, c.mem, s.Desc.Mem)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptHostCpu(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	savedPassthrough := options.HostOptions.HostCpuPassthrough
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.HostCpuPassthrough = savedPassthrough
+	}()
+	options.HostOptions.HostCpuPassthrough = true
+
+	cases := []struct {
+		name       string
+		migratable string
+		masked     string
+		migrate    bool
+		want       string
+		wantErr    string
+	}{
+		{name: "default", want: " -cpu host,+kvm_pv_eoi,kvm=off "},
+		{name: "migratable on", migratable: "on", want: " -cpu host,migratable=on,+kvm_pv_eoi,kvm=off "},
+		{name: "migratable off", migratable: "off", want: " -cpu host,migratable=off,+kvm_pv_eoi,kvm=off "},
+		{name: "migratable off migrating", migratable: "off", migrate: true, wantErr: "can't be migrated"},
+		{name: "invalid", migratable: "yes", wantErr: "invalid cpu_migratable"},
+		{name: "masked", masked: "pdpe1gb, avx512f", want: " -cpu host,-pdpe1gb,-avx512f,+kvm_pv_eoi,kvm=off "},
+		{name: "masked migratable", migratable: "on", masked: "avx512f", want: " -cpu host,migratable=on,-avx512f,+kvm_pv_eoi,kvm=off "},
+		{name: "masked invalid", masked: "-avx512f", wantErr: "invalid cpu feature name"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			s.Desc.Metadata["cpu_migratable"] = c.migratable
+			s.Desc.Metadata["cpu_masked_features"] = c.masked
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			if c.migrate {
+				data.Set("need_migrate", jsonutils.JSONTrue)
+			}
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if len(c.wantErr) > 0 {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			assert.Contains(t, script, c.want)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_waitQemuStartup(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir, savedInterval, savedProbe := procDir, qemuStartupPollInterval, probeQmpStatus
+	savedEnableQmp := options.HostOptions.EnableQmpMonitor
+	defer func() {
+		procDir, qemuStartupPollInterval, probeQmpStatus = savedProcDir, savedInterval, savedProbe
+		options.HostOptions.EnableQmpMonitor = savedEnableQmp
+	}()
+	procDir = path.Join(tmpDir, "proc")
+	qemuStartupPollInterval = 10 * time.Millisecond
+	options.HostOptions.EnableQmpMonitor = true
+
+	s := newTestGuestWithServersPath(path.Join(tmpDir, "servers"), nil)
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetVncFilePath(), []byte("1\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	probed := []string{}
+	probeQmpStatus = func(address string, timeout time.Duration) (string, error) {
+		probed = append(probed, address)
+		if len(probed) < 3 {
+			return "", errors.Errorf("connection refused")
+		}
+		return "prelaunch", nil
+	}
+
+	// no pid file
+	err := s.waitQemuStartup(50 * time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Equal(t, errors.ErrTimeout, errors.Cause(err))
+		assert.Contains(t, err.Error(), "pid file")
+	}
+	assert.Len(t, probed, 0)
+
+	// qemu of pid file shows up later, qmp answers on third probe
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.MkdirAll(path.Join(procDir, "1234"), 0755)
+		cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+		ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644)
+		ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644)
+	}()
+	assert.NoError(t, s.waitQemuStartup(5*time.Second))
+	assert.Equal(t, []string{"127.0.0.1:56101", "127.0.0.1:56101", "127.0.0.1:56101"}, probed)
+
+	// qmp never answers
+	probeQmpStatus = func(address string, timeout time.Duration) (string, error) {
+		return "", errors.Errorf("i/o timeout")
+	}
+	err = s.waitQemuStartup(50 * time.Millisecond)
+	if assert.Error(t, err) {
+		assert.Equal(t, errors.ErrTimeout, errors.Cause(err))
+		assert.Contains(t, err.Error(), "query-status")
+	}
+
+	// qmp monitor disabled, pid file is enough
+	options.HostOptions.EnableQmpMonitor = false
+	assert.NoError(t, s.waitQemuStartup(50*time.Millisecond))
+}
+
+func TestSKVMGuestInstance_CleanupGuestFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	defer func() { procDir = savedProcDir }()
+	procDir = path.Join(tmpDir, "proc")
+
+	serversPath := path.Join(tmpDir, "servers")
+	s := newTestGuestWithServersPath(serversPath, nil)
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	paths := s.Paths()
+	files := []string{
+		paths.Desc, paths.Pid, paths.EncryptKey, paths.QemuLog, paths.QgaSocket,
+		path.Join(paths.PKIDir, "ca-cert.pem"),
+		path.Join(s.HomeDir(), "if-up-br0-vnet1.sh"),
+	}
+	for _, f := range files {
+		if err := os.MkdirAll(path.Dir(f), 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+		if err := ioutil.WriteFile(f, []byte("1234\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %v", err)
+		}
+	}
+	other := path.Join(serversPath, "other-guest", "desc")
+	if err := os.MkdirAll(path.Dir(other), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(other, []byte("{}"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	// qemu of pid file is running
+	if err := os.MkdirAll(path.Join(procDir, "1234"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := s.CleanupGuestFiles(); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is running")
+	}
+	for _, f := range files {
+		assert.FileExists(t, f)
+	}
+
+	os.RemoveAll(procDir)
+	assert.NoError(t, s.CleanupGuestFiles())
+	_, err := os.Stat(s.HomeDir())
+	assert.True(t, os.IsNotExist(err), "home dir removed")
+	assert.FileExists(t, other)
+	// nothing left to clean
+	assert.NoError(t, s.CleanupGuestFiles())
+
+	for _, id := range []string{"", ".", "..", "../servers", "a/b"} {
+		s.Id = id
+		assert.Error(t, s.CleanupGuestFiles(), id)
+	}
+	assert.FileExists(t, other)
+}
+
+func TestSKVMGuestInstance_generateStartScriptBalloon(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	for _, enable := range []bool{false, true} {
+		s := newTestStartGuest()
+		if enable {
+			s.Desc.Metadata["enable_balloon"] = "true"
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		script, err := s.generateStartScript(data, host)
+		if err != nil {
+			t.Fatalf("generateStartScript: %v", err)
+		}
+		if enable {
+			assert.Contains(t, script, " -device virtio-balloon-pci,id=balloon0 ")
+		} else {
+			assert.NotContains(t, script, "virtio-balloon")
+		}
+	}
+}
+
+func TestSKVMGuestInstance_QueryBalloon(t *testing.T) {
+	s := newTestGuest(map[string]string{})
+	_, err := s.QueryBalloon()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no balloon device")
+	}
+
+	s = newTestGuest(map[string]string{"enable_balloon": "true"})
+	s.Monitor = &fakeMonitor{}
+	_, err = s.QueryBalloon()
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "requires qmp monitor")
+	}
+}
+
+func TestSKVMGuestInstance_SetBalloon(t *testing.T) {
+	s := newTestGuest(map[string]string{"enable_balloon": "true"})
+	s.Desc.Mem = 4096
+	mon := &fakeMonitor{}
+	s.Monitor = mon
+
+	assert.NoError(t, s.SetBalloon(2048*1024*1024))
+	assert.NoError(t, s.SetBalloon(4096*1024*1024))
+	assert.Equal(t, []string{"balloon 2147483648", "balloon 4294967296"}, mon.Commands())
+
+	for _, size := range []int64{4096*1024*1024 + 1, 0, -1} {
+		if err := s.SetBalloon(size); assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "out of range")
+		}
+	}
+	assert.Len(t, mon.Commands(), 2)
+
+	s = newTestGuest(map[string]string{})
+	s.Desc.Mem = 4096
+	s.Monitor = mon
+	if err := s.SetBalloon(2048 * 1024 * 1024); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "no balloon device")
+	}
+}
+
+func Test_getDisplayResolutionDriver(t *testing.T) {
+	for _, c := range []struct {
+		isArm      bool
+		vga        string
+		isVdiSpice bool
+		want       string
+	}{
+		{false, "std", false, ""},
+		{false, "", false, ""},
+		{false, "cirrus", false, ""},
+		{false, "vmware", false, ""},
+		{false, "qxl", false, "qxl-vga"},
+		{false, "virtio", false, "virtio-vga"},
+		{false, "std", true, "qxl-vga"},
+		{true, "", false, "virtio-gpu-pci"},
+		{true, "std", false, "virtio-gpu-pci"},
+		{true, "none", false, ""},
+	} {
+		assert.Equal(t, c.want, getDisplayResolutionDriver(c.isArm, c.vga, c.isVdiSpice), "%#v", c)
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptAarch64Vga(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.OvmfPath = ovmfPath
+	}()
+
+	cases := []struct {
+		name       string
+		vga        string
+		want       string
+		notWant    []string
+		wantGpuDev bool
+	}{
+		{name: "default", vga: "", wantGpuDev: true, notWant: []string{"-vga "}},
+		{name: "std", vga: "std", wantGpuDev: true, notWant: []string{"-vga "}},
+		{name: "virtio", vga: "virtio", wantGpuDev: true, notWant: []string{"-vga "}},
+		{name: "unsupported falls back to virtio", vga: "qxl", wantGpuDev: true, notWant: []string{"-vga ", "qxl"}},
+		{name: "headless", vga: "none", want: " -vga none ", notWant: []string{"virtio-gpu-pci"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			s.Desc.Vga = c.vga
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: apis.OS_ARCH_AARCH64, kvm: true}
+			script, err := s.generateStartScript(data, host)
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			cmdline, err := s.getQemuCmdlineFromContent(script)
+			if err != nil {
+				t.Fatalf("getQemuCmdlineFromContent: %v", err)
+			}
+			if c.wantGpuDev {
+				assert.Contains(t, cmdline, " -device virtio-gpu-pci,id=video1,max_outputs=1 ")
+			}
+			if len(c.want) > 0 {
+				assert.Contains(t, cmdline, c.want)
+			}
+			for _, notWant := range c.notWant {
+				assert.NotContains(t, cmdline, notWant)
+			}
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptDisplayMaxOutputs(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.OvmfPath = ovmfPath
+	}()
+
+	cases := []struct {
+		name       string
+		arch       string
+		vga        string
+		maxOutputs string
+		want       string
+		wantErr    bool
+	}{
+		{name: "x86 virtio", arch: apis.OS_ARCH_X86_64, vga: "virtio", maxOutputs: "2", want: " -global virtio-vga.max_outputs=2 "},
+		{name: "aarch64", arch: apis.OS_ARCH_AARCH64, maxOutputs: "4", want: " -device virtio-gpu-pci,id=video1,max_outputs=4 "},
+		{name: "aarch64 default", arch: apis.OS_ARCH_AARCH64, want: " -device virtio-gpu-pci,id=video1,max_outputs=1 "},
+		{name: "x86 default", arch: apis.OS_ARCH_X86_64, vga: "virtio"},
+		{name: "std ignored", arch: apis.OS_ARCH_X86_64, vga: "std", maxOutputs: "2"},
+		{name: "too many", arch: apis.OS_ARCH_X86_64, vga: "virtio", maxOutputs: "17", wantErr: true},
+		{name: "invalid", arch: apis.OS_ARCH_AARCH64, maxOutputs: "two", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			s.Desc.Vga = c.vga
+			if len(c.maxOutputs) > 0 {
+				s.Desc.Metadata["display_max_outputs"] = c.maxOutputs
+			}
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: c.arch, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			if len(c.want) > 0 {
+				assert.Contains(t, script, c.want)
+			} else {
+				assert.NotContains(t, script, "-global virtio-vga.max_outputs")
+			}
+		})
+	}
+}
+
+func TestSKVMGuestInstance_generateStartScriptHostCharDevices(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	render := func(metadata map[string]string) (string, error) {
+		s := newTestStartGuest()
+		for k, v := range metadata {
+			s.Desc.Metadata[k] = v
+		}
+		data := jsonutils.NewDict()
+		data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+		host := &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true}
+		return s.generateStartScript(data, host)
+	}
+
+	// character devices stand in for host ports
+	savedPrefixes := hostCharDevicePrefixes
+	hostCharDevicePrefixes = map[string]string{
+		qemu.HOST_CHARDEV_SERIAL:   "/dev/null",
+		qemu.HOST_CHARDEV_PARALLEL: "/dev/zero",
+	}
+	defer func() { hostCharDevicePrefixes = savedPrefixes }()
+	link := path.Join(t.TempDir(), "serial-by-id")
+	if err := os.Symlink("/dev/null", link); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	script, err := render(map[string]string{
+		"host_serial_devices":   link,
+		"host_parallel_devices": "/dev/zero",
+	})
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	assert.Contains(t, script, " -chardev pty,id=charserial0 -device isa-serial,chardev=charserial0,id=serial0"+
+		" -chardev serial,id=charhostserial0,path=/dev/null -device isa-serial,chardev=charhostserial0,id=hostserial0"+
+		" -chardev parallel,id=charhostparallel0,path=/dev/zero -device isa-parallel,chardev=charhostparallel0,id=hostparallel0 ")
+
+	_, err = render(map[string]string{"host_serial_devices": "/dev/nonexistent-ttyS9"})
+	assert.Error(t, err)
+	for _, dev := range []string{"/dev/null;reboot", "/dev/null -S", "/dev/zero", "/dev/kmsg", "/dev/null/../zero"} {
+		_, err = render(map[string]string{"host_serial_devices": dev})
+		assert.Error(t, err, dev)
+	}
+	// links are checked by what they point to
+	if err := os.Symlink("/dev/zero", link+"-zero"); err != nil {
+		t.Fatalf("Symlink: %v", err)
+	}
+	_, err = render(map[string]string{"host_serial_devices": link + "-zero"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "should be /dev/null*")
+	}
+
+	tmpDir := t.TempDir()
+	hostCharDevicePrefixes[qemu.HOST_CHARDEV_SERIAL] = tmpDir
+	_, err = render(map[string]string{"host_serial_devices": tmpDir})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not a character device")
+	}
+}
+
+type fakeArchHost struct {
+	fakeHost
+	arch string
+}
+
+func (h *fakeArchHost) IsAarch64() bool { return h.arch == apis.OS_ARCH_AARCH64 }
+
+func TestSKVMGuestInstance_SetDisplayResolution(t *testing.T) {
+	s := newTestGuestWithServersPath(t.TempDir(), map[string]string{})
+	s.manager.host = &fakeArchHost{arch: apis.OS_ARCH_X86_64}
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	// std vga is left untouched
+	s.Desc.Vga = "std"
+	assert.NoError(t, s.SetDisplayResolution(1920, 1080))
+	assert.Empty(t, s.Desc.DisplayResolution)
+	assert.NoFileExists(t, s.GetDescFilePath())
+
+	s.Desc.Vga = "virtio"
+	assert.Error(t, s.SetDisplayResolution(1920, 100))
+	assert.Error(t, s.SetDisplayResolution(10000, 1080))
+	assert.NoError(t, s.SetDisplayResolution(1920, 1080))
+	assert.Equal(t, "1920x1080", s.Desc.DisplayResolution)
+	content, err := ioutil.ReadFile(s.GetDescFilePath())
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	assert.Contains(t, string(content), "1920x1080")
+
+	// kept when desc is synced from region
+	newDesc := &desc.SGuestDesc{}
+	newDesc.Vga = "virtio"
+	assert.NoError(t, s.SaveDesc(newDesc))
+	assert.Equal(t, "1920x1080", s.Desc.DisplayResolution)
+
+	// std vga on aarch64 is replaced by virtio-gpu
+	s.manager.host = &fakeArchHost{arch: apis.OS_ARCH_AARCH64}
+	s.Desc.Vga = "std"
+	assert.NoError(t, s.SetDisplayResolution(1280, 720))
+	assert.Equal(t, "1280x720", s.Desc.DisplayResolution)
+}
+
+func TestSKVMGuestInstance_generateStartScriptDisplayResolution(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	ovmfPath := options.HostOptions.OvmfPath
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	defer func() {
+		guestManager = savedManager
+		options.HostOptions.OvmfPath = ovmfPath
+	}()
+
+	cases := []struct {
+		name       string
+		arch       string
+		vga        string
+		resolution string
+		want       string
+		wantErr    bool
+	}{
+		{name: "qxl", arch: apis.OS_ARCH_X86_64, vga: "qxl", resolution: "1920x1080", want: " -global qxl-vga.xres=1920 -global qxl-vga.yres=1080 "},
+		{name: "virtio", arch: apis.OS_ARCH_X86_64, vga: "virtio", resolution: "1280x720", want: " -global virtio-vga.xres=1280 -global virtio-vga.yres=720 "},
+		{name: "aarch64", arch: apis.OS_ARCH_AARCH64, resolution: "1280x720", want: " -global virtio-gpu-pci.xres=1280 -global virtio-gpu-pci.yres=720 "},
+		{name: "std ignored", arch: apis.OS_ARCH_X86_64, vga: "std", resolution: "1920x1080"},
+		{name: "invalid", arch: apis.OS_ARCH_X86_64, vga: "qxl", resolution: "1920*1080", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s := newTestStartGuest()
+			s.Desc.Vga = c.vga
+			s.Desc.DisplayResolution = c.resolution
+			data := jsonutils.NewDict()
+			data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+			host := &fakeHostCapabilities{arch: c.arch, kvm: true, intel: true}
+			script, err := s.generateStartScript(data, host)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			if err != nil {
+				t.Fatalf("generateStartScript: %v", err)
+			}
+			if len(c.want) > 0 {
+				assert.Contains(t, script, c.want)
+			} else {
+				assert.NotContains(t, script, "xres=")
+			}
+		})
+	}
+}
+
+func TestSKVMGuestInstance_getStablePciAddrs(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	defer func() { procDir = savedProcDir }()
+	procDir = path.Join(tmpDir, "proc")
+
+	s := newTestGuestWithServersPath(tmpDir, map[string]string{"stable_pci_address": "true"})
+	s.manager.host = &fakeArchHost{arch: apis.OS_ARCH_X86_64}
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	s.Desc.Disks = []*api.GuestdiskJsonDesc{
+		{DiskId: "disk-b", Driver: qemu.DISK_DRIVER_VIRTIO, Index: 0},
+	}
+	s.Desc.Nics = []*api.GuestnetworkJsonDesc{
+		{Mac: "00:22:00:00:00:02", Ifname: "vnet2", Index: 0},
+	}
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	addrs, err := s.getStablePciAddrs(2)
+	assert.NoError(t, err)
+	assert.Equal(t, qemu.StablePciAddrs{"disk/disk-b": qemu.PCI_SLOT_MAX, "nic/00:22:00:00:00:02": qemu.PCI_SLOT_MAX - 1}, addrs)
+	assert.Equal(t, 2, s.Desc.PciAutoSlots)
+
+	// guest is started, region syncs desc with a disk and nic sorting before existing ones
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.MkdirAll(path.Join(procDir, "1234"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	newDesc := *s.Desc
+	newDesc.SGuestHostDesc = desc.SGuestHostDesc{}
+	newDesc.Disks = []*api.GuestdiskJsonDesc{
+		{DiskId: "disk-a", Driver: qemu.DISK_DRIVER_VIRTIO, Index: 1},
+		s.Desc.Disks[0],
+	}
+	newDesc.Nics = []*api.GuestnetworkJsonDesc{
+		{Mac: "00:22:00:00:00:01", Ifname: "vnet1", Index: 1},
+		s.Desc.Nics[0],
+	}
+	assert.NoError(t, s.SaveDesc(&newDesc))
+
+	// hot-plug takes free slots below running devices, autoSlots stays as started
+	assert.Equal(t, qemu.PCI_SLOT_MAX-2, s.GetDiskAddr(1))
+	assert.Equal(t, qemu.PCI_SLOT_MAX, s.GetDiskAddr(0))
+	assert.Equal(t, qemu.PCI_SLOT_MAX-3, s.getNicAddr(1))
+	assert.Equal(t, qemu.PCI_SLOT_MAX-1, s.getNicAddr(0))
+	addrs, err = s.getStablePciAddrs(10)
+	assert.NoError(t, err)
+	assert.Len(t, addrs, 4)
+	assert.Equal(t, 2, s.Desc.PciAutoSlots)
+
+	// slots are saved with desc
+	s.Desc = nil
+	assert.NoError(t, s.LoadDesc())
+	assert.Equal(t, addrs, qemu.StablePciAddrs(s.Desc.PciSlots))
+}
+
+func TestSKVMGuestInstance_getStablePciAddrsFromRunning(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	defer func() { procDir = savedProcDir }()
+	procDir = path.Join(tmpDir, "proc")
+
+	s := newTestGuestWithServersPath(tmpDir, map[string]string{"stable_pci_address": "true"})
+	s.manager.host = &fakeArchHost{arch: apis.OS_ARCH_X86_64}
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	s.Desc.Disks = []*api.GuestdiskJsonDesc{
+		{DiskId: "disk-a", Driver: qemu.DISK_DRIVER_VIRTIO, Index: 0},
+		{DiskId: "disk-b", Driver: qemu.DISK_DRIVER_VIRTIO, Index: 1},
+	}
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.MkdirAll(path.Join(procDir, "1234"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	// started before slots were saved
+	cmdline := strings.Join([]string{
+		"/usr/bin/qemu-system-x86_64", "-uuid", "uuid-xxxx-xxxx",
+		"-device", "virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x15,iothread=iothread0,id=drive_0",
+	}, "\x00") + "\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	assert.Equal(t, 0x15, s.GetDiskAddr(0))
+	assert.Equal(t, qemu.PCI_SLOT_MAX, s.GetDiskAddr(1))
+}
+
+func TestSKVMGuestInstance_SetCpuThrottle(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	savedThrottle := cgroupCpuThrottle
+	defer func() {
+		procDir = savedProcDir
+		cgroupCpuThrottle = savedThrottle
+	}()
+	procDir = path.Join(tmpDir, "proc")
+	throttled := []int{}
+	cgroupCpuThrottle = func(pid, name string, coreNum, percent int) error {
+		throttled = append(throttled, percent)
+		return nil
+	}
+
+	s := newTestGuestWithServersPath(tmpDir, nil)
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	s.Desc.Cpu = 2
+	assert.Error(t, s.SetCpuThrottle(50))
+
+	// simulate running qemu
+	for _, dir := range []string{s.HomeDir(), path.Join(procDir, "1234")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("MkdirAll: %v", err)
+		}
+	}
+	cmdline := fmt.Sprintf("/usr/bin/qemu-system-x86_64\x00-uuid\x00%s\x00", s.Desc.Uuid)
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	s.cgroupPid = 1234
+	mon := &fakeMonitor{}
+	s.Monitor = mon
+
+	assert.Error(t, s.SetCpuThrottle(101))
+	assert.NoError(t, s.SetCpuThrottle(30))
+	assert.Equal(t, []int{30}, throttled)
+	assert.Empty(t, mon.Commands())
+
+	t.Run("migrating", func(t *testing.T) {
+		s.MigrateTask = &SGuestLiveMigrateTask{}
+		defer func() { s.MigrateTask = nil }()
+		throttled = []int{}
+		assert.NoError(t, s.SetCpuThrottle(50))
+		assert.NoError(t, s.SetCpuThrottle(0))
+		assert.Equal(t, []int{50, 0}, throttled)
+		assert.Equal(t, []string{"migrate-set-parameters cpu-throttle-initial 50"}, mon.Commands())
+	})
+}
@@ -0,0 +1,292 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"yunion.io/x/pkg/errors"
+
+	api "yunion.io/x/onecloud/pkg/apis/compute"
+)
+
+const (
+	// last slot of pci bus
+	PCI_SLOT_MAX = 0x1f
+)
+
+// StablePciAddrs maps device key to pci slot, it is saved with guest so that
+// devices keep their slots across restarts and hot-plugs
+type StablePciAddrs map[string]int
+
+func getStableDiskKey(disk *api.GuestdiskJsonDesc) string {
+	return "disk/" + disk.DiskId
+}
+
+// mac is the stable identity of nic across guest restarts
+func getStableNicKey(nic *api.GuestnetworkJsonDesc) string {
+	return "nic/" + nic.Mac
+}
+
+func (addrs StablePciAddrs) DiskAddr(disk *api.GuestdiskJsonDesc) (int, bool) {
+	addr, ok := addrs[getStableDiskKey(disk)]
+	return addr, ok
+}
+
+func (addrs StablePciAddrs) NicAddr(nic *api.GuestnetworkJsonDesc) (int, bool) {
+	addr, ok := addrs[getStableNicKey(nic)]
+	return addr, ok
+}
+
+func getStablePciKeys(disks []*api.GuestdiskJsonDesc, nics []*api.GuestnetworkJsonDesc) []string {
+	keys := []string{}
+	for _, disk := range disks {
+		if disk.Driver == DISK_DRIVER_VIRTIO {
+			keys = append(keys, getStableDiskKey(disk))
+		}
+	}
+	for _, nic := range nics {
+		keys = append(keys, getStableNicKey(nic))
+	}
+	return keys
+}
+
+// AllocStablePciAddrs keeps slots assigned to virtio disks and nics and allocates free
+// slots to new ones from the top of bus downwards, slots of removed devices are freed.
+// autoSlots slots above builtin devices are left to devices of which qemu picks the
+// lowest free slot, e.g. controllers and isolated devices, see CountAutoPciDevices
+func AllocStablePciAddrs(
+	assigned StablePciAddrs,
+	disks []*api.GuestdiskJsonDesc, nics []*api.GuestnetworkJsonDesc,
+	autoSlots int, isQ35, isVdiSpice bool,
+) (StablePciAddrs, error) {
+	// slots below GetDiskAddr(0) are taken by builtin devices
+	start := GetDiskAddr(0, isVdiSpice) + autoSlots
+	end := PCI_SLOT_MAX
+	if isQ35 {
+		// last slot of q35 is taken by ich9 lpc, sata and smbus
+		end--
+	}
+	keys := getStablePciKeys(disks, nics)
+	if len(keys) > end-start+1 {
+		return nil, errors.Errorf("%d devices don't fit in pci slots 0x%x-0x%x", len(keys), start, end)
+	}
+
+	addrs := StablePciAddrs{}
+	used := map[int]bool{}
+	newKeys := []string{}
+	for _, key := range keys {
+		addr, ok := assigned[key]
+		if !ok || addr < start || addr > end || used[addr] {
+			newKeys = append(newKeys, key)
+			continue
+		}
+		addrs[key] = addr
+		used[addr] = true
+	}
+	addr := end
+	for _, key := range newKeys {
+		for used[addr] {
+			addr--
+		}
+		addrs[key] = addr
+		used[addr] = true
+	}
+	return addrs, nil
+}
+
+var pciAddrReg = regexp.MustCompile(`^0x([0-9a-fA-F]{1,2})`)
+
+// GetStablePciAddrsFromDevices picks slots of virtio disks and nics from -device options
+// guest was started with, devices on pci-bridge are skipped
+func GetStablePciAddrsFromDevices(devices []string, disks []*api.GuestdiskJsonDesc, nics []*api.GuestnetworkJsonDesc) StablePciAddrs {
+	keys := map[string]string{}
+	for _, disk := range disks {
+		if disk.Driver == DISK_DRIVER_VIRTIO {
+			keys[fmt.Sprintf("drive_%d", disk.Index)] = getStableDiskKey(disk)
+		}
+	}
+	for _, nic := range nics {
+		keys[fmt.Sprintf("netdev-%s", nic.Ifname)] = getStableNicKey(nic)
+	}
+	addrs := StablePciAddrs{}
+	for _, dev := range devices {
+		params := map[string]string{}
+		for _, param := range strings.Split(dev, ",") {
+			if kv := strings.SplitN(param, "=", 2); len(kv) == 2 {
+				params[kv[0]] = kv[1]
+			}
+		}
+		key, ok := keys[params["id"]]
+		if !ok || params["bus"] == PCI_BRIDGE_ID {
+			continue
+		}
+		// start script may append helper substitutions to the last param
+		m := pciAddrReg.FindStringSubmatch(params["addr"])
+		if m == nil {
+			continue
+		}
+		addr, _ := strconv.ParseInt(m[1], 16, 32)
+		addrs[key] = int(addr)
+	}
+	return addrs
+}
+
+const (
+	PCI_BUS_PRIMARY = "pci.0"
+	// pci-bridge hangs on the last slot of primary bus
+	PCI_BRIDGE_ID   = "pci.1"
+	PCI_BRIDGE_ADDR = PCI_SLOT_MAX
+	// slot 0 of pci-bridge is taken by its shpc controller
+	PCI_BRIDGE_SLOT_START = 1
+)
+
+// PciPlacement is the bus and slot of a device
+type PciPlacement struct {
+	Bus  string
+	Addr int
+}
+
+// PciBridgePlan places virtio disks and nics of a guest whose devices overflow i440fx primary bus
+type PciBridgePlan struct {
+	disks map[int8]PciPlacement
+	nics  map[string]PciPlacement
+}
+
+func (p *PciBridgePlan) DiskPlacement(disk *api.GuestdiskJsonDesc) (PciPlacement, bool) {
+	if p == nil {
+		return PciPlacement{}, false
+	}
+	placement, ok := p.disks[disk.Index]
+	return placement, ok
+}
+
+func (p *PciBridgePlan) NicPlacement(nic *api.GuestnetworkJsonDesc) (PciPlacement, bool) {
+	if p == nil {
+		return PciPlacement{}, false
+	}
+	placement, ok := p.nics[nic.Ifname]
+	return placement, ok
+}
+
+// BridgeDevice is the pci-bridge device option, empty if bridge is not needed
+func (p *PciBridgePlan) BridgeDevice() string {
+	if p == nil {
+		return ""
+	}
+	return fmt.Sprintf("pci-bridge,id=%s,chassis_nr=1,bus=%s,addr=0x%x", PCI_BRIDGE_ID, PCI_BUS_PRIMARY, PCI_BRIDGE_ADDR)
+}
+
+// CountAutoPciDevices counts pci devices of which qemu picks slot on primary bus
+func CountAutoPciDevices(input *GenerateStartOptionsInput) int {
+	count := 0
+	if !input.DisableUsb {
+		// qemu-xhci
+		count += 1
+	}
+	// scsi controllers
+	hasScsi, hasPvscsi := false, false
+	for _, disk := range input.Disks {
+		hasScsi = hasScsi || disk.Driver == DISK_DRIVER_SCSI
+		hasPvscsi = hasPvscsi || disk.Driver == DISK_DRIVER_PVSCSI
+	}
+	if hasScsi {
+		if input.ScsiControllerCount > 1 {
+			count += input.ScsiControllerCount
+		} else {
+			count++
+		}
+	}
+	if hasPvscsi {
+		count++
+	}
+	if input.IsolatedDevicesParams != nil {
+		count += len(input.IsolatedDevicesParams.Devices)
+	}
+	if len(input.AudioBackend) > 0 && input.AudioBackend != AUDIO_BACKEND_NONE {
+		count++
+	}
+	if input.WatchdogModel == WATCHDOG_MODEL_I6300ESB {
+		count++
+	}
+	if input.EnableRNGRandom {
+		count++
+	}
+	if input.EnableBalloon {
+		count++
+	}
+	if input.EnablePvpanic && isPvpanicPci(input) {
+		count++
+	}
+	return count
+}
+
+// PlanPciBridge decides whether a pci-bridge is needed on i440fx machine, the primary bus has
+// only 32 slots shared by builtin devices, virtio disks, nics, isolated devices and controllers.
+// Once they don't fit, virtio disks and nics fill the primary bus in order and overflow ones
+// are placed on the bridge, nil plan is returned if everything fits on primary bus.
+func PlanPciBridge(input *GenerateStartOptionsInput) (*PciBridgePlan, error) {
+	if input.PCIBus != PCI_BUS_PRIMARY || input.QemuArch == Arch_aarch64 || input.StablePciAddrs != nil {
+		return nil, nil
+	}
+	disks := []*api.GuestdiskJsonDesc{}
+	for _, disk := range input.Disks {
+		if disk.Driver == DISK_DRIVER_VIRTIO {
+			disks = append(disks, disk)
+		}
+	}
+	start := GetDiskAddr(0, input.IsVdiSpice)
+	autoCount := CountAutoPciDevices(input)
+	if start+len(disks)+len(input.Nics)+autoCount <= PCI_SLOT_MAX+1 {
+		return nil, nil
+	}
+
+	plan := &PciBridgePlan{
+		disks: map[int8]PciPlacement{},
+		nics:  map[string]PciPlacement{},
+	}
+	// slots left below the bridge are kept for auto placed devices
+	primaryEnd := PCI_BRIDGE_ADDR - autoCount
+	primaryAddr, bridgeAddr := start, PCI_BRIDGE_SLOT_START
+	place := func(dev string) (PciPlacement, error) {
+		if primaryAddr < primaryEnd {
+			primaryAddr++
+			return PciPlacement{Bus: PCI_BUS_PRIMARY, Addr: primaryAddr - 1}, nil
+		}
+		if bridgeAddr > PCI_SLOT_MAX {
+			return PciPlacement{}, errors.Errorf("no free pci slot for %s on pci-bridge", dev)
+		}
+		bridgeAddr++
+		return PciPlacement{Bus: PCI_BRIDGE_ID, Addr: bridgeAddr - 1}, nil
+	}
+	for _, disk := range disks {
+		placement, err := place(fmt.Sprintf("disk %d", disk.Index))
+		if err != nil {
+			return nil, err
+		}
+		plan.disks[disk.Index] = placement
+	}
+	for _, nic := range input.Nics {
+		placement, err := place(fmt.Sprintf("nic %s", nic.Ifname))
+		if err != nil {
+			return nil, err
+		}
+		plan.nics[nic.Ifname] = placement
+	}
+	return plan, nil
+}
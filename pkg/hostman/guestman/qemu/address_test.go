@@ -0,0 +1,201 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package qemu
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	api "yunion.io/x/onecloud/pkg/apis/compute"
+)
+
+func TestAllocStablePciAddrs(t *testing.T) {
+	assert := assert.New(t)
+
+	disks := []*api.GuestdiskJsonDesc{
+		{DiskId: "8c6d3d46-3b7c-4a5c-8e35-0d7f3b0dbe01", Driver: DISK_DRIVER_VIRTIO, Index: 0},
+		{DiskId: "1f0b7c2e-92a4-4f55-9d0e-6a3c2f6a7b02", Driver: DISK_DRIVER_VIRTIO, Index: 1},
+		{DiskId: "c3a1e9b0-5d7e-4c1f-a2b3-9e8d7c6b5a03", Driver: DISK_DRIVER_SCSI, Index: 2},
+	}
+	nics := []*api.GuestnetworkJsonDesc{
+		{Mac: "00:22:64:3a:11:01", Ifname: "vnet1", Index: 0},
+	}
+	autoSlots := 3
+	addrs, err := AllocStablePciAddrs(nil, disks, nics, autoSlots, false, false)
+	assert.NoError(err)
+	// new devices take slots from the top of bus
+	assert.Equal(StablePciAddrs{
+		"disk/" + disks[0].DiskId: PCI_SLOT_MAX,
+		"disk/" + disks[1].DiskId: PCI_SLOT_MAX - 1,
+		"nic/" + nics[0].Mac:      PCI_SLOT_MAX - 2,
+	}, addrs)
+	// scsi disk is not on pci bus
+	_, ok := addrs.DiskAddr(disks[2])
+	assert.False(ok)
+
+	// new disk sorting before existing devices doesn't move them
+	newDisk := &api.GuestdiskJsonDesc{DiskId: "00000000-0000-0000-0000-000000000000", Driver: DISK_DRIVER_VIRTIO, Index: 3}
+	moreDisks := append([]*api.GuestdiskJsonDesc{newDisk}, disks...)
+	newNic := &api.GuestnetworkJsonDesc{Mac: "00:22:64:3a:11:00", Ifname: "vnet0", Index: 1}
+	moreNics := append([]*api.GuestnetworkJsonDesc{newNic}, nics...)
+	addrs2, err := AllocStablePciAddrs(addrs, moreDisks, moreNics, autoSlots, false, false)
+	assert.NoError(err)
+	for key, addr := range addrs {
+		assert.Equal(addr, addrs2[key], key)
+	}
+	diskAddr, _ := addrs2.DiskAddr(newDisk)
+	nicAddr, _ := addrs2.NicAddr(newNic)
+	assert.Equal([]int{PCI_SLOT_MAX - 3, PCI_SLOT_MAX - 4}, []int{diskAddr, nicAddr})
+
+	// slot of removed disk is freed and reused
+	addrs3, err := AllocStablePciAddrs(addrs2, moreDisks[1:], moreNics, autoSlots, false, false)
+	assert.NoError(err)
+	_, ok = addrs3.DiskAddr(newDisk)
+	assert.False(ok)
+	addrs4, err := AllocStablePciAddrs(addrs3, moreDisks, moreNics, autoSlots, false, false)
+	assert.NoError(err)
+	diskAddr, _ = addrs4.DiskAddr(newDisk)
+	assert.Equal(PCI_SLOT_MAX-3, diskAddr)
+
+	// assigned slot now reserved for qemu placed devices or out of q35 bus moves
+	start := GetDiskAddr(0, false)
+	assigned := StablePciAddrs{"disk/" + disks[0].DiskId: start, "disk/" + disks[1].DiskId: PCI_SLOT_MAX}
+	addrs5, err := AllocStablePciAddrs(assigned, disks, nil, autoSlots, true, false)
+	assert.NoError(err)
+	assert.Equal(StablePciAddrs{
+		"disk/" + disks[0].DiskId: PCI_SLOT_MAX - 1,
+		"disk/" + disks[1].DiskId: PCI_SLOT_MAX - 2,
+	}, addrs5)
+
+	// rendered device follows stable address rather than index
+	opt := newBaseOptions_x86_64()
+	dev := getDiskDeviceOption(opt, disks[0], false, "pci.0", false, addrs, nil, 1)
+	assert.Contains(dev, fmt.Sprintf(",bus=pci.0,addr=0x%x,", PCI_SLOT_MAX))
+	dev = getDiskDeviceOption(opt, disks[0], false, "pci.0", false, nil, nil, 1)
+	assert.Contains(dev, fmt.Sprintf(",bus=pci.0,addr=0x%x,", GetDiskAddr(0, false)))
+
+	// pci bus is exhausted
+	tooMany := []*api.GuestnetworkJsonDesc{}
+	for i := 0; i < PCI_SLOT_MAX-start-autoSlots; i++ {
+		tooMany = append(tooMany, &api.GuestnetworkJsonDesc{Mac: fmt.Sprintf("00:22:64:3a:12:%02x", i)})
+	}
+	_, err = AllocStablePciAddrs(nil, disks, tooMany, autoSlots, false, false)
+	assert.Error(err)
+	_, err = AllocStablePciAddrs(nil, disks[2:], tooMany, autoSlots, false, false)
+	assert.NoError(err)
+}
+
+func TestGetStablePciAddrsFromDevices(t *testing.T) {
+	disks := []*api.GuestdiskJsonDesc{
+		{DiskId: "disk-0", Driver: DISK_DRIVER_VIRTIO, Index: 0},
+		{DiskId: "disk-1", Driver: DISK_DRIVER_VIRTIO, Index: 1},
+		{DiskId: "disk-2", Driver: DISK_DRIVER_SCSI, Index: 2},
+	}
+	nics := []*api.GuestnetworkJsonDesc{
+		{Mac: "00:22:64:3a:11:01", Ifname: "vnet1"},
+		{Mac: "00:22:64:3a:11:02", Ifname: "vnet2"},
+	}
+	devices := []string{
+		"virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x1f,iothread=iothread0,id=drive_0",
+		"virtio-blk-pci,drive=drive_1,bus=pci.1,addr=0x2,iothread=iothread0,id=drive_1",
+		"scsi-hd,drive=drive_2,bus=scsi.0,id=drive_2",
+		"virtio-net-pci,id=netdev-vnet1,netdev=vnet1,mac=00:22:64:3a:11:01,addr=0x1e$(nic_speed 1000)",
+		"virtio-net-pci,id=netdev-vnet2,netdev=vnet2,mac=00:22:64:3a:11:02",
+		"qemu-xhci,id=usb",
+	}
+	assert.Equal(t, StablePciAddrs{
+		"disk/disk-0":           0x1f,
+		"nic/00:22:64:3a:11:01": 0x1e,
+	}, GetStablePciAddrsFromDevices(devices, disks, nics))
+}
+
+func TestPlanPciBridge(t *testing.T) {
+	assert := assert.New(t)
+
+	newInput := func(diskCount, nicCount int) *GenerateStartOptionsInput {
+		input := &GenerateStartOptionsInput{
+			QemuVersion: Version_4_2_0,
+			QemuArch:    Arch_x86_64,
+			UUID:        "uuid-xxxx-xxxx",
+			Mem:         1024,
+			Cpu:         2,
+			Name:        "test-vm",
+			OsName:      OS_NAME_LINUX,
+			HomeDir:     "/opt/cloud/workspace/servers/sid",
+			PidFilePath: "/opt/cloud/workspace/servers/sid/pid",
+			PCIBus:      PCI_BUS_PRIMARY,
+		}
+		for i := 0; i < diskCount; i++ {
+			input.Disks = append(input.Disks, &api.GuestdiskJsonDesc{Driver: DISK_DRIVER_VIRTIO, Index: int8(i), CacheMode: "none"})
+		}
+		for i := 0; i < nicCount; i++ {
+			ifname := fmt.Sprintf("vnet%d", i)
+			input.Nics = append(input.Nics, &api.GuestnetworkJsonDesc{
+				Index:          int8(i),
+				Driver:         "virtio",
+				Ifname:         ifname,
+				Mac:            fmt.Sprintf("00:22:64:3a:13:%02x", i),
+				UpscriptPath:   "/tmp/if-up-" + ifname,
+				DownscriptPath: "/tmp/if-down-" + ifname,
+			})
+		}
+		return input
+	}
+
+	// everything fits on primary bus
+	plan, err := PlanPciBridge(newInput(4, 2))
+	assert.NoError(err)
+	assert.Nil(plan)
+
+	// q35 has pcie root bus
+	q35 := newInput(20, 8)
+	q35.PCIBus = "pcie.0"
+	plan, err = PlanPciBridge(q35)
+	assert.NoError(err)
+	assert.Nil(plan)
+
+	input := newInput(20, 8)
+	plan, err = PlanPciBridge(input)
+	assert.NoError(err)
+	assert.NotNil(plan)
+	// slot below the bridge is left for qemu-xhci
+	for i, disk := range input.Disks {
+		placement, ok := plan.DiskPlacement(disk)
+		assert.True(ok)
+		assert.Equal(PciPlacement{Bus: PCI_BUS_PRIMARY, Addr: GetDiskAddr(i, false)}, placement)
+	}
+	for i, nic := range input.Nics[:3] {
+		placement, _ := plan.NicPlacement(nic)
+		assert.Equal(PciPlacement{Bus: PCI_BUS_PRIMARY, Addr: 0x1b + i}, placement)
+	}
+	for i, nic := range input.Nics[3:] {
+		placement, _ := plan.NicPlacement(nic)
+		assert.Equal(PciPlacement{Bus: PCI_BRIDGE_ID, Addr: PCI_BRIDGE_SLOT_START + i}, placement)
+	}
+
+	cmd, err := GenerateStartOptions(input)
+	assert.NoError(err)
+	assert.Contains(cmd, "-device pci-bridge,id=pci.1,chassis_nr=1,bus=pci.0,addr=0x1f ")
+	assert.Contains(cmd, "-device virtio-blk-pci,drive=drive_19,bus=pci.0,addr=0x1a,")
+	assert.Contains(cmd, "-device virtio-net-pci,id=netdev-vnet2,netdev=vnet2,mac=00:22:64:3a:13:02,bus=pci.0,addr=0x1d")
+	assert.Contains(cmd, "-device virtio-net-pci,id=netdev-vnet3,netdev=vnet3,mac=00:22:64:3a:13:03,bus=pci.1,addr=0x1")
+	assert.Contains(cmd, "-device virtio-net-pci,id=netdev-vnet7,netdev=vnet7,mac=00:22:64:3a:13:07,bus=pci.1,addr=0x5")
+
+	// pci-bridge is exhausted as well
+	_, err = PlanPciBridge(newInput(20, 40))
+	assert.Error(err)
+}
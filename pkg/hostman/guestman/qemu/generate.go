@@ -16,6 +16,7 @@ package qemu
 
 import (
 	"fmt"
+	"regexp"
 	"strings"
 
 	"yunion.io/x/pkg/errors"
@@ -24,6 +25,7 @@ import (
 	api "yunion.io/x/onecloud/pkg/apis/compute"
 	"yunion.io/x/onecloud/pkg/hostman/isolated_device"
 	"yunion.io/x/onecloud/pkg/util/fileutils2"
+	"yunion.io/x/onecloud/pkg/util/version"
 )
 
 type Monitor struct {
@@ -43,41 +45,74 @@ type GenerateStartOptionsInput struct {
 	Mem                   uint64
 	Cpu                   uint
 	Name                  string
+	ProcessName           string
 	OsName                string
 	HugepagesEnabled      bool
 	EnableMemfd           bool
+	OvercommitMemLock     bool
+	OvercommitCpuPm       bool
+	RealtimeMode          bool
+	NumaNodes             []NumaNode
+	GlobalProperties      []GlobalProperty
+	AcpiTables            []string
+	SmbiosOemStrings      []string
+	Hostname              string
+	HostnameChannel       string
+	StablePciAddrs        StablePciAddrs
+	AudioBackend          string
+	WatchdogModel         string
+	WatchdogAction        string
+	ScsiController        string
+	ScsiControllerCount   int
 	IsQ35                 bool
 	BootOrder             string
+	BootMenu              bool
+	BootMenuSplashTime    uint
+	BootSplash            string
+	BootStrict            bool
 	CdromPath             string
 	Nics                  []*api.GuestnetworkJsonDesc
 	OVNIntegrationBridge  string
 	Disks                 []*api.GuestdiskJsonDesc
 	Devices               []string
 	Machine               string
+	DumpGuestCore         bool
+	DisableMemMerge       bool
 	BIOS                  string
 	OVMFPath              string
+	VNCListen             string
+	DisableUsb            bool
 	VNCPort               uint
 	VNCPassword           bool
 	IsolatedDevicesParams *isolated_device.QemuParams
 	EnableLog             bool
 	LogPath               string
+	LogItem               string
+	Trace                 *TraceOption
 	HMPMonitor            *Monitor
 	QMPMonitor            *Monitor
 	IsVdiSpice            bool
 	SpicePort             uint
+	SpiceTuning           *SpiceTuning
 	PCIBus                string
 	VGA                   string
 	PidFilePath           string
 	HomeDir               string
 	ExtraOptions          []string
 	EnableRNGRandom       bool
+	EnableBalloon         bool
 	EnableSerialDevice    bool
+	HostCharDevices       []HostCharDevice
 	NeedMigrate           bool
 	LiveMigratePort       uint
 	LiveMigrateUseTLS     bool
+	DeferIncoming         bool
 	IsSlave               bool
 	IsMaster              bool
 	EnablePvpanic         bool
+	NoReboot              bool
+	NoShutdown            bool
+	RunAsUser             string
 
 	EncryptKeyPath string
 }
@@ -105,7 +140,12 @@ func GenerateStartOptions(
 	opts = append(opts, drvOpt.FreezeCPU(), cpuOpt)
 
 	if input.EnableLog {
-		opts = append(opts, drvOpt.Log(input.EnableLog, input.LogPath))
+		opts = append(opts,
+			drvOpt.MsgTimestamp(input.EnableLog),
+			drvOpt.Log(input.EnableLog, input.LogPath, input.LogItem))
+	}
+	if input.Trace != nil {
+		opts = append(opts, drvOpt.Trace(input.Trace))
 	}
 
 	// TODO hmp - -
@@ -121,16 +161,57 @@ func GenerateStartOptions(
 		drvOpt.Nodefconfig(),
 		drvOpt.NoKVMPitReinjection(),
 		drvOpt.Global(),
-		drvOpt.Machine(input.Machine, accel),
+		drvOpt.Machine(input.Machine, accel, input.DumpGuestCore, !input.DisableMemMerge),
 		drvOpt.KeyboardLayoutLanguage("en-us"),
 		drvOpt.SMP(input.Cpu),
-		drvOpt.Name(input.Name),
+		drvOpt.Name(input.Name, input.ProcessName),
 		drvOpt.UUID(input.EnableUUID, input.UUID),
 		drvOpt.Memory(input.Mem),
 	)
 
+	for _, prop := range input.GlobalProperties {
+		if err := validateGlobalProperty(prop); err != nil {
+			return "", errors.Wrap(err, "validate global property")
+		}
+		opts = append(opts, drvOpt.GlobalProperty(prop))
+	}
+
+	if len(input.AcpiTables) > 0 {
+		acpiOpts, err := getAcpiTableOptions(drvOpt, input.Machine, input.AcpiTables)
+		if err != nil {
+			return "", errors.Wrap(err, "get acpi table options")
+		}
+		opts = append(opts, acpiOpts...)
+	}
+
+	for _, oemStr := range input.SmbiosOemStrings {
+		opts = append(opts, drvOpt.SmbiosOemString(oemStr))
+	}
+
+	if len(input.HostnameChannel) > 0 {
+		hostnameOpt, err := getHostnameOption(drvOpt, input.HostnameChannel, input.Hostname)
+		if err != nil {
+			return "", errors.Wrap(err, "get hostname option")
+		}
+		opts = append(opts, hostnameOpt)
+	}
+
+	if input.NoReboot {
+		opts = append(opts, drvOpt.NoReboot())
+	}
+
+	if input.NoShutdown {
+		opts = append(opts, drvOpt.NoShutdown())
+	}
+
+	if len(input.RunAsUser) > 0 {
+		opts = append(opts, drvOpt.RunAs(input.RunAsUser))
+	}
+
 	var memDev string
-	if input.HugepagesEnabled {
+	if len(input.NumaNodes) > 0 {
+		memDev = strings.Join(getNumaMemOptions(drvOpt, input), " ")
+	} else if input.HugepagesEnabled {
 		memDev = drvOpt.MemPath(input.Mem, fmt.Sprintf("/dev/hugepages/%s", input.UUID))
 	} else if input.EnableMemfd {
 		memDev = drvOpt.MemFd(input.Mem)
@@ -138,13 +219,30 @@ func GenerateStartOptions(
 		memDev = drvOpt.MemDev(input.Mem)
 	}
 	opts = append(opts, memDev)
+	if input.RealtimeMode {
+		opts = append(opts, getRealtimeOptions(drvOpt)...)
+	} else if overcommit := drvOpt.Overcommit(input.OvercommitMemLock, input.OvercommitCpuPm); len(overcommit) > 0 {
+		opts = append(opts, overcommit)
+	}
 
 	// bootOrder
-	enableMenu := false
-	if input.CdromPath != "" {
-		enableMenu = true
+	bootOpt := BootOption{
+		Order:      input.BootOrder,
+		EnableMenu: input.CdromPath != "" || input.BootMenu,
+		SplashTime: input.BootMenuSplashTime,
+		Splash:     input.BootSplash,
+		Strict:     input.BootStrict,
+	}
+	if err := validateBootOption(bootOpt); err != nil {
+		return "", errors.Wrap(err, "validate boot option")
+	}
+	if hasDeviceBootIndex(input.Devices) {
+		// order and per-device bootindex must not be mixed, bootindex wins
+		bootOpt.Order = ""
+	}
+	if bootStr := drvOpt.Boot(bootOpt); len(bootStr) > 0 {
+		opts = append(opts, bootStr)
 	}
-	opts = append(opts, drvOpt.Boot(input.BootOrder, enableMenu))
 
 	// bios
 	if input.BIOS == BIOS_UEFI {
@@ -160,7 +258,9 @@ func GenerateStartOptions(
 
 	opts = append(opts, drvOpt.Device("virtio-serial"))
 	// enable USB emulation
-	opts = append(opts, drvOpt.USB())
+	if !input.DisableUsb {
+		opts = append(opts, drvOpt.USB())
+	}
 	for _, device := range input.Devices {
 		opts = append(opts, drvOpt.Device(device))
 	}
@@ -171,7 +271,10 @@ func GenerateStartOptions(
 
 	// vdi spice
 	if input.IsVdiSpice {
-		opts = append(opts, drvOpt.VdiSpice(input.SpicePort, input.PCIBus)...)
+		if err := input.SpiceTuning.Validate(); err != nil {
+			return "", errors.Wrap(err, "validate spice tuning")
+		}
+		opts = append(opts, drvOpt.VdiSpice(input.SpicePort, input.PCIBus, input.SpiceTuning)...)
 	} else {
 		if input.IsolatedDevicesParams != nil && len(input.IsolatedDevicesParams.Vga) > 0 {
 			opts = append(opts, drvOpt.VGA("", input.IsolatedDevicesParams.Vga))
@@ -180,7 +283,7 @@ func GenerateStartOptions(
 				opts = append(opts, drvOpt.VGA(input.VGA, ""))
 			}
 		}
-		opts = append(opts, drvOpt.VNC(input.VNCPort, input.VNCPassword))
+		opts = append(opts, drvOpt.VNC(input.VNCListen, input.VNCPort, input.VNCPassword))
 	}
 
 	// iothread object
@@ -193,21 +296,56 @@ func GenerateStartOptions(
 	}
 
 	// genereate disk options
-	opts = append(opts, generateDisksOptions(drvOpt, input.Disks, input.PCIBus, input.IsVdiSpice, isEncrypt)...)
+	stableAddrs := input.StablePciAddrs
+	bridgePlan, err := PlanPciBridge(input)
+	if err != nil {
+		return "", errors.Wrap(err, "PlanPciBridge")
+	}
+	if bridge := bridgePlan.BridgeDevice(); len(bridge) > 0 {
+		opts = append(opts, drvOpt.Device(bridge))
+	}
+	scsiControllers, err := getScsiControllers(drvOpt, input.ScsiController, input.ScsiControllerCount)
+	if err != nil {
+		return "", errors.Wrap(err, "getScsiControllers")
+	}
+	opts = append(opts, generateDisksOptions(drvOpt, input.Disks, input.PCIBus, input.IsVdiSpice, isEncrypt, stableAddrs, bridgePlan, scsiControllers)...)
 
 	// cdrom
 	opts = append(opts, drvOpt.Cdrom(input.CdromPath, input.OsName, input.IsQ35, len(input.Disks))...)
 
 	// genereate nics
-	nicOpts, err := generateNicOptions(drvOpt, input)
+	nicOpts, err := generateNicOptions(drvOpt, input, stableAddrs, bridgePlan)
 	if err != nil {
 		return "", errors.Wrap(err, "generateNicOptions")
 	}
 	opts = append(opts, nicOpts...)
 
+	// audio
+	if len(input.AudioBackend) > 0 && input.AudioBackend != AUDIO_BACKEND_NONE {
+		if !utils.IsInStringArray(input.AudioBackend, AudioBackends) {
+			return "", errors.Errorf("unsupported audio backend %q", input.AudioBackend)
+		}
+		if input.IsVdiSpice {
+			// spice vdi already has its own sound card
+			return "", errors.Errorf("audio backend %s conflicts with spice vdi", input.AudioBackend)
+		}
+		opts = append(opts, drvOpt.Audio(input.AudioBackend)...)
+	}
+
+	// watchdog
+	if len(input.WatchdogModel) > 0 {
+		watchdogOpts, err := getWatchdogOptions(drvOpt, input.WatchdogModel, input.WatchdogAction)
+		if err != nil {
+			return "", errors.Wrap(err, "getWatchdogOptions")
+		}
+		opts = append(opts, watchdogOpts...)
+	}
+
 	// isolated devices
 	// USB 3.0
-	opts = append(opts, drvOpt.Device("qemu-xhci,id=usb"))
+	if !input.DisableUsb {
+		opts = append(opts, drvOpt.Device("qemu-xhci,id=usb"))
+	}
 	if input.IsolatedDevicesParams != nil {
 		for _, each := range input.IsolatedDevicesParams.Devices {
 			opts = append(opts, each)
@@ -230,20 +368,266 @@ func GenerateStartOptions(
 		opts = append(opts, getRNGRandomOptions(drvOpt)...)
 	}
 
+	// memory balloon
+	if input.EnableBalloon {
+		opts = append(opts, drvOpt.Device("virtio-balloon-pci,id="+BALLOON_DEVICE_ID))
+	}
+
 	// serial device
 	if input.EnableSerialDevice {
 		opts = append(opts, drvOpt.SerialDevice()...)
 	}
 
+	// host serial and parallel ports
+	if len(input.HostCharDevices) > 0 {
+		charDevOpts, err := getHostCharDeviceOptions(drvOpt, input.HostCharDevices, input.EnableSerialDevice)
+		if err != nil {
+			return "", errors.Wrap(err, "get host char device options")
+		}
+		opts = append(opts, charDevOpts...)
+	}
+
 	// migrate options
 	opts = append(opts, getMigrateOptions(drvOpt, input)...)
 
 	// pvpanic device
-	opts = append(opts, drvOpt.PvpanicDevice())
+	if input.EnablePvpanic {
+		opts = append(opts, getPvpanicOption(drvOpt, input))
+	}
 
 	return strings.Join(opts, " "), nil
 }
 
+// getRealtimeOptions composes options of latency-deterministic guest:
+// mlock guest memory, keep idle vcpus on host cpus and drop hpet timer
+func getRealtimeOptions(drvOpt QemuOptions) []string {
+	opts := []string{drvOpt.Overcommit(true, true)}
+	if noHpet := drvOpt.NoHpet(); len(noHpet) > 0 {
+		opts = append(opts, noHpet)
+	}
+	return opts
+}
+
+// NumaNode is a guest numa node with memory bound to host numa node
+type NumaNode struct {
+	// vcpu index range, e.g. 0-3
+	Cpus     string
+	MemMB    uint64
+	HostNode int
+}
+
+// getNumaMemOptions splits guest memory into backends bound to host nodes,
+// hotpluggable vcpus go to the last node as qemu requires all of them assigned
+func getNumaMemOptions(drvOpt QemuOptions, input *GenerateStartOptionsInput) []string {
+	opts := []string{}
+	for i, node := range input.NumaNodes {
+		id := fmt.Sprintf("mem%d", i)
+		var backend string
+		if input.HugepagesEnabled {
+			backend = fmt.Sprintf("memory-backend-file,id=%s,size=%dM,mem-path=/dev/hugepages/%s,share=on,prealloc=on", id, node.MemMB, input.UUID)
+		} else if input.EnableMemfd {
+			backend = fmt.Sprintf("memory-backend-memfd,id=%s,size=%dM,share=on,prealloc=on", id, node.MemMB)
+		} else {
+			backend = fmt.Sprintf("memory-backend-ram,id=%s,size=%dM", id, node.MemMB)
+		}
+		opts = append(opts, fmt.Sprintf("-object %s,host-nodes=%d,policy=bind", backend, node.HostNode))
+		cpus := "cpus=" + node.Cpus
+		if i == len(input.NumaNodes)-1 && input.Cpu < drvOpt.MaxCpus() {
+			cpus += fmt.Sprintf(",cpus=%d-%d", input.Cpu, drvOpt.MaxCpus()-1)
+		}
+		opts = append(opts, fmt.Sprintf("-numa node,nodeid=%d,%s,memdev=%s", i, cpus, id))
+	}
+	return opts
+}
+
+// watchdog action defaults to reset, ib700 is an isa device only available on x86
+func getWatchdogOptions(drvOpt QemuOptions, model, action string) ([]string, error) {
+	if !utils.IsInStringArray(model, WatchdogModels) {
+		return nil, errors.Errorf("unsupported watchdog model %q", model)
+	}
+	if model == WATCHDOG_MODEL_IB700 && drvOpt.IsArm() {
+		return nil, errors.Errorf("watchdog model %s is not supported on arm", model)
+	}
+	if len(action) == 0 {
+		action = WATCHDOG_ACTION_RESET
+	}
+	if !utils.IsInStringArray(action, WatchdogActions) {
+		return nil, errors.Errorf("unsupported watchdog action %q", action)
+	}
+	return drvOpt.Watchdog(model, action), nil
+}
+
+// isPvpanicPci tells whether pvpanic is a pci device, pvpanic-pci suits
+// q35 and arm virt machines while isa pvpanic is kept for pc and qemu
+// older than 6.0, on which arm guests have no pvpanic
+func isPvpanicPci(input *GenerateStartOptionsInput) bool {
+	if version.LT(string(input.QemuVersion), "6.0") {
+		return false
+	}
+	return input.QemuArch == Arch_aarch64 || input.Machine == api.VM_MACHINE_TYPE_Q35
+}
+
+func getPvpanicOption(drvOpt QemuOptions, input *GenerateStartOptionsInput) string {
+	if isPvpanicPci(input) {
+		return drvOpt.PvpanicPciDevice()
+	}
+	return drvOpt.PvpanicDevice()
+}
+
+var hostnameLabelReg = regexp.MustCompile(`^[a-zA-Z0-9]([a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?$`)
+
+// validateHostname checks hostname or fqdn is made of rfc 1123 labels,
+// which also keeps it free of characters special to qemu and shell
+func validateHostname(hostname string) error {
+	if len(hostname) == 0 || len(hostname) > 253 {
+		return errors.Errorf("invalid hostname %q, length must be in [1, 253]", hostname)
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if !hostnameLabelReg.MatchString(label) {
+			return errors.Errorf("invalid hostname %q", hostname)
+		}
+	}
+	return nil
+}
+
+// getHostnameOption passes hostname of guest through smbios or fw_cfg
+// for guest images setting hostname without cloud-init
+func getHostnameOption(drvOpt QemuOptions, channel, hostname string) (string, error) {
+	if err := validateHostname(hostname); err != nil {
+		return "", err
+	}
+	switch channel {
+	case HOSTNAME_CHANNEL_SMBIOS:
+		return drvOpt.SmbiosSystemSku(hostname), nil
+	case HOSTNAME_CHANNEL_FW_CFG:
+		return drvOpt.FwCfgString(FW_CFG_HOSTNAME, hostname), nil
+	}
+	return "", errors.Errorf("unsupported hostname channel %q", channel)
+}
+
+// host serial and parallel ports are isa devices only available on x86, they
+// take isa ports following the console serial
+func getHostCharDeviceOptions(drvOpt QemuOptions, devs []HostCharDevice, consoleSerial bool) ([]string, error) {
+	if drvOpt.IsArm() {
+		return nil, errors.Errorf("host serial and parallel passthrough is not supported on arm")
+	}
+	serialMax := MAX_ISA_SERIAL_COUNT
+	if consoleSerial {
+		serialMax -= 1
+	}
+	opts := []string{}
+	serials, parallels := 0, 0
+	for _, dev := range devs {
+		if err := ValidateSafePath(dev.Path); err != nil {
+			return nil, errors.Wrapf(err, "host %s device", dev.Type)
+		}
+		var id, model string
+		switch dev.Type {
+		case HOST_CHARDEV_SERIAL:
+			if serials >= serialMax {
+				return nil, errors.Errorf("too many host serial devices, at most %d", serialMax)
+			}
+			id, model = fmt.Sprintf("hostserial%d", serials), "isa-serial"
+			serials += 1
+		case HOST_CHARDEV_PARALLEL:
+			if parallels >= MAX_ISA_PARALLEL_COUNT {
+				return nil, errors.Errorf("too many host parallel devices, at most %d", MAX_ISA_PARALLEL_COUNT)
+			}
+			id, model = fmt.Sprintf("hostparallel%d", parallels), "isa-parallel"
+			parallels += 1
+		default:
+			return nil, errors.Errorf("unsupported host char device type %q", dev.Type)
+		}
+		opts = append(opts,
+			fmt.Sprintf("%s,path=%s", drvOpt.Chardev(dev.Type, "char"+id, ""), dev.Path),
+			drvOpt.Device(fmt.Sprintf("%s,chardev=char%s,id=%s", model, id, id)),
+		)
+	}
+	return opts, nil
+}
+
+// scsiControllers are the hbas scsi disks hang on
+type scsiControllers struct {
+	model string
+	count int
+}
+
+// GetScsiControllerId keeps id of the first controller as scsi, which existing guests are started with
+func GetScsiControllerId(idx int) string {
+	if idx == 0 {
+		return "scsi"
+	}
+	return fmt.Sprintf("scsi%d", idx)
+}
+
+// GetScsiBus spreads disks across controllers round-robin by disk index,
+// so a disk stays on its controller when other disks are attached or detached
+func GetScsiBus(diskIndex int8, controllerCount int) string {
+	if controllerCount < 1 {
+		controllerCount = 1
+	}
+	return GetScsiControllerId(int(diskIndex)%controllerCount) + ".0"
+}
+
+func (c *scsiControllers) Devices(drvOpt QemuOptions) []string {
+	// FIXME: iothread will make qemu-monitor hang
+	// REF: https://www.mail-archive.com/qemu-devel@nongnu.org/msg592729.html
+	// cmd += " -device virtio-scsi-pci,id=scsi,iothread=iothread0,num_queues=4,vectors=5"
+	opts := []string{}
+	for i := 0; i < c.count; i++ {
+		opts = append(opts, drvOpt.Device(fmt.Sprintf("%s,id=%s", c.model, GetScsiControllerId(i))))
+	}
+	return opts
+}
+
+// scsi controller defaults to a single virtio-scsi, emulated hbas of legacy guests are x86 only
+// and only virtio-scsi could be multiplied to spread disks
+func getScsiControllers(drvOpt QemuOptions, model string, count int) (*scsiControllers, error) {
+	if len(model) == 0 {
+		model = SCSI_CONTROLLER_VIRTIO
+	}
+	if !utils.IsInStringArray(model, ScsiControllers) {
+		return nil, errors.Errorf("unsupported scsi controller %q", model)
+	}
+	if model != SCSI_CONTROLLER_VIRTIO && drvOpt.IsArm() {
+		return nil, errors.Errorf("scsi controller %s is not supported on arm", model)
+	}
+	if count < 0 || count > MAX_SCSI_CONTROLLER_COUNT {
+		return nil, errors.Errorf("invalid scsi controller count %d, at most %d", count, MAX_SCSI_CONTROLLER_COUNT)
+	}
+	if count == 0 {
+		count = 1
+	}
+	if count > 1 && model != SCSI_CONTROLLER_VIRTIO {
+		return nil, errors.Errorf("multiple scsi controllers require %s rather than %s", SCSI_CONTROLLER_VIRTIO, model)
+	}
+	return &scsiControllers{model: model, count: count}, nil
+}
+
+// acpi tables are only injected to x86 pc and q35 machines
+func getAcpiTableOptions(drvOpt QemuOptions, machine string, files []string) ([]string, error) {
+	if drvOpt.IsArm() || (machine != "" && machine != api.VM_MACHINE_TYPE_PC && machine != api.VM_MACHINE_TYPE_Q35) {
+		return nil, errors.Errorf("acpi table is not supported on machine %s", machine)
+	}
+	opts := []string{}
+	for _, file := range files {
+		if strings.Contains(file, ",") {
+			return nil, errors.Errorf("acpi table %q contains comma", file)
+		}
+		opts = append(opts, drvOpt.AcpiTable(file))
+	}
+	return opts, nil
+}
+
+func hasDeviceBootIndex(devices []string) bool {
+	for _, dev := range devices {
+		if strings.Contains(dev, "bootindex=") {
+			return true
+		}
+	}
+	return false
+}
+
 func getMonitorOptions(drvOpt QemuOptions, input *Monitor) []string {
 	if input == nil {
 		return nil
@@ -256,7 +640,7 @@ func getMonitorOptions(drvOpt QemuOptions, input *Monitor) []string {
 	return opts
 }
 
-func generateDisksOptions(drvOpt QemuOptions, disks []*api.GuestdiskJsonDesc, pciBus string, isVdiSpice bool, isEncrypt bool) []string {
+func generateDisksOptions(drvOpt QemuOptions, disks []*api.GuestdiskJsonDesc, pciBus string, isVdiSpice bool, isEncrypt bool, stableAddrs StablePciAddrs, bridgePlan *PciBridgePlan, scsi *scsiControllers) []string {
 	opts := []string{}
 	isArm := drvOpt.IsArm()
 	firstDriver := make(map[string]bool)
@@ -270,10 +654,7 @@ func generateDisksOptions(drvOpt QemuOptions, disks []*api.GuestdiskJsonDesc, pc
 			if _, ok := firstDriver[driver]; !ok {
 				switch driver {
 				case DISK_DRIVER_SCSI:
-					// FIXME: iothread will make qemu-monitor hang
-					// REF: https://www.mail-archive.com/qemu-devel@nongnu.org/msg592729.html
-					// cmd += " -device virtio-scsi-pci,id=scsi,iothread=iothread0,num_queues=4,vectors=5"
-					opts = append(opts, drvOpt.Device("virtio-scsi-pci,id=scsi"))
+					opts = append(opts, scsi.Devices(drvOpt)...)
 				case DISK_DRIVER_PVSCSI:
 					opts = append(opts, drvOpt.Device("pvscsi,id=scsi"))
 				}
@@ -282,7 +663,7 @@ func generateDisksOptions(drvOpt QemuOptions, disks []*api.GuestdiskJsonDesc, pc
 		}
 		opts = append(opts,
 			getDiskDriveOption(drvOpt, disk, isArm, isEncrypt),
-			getDiskDeviceOption(drvOpt, disk, isArm, pciBus, isVdiSpice),
+			getDiskDeviceOption(drvOpt, disk, isArm, pciBus, isVdiSpice, stableAddrs, bridgePlan, scsi.count),
 		)
 	}
 	return opts
@@ -327,7 +708,7 @@ func isLocalStorage(disk *api.GuestdiskJsonDesc) bool {
 	}
 }
 
-func getDiskDeviceOption(optDrv QemuOptions, disk *api.GuestdiskJsonDesc, isArm bool, pciBus string, isVdiSpice bool) string {
+func getDiskDeviceOption(optDrv QemuOptions, disk *api.GuestdiskJsonDesc, isArm bool, pciBus string, isVdiSpice bool, stableAddrs StablePciAddrs, bridgePlan *PciBridgePlan, scsiControllerCount int) string {
 	diskIndex := disk.Index
 	diskDriver := disk.Driver
 	numQueues := disk.NumQueues
@@ -349,10 +730,20 @@ func getDiskDeviceOption(optDrv QemuOptions, disk *api.GuestdiskJsonDesc, isArm
 	opt += fmt.Sprintf(",drive=drive_%d", diskIndex)
 	if diskDriver == DISK_DRIVER_VIRTIO {
 		// virtio-blk
-		opt += fmt.Sprintf(",bus=%s,addr=0x%x", pciBus, GetDiskAddr(int(diskIndex), isVdiSpice))
+		if placement, ok := bridgePlan.DiskPlacement(disk); ok {
+			opt += fmt.Sprintf(",bus=%s,addr=0x%x", placement.Bus, placement.Addr)
+		} else {
+			addr, ok := stableAddrs.DiskAddr(disk)
+			if !ok {
+				addr = GetDiskAddr(int(diskIndex), isVdiSpice)
+			}
+			opt += fmt.Sprintf(",bus=%s,addr=0x%x", pciBus, addr)
+		}
 		// opt += fmt.Sprintf(",num-queues=%d,vectors=%d,iothread=iothread0", numQueues, numQueues+1)
 		opt += ",iothread=iothread0"
-	} else if utils.IsInStringArray(diskDriver, []string{DISK_DRIVER_SCSI, DISK_DRIVER_PVSCSI}) {
+	} else if diskDriver == DISK_DRIVER_SCSI {
+		opt += fmt.Sprintf(",bus=%s", GetScsiBus(diskIndex, scsiControllerCount))
+	} else if diskDriver == DISK_DRIVER_PVSCSI {
 		opt += ",bus=scsi.0"
 	} else if diskDriver == DISK_DRIVER_IDE {
 		opt += fmt.Sprintf(",bus=ide.%d,unit=%d", diskIndex/2, diskIndex%2)
@@ -363,6 +754,14 @@ func getDiskDeviceOption(optDrv QemuOptions, disk *api.GuestdiskJsonDesc, isArm
 	if isSsd {
 		opt += ",rotation_rate=1"
 	}
+	if diskDriver == DISK_DRIVER_VIRTIO || diskDriver == DISK_DRIVER_SCSI || diskDriver == DISK_DRIVER_PVSCSI {
+		if disk.LogicalBlockSize > 0 {
+			opt += fmt.Sprintf(",logical_block_size=%d", disk.LogicalBlockSize)
+		}
+		if disk.PhysicalBlockSize > 0 {
+			opt += fmt.Sprintf(",physical_block_size=%d", disk.PhysicalBlockSize)
+		}
+	}
 	return optDrv.Device(opt)
 
 }
@@ -401,7 +800,7 @@ func GetDiskDeviceModel(driver string) string {
 	}
 }
 
-func generateNicOptions(drvOpt QemuOptions, input *GenerateStartOptionsInput) ([]string, error) {
+func generateNicOptions(drvOpt QemuOptions, input *GenerateStartOptionsInput, stableAddrs StablePciAddrs, bridgePlan *PciBridgePlan) ([]string, error) {
 	opts := []string{}
 	nics := input.Nics
 	/*
@@ -412,6 +811,9 @@ func generateNicOptions(drvOpt QemuOptions, input *GenerateStartOptionsInput) ([
 	 */
 	withAddr := false
 	for idx := range nics {
+		if err := ValidateNicQueueSize(nics[idx]); err != nil {
+			return nil, err
+		}
 		netDevOpt, err := getNicNetdevOption(drvOpt, nics[idx], input.IsKVMSupport)
 		if err != nil {
 			return nil, errors.Wrapf(err, "getNicNetdevOption %v", nics[idx])
@@ -420,7 +822,7 @@ func generateNicOptions(drvOpt QemuOptions, input *GenerateStartOptionsInput) ([
 			netDevOpt,
 			// aarch64 with addr lead to:
 			// virtio_net: probe of virtioN failed with error -22
-			getNicDeviceOption(drvOpt, nics[idx], input, withAddr))
+			getNicDeviceOption(drvOpt, nics[idx], input, withAddr, stableAddrs, bridgePlan))
 	}
 	return opts, nil
 }
@@ -440,28 +842,107 @@ func getNicNetdevOption(drvOpt QemuOptions, nic *api.GuestnetworkJsonDesc, isKVM
 	opt += fmt.Sprintf(",id=%s", nic.Ifname)
 	opt += fmt.Sprintf(",ifname=%s", nic.Ifname)
 	if nic.Driver == "virtio" && isKVMSupport {
-		opt += ",vhost=on,vhostforce=off"
-		if nic.NumQueues > 1 {
-			opt += fmt.Sprintf(",queues=%d", nic.NumQueues)
+		if IsNicVhostEnabled(nic) {
+			opt += ",vhost=on,vhostforce=off"
+		} else {
+			opt += ",vhost=off"
 		}
 	}
+	// tap queues must match virtio-net mq of device, with or without vhost
+	if IsNicMultiQueue(nic) {
+		opt += fmt.Sprintf(",queues=%d", nic.NumQueues)
+	}
 	opt += fmt.Sprintf(",script=%s", nic.UpscriptPath)
 	opt += fmt.Sprintf(",downscript=%s", nic.DownscriptPath)
 	return opt, nil
 }
 
+// IsNicVhostEnabled tells whether tap of nic uses in kernel vhost-net,
+// it's on unless turned off explicitly, e.g. on kernels with buggy vhost-net
+func IsNicVhostEnabled(nic *api.GuestnetworkJsonDesc) bool {
+	return nic.Vhost == nil || *nic.Vhost
+}
+
+const (
+	BALLOON_DEVICE_ID = "balloon0"
+	// qom path of balloon device, guest memory stats are read from it
+	BALLOON_QOM_PATH = "/machine/peripheral/" + BALLOON_DEVICE_ID
+)
+
+const (
+	NIC_QUEUE_SIZE_MIN = 256
+	NIC_QUEUE_SIZE_MAX = 1024
+)
+
+// ValidateNicQueueSize checks virtio-net ring sizes are powers of 2 within range qemu accepts,
+// they are ignored by other nic models
+func ValidateNicQueueSize(nic *api.GuestnetworkJsonDesc) error {
+	for _, q := range []struct {
+		name string
+		size int
+	}{
+		{"rx_queue_size", nic.RxQueueSize},
+		{"tx_queue_size", nic.TxQueueSize},
+	} {
+		if q.size == 0 {
+			continue
+		}
+		if q.size < NIC_QUEUE_SIZE_MIN || q.size > NIC_QUEUE_SIZE_MAX || q.size&(q.size-1) != 0 {
+			return errors.Errorf("nic %s invalid %s %d, must be power of 2 in [%d, %d]",
+				nic.Ifname, q.name, q.size, NIC_QUEUE_SIZE_MIN, NIC_QUEUE_SIZE_MAX)
+		}
+	}
+	return nil
+}
+
+// ValidateDiskBlockSize checks advertised block sizes are 512 or 4096 and
+// physical one is not smaller than logical one
+func ValidateDiskBlockSize(disk *api.GuestdiskJsonDesc) error {
+	for _, b := range []struct {
+		name string
+		size int
+	}{
+		{"logical_block_size", disk.LogicalBlockSize},
+		{"physical_block_size", disk.PhysicalBlockSize},
+	} {
+		if b.size != 0 && b.size != 512 && b.size != 4096 {
+			return errors.Errorf("disk %d invalid %s %d, must be 512 or 4096", disk.Index, b.name, b.size)
+		}
+	}
+	logical := disk.LogicalBlockSize
+	if logical == 0 {
+		logical = 512
+	}
+	if disk.PhysicalBlockSize != 0 && disk.PhysicalBlockSize < logical {
+		return errors.Errorf("disk %d physical_block_size %d less than logical_block_size %d",
+			disk.Index, disk.PhysicalBlockSize, logical)
+	}
+	return nil
+}
+
+// IsNicMultiQueue tells whether qemu opens tap of nic with multiple queues
+func IsNicMultiQueue(nic *api.GuestnetworkJsonDesc) bool {
+	return nic.Driver == "virtio" && nic.NumQueues > 1
+}
+
 func getNicDeviceOption(
 	drvOpt QemuOptions,
 	nic *api.GuestnetworkJsonDesc,
 	input *GenerateStartOptionsInput,
 	withAddr bool,
+	stableAddrs StablePciAddrs,
+	bridgePlan *PciBridgePlan,
 ) string {
 	cmd := fmt.Sprintf("-device %s", GetNicDeviceModel(nic.Driver))
 	cmd += fmt.Sprintf(",id=netdev-%s", nic.Ifname)
 	cmd += fmt.Sprintf(",netdev=%s", nic.Ifname)
 	cmd += fmt.Sprintf(",mac=%s", nic.Mac)
 
-	if withAddr {
+	if placement, ok := bridgePlan.NicPlacement(nic); ok {
+		cmd += fmt.Sprintf(",bus=%s,addr=0x%x", placement.Bus, placement.Addr)
+	} else if addr, ok := stableAddrs.NicAddr(nic); ok && !drvOpt.IsArm() {
+		cmd += fmt.Sprintf(",addr=0x%x", addr)
+	} else if withAddr {
 		disksLen := len(input.Disks)
 		isoDevsLen := 0
 		if input.IsolatedDevicesParams != nil {
@@ -476,6 +957,13 @@ func getNicDeviceOption(
 		if nic.Vectors != nil {
 			cmd += fmt.Sprintf(",vectors=%d", *nic.Vectors)
 		}
+		if nic.RxQueueSize > 0 {
+			cmd += fmt.Sprintf(",rx_queue_size=%d", nic.RxQueueSize)
+		}
+		// qemu keeps tx ring at 256 unless backend is vhost-user
+		if nic.TxQueueSize > 0 {
+			cmd += fmt.Sprintf(",tx_queue_size=%d", nic.TxQueueSize)
+		}
 		cmd += fmt.Sprintf("$(nic_speed %d)", nic.Bw)
 		if nic.Bridge == input.OVNIntegrationBridge {
 			cmd += fmt.Sprintf("$(nic_mtu %q)", nic.Bridge)
@@ -515,7 +1003,7 @@ func getRNGRandomOptions(drvOpt QemuOptions) []string {
 func getMigrateOptions(drvOpt QemuOptions, input *GenerateStartOptionsInput) []string {
 	opts := []string{}
 	if input.NeedMigrate {
-		if input.LiveMigrateUseTLS {
+		if input.LiveMigrateUseTLS || input.DeferIncoming {
 			opts = append(opts, fmt.Sprintf("-incoming defer"))
 		} else {
 			opts = append(opts, fmt.Sprintf("-incoming tcp:0:%d", input.LiveMigratePort))
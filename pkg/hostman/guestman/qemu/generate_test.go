@@ -15,11 +15,14 @@
 package qemu
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"yunion.io/x/log"
+
+	api "yunion.io/x/onecloud/pkg/apis/compute"
 )
 
 func TestGenerateStartCommand(t *testing.T) {
@@ -42,3 +45,267 @@ func TestGenerateStartCommand(t *testing.T) {
 	log.Errorf("cmd: %s", cmd)
 	log.Errorf("error: %s", err)
 }
+
+func TestGenerateStartOptionsVersions(t *testing.T) {
+	newInput := func(ver Version) *GenerateStartOptionsInput {
+		return &GenerateStartOptionsInput{
+			QemuVersion:  ver,
+			QemuArch:     Arch_x86_64,
+			UUID:         "uuid-xxxx-xxxx",
+			Mem:          1024,
+			Cpu:          2,
+			Name:         "test-vm",
+			OsName:       OS_NAME_LINUX,
+			HomeDir:      "/opt/cloud/workspace/servers/sid",
+			PidFilePath:  "/opt/cloud/workspace/servers/sid/pid",
+			RealtimeMode: true,
+		}
+	}
+	cases := []struct {
+		version Version
+		want    []string
+		notWant []string
+	}{
+		{Version_2_12_1, []string{" -realtime mlock=on ", " -no-hpet "}, []string{"-overcommit", "hpet=off"}},
+		{Version_4_2_0, []string{" -overcommit mem-lock=on,cpu-pm=on ", " -no-hpet "}, []string{"-realtime", "hpet=off"}},
+		{Version_8_2_0, []string{" -overcommit mem-lock=on,cpu-pm=on ", " -machine hpet=off "}, []string{"-realtime", "-no-hpet"}},
+	}
+	for _, c := range cases {
+		t.Run(string(c.version), func(t *testing.T) {
+			cmd, err := GenerateStartOptions(newInput(c.version))
+			assert.NoError(t, err)
+			for _, want := range c.want {
+				assert.Contains(t, cmd+" ", want)
+			}
+			for _, notWant := range c.notWant {
+				assert.NotContains(t, cmd, notWant)
+			}
+		})
+	}
+}
+
+func Test_getNicNetdevOption(t *testing.T) {
+	off := false
+	on := true
+	newNic := func(driver string, vhost *bool, queues int) *api.GuestnetworkJsonDesc {
+		return &api.GuestnetworkJsonDesc{
+			Ifname:         "vnet1",
+			Driver:         driver,
+			Vhost:          vhost,
+			NumQueues:      queues,
+			UpscriptPath:   "/tmp/if-up",
+			DownscriptPath: "/tmp/if-down",
+		}
+	}
+	drvOpt := newBaseOptions_x86_64()
+	for _, c := range []struct {
+		name string
+		nic  *api.GuestnetworkJsonDesc
+		kvm  bool
+		want string
+	}{
+		{
+			name: "virtio vhost by default",
+			nic:  newNic("virtio", nil, 0),
+			kvm:  true,
+			want: "-netdev type=tap,id=vnet1,ifname=vnet1,vhost=on,vhostforce=off,script=/tmp/if-up,downscript=/tmp/if-down",
+		},
+		{
+			name: "virtio vhost on",
+			nic:  newNic("virtio", &on, 4),
+			kvm:  true,
+			want: "-netdev type=tap,id=vnet1,ifname=vnet1,vhost=on,vhostforce=off,queues=4,script=/tmp/if-up,downscript=/tmp/if-down",
+		},
+		{
+			name: "virtio vhost off",
+			nic:  newNic("virtio", &off, 4),
+			kvm:  true,
+			want: "-netdev type=tap,id=vnet1,ifname=vnet1,vhost=off,queues=4,script=/tmp/if-up,downscript=/tmp/if-down",
+		},
+		{
+			name: "virtio without kvm",
+			nic:  newNic("virtio", &on, 0),
+			want: "-netdev type=tap,id=vnet1,ifname=vnet1,script=/tmp/if-up,downscript=/tmp/if-down",
+		},
+		{
+			name: "virtio queues without kvm",
+			nic:  newNic("virtio", nil, 4),
+			want: "-netdev type=tap,id=vnet1,ifname=vnet1,queues=4,script=/tmp/if-up,downscript=/tmp/if-down",
+		},
+		{
+			name: "e1000 ignores vhost",
+			nic:  newNic("e1000", &on, 0),
+			kvm:  true,
+			want: "-netdev type=tap,id=vnet1,ifname=vnet1,script=/tmp/if-up,downscript=/tmp/if-down",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt, err := getNicNetdevOption(drvOpt, c.nic, c.kvm)
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, opt)
+		})
+	}
+}
+
+func TestValidateNicQueueSize(t *testing.T) {
+	for _, c := range []struct {
+		rx, tx  int
+		wantErr string
+	}{
+		{0, 0, ""},
+		{256, 256, ""},
+		{1024, 512, ""},
+		{128, 0, "invalid rx_queue_size 128"},
+		{2048, 0, "invalid rx_queue_size 2048"},
+		{0, 300, "invalid tx_queue_size 300"},
+		{0, -256, "invalid tx_queue_size -256"},
+	} {
+		nic := &api.GuestnetworkJsonDesc{Ifname: "vnet1", Driver: "virtio", RxQueueSize: c.rx, TxQueueSize: c.tx}
+		err := ValidateNicQueueSize(nic)
+		if len(c.wantErr) == 0 {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), c.wantErr)
+		}
+	}
+}
+
+func TestValidateDiskBlockSize(t *testing.T) {
+	for _, c := range []struct {
+		logical, physical int
+		wantErr           string
+	}{
+		{0, 0, ""},
+		{512, 512, ""},
+		{512, 4096, ""},
+		{4096, 4096, ""},
+		{0, 4096, ""},
+		{4096, 0, ""},
+		{1024, 0, "invalid logical_block_size 1024"},
+		{0, 8192, "invalid physical_block_size 8192"},
+		{4096, 512, "physical_block_size 512 less than logical_block_size 4096"},
+	} {
+		disk := &api.GuestdiskJsonDesc{Index: 1, LogicalBlockSize: c.logical, PhysicalBlockSize: c.physical}
+		err := ValidateDiskBlockSize(disk)
+		if len(c.wantErr) == 0 {
+			assert.NoError(t, err)
+		} else if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), c.wantErr)
+		}
+	}
+}
+
+func Test_getHostCharDeviceOptions(t *testing.T) {
+	devs := []HostCharDevice{
+		{Type: HOST_CHARDEV_SERIAL, Path: "/dev/ttyS1"},
+		{Type: HOST_CHARDEV_PARALLEL, Path: "/dev/parport0"},
+		{Type: HOST_CHARDEV_SERIAL, Path: "/dev/ttyUSB0"},
+	}
+	opts, err := getHostCharDeviceOptions(newBaseOptions_x86_64(), devs, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"-chardev serial,id=charhostserial0,path=/dev/ttyS1",
+		"-device isa-serial,chardev=charhostserial0,id=hostserial0",
+		"-chardev parallel,id=charhostparallel0,path=/dev/parport0",
+		"-device isa-parallel,chardev=charhostparallel0,id=hostparallel0",
+		"-chardev serial,id=charhostserial1,path=/dev/ttyUSB0",
+		"-device isa-serial,chardev=charhostserial1,id=hostserial1",
+	}, opts)
+
+	serials := []HostCharDevice{}
+	for i := 0; i < MAX_ISA_SERIAL_COUNT; i++ {
+		serials = append(serials, HostCharDevice{Type: HOST_CHARDEV_SERIAL, Path: fmt.Sprintf("/dev/ttyS%d", i)})
+	}
+	_, err = getHostCharDeviceOptions(newBaseOptions_x86_64(), serials, false)
+	assert.NoError(t, err)
+	// console serial takes one isa serial port
+	_, err = getHostCharDeviceOptions(newBaseOptions_x86_64(), serials, true)
+	assert.Error(t, err)
+
+	for _, dev := range []HostCharDevice{
+		{Type: HOST_CHARDEV_SERIAL, Path: "ttyS0"},
+		{Type: HOST_CHARDEV_SERIAL, Path: "/dev/ttyS0,logfile=/tmp/x"},
+		{Type: HOST_CHARDEV_SERIAL, Path: "/dev/ttyS0;reboot"},
+		{Type: HOST_CHARDEV_SERIAL, Path: "/dev/ttyS0 -S"},
+		{Type: "usb", Path: "/dev/ttyS0"},
+	} {
+		_, err := getHostCharDeviceOptions(newBaseOptions_x86_64(), []HostCharDevice{dev}, false)
+		assert.Error(t, err, "%#v", dev)
+	}
+	_, err = getHostCharDeviceOptions(newBaseOptions_aarch64(), devs[:1], false)
+	assert.Error(t, err)
+}
+
+func Test_getPvpanicOption(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		arch    Arch
+		version Version
+		machine string
+		want    string
+	}{
+		{"pc", Arch_x86_64, Version_8_2_0, api.VM_MACHINE_TYPE_PC, "-device pvpanic"},
+		{"q35", Arch_x86_64, Version_8_2_0, api.VM_MACHINE_TYPE_Q35, "-device pvpanic-pci"},
+		{"q35 before 6.0", Arch_x86_64, Version_4_2_0, api.VM_MACHINE_TYPE_Q35, "-device pvpanic"},
+		{"arm virt", Arch_aarch64, Version_8_2_0, api.VM_MACHINE_TYPE_ARM_VIRT, "-device pvpanic-pci"},
+		{"arm default machine", Arch_aarch64, Version_8_2_0, "", "-device pvpanic-pci"},
+		{"arm before 6.0", Arch_aarch64, Version_4_2_0, api.VM_MACHINE_TYPE_ARM_VIRT, ""},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var drvOpt QemuOptions = newBaseOptions_x86_64()
+			if c.arch == Arch_aarch64 {
+				drvOpt = newBaseOptions_aarch64()
+			}
+			input := &GenerateStartOptionsInput{QemuArch: c.arch, QemuVersion: c.version, Machine: c.machine, EnablePvpanic: true}
+			assert.Equal(t, c.want, getPvpanicOption(drvOpt, input))
+		})
+	}
+}
+
+func Test_getDiskDeviceOptionBlockSize(t *testing.T) {
+	drvOpt := newBaseOptions_x86_64()
+	for _, c := range []struct {
+		name              string
+		driver            string
+		logical, physical int
+		want              string
+	}{
+		{"virtio default", DISK_DRIVER_VIRTIO, 0, 0, "-device virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x7,iothread=iothread0,id=drive_0"},
+		{"virtio 512", DISK_DRIVER_VIRTIO, 512, 512, "-device virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x7,iothread=iothread0,id=drive_0,logical_block_size=512,physical_block_size=512"},
+		{"virtio 4k", DISK_DRIVER_VIRTIO, 4096, 4096, "-device virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x7,iothread=iothread0,id=drive_0,logical_block_size=4096,physical_block_size=4096"},
+		{"scsi 512", DISK_DRIVER_SCSI, 512, 512, "-device scsi-hd,drive=drive_0,bus=scsi.0,id=drive_0,logical_block_size=512,physical_block_size=512"},
+		{"scsi 4k", DISK_DRIVER_SCSI, 4096, 4096, "-device scsi-hd,drive=drive_0,bus=scsi.0,id=drive_0,logical_block_size=4096,physical_block_size=4096"},
+		{"ide ignored", DISK_DRIVER_IDE, 4096, 4096, "-device ide-hd,drive=drive_0,bus=ide.0,unit=0,id=drive_0"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			disk := &api.GuestdiskJsonDesc{Driver: c.driver, LogicalBlockSize: c.logical, PhysicalBlockSize: c.physical}
+			assert.Equal(t, c.want, getDiskDeviceOption(drvOpt, disk, false, "pci.0", false, nil, nil, 1))
+		})
+	}
+}
+
+func Test_getNicDeviceOptionQueueSize(t *testing.T) {
+	drvOpt := newBaseOptions_x86_64()
+	input := &GenerateStartOptionsInput{OVNIntegrationBridge: "brvpc"}
+	nic := &api.GuestnetworkJsonDesc{
+		Ifname:      "vnet1",
+		Driver:      "virtio",
+		Mac:         "00:22:0a:00:00:01",
+		RxQueueSize: 1024,
+		TxQueueSize: 512,
+	}
+	assert.Equal(t,
+		"-device virtio-net-pci,id=netdev-vnet1,netdev=vnet1,mac=00:22:0a:00:00:01,rx_queue_size=1024,tx_queue_size=512$(nic_speed 0)",
+		getNicDeviceOption(drvOpt, nic, input, false, nil, nil))
+
+	nic.TxQueueSize = 0
+	assert.Equal(t,
+		"-device virtio-net-pci,id=netdev-vnet1,netdev=vnet1,mac=00:22:0a:00:00:01,rx_queue_size=1024$(nic_speed 0)",
+		getNicDeviceOption(drvOpt, nic, input, false, nil, nil))
+
+	// ignored by emulated nics
+	nic.Driver = "e1000"
+	assert.Equal(t,
+		"-device e1000-82545em,id=netdev-vnet1,netdev=vnet1,mac=00:22:0a:00:00:01",
+		getNicDeviceOption(drvOpt, nic, input, false, nil, nil))
+}
@@ -17,10 +17,13 @@ package qemu
 import (
 	"fmt"
 	"path"
+	"regexp"
 	"strings"
 	"sync"
 
 	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+	"yunion.io/x/pkg/utils"
 
 	"yunion.io/x/onecloud/pkg/apis/compute"
 )
@@ -28,6 +31,7 @@ import (
 type Version string
 
 const (
+	Version_8_2_0  Version = "8.2.0"
 	Version_4_2_0  Version = "4.2.0"
 	Version_4_0_1  Version = "4.0.1"
 	Version_2_12_1 Version = "2.12.1"
@@ -58,9 +62,172 @@ const (
 	DISK_DRIVER_IDE    = "ide"
 	DISK_DRIVER_SATA   = "sata"
 
+	NIC_DRIVER_VIRTIO  = "virtio"
+	NIC_DRIVER_E1000   = "e1000"
+	NIC_DRIVER_E1000E  = "e1000e"
+	NIC_DRIVER_VMXNET3 = "vmxnet3"
+
 	BIOS_UEFI = "UEFI"
+
+	// spice vdi brings its own sound card played through spice, so there is
+	// no spice backend here
+	AUDIO_BACKEND_NONE = "none"
+	AUDIO_BACKEND_PA   = "pa"
+	AUDIO_BACKEND_ALSA = "alsa"
+)
+
+const (
+	LOG_ITEM_ALL          = "all"
+	LOG_ITEM_GUEST_ERRORS = "guest_errors"
+)
+
+var AudioBackends = []string{AUDIO_BACKEND_NONE, AUDIO_BACKEND_PA, AUDIO_BACKEND_ALSA}
+
+var (
+	SpiceStreamingVideoModes  = []string{"off", "all", "filter"}
+	SpiceImageCompressions    = []string{"auto_glz", "auto_lz", "quic", "glz", "lz", "off"}
+	SpiceWanCompressions      = []string{"auto", "never", "always"}
+	SpicePlaybackCompressions = []string{"on", "off"}
+)
+
+// SpiceTuning holds optional params of -spice, empty ones are left to spice defaults
+type SpiceTuning struct {
+	StreamingVideo        string
+	ImageCompression      string
+	JpegWanCompression    string
+	ZlibGlzWanCompression string
+	PlaybackCompression   string
+}
+
+type spiceParam struct {
+	key     string
+	value   string
+	choices []string
+}
+
+func (t *SpiceTuning) params() []spiceParam {
+	if t == nil {
+		return nil
+	}
+	return []spiceParam{
+		{"streaming-video", t.StreamingVideo, SpiceStreamingVideoModes},
+		{"image-compression", t.ImageCompression, SpiceImageCompressions},
+		{"jpeg-wan-compression", t.JpegWanCompression, SpiceWanCompressions},
+		{"zlib-glz-wan-compression", t.ZlibGlzWanCompression, SpiceWanCompressions},
+		{"playback-compression", t.PlaybackCompression, SpicePlaybackCompressions},
+	}
+}
+
+func (t *SpiceTuning) Validate() error {
+	errs := []error{}
+	for _, p := range t.params() {
+		if len(p.value) > 0 && !utils.IsInStringArray(p.value, p.choices) {
+			errs = append(errs, errors.Errorf("invalid spice %s %q, choices: %s", p.key, p.value, strings.Join(p.choices, "|")))
+		}
+	}
+	return errors.NewAggregate(errs)
+}
+
+func (t *SpiceTuning) String() string {
+	opt := ""
+	for _, p := range t.params() {
+		if len(p.value) > 0 {
+			opt += fmt.Sprintf(",%s=%s", p.key, p.value)
+		}
+	}
+	return opt
+}
+
+// TraceOption enables qemu trace events by a pattern and/or an events file,
+// trace output goes to File for the simple backend and to qemu log for the log backend
+type TraceOption struct {
+	Enable string
+	Events string
+	File   string
+}
+
+func (t *TraceOption) String() string {
+	params := []string{}
+	if len(t.Enable) > 0 {
+		params = append(params, "enable="+t.Enable)
+	}
+	if len(t.Events) > 0 {
+		params = append(params, "events="+shellQuote(t.Events))
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	if len(t.File) > 0 {
+		params = append(params, "file="+shellQuote(t.File))
+	}
+	return strings.Join(params, ",")
+}
+
+const (
+	WATCHDOG_MODEL_I6300ESB = "i6300esb"
+	// isa device, x86 only
+	WATCHDOG_MODEL_IB700 = "ib700"
+
+	WATCHDOG_ACTION_RESET     = "reset"
+	WATCHDOG_ACTION_SHUTDOWN  = "shutdown"
+	WATCHDOG_ACTION_POWEROFF  = "poweroff"
+	WATCHDOG_ACTION_PAUSE     = "pause"
+	WATCHDOG_ACTION_DEBUG     = "debug"
+	WATCHDOG_ACTION_NONE      = "none"
+	WATCHDOG_ACTION_INJECTNMI = "inject-nmi"
+)
+
+const (
+	SCSI_CONTROLLER_VIRTIO      = "virtio-scsi-pci"
+	SCSI_CONTROLLER_LSI         = "lsi53c895a"
+	SCSI_CONTROLLER_LSI810      = "lsi53c810"
+	SCSI_CONTROLLER_MEGASAS     = "megasas"
+	SCSI_CONTROLLER_MEGASASGEN2 = "megasas-gen2"
+	SCSI_CONTROLLER_MPTSAS      = "mptsas1068"
+)
+
+// each virtio-scsi controller takes a pci slot
+const MAX_SCSI_CONTROLLER_COUNT = 8
+
+// scsi controllers of qemu which disk driver scsi could hang on
+var ScsiControllers = []string{
+	SCSI_CONTROLLER_VIRTIO, SCSI_CONTROLLER_LSI, SCSI_CONTROLLER_LSI810,
+	SCSI_CONTROLLER_MEGASAS, SCSI_CONTROLLER_MEGASASGEN2, SCSI_CONTROLLER_MPTSAS,
+}
+
+var (
+	WatchdogModels  = []string{WATCHDOG_MODEL_I6300ESB, WATCHDOG_MODEL_IB700}
+	WatchdogActions = []string{
+		WATCHDOG_ACTION_RESET, WATCHDOG_ACTION_SHUTDOWN, WATCHDOG_ACTION_POWEROFF,
+		WATCHDOG_ACTION_PAUSE, WATCHDOG_ACTION_DEBUG, WATCHDOG_ACTION_NONE, WATCHDOG_ACTION_INJECTNMI,
+	}
+)
+
+const (
+	HOST_CHARDEV_SERIAL   = "serial"
+	HOST_CHARDEV_PARALLEL = "parallel"
+
+	// isa serial ports COM1-COM4, console serial takes the first one
+	MAX_ISA_SERIAL_COUNT = 4
+	// isa parallel ports LPT1-LPT3
+	MAX_ISA_PARALLEL_COUNT = 3
+)
+
+const (
+	// hostname of guest is passed as sku of smbios type 1
+	HOSTNAME_CHANNEL_SMBIOS = "smbios"
+	// hostname of guest is passed as fw_cfg item FW_CFG_HOSTNAME
+	HOSTNAME_CHANNEL_FW_CFG = "fw_cfg"
+
+	FW_CFG_HOSTNAME = "opt/hostname"
 )
 
+// HostCharDevice is a host serial or parallel port passed through to guest
+type HostCharDevice struct {
+	Type string
+	Path string
+}
+
 type QemuCommand interface {
 	GetVersion() Version
 	GetArch() Arch
@@ -75,29 +242,189 @@ type CPUOption struct {
 	IsCPUAMD           bool
 	EnableNested       bool
 	IsolatedDeviceCPU  string
+	// on or off appended as migratable of x86_64 host passthrough cpu,
+	// empty keeps qemu default
+	HostCPUMigratable string
+	// features subtracted from x86_64 host passthrough cpu, e.g. avx512f
+	HostCPUMaskedFeatures []string
+
+	// named cpu model, e.g. Haswell on x86_64, cortex-a72 on aarch64
+	CPUModel string
+	// extra cpu features, x86_64 like +avx and aarch64 like pmu=on
+	CPUFeatures []string
+}
+
+var (
+	cpuModels_x86_64 = []string{
+		"qemu64", "kvm64", "Penryn", "Nehalem", "Westmere",
+		"SandyBridge", "IvyBridge", "Haswell", "Broadwell",
+		"Skylake-Client", "Skylake-Server", "Cascadelake-Server", "Icelake-Server",
+		"Opteron_G4", "Opteron_G5", "EPYC", "EPYC-Rome", "Dhyana",
+	}
+	cpuModels_aarch64 = []string{
+		"host", "max", "cortex-a53", "cortex-a57", "cortex-a72", "neoverse-n1",
+	}
+
+	cpuFeatureReg_x86_64  = regexp.MustCompile(`^[+-][a-zA-Z0-9_.-]+$`)
+	cpuFeatureReg_aarch64 = regexp.MustCompile(`^[a-zA-Z0-9_-]+=(on|off)$`)
+
+	globalPropertyTokenReg = regexp.MustCompile(`^[a-zA-Z0-9_-]+$`)
+
+	cpuFeatureNameReg = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+	// absolute path without shell metacharacters or commas of qemu options
+	safePathReg = regexp.MustCompile(`^/[a-zA-Z0-9_./@+=:-]+$`)
+)
+
+// ValidateSafePath checks path taken from metadata is absolute and safe to be
+// embedded in start script, which is evaluated by shell
+func ValidateSafePath(p string) error {
+	if !safePathReg.MatchString(p) {
+		return errors.Errorf("path %q should be absolute and consist of letters, digits and _./@+=:-", p)
+	}
+	return nil
+}
+
+// shellQuote single quotes value for eval of start script
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// GlobalProperty sets default value of device property, rendered as -global driver.property=value
+type GlobalProperty struct {
+	Driver   string
+	Property string
+	Value    string
+}
+
+// ParseGlobalProperty parses driver.property=value
+func ParseGlobalProperty(str string) (GlobalProperty, error) {
+	prop := GlobalProperty{}
+	eq := strings.Index(str, "=")
+	dot := strings.Index(str, ".")
+	if eq < 0 || dot < 0 || dot > eq {
+		return prop, errors.Errorf("global property %q not in form driver.property=value", str)
+	}
+	prop.Driver, prop.Property, prop.Value = str[:dot], str[dot+1:eq], str[eq+1:]
+	if err := validateGlobalProperty(prop); err != nil {
+		return prop, err
+	}
+	return prop, nil
+}
+
+// validateGlobalProperty only accepts simple tokens, so that no extra option could be smuggled in
+func validateGlobalProperty(prop GlobalProperty) error {
+	for _, token := range []string{prop.Driver, prop.Property, prop.Value} {
+		if !globalPropertyTokenReg.MatchString(token) {
+			return errors.Errorf("invalid token %q in global property %s.%s=%s", token, prop.Driver, prop.Property, prop.Value)
+		}
+	}
+	return nil
+}
+
+const (
+	// qemu stores splash-time in a 16 bit fw_cfg entry
+	BOOT_MENU_SPLASH_TIME_MAX = 65535
+)
+
+type BootOption struct {
+	Order      string
+	EnableMenu bool
+	// boot menu timeout in milliseconds
+	SplashTime uint
+	// splash picture shown by bios during boot menu
+	Splash string
+	Strict bool
+}
+
+func validateBootOption(opt BootOption) error {
+	if opt.SplashTime > BOOT_MENU_SPLASH_TIME_MAX {
+		return errors.Errorf("boot menu splash time %dms out of range [0, %d]", opt.SplashTime, BOOT_MENU_SPLASH_TIME_MAX)
+	}
+	if opt.SplashTime > 0 && !opt.EnableMenu {
+		return errors.Errorf("boot menu splash time requires boot menu enabled")
+	}
+	if len(opt.Splash) > 0 {
+		if !opt.EnableMenu {
+			return errors.Errorf("boot splash requires boot menu enabled")
+		}
+		if err := ValidateSafePath(opt.Splash); err != nil {
+			return errors.Wrap(err, "boot splash")
+		}
+	}
+	return nil
+}
+
+func validateCPUModel(arch Arch, model string) error {
+	models := cpuModels_x86_64
+	if arch == Arch_aarch64 {
+		models = cpuModels_aarch64
+	}
+	if !utils.IsInStringArray(model, models) {
+		return errors.Errorf("cpu model %q is not supported on %s", model, arch)
+	}
+	return nil
+}
+
+func validateCPUFeatures(arch Arch, features []string) error {
+	reg := cpuFeatureReg_x86_64
+	if arch == Arch_aarch64 {
+		reg = cpuFeatureReg_aarch64
+	}
+	for _, feature := range features {
+		if !reg.MatchString(feature) {
+			return errors.Errorf("invalid cpu feature %q for %s", feature, arch)
+		}
+	}
+	return nil
+}
+
+func validateCPUFeatureNames(names []string) error {
+	for _, name := range names {
+		if !cpuFeatureNameReg.MatchString(name) {
+			return errors.Errorf("invalid cpu feature name %q", name)
+		}
+	}
+	return nil
 }
 
 type QemuOptions interface {
 	IsArm() bool
 	CPU(opt CPUOption, osName string) (string, string, error)
-	Log(enable bool, qemuLogPath string) string
+	Log(enable bool, qemuLogPath string, logItem string) string
+	MsgTimestamp(enable bool) string
+	Trace(opt *TraceOption) string
 	RTC() string
 	FreezeCPU() string
 	Daemonize() string
+	NoReboot() string
+	NoShutdown() string
+	RunAs(user string) string
 	Nodefaults() string
 	Nodefconfig() string
 	NoKVMPitReinjection() string
 	Global() string
-	Machine(machineType string, accel string) string
+	GlobalProperty(prop GlobalProperty) string
+	AcpiTable(file string) string
+	SmbiosOemString(value string) string
+	SmbiosSystemSku(sku string) string
+	FwCfgString(name, value string) string
+	Audio(backend string) []string
+	Watchdog(model, action string) []string
+	Machine(machineType string, accel string, dumpGuestCore, memMerge bool) string
 	KeyboardLayoutLanguage(lang string) string
 	SMP(cpus uint) string
-	Name(name string) string
+	// MaxCpus is count of vcpus including hotpluggable ones
+	MaxCpus() uint
+	Name(name string, process string) string
 	UUID(enable bool, uuid string) string
 	Memory(sizeMB uint64) string
 	MemPath(sizeMB uint64, p string) string
 	MemDev(sizeMB uint64) string
 	MemFd(sizeMB uint64) string
-	Boot(order string, enableMenu bool) string
+	Overcommit(memLock, cpuPm bool) string
+	NoHpet() string
+	Boot(opt BootOption) string
 	BIOS(file string) string
 	Device(devStr string) string
 	Drive(driveStr string) string
@@ -108,13 +435,14 @@ type QemuOptions interface {
 	Object(typeName string, props map[string]string) string
 	Pidfile(file string) string
 	USB() string
-	VdiSpice(spicePort uint, pciBus string) []string
-	VNC(port uint, usePasswd bool) string
+	VdiSpice(spicePort uint, pciBus string, tuning *SpiceTuning) []string
+	VNC(listen string, port uint, usePasswd bool) string
 	VGA(vType string, alterOpt string) string
 	Cdrom(cdromPath string, osName string, isQ35 bool, disksLen int) []string
 	SerialDevice() []string
 	QGA(homeDir string) []string
 	PvpanicDevice() string
+	PvpanicPciDevice() string
 }
 
 var (
@@ -192,11 +520,32 @@ func (o baseOptions) IsArm() bool {
 	return o.arch == Arch_aarch64
 }
 
-func (o baseOptions) Log(enable bool, qemuLogPath string) string {
+func (o baseOptions) Log(enable bool, qemuLogPath string, logItem string) string {
+	if !enable {
+		return ""
+	}
+	if logItem == "" {
+		logItem = LOG_ITEM_ALL
+	}
+	return fmt.Sprintf("-D %s -d %s", qemuLogPath, logItem)
+}
+
+func (o baseOptions) MsgTimestamp(enable bool) string {
 	if !enable {
 		return ""
 	}
-	return fmt.Sprintf("-D %s -d all", qemuLogPath)
+	return "-msg timestamp=on"
+}
+
+func (o baseOptions) Trace(opt *TraceOption) string {
+	if opt == nil {
+		return ""
+	}
+	params := opt.String()
+	if len(params) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("-trace %s", params)
 }
 
 func (o baseOptions) RTC() string {
@@ -207,6 +556,18 @@ func (o baseOptions) Daemonize() string {
 	return "-daemonize"
 }
 
+func (o baseOptions) NoReboot() string {
+	return "-no-reboot"
+}
+
+func (o baseOptions) NoShutdown() string {
+	return "-no-shutdown"
+}
+
+func (o baseOptions) RunAs(user string) string {
+	return fmt.Sprintf("-runas %s", user)
+}
+
 func (o baseOptions) FreezeCPU() string {
 	return "-S"
 }
@@ -227,12 +588,67 @@ func (o baseOptions) Global() string {
 	return "-global kvm-pit.lost_tick_policy=discard"
 }
 
+func (o baseOptions) GlobalProperty(prop GlobalProperty) string {
+	return fmt.Sprintf("-global %s.%s=%s", prop.Driver, prop.Property, prop.Value)
+}
+
+// AcpiTable renders acpi table file quoted for shell, file should have no comma
+func (o baseOptions) AcpiTable(file string) string {
+	return "-acpitable file=" + shellQuote(file)
+}
+
+// SmbiosOemString renders smbios type 11 oem string,
+// comma is doubled for qemu and whole option is single quoted for shell
+func (o baseOptions) SmbiosOemString(value string) string {
+	value = strings.ReplaceAll(value, ",", ",,")
+	value = strings.ReplaceAll(value, "'", `'\''`)
+	return fmt.Sprintf("-smbios 'type=11,value=%s'", value)
+}
+
+// SmbiosSystemSku renders sku number of smbios type 1 system information,
+// which linux guest reads from /sys/class/dmi/id/product_sku
+func (o baseOptions) SmbiosSystemSku(sku string) string {
+	return fmt.Sprintf("-smbios type=1,sku=%s", sku)
+}
+
+// FwCfgString renders a fw_cfg item of string value, which linux guest reads
+// from /sys/firmware/qemu_fw_cfg/by_name/<name>/raw
+func (o baseOptions) FwCfgString(name, value string) string {
+	return fmt.Sprintf("-fw_cfg name=%s,string=%s", name, value)
+}
+
+// Audio wires an intel hda sound card to host audio backend, none means no audio device
+func (o baseOptions) Audio(backend string) []string {
+	if backend == "" || backend == AUDIO_BACKEND_NONE {
+		return nil
+	}
+	return []string{
+		fmt.Sprintf("-audiodev %s,id=audio0", backend),
+		o.Device("intel-hda,id=sound0"),
+		o.Device("hda-duplex,id=sound0-codec0,bus=sound0.0,cad=0,audiodev=audio0"),
+	}
+}
+
+// Watchdog adds watchdog device and the action taken when it expires
+func (o baseOptions) Watchdog(model, action string) []string {
+	return []string{
+		o.Device(fmt.Sprintf("%s,id=watchdog0", model)),
+		fmt.Sprintf("-watchdog-action %s", action),
+	}
+}
+
 func (o baseOptions) KeyboardLayoutLanguage(lang string) string {
 	return "-k " + lang
 }
 
-func (o baseOptions) Name(name string) string {
-	return fmt.Sprintf(`-name '%s',debug-threads=on`, name)
+// Name set guest name, vcpu threads are named after it with debug-threads,
+// process set the process title, which is truncated to 15 characters by kernel
+func (o baseOptions) Name(name string, process string) string {
+	opt := fmt.Sprintf(`-name '%s'`, name)
+	if len(process) > 0 {
+		opt += fmt.Sprintf(",process=%s", process)
+	}
+	return opt + ",debug-threads=on"
 }
 
 func (o baseOptions) UUID(enable bool, uuid string) string {
@@ -254,16 +670,50 @@ func (o baseOptions) MemDev(sizeMB uint64) string {
 	return fmt.Sprintf("-object memory-backend-ram,id=mem,size=%dM -numa node,memdev=mem", sizeMB)
 }
 
+func (o baseOptions) Overcommit(memLock, cpuPm bool) string {
+	params := []string{}
+	if memLock {
+		params = append(params, "mem-lock=on")
+	}
+	if cpuPm {
+		params = append(params, "cpu-pm=on")
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return "-overcommit " + strings.Join(params, ",")
+}
+
+// hpet only exists on x86
+func (o baseOptions) NoHpet() string {
+	return ""
+}
+
 func (o baseOptions) MemFd(sizeMB uint64) string {
 	return fmt.Sprintf("-object memory-backend-memfd,id=mem,size=%dM,share=on,prealloc=on -numa node,memdev=mem", sizeMB)
 }
 
-func (o baseOptions) Boot(order string, enableMenu bool) string {
-	opt := "-boot order=" + order
-	if enableMenu {
-		opt += ",menu=on"
+func (o baseOptions) Boot(opt BootOption) string {
+	params := []string{}
+	if len(opt.Order) > 0 {
+		params = append(params, "order="+opt.Order)
 	}
-	return opt
+	if opt.EnableMenu {
+		params = append(params, "menu=on")
+		if len(opt.Splash) > 0 {
+			params = append(params, "splash="+shellQuote(opt.Splash))
+		}
+		if opt.SplashTime > 0 {
+			params = append(params, fmt.Sprintf("splash-time=%d", opt.SplashTime))
+		}
+	}
+	if opt.Strict {
+		params = append(params, "strict=on")
+	}
+	if len(params) == 0 {
+		return ""
+	}
+	return "-boot " + strings.Join(params, ",")
 }
 
 func (o baseOptions) BIOS(file string) string {
@@ -274,6 +724,11 @@ func (o baseOptions) Device(devStr string) string {
 	return "-device " + devStr
 }
 
+// pvpanic-pci is available since qemu 6.0
+func (o baseOptions) PvpanicPciDevice() string {
+	return o.Device("pvpanic-pci")
+}
+
 func (o baseOptions) Drive(driveStr string) string {
 	return "-drive " + driveStr
 }
@@ -319,11 +774,11 @@ func (o baseOptions) USB() string {
 	return "-usb"
 }
 
-func (o baseOptions) VdiSpice(spicePort uint, pciBus string) []string {
+func (o baseOptions) VdiSpice(spicePort uint, pciBus string, tuning *SpiceTuning) []string {
 	return []string{
 		o.Device("intel-hda,id=sound0"),
 		o.Device("hda-duplex,id=sound0-codec0,bus=sound0.0,cad=0"),
-		fmt.Sprintf("-spice port=%d,disable-ticketing=off,seamless-migration=on", spicePort),
+		fmt.Sprintf("-spice port=%d,disable-ticketing=off,seamless-migration=on%s", spicePort, tuning.String()),
 		// # ,streaming-video=all,playback-compression=on,jpeg-wan-compression=always,zlib-glz-wan-compression=always,image-compression=glz" % (5900+vnc_port)
 		o.Device(fmt.Sprintf("virtio-serial-pci,id=virtio-serial0,max_ports=16,bus=%s", pciBus)),
 		o.Chardev("spicevmc", "vdagent", "vdagent"),
@@ -341,8 +796,12 @@ func (o baseOptions) VdiSpice(spicePort uint, pciBus string) []string {
 	}
 }
 
-func (o baseOptions) VNC(port uint, usePasswd bool) string {
-	opt := fmt.Sprintf("-vnc :%d", port)
+// VNC listens on all addresses if listen is empty, port is display number
+func (o baseOptions) VNC(listen string, port uint, usePasswd bool) string {
+	if strings.Contains(listen, ":") {
+		listen = "[" + listen + "]"
+	}
+	opt := fmt.Sprintf("-vnc %s:%d", listen, port)
 	if usePasswd {
 		opt += ",password"
 	}
@@ -375,8 +834,23 @@ func (o *baseOptions_x86_64) CPU(input CPUOption, osName string) (string, string
 			cpuType = "Penryn,vendor=GenuineIntel"
 		} else if input.HostCPUPassthrough {
 			cpuType = "host"
+			if len(input.HostCPUMigratable) > 0 {
+				cpuType += ",migratable=" + input.HostCPUMigratable
+			}
+			if err := validateCPUFeatureNames(input.HostCPUMaskedFeatures); err != nil {
+				return "", "", err
+			}
+			for _, feature := range input.HostCPUMaskedFeatures {
+				cpuType += ",-" + feature
+			}
 			// https://unix.stackexchange.com/questions/216925/nmi-received-for-unknown-reason-20-do-you-have-a-strange-power-saving-mode-ena
 			cpuType += ",+kvm_pv_eoi"
+		} else if len(input.CPUModel) > 0 {
+			if err := validateCPUModel(o.arch, input.CPUModel); err != nil {
+				return "", "", err
+			}
+			cpuType = input.CPUModel
+			cpuType += ",+kvm_pv_eoi"
 		} else {
 			cpuType = "qemu64"
 			cpuType += ",+kvm_pv_eoi"
@@ -390,6 +864,13 @@ func (o *baseOptions_x86_64) CPU(input CPUOption, osName string) (string, string
 			}
 		}
 
+		if len(input.CPUFeatures) > 0 {
+			if err := validateCPUFeatures(o.arch, input.CPUFeatures); err != nil {
+				return "", "", err
+			}
+			cpuType += "," + strings.Join(input.CPUFeatures, ",")
+		}
+
 		if !input.EnableNested {
 			cpuType += ",kvm=off"
 		}
@@ -404,12 +885,34 @@ func (o *baseOptions_x86_64) CPU(input CPUOption, osName string) (string, string
 	return fmt.Sprintf("-cpu %s", cpuType), accel, nil
 }
 
-func (o baseOptions_x86_64) Machine(mType string, accel string) string {
-	return fmt.Sprintf("-machine %s,accel=%s", mType, accel)
+func (o baseOptions_x86_64) Machine(mType string, accel string, dumpGuestCore, memMerge bool) string {
+	return fmt.Sprintf("-machine %s,accel=%s%s", mType, accel, machineMemoryProps(dumpGuestCore, memMerge))
+}
+
+// guest memory is left out of qemu core dumps unless asked for,
+// cores of large guests are useless and fill up disks.
+// mem-merge is on by default in qemu, only turning it off is emitted
+func machineMemoryProps(dumpGuestCore, memMerge bool) string {
+	props := ""
+	if !dumpGuestCore {
+		props += ",dump-guest-core=off"
+	}
+	if !memMerge {
+		props += ",mem-merge=off"
+	}
+	return props
+}
+
+func (o baseOptions_x86_64) NoHpet() string {
+	return "-no-hpet"
 }
 
 func (o baseOptions_x86_64) SMP(cpus uint) string {
-	return fmt.Sprintf("-smp cpus=%d,sockets=2,cores=64,maxcpus=128", cpus)
+	return fmt.Sprintf("-smp cpus=%d,sockets=2,cores=64,maxcpus=%d", cpus, o.MaxCpus())
+}
+
+func (o baseOptions_x86_64) MaxCpus() uint {
+	return 128
 }
 
 func (o baseOptions_x86_64) Memory(sizeMB uint64) string {
@@ -459,8 +962,8 @@ func (o baseOptions_x86_64) PvpanicDevice() string {
 	return o.Device("pvpanic")
 }
 
-func (o baseOptions_x86_64) VdiSpice(spicePort uint, pciBus string) []string {
-	baseOpts := o.baseOptions.VdiSpice(spicePort, pciBus)
+func (o baseOptions_x86_64) VdiSpice(spicePort uint, pciBus string, tuning *SpiceTuning) []string {
+	baseOpts := o.baseOptions.VdiSpice(spicePort, pciBus, tuning)
 	vga := o.Device("qxl-vga,id=video0,ram_size=141557760,vram_size=141557760")
 	return append([]string{vga}, baseOpts...)
 }
@@ -479,7 +982,9 @@ func (o *baseOptions_aarch64) CPU(input CPUOption, osName string) (string, strin
 	var accel, cpuType string
 	if input.EnableKVM {
 		accel = "kvm"
-		if input.HostCPUPassthrough {
+		if len(input.CPUModel) > 0 {
+			cpuType = input.CPUModel
+		} else if input.HostCPUPassthrough {
 			cpuType = "host"
 		} else {
 			// * under KVM, -cpu max is the same as -cpu host
@@ -489,16 +994,31 @@ func (o *baseOptions_aarch64) CPU(input CPUOption, osName string) (string, strin
 	} else {
 		accel = "tcg"
 		cpuType = "max"
+		// -cpu host is only available with KVM
+		if len(input.CPUModel) > 0 && input.CPUModel != "host" {
+			cpuType = input.CPUModel
+		}
+	}
+	if len(input.CPUModel) > 0 {
+		if err := validateCPUModel(o.arch, input.CPUModel); err != nil {
+			return "", "", err
+		}
+	}
+	if len(input.CPUFeatures) > 0 {
+		if err := validateCPUFeatures(o.arch, input.CPUFeatures); err != nil {
+			return "", "", err
+		}
+		cpuType += "," + strings.Join(input.CPUFeatures, ",")
 	}
 	return fmt.Sprintf("-cpu %s", cpuType), accel, nil
 }
 
-func (o baseOptions_aarch64) Machine(mType string, accel string) string {
+func (o baseOptions_aarch64) Machine(mType string, accel string, dumpGuestCore, memMerge bool) string {
 	// TODO: fix machine type on region controller side
 	if mType == "" || mType == compute.VM_MACHINE_TYPE_PC || mType == compute.VM_MACHINE_TYPE_Q35 {
 		mType = "virt"
 	}
-	return fmt.Sprintf("-machine %s,accel=%s,gic-version=3", mType, accel)
+	return fmt.Sprintf("-machine %s,accel=%s,gic-version=3%s", mType, accel, machineMemoryProps(dumpGuestCore, memMerge))
 }
 
 func (o baseOptions_aarch64) NoKVMPitReinjection() string {
@@ -512,7 +1032,11 @@ func (o baseOptions_aarch64) Global() string {
 func (o baseOptions_aarch64) SMP(cpus uint) string {
 	// warning: Number of hotpluggable cpus requested (128)
 	// exceeds the recommended cpus supported by KVM (32)
-	return fmt.Sprintf("-smp cpus=%d,sockets=2,cores=32,maxcpus=64", cpus)
+	return fmt.Sprintf("-smp cpus=%d,sockets=2,cores=32,maxcpus=%d", cpus, o.MaxCpus())
+}
+
+func (o baseOptions_aarch64) MaxCpus() uint {
+	return 64
 }
 
 func (o baseOptions_aarch64) Memory(sizeMB uint64) string {
@@ -542,6 +1066,6 @@ func (o baseOptions_aarch64) PvpanicDevice() string {
 	return ""
 }
 
-func (o baseOptions_aarch64) VdiSpice(spicePort uint, pciBus string) []string {
-	return o.baseOptions.VdiSpice(spicePort, "pcie.0")
+func (o baseOptions_aarch64) VdiSpice(spicePort uint, pciBus string, tuning *SpiceTuning) []string {
+	return o.baseOptions.VdiSpice(spicePort, "pcie.0", tuning)
 }
@@ -15,9 +15,12 @@
 package qemu
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	api "yunion.io/x/onecloud/pkg/apis/compute"
 )
 
 func Test_baseOptions(t *testing.T) {
@@ -38,6 +41,24 @@ func Test_baseOptions(t *testing.T) {
 		Port: 1234,
 		Mode: "readline",
 	}))
+	// test name
+	assert.Equal("-name 'vm1',debug-threads=on", opt.Name("vm1", ""))
+	assert.Equal("-name 'vm1',process=b9a3f9d0-8d53-4b4a-8b2d-3b2e5aa3c9e1,debug-threads=on",
+		opt.Name("vm1", "b9a3f9d0-8d53-4b4a-8b2d-3b2e5aa3c9e1"))
+	// test no reboot
+	assert.Equal("-no-reboot", opt.NoReboot())
+	// test trace
+	assert.Equal("", opt.Trace(nil))
+	assert.Equal("", opt.Trace(&TraceOption{File: "/tmp/trace.log"}))
+	assert.Equal("-trace enable=virtio_blk_*,file='/tmp/trace.log'", opt.Trace(&TraceOption{Enable: "virtio_blk_*", File: "/tmp/trace.log"}))
+	assert.Equal("-trace events='/tmp/events'", opt.Trace(&TraceOption{Events: "/tmp/events"}))
+	assert.Equal("-trace enable=qmp_*,events='/tmp/events',file='/tmp/trace.log'",
+		opt.Trace(&TraceOption{Enable: "qmp_*", Events: "/tmp/events", File: "/tmp/trace.log"}))
+	// test overcommit
+	assert.Equal("-overcommit mem-lock=on,cpu-pm=on", opt.Overcommit(true, true))
+	assert.Equal("-overcommit mem-lock=on", opt.Overcommit(true, false))
+	assert.Equal("-overcommit cpu-pm=on", opt.Overcommit(false, true))
+	assert.Equal("", opt.Overcommit(false, false))
 	// test memory
 	assert.Equal("-m 1024M,slots=4,maxmem=524288M", opt.Memory(1024))
 	// test device
@@ -60,11 +81,315 @@ func Test_baseOptions(t *testing.T) {
 		"-chardev spicevmc,id=usbredirchardev2,name=usbredir",
 		"-device usb-redir,chardev=usbredirchardev2,id=usbredirdev2",
 	},
-		opt.VdiSpice(5910, "pcie.0"))
+		opt.VdiSpice(5910, "pcie.0", nil))
 	// test vnc
-	assert.Equal("-vnc :5900,password", opt.VNC(5900, true))
-	assert.Equal("-vnc :5900", opt.VNC(5900, false))
+	assert.Equal("-vnc :5900,password", opt.VNC("", 5900, true))
+	assert.Equal("-vnc :5900", opt.VNC("", 5900, false))
+	assert.Equal("-vnc 10.168.0.2:1,password", opt.VNC("10.168.0.2", 1, true))
+	assert.Equal("-vnc [fd00::2]:1", opt.VNC("fd00::2", 1, false))
 	// test vga
 	assert.Equal("-vga std", opt.VGA("std", ""))
 	assert.Equal("-vga x", opt.VGA("std", "-vga x"))
 }
+
+func Test_CPUModel(t *testing.T) {
+	assert := assert.New(t)
+
+	armOpt := newBaseOptions_aarch64()
+	for _, c := range []struct {
+		input CPUOption
+		want  string
+		accel string
+	}{
+		{CPUOption{EnableKVM: true, CPUModel: "cortex-a72"}, "-cpu cortex-a72", "kvm"},
+		{CPUOption{EnableKVM: true, CPUModel: "neoverse-n1", CPUFeatures: []string{"pmu=on", "sve=off"}}, "-cpu neoverse-n1,pmu=on,sve=off", "kvm"},
+		{CPUOption{EnableKVM: true, CPUModel: "host"}, "-cpu host", "kvm"},
+		{CPUOption{EnableKVM: true, HostCPUPassthrough: true}, "-cpu host", "kvm"},
+		{CPUOption{EnableKVM: false, CPUModel: "host"}, "-cpu max", "tcg"},
+		{CPUOption{EnableKVM: false, CPUModel: "cortex-a57"}, "-cpu cortex-a57", "tcg"},
+	} {
+		cpu, accel, err := armOpt.CPU(c.input, OS_NAME_LINUX)
+		assert.NoError(err)
+		assert.Equal(c.want, cpu)
+		assert.Equal(c.accel, accel)
+	}
+
+	// x86_64 models and features are rejected on aarch64
+	_, _, err := armOpt.CPU(CPUOption{EnableKVM: true, CPUModel: "Haswell"}, OS_NAME_LINUX)
+	assert.Error(err)
+	_, _, err = armOpt.CPU(CPUOption{EnableKVM: true, CPUModel: "cortex-a72", CPUFeatures: []string{"+avx"}}, OS_NAME_LINUX)
+	assert.Error(err)
+
+	x86Opt := newBaseOptions_x86_64()
+	cpu, _, err := x86Opt.CPU(CPUOption{EnableKVM: true, EnableNested: true, CPUModel: "Haswell", CPUFeatures: []string{"-x2apic"}}, OS_NAME_LINUX)
+	assert.NoError(err)
+	assert.Equal("-cpu Haswell,+kvm_pv_eoi,-x2apic", cpu)
+	_, _, err = x86Opt.CPU(CPUOption{EnableKVM: true, CPUModel: "cortex-a72"}, OS_NAME_LINUX)
+	assert.Error(err)
+
+	for migratable, want := range map[string]string{
+		"":    "-cpu host,+kvm_pv_eoi",
+		"on":  "-cpu host,migratable=on,+kvm_pv_eoi",
+		"off": "-cpu host,migratable=off,+kvm_pv_eoi",
+	} {
+		cpu, _, err = x86Opt.CPU(CPUOption{EnableKVM: true, EnableNested: true, HostCPUPassthrough: true, HostCPUMigratable: migratable}, OS_NAME_LINUX)
+		assert.NoError(err)
+		assert.Equal(want, cpu)
+	}
+
+	masked := CPUOption{EnableKVM: true, EnableNested: true, HostCPUPassthrough: true, HostCPUMigratable: "on", HostCPUMaskedFeatures: []string{"pdpe1gb", "avx512f"}}
+	cpu, _, err = x86Opt.CPU(masked, OS_NAME_LINUX)
+	assert.NoError(err)
+	assert.Equal("-cpu host,migratable=on,-pdpe1gb,-avx512f,+kvm_pv_eoi", cpu)
+	// masks only apply to host passthrough cpu
+	masked.HostCPUPassthrough = false
+	masked.CPUModel = "Haswell"
+	cpu, _, err = x86Opt.CPU(masked, OS_NAME_LINUX)
+	assert.NoError(err)
+	assert.Equal("-cpu Haswell,+kvm_pv_eoi", cpu)
+	for _, name := range []string{"-avx", "+avx", "avx,+vmx", "", "a b"} {
+		_, _, err = x86Opt.CPU(CPUOption{EnableKVM: true, HostCPUPassthrough: true, HostCPUMaskedFeatures: []string{name}}, OS_NAME_LINUX)
+		assert.Error(err, name)
+	}
+}
+
+func Test_Boot(t *testing.T) {
+	assert := assert.New(t)
+
+	opt := newBaseOptions_x86_64()
+	assert.Equal("-boot order=cdn", opt.Boot(BootOption{Order: "cdn"}))
+	assert.Equal("-boot order=cdn,menu=on", opt.Boot(BootOption{Order: "cdn", EnableMenu: true}))
+	assert.Equal("-boot order=cdn,menu=on,splash-time=5000,strict=on",
+		opt.Boot(BootOption{Order: "cdn", EnableMenu: true, SplashTime: 5000, Strict: true}))
+	assert.Equal("-boot menu=on,splash-time=3000", opt.Boot(BootOption{EnableMenu: true, SplashTime: 3000}))
+	assert.Equal("", opt.Boot(BootOption{}))
+	assert.Equal("-boot menu=on,splash='/opt/cloud/splash.bmp',splash-time=3000",
+		opt.Boot(BootOption{EnableMenu: true, Splash: "/opt/cloud/splash.bmp", SplashTime: 3000}))
+
+	assert.NoError(validateBootOption(BootOption{EnableMenu: true, SplashTime: BOOT_MENU_SPLASH_TIME_MAX}))
+	assert.Error(validateBootOption(BootOption{EnableMenu: true, SplashTime: BOOT_MENU_SPLASH_TIME_MAX + 1}))
+	assert.Error(validateBootOption(BootOption{SplashTime: 1000}))
+	assert.NoError(validateBootOption(BootOption{EnableMenu: true, Splash: "/opt/cloud/splash.bmp"}))
+	assert.Error(validateBootOption(BootOption{Splash: "/opt/cloud/splash.bmp"}))
+	assert.Error(validateBootOption(BootOption{EnableMenu: true, Splash: "/opt/cloud/a,b.bmp"}))
+	assert.Error(validateBootOption(BootOption{EnableMenu: true, Splash: "/opt/cloud/a b.bmp"}))
+	assert.Error(validateBootOption(BootOption{EnableMenu: true, Splash: "/opt/cloud/$(reboot).bmp"}))
+
+	// order is dropped as soon as a device carries its own bootindex
+	assert.False(hasDeviceBootIndex([]string{"virtio-blk-pci,drive=drive_0"}))
+	assert.True(hasDeviceBootIndex([]string{"virtio-blk-pci,drive=drive_0,bootindex=1"}))
+}
+
+func Test_getRealtimeOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal([]string{"-overcommit mem-lock=on,cpu-pm=on", "-no-hpet"}, getRealtimeOptions(newBaseOptions_x86_64()))
+	assert.Equal([]string{"-overcommit mem-lock=on,cpu-pm=on"}, getRealtimeOptions(newBaseOptions_aarch64()))
+	assert.Equal([]string{"-realtime mlock=on", "-no-hpet"}, getRealtimeOptions(newOpt_2_12_1_x86_64()))
+	assert.Equal([]string{"-overcommit mem-lock=on,cpu-pm=on", "-machine hpet=off"}, getRealtimeOptions(newOpt_8_2_0_x86_64()))
+}
+
+func Test_GlobalProperty(t *testing.T) {
+	assert := assert.New(t)
+
+	opt := newBaseOptions_x86_64()
+	prop, err := ParseGlobalProperty("PIIX4_PM.disable_s3=1")
+	assert.NoError(err)
+	assert.Equal(GlobalProperty{Driver: "PIIX4_PM", Property: "disable_s3", Value: "1"}, prop)
+	assert.Equal("-global PIIX4_PM.disable_s3=1", opt.GlobalProperty(prop))
+	assert.Equal("-global ICH9-LPC.disable_s4=1",
+		opt.GlobalProperty(GlobalProperty{Driver: "ICH9-LPC", Property: "disable_s4", Value: "1"}))
+
+	for _, str := range []string{
+		"",
+		"PIIX4_PM",
+		"PIIX4_PM.disable_s3",
+		"PIIX4_PM=1",
+		"disable_s3=PIIX4_PM.1",
+		".disable_s3=1",
+		"PIIX4_PM.=1",
+		"PIIX4_PM.disable_s3=",
+		"PIIX4_PM.disable_s3=1 -device foo",
+		"PIIX4_PM.disable_s3=1,x=2",
+		"PIIX4_PM.disable_s3=$(reboot)",
+		"PIIX4_PM.disable_s3='1'",
+	} {
+		_, err := ParseGlobalProperty(str)
+		assert.Error(err, str)
+	}
+	assert.Error(validateGlobalProperty(GlobalProperty{Driver: "PIIX4_PM", Property: "disable_s3", Value: "1;reboot"}))
+}
+
+func Test_getAcpiTableOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	x86Opt := newBaseOptions_x86_64()
+	assert.Equal("-acpitable file='/opt/cloud/acpi/slic.bin'", x86Opt.AcpiTable("/opt/cloud/acpi/slic.bin"))
+	assert.Equal(`-acpitable file='/opt/cloud/acpi/it'\''s.bin'`, x86Opt.AcpiTable("/opt/cloud/acpi/it's.bin"))
+
+	files := []string{"/opt/cloud/acpi/slic.bin", "/opt/cloud/acpi/msdm.bin"}
+	for _, machine := range []string{"", "pc", "q35"} {
+		opts, err := getAcpiTableOptions(x86Opt, machine, files)
+		assert.NoError(err)
+		assert.Equal([]string{
+			"-acpitable file='/opt/cloud/acpi/slic.bin'",
+			"-acpitable file='/opt/cloud/acpi/msdm.bin'",
+		}, opts)
+	}
+	_, err := getAcpiTableOptions(x86Opt, "virt", files)
+	assert.Error(err)
+	_, err = getAcpiTableOptions(x86Opt, "pc", []string{"/opt/cloud/acpi/a,b.bin"})
+	assert.Error(err)
+	_, err = getAcpiTableOptions(newBaseOptions_aarch64(), "pc", files)
+	assert.Error(err)
+}
+
+func Test_SmbiosOemString(t *testing.T) {
+	assert := assert.New(t)
+
+	opt := newBaseOptions_x86_64()
+	assert.Equal("-smbios 'type=11,value=io.systemd.credential:hostname=vm1'", opt.SmbiosOemString("io.systemd.credential:hostname=vm1"))
+	assert.Equal("-smbios 'type=11,value=ds=nocloud;s=http://10.0.0.1/,,a,,b'", opt.SmbiosOemString("ds=nocloud;s=http://10.0.0.1/,a,b"))
+	assert.Equal(`-smbios 'type=11,value=it'\''s'`, opt.SmbiosOemString("it's"))
+}
+
+func Test_getHostnameOption(t *testing.T) {
+	drvOpt := newBaseOptions_x86_64()
+	opt, err := getHostnameOption(drvOpt, HOSTNAME_CHANNEL_SMBIOS, "vm-01.example.com")
+	assert.NoError(t, err)
+	assert.Equal(t, "-smbios type=1,sku=vm-01.example.com", opt)
+
+	opt, err = getHostnameOption(newBaseOptions_aarch64(), HOSTNAME_CHANNEL_FW_CFG, "vm-01")
+	assert.NoError(t, err)
+	assert.Equal(t, "-fw_cfg name=opt/hostname,string=vm-01", opt)
+
+	for _, hostname := range []string{"", "-vm", "vm_01", "vm,01", "vm 01", "vm..example", "vm'01", strings.Repeat("a", 64)} {
+		_, err := getHostnameOption(drvOpt, HOSTNAME_CHANNEL_FW_CFG, hostname)
+		assert.Error(t, err, hostname)
+	}
+	_, err = getHostnameOption(drvOpt, "cloud-init", "vm-01")
+	assert.Error(t, err)
+}
+
+func Test_Audio(t *testing.T) {
+	assert := assert.New(t)
+
+	opt := newBaseOptions_x86_64()
+	for _, backend := range []string{AUDIO_BACKEND_PA, AUDIO_BACKEND_ALSA} {
+		assert.Equal([]string{
+			"-audiodev " + backend + ",id=audio0",
+			"-device intel-hda,id=sound0",
+			"-device hda-duplex,id=sound0-codec0,bus=sound0.0,cad=0,audiodev=audio0",
+		}, opt.Audio(backend))
+	}
+	assert.Len(opt.Audio(AUDIO_BACKEND_NONE), 0)
+	assert.Len(opt.Audio(""), 0)
+}
+
+func Test_getWatchdogOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	x86 := newBaseOptions_x86_64()
+	opts, err := getWatchdogOptions(x86, WATCHDOG_MODEL_I6300ESB, "")
+	assert.NoError(err)
+	assert.Equal([]string{"-device i6300esb,id=watchdog0", "-watchdog-action reset"}, opts)
+
+	opts, err = getWatchdogOptions(x86, WATCHDOG_MODEL_IB700, WATCHDOG_ACTION_INJECTNMI)
+	assert.NoError(err)
+	assert.Equal([]string{"-device ib700,id=watchdog0", "-watchdog-action inject-nmi"}, opts)
+
+	_, err = getWatchdogOptions(x86, WATCHDOG_MODEL_I6300ESB, "reboot")
+	assert.Error(err)
+	_, err = getWatchdogOptions(x86, "diag288", "")
+	assert.Error(err)
+
+	arm := newBaseOptions_aarch64()
+	opts, err = getWatchdogOptions(arm, WATCHDOG_MODEL_I6300ESB, WATCHDOG_ACTION_PAUSE)
+	assert.NoError(err)
+	assert.Equal([]string{"-device i6300esb,id=watchdog0", "-watchdog-action pause"}, opts)
+	_, err = getWatchdogOptions(arm, WATCHDOG_MODEL_IB700, "")
+	assert.Error(err)
+}
+
+func Test_ScsiController(t *testing.T) {
+	assert := assert.New(t)
+
+	x86 := newBaseOptions_x86_64()
+	disks := []*api.GuestdiskJsonDesc{
+		{Driver: DISK_DRIVER_SCSI, Index: 0, CacheMode: "none", AioMode: "native"},
+		{Driver: DISK_DRIVER_SCSI, Index: 1, CacheMode: "none", AioMode: "native"},
+	}
+	for model, device := range map[string]string{
+		"":                      "-device virtio-scsi-pci,id=scsi",
+		SCSI_CONTROLLER_VIRTIO:  "-device virtio-scsi-pci,id=scsi",
+		SCSI_CONTROLLER_LSI:     "-device lsi53c895a,id=scsi",
+		SCSI_CONTROLLER_MEGASAS: "-device megasas,id=scsi",
+	} {
+		controllers, err := getScsiControllers(x86, model, 0)
+		assert.NoError(err)
+		opts := generateDisksOptions(x86, disks, "pci.0", false, false, nil, nil, controllers)
+		assert.Equal([]string{
+			device,
+			"-drive file=$DISK_0,if=none,id=drive_0,cache=none,aio=native,file.locking=off",
+			"-device scsi-hd,drive=drive_0,bus=scsi.0,id=drive_0",
+			"-drive file=$DISK_1,if=none,id=drive_1,cache=none,aio=native,file.locking=off",
+			"-device scsi-hd,drive=drive_1,bus=scsi.0,id=drive_1",
+		}, opts)
+	}
+
+	_, err := getScsiControllers(x86, "buslogic", 0)
+	assert.Error(err)
+	arm := newBaseOptions_aarch64()
+	_, err = getScsiControllers(arm, SCSI_CONTROLLER_MEGASAS, 0)
+	assert.Error(err)
+	controllers, err := getScsiControllers(arm, "", 0)
+	assert.NoError(err)
+	assert.Equal(&scsiControllers{model: SCSI_CONTROLLER_VIRTIO, count: 1}, controllers)
+}
+
+func Test_MultipleScsiControllers(t *testing.T) {
+	assert := assert.New(t)
+
+	x86 := newBaseOptions_x86_64()
+	disks := []*api.GuestdiskJsonDesc{}
+	for i := 0; i < 10; i++ {
+		disks = append(disks, &api.GuestdiskJsonDesc{Driver: DISK_DRIVER_SCSI, Index: int8(i), CacheMode: "none", AioMode: "native"})
+	}
+	controllers, err := getScsiControllers(x86, "", 3)
+	assert.NoError(err)
+	opts := generateDisksOptions(x86, disks, "pci.0", false, false, nil, nil, controllers)
+	assert.Equal([]string{
+		"-device virtio-scsi-pci,id=scsi",
+		"-device virtio-scsi-pci,id=scsi1",
+		"-device virtio-scsi-pci,id=scsi2",
+	}, opts[:3])
+
+	buses := map[string][]int8{}
+	for _, disk := range disks {
+		dev := getDiskDeviceOption(x86, disk, false, "pci.0", false, nil, nil, 3)
+		bus := GetScsiBus(disk.Index, 3)
+		assert.Contains(dev, ",bus="+bus+",")
+		assert.Contains(opts, dev)
+		buses[bus] = append(buses[bus], disk.Index)
+	}
+	assert.Equal(map[string][]int8{
+		"scsi.0":  {0, 3, 6, 9},
+		"scsi1.0": {1, 4, 7},
+		"scsi2.0": {2, 5, 8},
+	}, buses)
+
+	// only virtio-scsi could be multiplied
+	_, err = getScsiControllers(x86, SCSI_CONTROLLER_LSI, 3)
+	assert.Error(err)
+	_, err = getScsiControllers(x86, "", MAX_SCSI_CONTROLLER_COUNT+1)
+	assert.Error(err)
+}
+
+func TestValidateSafePath(t *testing.T) {
+	for _, p := range []string{"/opt/cloud/trace-events", "/tmp/a_b.1/x+y@z"} {
+		assert.NoError(t, ValidateSafePath(p), p)
+	}
+	for _, p := range []string{"", "events", "/tmp/a b", "/tmp/$(reboot)", "/tmp/a;ls", "/tmp/a,b", "/tmp/`id`", "/tmp/'x'"} {
+		assert.Error(t, ValidateSafePath(p), p)
+	}
+}
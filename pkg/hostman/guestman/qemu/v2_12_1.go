@@ -39,6 +39,14 @@ func newOpt_2_12_1_x86_64() QemuOptions {
 	}
 }
 
+func (o opt_2121_x86_64) Overcommit(memLock, cpuPm bool) string {
+	// -overcommit is added in 3.0, cpu-pm has no equivalent before it
+	if !memLock {
+		return ""
+	}
+	return "-realtime mlock=on"
+}
+
 func newCmd_2_12_1_aarch64() QemuCommand {
 	return newBaseCommand(
 		Version_2_12_1,
@@ -0,0 +1,160 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+)
+
+// hasDisplay tells whether guest has a display device to be dumped
+func (s *SKVMGuestInstance) hasDisplay() bool {
+	if s.manager.host.IsAarch64() {
+		return s.getAarch64Vga() != "none"
+	}
+	return s.Desc.Vga != "none" || s.IsVdiSpice()
+}
+
+// Screenshot dumps current display of running guest to target, which is
+// written in ppm format as qemu dumps, or converted to png if ends with .png
+func (s *SKVMGuestInstance) Screenshot(target string) error {
+	if !path.IsAbs(target) {
+		return errors.Errorf("screenshot target %q is not an absolute path", target)
+	}
+	ext := strings.ToLower(path.Ext(target))
+	if ext != ".ppm" && ext != ".png" {
+		return errors.Errorf("screenshot target %q should be .ppm or .png", target)
+	}
+	if !s.IsRunning() || s.Monitor == nil {
+		return errors.Errorf("guest %s is not running", s.GetName())
+	}
+	if !s.hasDisplay() {
+		return errors.Wrap(errors.ErrNotSupported, "guest has no display")
+	}
+	dumpFile := target
+	if ext == ".png" {
+		dumpFile = path.Join(s.HomeDir(), "screendump.ppm")
+		defer os.Remove(dumpFile)
+	}
+	ch := make(chan string, 1)
+	s.Monitor.ScreenDump(dumpFile, func(res string) { ch <- res })
+	if res := <-ch; len(res) > 0 {
+		return errors.Errorf("screendump %s: %s", dumpFile, res)
+	}
+	if ext == ".png" {
+		if err := ppmToPng(dumpFile, target); err != nil {
+			return errors.Wrap(err, "ppmToPng")
+		}
+	}
+	log.Infof("%s screenshot saved to %s", s.logPrefix(), target)
+	return nil
+}
+
+func readPpmToken(r *bufio.Reader) (string, error) {
+	token := []byte{}
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '#' && len(token) == 0:
+			if _, err := r.ReadString('\n'); err != nil {
+				return "", err
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			// single whitespace after the last token ends the header
+			if len(token) > 0 {
+				return string(token), nil
+			}
+		default:
+			token = append(token, c)
+		}
+	}
+}
+
+// decodePpm decodes binary ppm (P6) with 8 bits samples, which qemu screendump writes
+func decodePpm(r io.Reader) (image.Image, error) {
+	br := bufio.NewReader(r)
+	header := make([]int, 3)
+	magic, err := readPpmToken(br)
+	if err != nil {
+		return nil, errors.Wrap(err, "read magic")
+	}
+	if magic != "P6" {
+		return nil, errors.Errorf("unsupported ppm magic %q", magic)
+	}
+	for i := range header {
+		token, err := readPpmToken(br)
+		if err != nil {
+			return nil, errors.Wrap(err, "read header")
+		}
+		if _, err := fmt.Sscanf(token, "%d", &header[i]); err != nil || header[i] <= 0 {
+			return nil, errors.Errorf("invalid ppm header %q", token)
+		}
+	}
+	width, height, maxVal := header[0], header[1], header[2]
+	if maxVal > 255 {
+		return nil, errors.Errorf("unsupported ppm max value %d", maxVal)
+	}
+	pixels := make([]byte, width*height*3)
+	if _, err := io.ReadFull(br, pixels); err != nil {
+		return nil, errors.Wrap(err, "read pixels")
+	}
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			p := pixels[(y*width+x)*3:]
+			img.Set(x, y, color.RGBA{
+				R: uint8(int(p[0]) * 255 / maxVal),
+				G: uint8(int(p[1]) * 255 / maxVal),
+				B: uint8(int(p[2]) * 255 / maxVal),
+				A: 255,
+			})
+		}
+	}
+	return img, nil
+}
+
+func ppmToPng(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return errors.Wrapf(err, "open %s", src)
+	}
+	defer in.Close()
+	img, err := decodePpm(in)
+	if err != nil {
+		return errors.Wrapf(err, "decode %s", src)
+	}
+	out, err := os.Create(dst)
+	if err != nil {
+		return errors.Wrapf(err, "create %s", dst)
+	}
+	if err := png.Encode(out, img); err != nil {
+		out.Close()
+		return errors.Wrapf(err, "encode %s", dst)
+	}
+	return out.Close()
+}
@@ -0,0 +1,111 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"bytes"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"yunion.io/x/onecloud/pkg/apis"
+)
+
+// 2x1 image of a red and a blue pixel
+var samplePpm = append([]byte("P6\n# qemu\n2 1\n255\n"), 255, 0, 0, 0, 0, 255)
+
+func Test_decodePpm(t *testing.T) {
+	img, err := decodePpm(bytes.NewReader(samplePpm))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, img.Bounds().Dx())
+	assert.Equal(t, 1, img.Bounds().Dy())
+	assert.Equal(t, color.RGBA{R: 255, A: 255}, img.At(0, 0))
+	assert.Equal(t, color.RGBA{B: 255, A: 255}, img.At(1, 0))
+
+	for _, content := range []string{"P3\n2 1\n255\n", "P6\n2 x\n255\n", "P6\n2 1\n65535\n", "P6\n2 1\n255\n\xff"} {
+		_, err := decodePpm(bytes.NewReader([]byte(content)))
+		assert.Error(t, err, content)
+	}
+}
+
+func TestSKVMGuestInstance_Screenshot(t *testing.T) {
+	tmpDir := t.TempDir()
+	savedProcDir := procDir
+	defer func() { procDir = savedProcDir }()
+	procDir = path.Join(tmpDir, "proc")
+
+	s := newTestGuestWithServersPath(tmpDir, map[string]string{})
+	s.manager.host = &fakeArchHost{arch: apis.OS_ARCH_X86_64}
+	s.Desc.Uuid = "uuid-xxxx-xxxx"
+	mon := &fakeMonitor{screen: samplePpm}
+	s.Monitor = mon
+	if err := os.MkdirAll(s.HomeDir(), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+
+	target := path.Join(tmpDir, "screen.ppm")
+	if err := s.Screenshot(target); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "is not running")
+	}
+
+	if err := ioutil.WriteFile(s.GetPidFilePath(), []byte("1234\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.MkdirAll(path.Join(procDir, "1234"), 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	cmdline := "/usr/bin/qemu-system-x86_64\x00-uuid\x00uuid-xxxx-xxxx\x00"
+	if err := ioutil.WriteFile(path.Join(procDir, "1234", "cmdline"), []byte(cmdline), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	assert.Error(t, s.Screenshot("screen.ppm"))
+	assert.Error(t, s.Screenshot(path.Join(tmpDir, "screen.jpg")))
+	assert.Empty(t, mon.Commands())
+
+	assert.NoError(t, s.Screenshot(target))
+	content, err := ioutil.ReadFile(target)
+	assert.NoError(t, err)
+	assert.Equal(t, samplePpm, content)
+
+	pngTarget := path.Join(tmpDir, "screen.png")
+	assert.NoError(t, s.Screenshot(pngTarget))
+	dumpFile := path.Join(s.HomeDir(), "screendump.ppm")
+	assert.Equal(t, []string{"screendump " + target, "screendump " + dumpFile}, mon.Commands())
+	assert.NoFileExists(t, dumpFile)
+	f, err := os.Open(pngTarget)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer f.Close()
+	img, err := png.Decode(f)
+	assert.NoError(t, err)
+	r, g, b, _ := img.At(1, 0).RGBA()
+	assert.Equal(t, []uint32{0, 0, 0xffff}, []uint32{r, g, b})
+
+	s.Desc.Vga = "none"
+	if err := s.Screenshot(target); assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "guest has no display")
+	}
+	s.manager.host = &fakeArchHost{arch: apis.OS_ARCH_AARCH64}
+	assert.Error(t, s.Screenshot(target))
+	s.Desc.Vga = "std"
+	assert.NoError(t, s.Screenshot(target))
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"fmt"
+	"hash/fnv"
+	"path"
+	"strings"
+
+	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+
+	"yunion.io/x/onecloud/pkg/hostman/options"
+	"yunion.io/x/onecloud/pkg/util/fileutils2"
+	"yunion.io/x/onecloud/pkg/util/procutils"
+)
+
+const (
+	SECURITY_DRIVER_NONE     = "none"
+	SECURITY_DRIVER_SELINUX  = "selinux"
+	SECURITY_DRIVER_APPARMOR = "apparmor"
+
+	SELINUX_PROCESS_TYPE = "svirt_t"
+	SELINUX_IMAGE_TYPE   = "svirt_image_t"
+	SELINUX_CONTENT_TYPE = "virt_content_t"
+	// count of selinux mcs categories guests are separated with
+	SELINUX_MCS_CATEGORIES = 1024
+
+	APPARMOR_PROFILE_DIR = "/etc/apparmor.d/cloudpods"
+)
+
+type sFileSecurityLabel struct {
+	Path string
+	// directory is labeled with files under it
+	IsDir bool
+	// shared by guests, e.g. cdrom and template backing file
+	ReadOnly bool
+	Label    string
+}
+
+// getSecurityLabelFiles returns local files qemu opens: home dir holding sockets,
+// pid, state and encrypt key files, disks and their backing templates and cdrom.
+// Paths of network storage, e.g. rbd:pool/image, are not files and are skipped
+func (s *SKVMGuestInstance) getSecurityLabelFiles() []sFileSecurityLabel {
+	files := []sFileSecurityLabel{{Path: s.HomeDir(), IsDir: true}}
+	addFile := func(file sFileSecurityLabel) {
+		if path.IsAbs(file.Path) {
+			files = append(files, file)
+		}
+	}
+	for _, disk := range s.Desc.Disks {
+		addFile(sFileSecurityLabel{Path: disk.Path})
+		addFile(sFileSecurityLabel{Path: disk.ImagePath, ReadOnly: true})
+	}
+	if s.Desc.Cdrom != nil {
+		addFile(sFileSecurityLabel{Path: s.Desc.Cdrom.Path, ReadOnly: true})
+	}
+	addFile(sFileSecurityLabel{Path: s.Desc.Metadata["boot_splash"], ReadOnly: true})
+	for _, key := range []string{"host_serial_devices", "host_parallel_devices"} {
+		for _, dev := range strings.Split(s.Desc.Metadata[key], ",") {
+			addFile(sFileSecurityLabel{Path: strings.TrimSpace(dev)})
+		}
+	}
+	return files
+}
+
+// getSelinuxMcsCategories derives a distinct category pair from guest uuid,
+// files of a guest are not accessible to qemu of other guests
+func getSelinuxMcsCategories(uuid string) string {
+	h := fnv.New32a()
+	h.Write([]byte(uuid))
+	sum := h.Sum32()
+	c0 := sum % SELINUX_MCS_CATEGORIES
+	c1 := (sum / SELINUX_MCS_CATEGORIES) % (SELINUX_MCS_CATEGORIES - 1)
+	if c1 >= c0 {
+		c1 += 1
+	} else {
+		c0, c1 = c1, c0
+	}
+	return fmt.Sprintf("c%d,c%d", c0, c1)
+}
+
+// getSelinuxProcessContext is the context qemu runs in, its categories
+// match labels of the guest's own files
+func getSelinuxProcessContext(uuid string) string {
+	return fmt.Sprintf("system_u:system_r:%s:s0:%s", SELINUX_PROCESS_TYPE, getSelinuxMcsCategories(uuid))
+}
+
+func getSelinuxLabel(uuid string, file sFileSecurityLabel) string {
+	if file.ReadOnly {
+		return fmt.Sprintf("system_u:object_r:%s:s0", SELINUX_CONTENT_TYPE)
+	}
+	return fmt.Sprintf("system_u:object_r:%s:s0:%s", SELINUX_IMAGE_TYPE, getSelinuxMcsCategories(uuid))
+}
+
+// apparmor label is the file rule of guest profile
+func getAppArmorLabel(file sFileSecurityLabel) string {
+	perm := "rwk"
+	if file.ReadOnly {
+		perm = "r"
+	}
+	if file.IsDir {
+		return fmt.Sprintf("%q r,\n%q %s,", file.Path+"/", file.Path+"/**", perm)
+	}
+	return fmt.Sprintf("%q %s,", file.Path, perm)
+}
+
+func computeSecurityLabels(driver, uuid string, files []sFileSecurityLabel) ([]sFileSecurityLabel, error) {
+	ret := make([]sFileSecurityLabel, len(files))
+	for i, file := range files {
+		switch driver {
+		case SECURITY_DRIVER_SELINUX:
+			file.Label = getSelinuxLabel(uuid, file)
+		case SECURITY_DRIVER_APPARMOR:
+			file.Label = getAppArmorLabel(file)
+		default:
+			return nil, errors.Wrapf(errors.ErrNotSupported, "security driver %q", driver)
+		}
+		ret[i] = file
+	}
+	return ret, nil
+}
+
+func getAppArmorProfileName(uuid string) string {
+	return fmt.Sprintf("cloudpods-%s", uuid)
+}
+
+// rules every confined qemu needs besides guest files: binaries of installed
+// qemu versions and devices of kvm, tap and hugepages
+var appArmorBaseRules = []string{
+	"/usr/bin/qemu-* rmix,",
+	"/usr/local/bin/qemu-* rmix,",
+	"/usr/local/qemu-*/** rmix,",
+	"/dev/kvm rw,",
+	"/dev/net/tun rw,",
+	"/dev/vhost-net rw,",
+	"/dev/hugepages/** rw,",
+}
+
+func getAppArmorProfile(uuid string, labels []sFileSecurityLabel) string {
+	rules := []string{}
+	for _, rule := range appArmorBaseRules {
+		rules = append(rules, "  "+rule)
+	}
+	for _, l := range labels {
+		for _, rule := range strings.Split(l.Label, "\n") {
+			rules = append(rules, "  "+rule)
+		}
+	}
+	return fmt.Sprintf("profile %s {\n  #include <abstractions/base>\n%s\n}\n",
+		getAppArmorProfileName(uuid), strings.Join(rules, "\n"))
+}
+
+// applySecurityLabels relabels files for selinux or loads guest apparmor profile
+var applySecurityLabels = func(driver, uuid string, labels []sFileSecurityLabel) error {
+	switch driver {
+	case SECURITY_DRIVER_SELINUX:
+		for _, l := range labels {
+			args := []string{l.Label, l.Path}
+			if l.IsDir {
+				args = append([]string{"-R"}, args...)
+			}
+			if output, err := procutils.NewRemoteCommandAsFarAsPossible("chcon", args...).Output(); err != nil {
+				return errors.Wrapf(err, "chcon %s: %s", l.Path, output)
+			}
+		}
+	case SECURITY_DRIVER_APPARMOR:
+		profile := path.Join(APPARMOR_PROFILE_DIR, uuid)
+		if err := procutils.NewRemoteCommandAsFarAsPossible("mkdir", "-p", APPARMOR_PROFILE_DIR).Run(); err != nil {
+			return errors.Wrapf(err, "mkdir %s", APPARMOR_PROFILE_DIR)
+		}
+		if err := fileutils2.FilePutContents(profile, getAppArmorProfile(uuid, labels), false); err != nil {
+			return errors.Wrapf(err, "write profile %s", profile)
+		}
+		if output, err := procutils.NewRemoteCommandAsFarAsPossible("apparmor_parser", "-r", profile).Output(); err != nil {
+			return errors.Wrapf(err, "apparmor_parser %s: %s", profile, output)
+		}
+	}
+	return nil
+}
+
+// removeSecurityProfile unloads guest apparmor profile and removes its file
+var removeSecurityProfile = func(driver, uuid string) error {
+	if driver != SECURITY_DRIVER_APPARMOR {
+		return nil
+	}
+	profile := path.Join(APPARMOR_PROFILE_DIR, uuid)
+	if !fileutils2.Exists(profile) {
+		return nil
+	}
+	if output, err := procutils.NewRemoteCommandAsFarAsPossible("apparmor_parser", "-R", profile).Output(); err != nil {
+		return errors.Wrapf(err, "apparmor_parser -R %s: %s", profile, output)
+	}
+	if output, err := procutils.NewRemoteCommandAsFarAsPossible("rm", "-f", profile).Output(); err != nil {
+		return errors.Wrapf(err, "rm %s: %s", profile, output)
+	}
+	return nil
+}
+
+// applyGuestSecurityLabels labels guest files for security module of host
+// so that confined qemu is able to open them
+func (s *SKVMGuestInstance) applyGuestSecurityLabels() error {
+	driver := options.HostOptions.SecurityDriver
+	if len(driver) == 0 || driver == SECURITY_DRIVER_NONE {
+		return nil
+	}
+	labels, err := computeSecurityLabels(driver, s.Desc.Uuid, s.getSecurityLabelFiles())
+	if err != nil {
+		return errors.Wrap(err, "computeSecurityLabels")
+	}
+	log.Infof("apply %s labels of guest %s", driver, s.GetName())
+	return applySecurityLabels(driver, s.Desc.Uuid, labels)
+}
+
+// removeGuestSecurityProfile unloads profile of deleted guest, relabeled
+// files are removed with guest
+func (s *SKVMGuestInstance) removeGuestSecurityProfile() error {
+	driver := options.HostOptions.SecurityDriver
+	if len(driver) == 0 || driver == SECURITY_DRIVER_NONE {
+		return nil
+	}
+	return removeSecurityProfile(driver, s.Desc.Uuid)
+}
+
+// getSecurityLaunchScript confines qemu launched by start script, with apparmor
+// profile or selinux context matching labels of guest files
+func (s *SKVMGuestInstance) getSecurityLaunchScript() string {
+	switch options.HostOptions.SecurityDriver {
+	case SECURITY_DRIVER_SELINUX:
+		return fmt.Sprintf("CMD=\"runcon %s $CMD\"\n", getSelinuxProcessContext(s.Desc.Uuid))
+	case SECURITY_DRIVER_APPARMOR:
+		return fmt.Sprintf("CMD=\"aa-exec -p %s -- $CMD\"\n", getAppArmorProfileName(s.Desc.Uuid))
+	}
+	return ""
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	api "yunion.io/x/onecloud/pkg/apis/compute"
+	"yunion.io/x/onecloud/pkg/hostman/options"
+)
+
+func newTestLabelGuest() *SKVMGuestInstance {
+	s := newTestStartGuest()
+	s.Desc.Disks = []*api.GuestdiskJsonDesc{
+		{Path: "/opt/cloud/workspace/disks/disk-0", ImagePath: "/opt/cloud/workspace/disks/image_cache/img-0"},
+		{Path: "/opt/cloud/workspace/disks/disk-1"},
+		// network storage is not labeled
+		{Path: "rbd:pool/disk-2:mon_host=10.0.0.1"},
+	}
+	s.Desc.Cdrom = &api.GuestcdromJsonDesc{Path: "/opt/cloud/workspace/disks/image_cache/iso-0"}
+	return s
+}
+
+func Test_getSelinuxMcsCategories(t *testing.T) {
+	reg := regexp.MustCompile(`^c(\d+),c(\d+)$`)
+	seen := map[string]string{}
+	for _, uuid := range []string{"uuid-xxxx-xxxx", "uuid-yyyy-yyyy", "uuid-zzzz-zzzz", ""} {
+		cats := getSelinuxMcsCategories(uuid)
+		m := reg.FindStringSubmatch(cats)
+		if assert.NotNil(t, m, cats) {
+			c0, _ := strconv.Atoi(m[1])
+			c1, _ := strconv.Atoi(m[2])
+			assert.True(t, c0 < c1 && c1 < SELINUX_MCS_CATEGORIES, cats)
+		}
+		assert.Equal(t, cats, getSelinuxMcsCategories(uuid))
+		assert.NotContains(t, seen, cats)
+		seen[cats] = uuid
+	}
+}
+
+func Test_computeSecurityLabels(t *testing.T) {
+	s := newTestLabelGuest()
+	files := s.getSecurityLabelFiles()
+	cats := getSelinuxMcsCategories(s.Desc.Uuid)
+
+	labels, err := computeSecurityLabels(SECURITY_DRIVER_SELINUX, s.Desc.Uuid, files)
+	if err != nil {
+		t.Fatalf("computeSecurityLabels: %v", err)
+	}
+	imageLabel := "system_u:object_r:svirt_image_t:s0:" + cats
+	contentLabel := "system_u:object_r:virt_content_t:s0"
+	assert.Equal(t, []sFileSecurityLabel{
+		{Path: s.HomeDir(), IsDir: true, Label: imageLabel},
+		{Path: "/opt/cloud/workspace/disks/disk-0", Label: imageLabel},
+		{Path: "/opt/cloud/workspace/disks/image_cache/img-0", ReadOnly: true, Label: contentLabel},
+		{Path: "/opt/cloud/workspace/disks/disk-1", Label: imageLabel},
+		{Path: "/opt/cloud/workspace/disks/image_cache/iso-0", ReadOnly: true, Label: contentLabel},
+	}, labels)
+	// files passed in are not labeled
+	assert.Empty(t, files[0].Label)
+
+	labels, err = computeSecurityLabels(SECURITY_DRIVER_APPARMOR, s.Desc.Uuid, files)
+	if err != nil {
+		t.Fatalf("computeSecurityLabels: %v", err)
+	}
+	assert.Equal(t, `profile cloudpods-uuid-xxxx-xxxx {
+  #include <abstractions/base>
+  /usr/bin/qemu-* rmix,
+  /usr/local/bin/qemu-* rmix,
+  /usr/local/qemu-*/** rmix,
+  /dev/kvm rw,
+  /dev/net/tun rw,
+  /dev/vhost-net rw,
+  /dev/hugepages/** rw,
+  "/opt/cloud/workspace/servers/test-guest/" r,
+  "/opt/cloud/workspace/servers/test-guest/**" rwk,
+  "/opt/cloud/workspace/disks/disk-0" rwk,
+  "/opt/cloud/workspace/disks/image_cache/img-0" r,
+  "/opt/cloud/workspace/disks/disk-1" rwk,
+  "/opt/cloud/workspace/disks/image_cache/iso-0" r,
+}
+`, getAppArmorProfile(s.Desc.Uuid, labels))
+
+	_, err = computeSecurityLabels("smack", s.Desc.Uuid, files)
+	assert.Error(t, err)
+}
+
+func TestSKVMGuestInstance_applyGuestSecurityLabels(t *testing.T) {
+	savedDriver := options.HostOptions.SecurityDriver
+	savedApply := applySecurityLabels
+	defer func() {
+		options.HostOptions.SecurityDriver = savedDriver
+		applySecurityLabels = savedApply
+	}()
+	applied := map[string][]sFileSecurityLabel{}
+	applySecurityLabels = func(driver, uuid string, labels []sFileSecurityLabel) error {
+		applied[driver] = labels
+		return nil
+	}
+
+	s := newTestLabelGuest()
+	for _, driver := range []string{"", SECURITY_DRIVER_NONE} {
+		options.HostOptions.SecurityDriver = driver
+		assert.NoError(t, s.applyGuestSecurityLabels())
+	}
+	assert.Len(t, applied, 0)
+
+	options.HostOptions.SecurityDriver = SECURITY_DRIVER_SELINUX
+	assert.NoError(t, s.applyGuestSecurityLabels())
+	assert.Len(t, applied[SECURITY_DRIVER_SELINUX], 5)
+
+	options.HostOptions.SecurityDriver = "smack"
+	assert.Error(t, s.applyGuestSecurityLabels())
+}
+
+func TestSKVMGuestInstance_getSecurityLaunchScript(t *testing.T) {
+	savedDriver := options.HostOptions.SecurityDriver
+	defer func() { options.HostOptions.SecurityDriver = savedDriver }()
+
+	s := newTestLabelGuest()
+	cats := getSelinuxMcsCategories(s.Desc.Uuid)
+	for driver, want := range map[string]string{
+		"":                       "",
+		SECURITY_DRIVER_NONE:     "",
+		SECURITY_DRIVER_SELINUX:  "CMD=\"runcon system_u:system_r:svirt_t:s0:" + cats + " $CMD\"\n",
+		SECURITY_DRIVER_APPARMOR: "CMD=\"aa-exec -p cloudpods-uuid-xxxx-xxxx -- $CMD\"\n",
+	} {
+		options.HostOptions.SecurityDriver = driver
+		assert.Equal(t, want, s.getSecurityLaunchScript(), driver)
+	}
+}
+
+func TestSKVMGuestInstance_removeGuestSecurityProfile(t *testing.T) {
+	savedDriver := options.HostOptions.SecurityDriver
+	savedRemove := removeSecurityProfile
+	defer func() {
+		options.HostOptions.SecurityDriver = savedDriver
+		removeSecurityProfile = savedRemove
+	}()
+	removed := []string{}
+	removeSecurityProfile = func(driver, uuid string) error {
+		removed = append(removed, driver+"/"+uuid)
+		return nil
+	}
+
+	s := newTestLabelGuest()
+	options.HostOptions.SecurityDriver = SECURITY_DRIVER_NONE
+	assert.NoError(t, s.removeGuestSecurityProfile())
+	options.HostOptions.SecurityDriver = SECURITY_DRIVER_APPARMOR
+	assert.NoError(t, s.removeGuestSecurityProfile())
+	assert.Equal(t, []string{"apparmor/uuid-xxxx-xxxx"}, removed)
+}
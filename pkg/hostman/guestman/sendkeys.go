@@ -0,0 +1,165 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"fmt"
+	"strings"
+
+	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+)
+
+// SENDKEY_MAX_COMBO_KEYS is the max keys pressed together, qemu limits to 16
+const SENDKEY_MAX_COMBO_KEYS = 16
+
+var (
+	// common key names to qemu qcodes, names already being qcodes are
+	// accepted as they are
+	sendKeyAliases = map[string]string{
+		"control":     "ctrl",
+		"lctrl":       "ctrl",
+		"rctrl":       "ctrl_r",
+		"lalt":        "alt",
+		"ralt":        "alt_r",
+		"altgr":       "alt_r",
+		"lshift":      "shift",
+		"rshift":      "shift_r",
+		"win":         "meta_l",
+		"super":       "meta_l",
+		"meta":        "meta_l",
+		"cmd":         "meta_l",
+		"enter":       "ret",
+		"return":      "ret",
+		"escape":      "esc",
+		"del":         "delete",
+		"ins":         "insert",
+		"space":       "spc",
+		"bs":          "backspace",
+		"pageup":      "pgup",
+		"pagedown":    "pgdn",
+		"printscreen": "print",
+		"prtsc":       "print",
+		"capslock":    "caps_lock",
+		"numlock":     "num_lock",
+		"scrolllock":  "scroll_lock",
+		"break":       "pause",
+		"-":           "minus",
+		"=":           "equal",
+		"[":           "bracket_left",
+		"]":           "bracket_right",
+		";":           "semicolon",
+		"'":           "apostrophe",
+		"`":           "grave_accent",
+		"\\":          "backslash",
+		",":           "comma",
+		".":           "dot",
+		"/":           "slash",
+	}
+
+	sendKeyQcodes = map[string]bool{}
+)
+
+func init() {
+	for _, qcode := range []string{
+		"ctrl", "ctrl_r", "alt", "alt_r", "shift", "shift_r", "meta_l", "meta_r", "menu",
+		"ret", "esc", "delete", "insert", "spc", "tab", "backspace",
+		"home", "end", "pgup", "pgdn", "up", "down", "left", "right",
+		"print", "sysrq", "pause", "caps_lock", "num_lock", "scroll_lock",
+		"minus", "equal", "bracket_left", "bracket_right", "semicolon", "apostrophe",
+		"grave_accent", "backslash", "comma", "dot", "slash", "less",
+		"kp_0", "kp_1", "kp_2", "kp_3", "kp_4", "kp_5", "kp_6", "kp_7", "kp_8", "kp_9",
+		"kp_add", "kp_subtract", "kp_multiply", "kp_divide", "kp_decimal", "kp_enter",
+		"power", "sleep", "wake",
+	} {
+		sendKeyQcodes[qcode] = true
+	}
+	for c := 'a'; c <= 'z'; c++ {
+		sendKeyQcodes[string(c)] = true
+	}
+	for c := '0'; c <= '9'; c++ {
+		sendKeyQcodes[string(c)] = true
+	}
+	for i := 1; i <= 12; i++ {
+		sendKeyQcodes[fmt.Sprintf("f%d", i)] = true
+	}
+}
+
+func getKeyQcode(key string) (string, error) {
+	name := strings.ToLower(strings.TrimSpace(key))
+	if qcode, ok := sendKeyAliases[name]; ok {
+		return qcode, nil
+	}
+	if sendKeyQcodes[name] {
+		return name, nil
+	}
+	return "", errors.Wrapf(errors.ErrNotSupported, "key %q", key)
+}
+
+// parseKeyCombo maps a combo of keys joined by '-' or '+', e.g. ctrl-alt-del,
+// to qcodes which are pressed together
+func parseKeyCombo(combo string) ([]string, error) {
+	if len(combo) == 0 {
+		return nil, errors.Errorf("empty key")
+	}
+	names := []string{combo}
+	if len(combo) > 1 {
+		names = strings.FieldsFunc(combo, func(r rune) bool { return r == '-' || r == '+' })
+		if len(names) == 0 {
+			// separators only, e.g. "--", is looked up as a whole
+			names = []string{combo}
+		}
+	}
+	if len(names) > SENDKEY_MAX_COMBO_KEYS {
+		return nil, errors.Errorf("key combo %q has more than %d keys", combo, SENDKEY_MAX_COMBO_KEYS)
+	}
+	qcodes := make([]string, 0, len(names))
+	for _, name := range names {
+		qcode, err := getKeyQcode(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "key combo %q", combo)
+		}
+		qcodes = append(qcodes, qcode)
+	}
+	return qcodes, nil
+}
+
+// SendKeys sends keys to guest one after another through monitor, each key
+// may be a combo of modifiers, e.g. ["ctrl-alt-del"] or ["e", "down", "enter"]
+func (s *SKVMGuestInstance) SendKeys(keys []string) error {
+	if len(keys) == 0 {
+		return errors.Errorf("no keys to send")
+	}
+	combos := make([][]string, 0, len(keys))
+	for _, key := range keys {
+		qcodes, err := parseKeyCombo(key)
+		if err != nil {
+			return err
+		}
+		combos = append(combos, qcodes)
+	}
+	if s.Monitor == nil {
+		return errors.Errorf("guest %s monitor not connected", s.GetName())
+	}
+	for _, qcodes := range combos {
+		ch := make(chan string, 1)
+		s.Monitor.SendKey(qcodes, 0, func(res string) { ch <- res })
+		if res := <-ch; len(res) > 0 {
+			return errors.Errorf("send key %s: %s", strings.Join(qcodes, "-"), res)
+		}
+	}
+	log.Infof("%s sent keys %v", s.logPrefix(), keys)
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_parseKeyCombo(t *testing.T) {
+	cases := []struct {
+		combo   string
+		want    []string
+		wantErr bool
+	}{
+		{combo: "enter", want: []string{"ret"}},
+		{combo: "Return", want: []string{"ret"}},
+		{combo: "a", want: []string{"a"}},
+		{combo: "F12", want: []string{"f12"}},
+		{combo: "space", want: []string{"spc"}},
+		{combo: "esc", want: []string{"esc"}},
+		{combo: "-", want: []string{"minus"}},
+		{combo: "ctrl-alt-del", want: []string{"ctrl", "alt", "delete"}},
+		{combo: "Ctrl+Alt+Delete", want: []string{"ctrl", "alt", "delete"}},
+		{combo: "ctrl-minus", want: []string{"ctrl", "minus"}},
+		{combo: "win+r", want: []string{"meta_l", "r"}},
+		{combo: "alt-f4", want: []string{"alt", "f4"}},
+		{combo: "", wantErr: true},
+		{combo: "--", wantErr: true},
+		{combo: "ctrl-foo", wantErr: true},
+		{combo: "f13", wantErr: true},
+	}
+	for _, c := range cases {
+		t.Run(c.combo, func(t *testing.T) {
+			got, err := parseKeyCombo(c.combo)
+			if c.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, c.want, got)
+		})
+	}
+}
+
+func TestSKVMGuestInstance_SendKeys(t *testing.T) {
+	s := newTestGuest(map[string]string{})
+	assert.Error(t, s.SendKeys([]string{"ctrl-alt-del"}))
+
+	mon := &fakeMonitor{}
+	s.Monitor = mon
+	assert.NoError(t, s.SendKeys([]string{"ctrl-alt-del"}))
+	assert.NoError(t, s.SendKeys([]string{"e", "down", "enter"}))
+	assert.Equal(t, []string{
+		"sendkey ctrl-alt-delete",
+		"sendkey e",
+		"sendkey down",
+		"sendkey ret",
+	}, mon.Commands())
+
+	// nothing is sent if any key is unknown
+	assert.Error(t, s.SendKeys([]string{"enter", "nokey"}))
+	assert.Error(t, s.SendKeys(nil))
+	assert.Len(t, mon.Commands(), 4)
+}
@@ -0,0 +1,234 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package guestman
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"yunion.io/x/jsonutils"
+	"yunion.io/x/pkg/utils"
+
+	"yunion.io/x/onecloud/pkg/apis"
+	api "yunion.io/x/onecloud/pkg/apis/compute"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/desc"
+	"yunion.io/x/onecloud/pkg/hostman/guestman/qemu"
+	"yunion.io/x/onecloud/pkg/hostman/hostinfo/hostbridge"
+	"yunion.io/x/onecloud/pkg/hostman/hostutils"
+	"yunion.io/x/onecloud/pkg/hostman/options"
+	"yunion.io/x/onecloud/pkg/hostman/storageman"
+)
+
+// go test -run TestGenerateStartScriptGolden -update
+var updateGolden = flag.Bool("update", false, "update golden start scripts in testdata")
+
+type fakeBridge struct {
+	hostbridge.IBridgeDriver
+	name string
+}
+
+func (b *fakeBridge) Bridge() string {
+	return b.name
+}
+
+// nic scripts are rendered by bridge drivers, not pinned here
+func (b *fakeBridge) GenerateIfupScripts(scriptPath string, nic *api.GuestnetworkJsonDesc, isSlave bool) error {
+	return nil
+}
+
+func (b *fakeBridge) GenerateIfdownScripts(scriptPath string, nic *api.GuestnetworkJsonDesc, isSlave bool) error {
+	return nil
+}
+
+// fakeHost resolves nic script paths through its bridges,
+// any bridge is found unless bridges are given
+type fakeHost struct {
+	hostutils.IHost
+	bridges []string
+}
+
+func (h *fakeHost) GetBridgeDev(bridge string) hostbridge.IBridgeDriver {
+	if h.bridges != nil && !utils.IsInStringArray(bridge, h.bridges) {
+		return nil
+	}
+	return &fakeBridge{name: bridge}
+}
+
+type fakeDisk struct {
+	storageman.IDisk
+	path string
+}
+
+func (d *fakeDisk) GetType() string {
+	return api.STORAGE_LOCAL
+}
+
+func (d *fakeDisk) GetDiskSetupScripts(idx int) string {
+	return fmt.Sprintf("DISK_%d=%s\n", idx, d.path)
+}
+
+func newGoldenDisk(index int8, driver string) *api.GuestdiskJsonDesc {
+	diskId := fmt.Sprintf("disk-%d", index)
+	return &api.GuestdiskJsonDesc{
+		DiskId:    diskId,
+		Index:     index,
+		Driver:    driver,
+		CacheMode: "none",
+		AioMode:   "native",
+		Format:    "qcow2",
+		Size:      30720,
+		Path:      "/opt/cloud/workspace/disks/" + diskId,
+	}
+}
+
+func newGoldenNic(index int8, driver string) *api.GuestnetworkJsonDesc {
+	return &api.GuestnetworkJsonDesc{
+		Index:   index,
+		Driver:  driver,
+		Bridge:  "br0",
+		Ifname:  fmt.Sprintf("vnet%d", index),
+		Mac:     fmt.Sprintf("00:22:0a:00:00:0%d", index),
+		Ip:      fmt.Sprintf("10.0.0.%d", 10+index),
+		Masklen: 24,
+		Bw:      1000,
+		Mtu:     1500,
+	}
+}
+
+type goldenGuest struct {
+	name     string
+	host     *fakeHostCapabilities
+	metadata map[string]string
+	desc     func(d *desc.SGuestDesc)
+}
+
+var goldenGuests = []goldenGuest{
+	{
+		name: "linux_virtio",
+		host: &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true},
+		desc: func(d *desc.SGuestDesc) {
+			d.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "virtio"), newGoldenDisk(1, "virtio")}
+			d.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio")}
+		},
+	},
+	{
+		name:     "windows_q35_uefi",
+		host:     &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true},
+		metadata: map[string]string{"os_name": OS_NAME_WINDOWS},
+		desc: func(d *desc.SGuestDesc) {
+			d.Machine = api.VM_MACHINE_TYPE_Q35
+			d.Bios = qemu.BIOS_UEFI
+			d.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "scsi")}
+			d.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "e1000")}
+		},
+	},
+	{
+		name:     "macos",
+		host:     &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true},
+		metadata: map[string]string{"os_name": OS_NAME_MACOS},
+		desc: func(d *desc.SGuestDesc) {
+			d.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "virtio")}
+			d.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio")}
+		},
+	},
+	{
+		name: "aarch64",
+		host: &fakeHostCapabilities{arch: apis.OS_ARCH_AARCH64, kvm: true},
+		desc: func(d *desc.SGuestDesc) {
+			d.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "virtio")}
+			d.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio")}
+		},
+	},
+	{
+		name: "spice_vdi",
+		host: &fakeHostCapabilities{arch: apis.OS_ARCH_X86_64, kvm: true, intel: true},
+		desc: func(d *desc.SGuestDesc) {
+			d.Vdi = "spice"
+			d.Vga = "qxl"
+			d.Disks = []*api.GuestdiskJsonDesc{newGoldenDisk(0, "virtio")}
+			d.Nics = []*api.GuestnetworkJsonDesc{newGoldenNic(0, "virtio")}
+		},
+	},
+}
+
+// qemu binary is looked up on the running host
+var goldenQemuCmdReg = regexp.MustCompile(`(?m)^DEFAULT_QEMU_CMD=.*$`)
+
+func renderGoldenStartScript(t *testing.T, g goldenGuest) string {
+	s := newTestGuest(map[string]string{})
+	s.Desc.Name = "golden-vm"
+	s.Desc.Uuid = "00000000-0000-0000-0000-000000000001"
+	s.Desc.Mem = 2048
+	s.Desc.Cpu = 2
+	for k, v := range g.metadata {
+		s.Desc.Metadata[k] = v
+	}
+	g.desc(s.Desc)
+
+	host := *g.host
+	host.disks = map[string]storageman.IDisk{}
+	for _, disk := range s.Desc.Disks {
+		host.disks[disk.Path] = &fakeDisk{path: disk.Path}
+	}
+
+	// rendering does not depend on ports listened on the host running tests
+	savedPortUsed := tcpPortUsed
+	tcpPortUsed = func(string, int) bool { return false }
+	defer func() { tcpPortUsed = savedPortUsed }()
+
+	data := jsonutils.NewDict()
+	data.Set("qemu_version", jsonutils.NewString(string(qemu.Version_4_2_0)))
+	data.Set("vnc_port", jsonutils.NewInt(1))
+	script, err := s.generateStartScript(data, &host)
+	if err != nil {
+		t.Fatalf("generateStartScript: %v", err)
+	}
+	return goldenQemuCmdReg.ReplaceAllString(script, "DEFAULT_QEMU_CMD='/usr/bin/qemu-system'")
+}
+
+func TestGenerateStartScriptGolden(t *testing.T) {
+	savedManager := guestManager
+	guestManager = &SGuestManager{host: &fakeHost{}}
+	defer func() { guestManager = savedManager }()
+
+	savedOptions := options.HostOptions
+	options.HostOptions.OvmfPath = "/opt/cloud/contrib/OVMF.fd"
+	options.HostOptions.OvnIntegrationBridge = "brvpc"
+	defer func() { options.HostOptions = savedOptions }()
+
+	for _, g := range goldenGuests {
+		t.Run(g.name, func(t *testing.T) {
+			script := renderGoldenStartScript(t, g)
+			goldenPath := filepath.Join("testdata", "start_scripts", g.name+".sh")
+			if *updateGolden {
+				if err := ioutil.WriteFile(goldenPath, []byte(script), 0644); err != nil {
+					t.Fatalf("write %s: %v", goldenPath, err)
+				}
+				return
+			}
+			golden, err := ioutil.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("read %s: %v, run with -update to create it", goldenPath, err)
+			}
+			if script != string(golden) {
+				t.Errorf("start script of %s differs from %s, run with -update if intended\ngot:\n%s", g.name, goldenPath, script)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+/opt/cloud/workspace/servers/test-guest/if-down-br0-vnet0.sh vnet0 &
+wait
+echo 1 > /opt/cloud/workspace/servers/test-guest/vnc
+ DISK_0=/opt/cloud/workspace/disks/disk-0
+STATE_FILE=`ls -d /opt/cloud/workspace/servers/test-guest/STATEFILE* | head -n 1`
+PID_FILE=/opt/cloud/workspace/servers/test-guest/pid
+DEFAULT_QEMU_CMD='/usr/bin/qemu-system'
+QEMU_CMD=$DEFAULT_QEMU_CMD
+QEMU_CMD_KVM_ARG=-enable-kvm
+
+function nic_speed() {
+    $QEMU_CMD $QEMU_CMD_KVM_ARG -device virtio-net-pci,help 2>&1 | grep -q "\<speed="
+    if [ "$?" -eq "0" ]; then
+        echo ",speed=$1"
+    fi
+}
+
+function nic_mtu() {
+    local bridge="$1"; shift
+
+    $QEMU_CMD $QEMU_CMD_KVM_ARG -device virtio-net-pci,help 2>&1 | grep -q '\<host_mtu='
+    if [ "$?" -eq "0" ]; then
+        local origmtu="$(<"/sys/class/net/$bridge/mtu")"
+        if [ -n "$origmtu" -a "$origmtu" -gt 576 ]; then
+            echo ",host_mtu=$(($origmtu - 60))"
+        fi
+    fi
+}
+CMD="$QEMU_CMD $QEMU_CMD_KVM_ARG -S -cpu max -chardev socket,id=hmqmondev,port=55901,host=127.0.0.1,nodelay,server,nowait -mon chardev=hmqmondev,id=hmqmon,mode=readline -rtc base=utc,clock=host,driftfix=none -daemonize -nodefaults -no-user-config   -machine virt,accel=kvm,gic-version=3,dump-guest-core=off -k en-us -smp cpus=2,sockets=2,cores=32,maxcpus=64 -name 'golden-vm',debug-threads=on  -m 2048M,slots=4,maxmem=262144M -object memory-backend-ram,id=mem,size=2048M -numa node,memdev=mem -bios /opt/cloud/contrib/OVMF.fd -device virtio-serial -usb -device qemu-xhci,p2=8,p3=8,id=usb1 -device usb-tablet,id=input0,bus=usb1.0,port=1 -device usb-kbd,id=input1,bus=usb1.0,port=2 -device virtio-gpu-pci,id=video1,max_outputs=1 -vnc :1 -object iothread,id=iothread0 -drive file=$DISK_0,if=none,id=drive_0,cache=none,aio=native,file.locking=off -device virtio-blk-pci,drive=drive_0,bus=pci.0,addr=0x7,iothread=iothread0,id=drive_0 -netdev type=tap,id=vnet0,ifname=vnet0,vhost=on,vhostforce=off,script=/opt/cloud/workspace/servers/test-guest/if-up-br0-vnet0.sh,downscript=/opt/cloud/workspace/servers/test-guest/if-down-br0-vnet0.sh -device virtio-net-pci,id=netdev-vnet0,netdev=vnet0,mac=00:22:0a:00:00:00$(nic_speed 1000) -device qemu-xhci,id=usb -pidfile /opt/cloud/workspace/servers/test-guest/pid   "
+
+if [ ! -z "$STATE_FILE" ] && [ -d "$STATE_FILE" ] && [ -f "$STATE_FILE/content" ]; then
+    CMD="$CMD --incoming \"exec: cat $STATE_FILE/content\""
+elif [ ! -z "$STATE_FILE" ] && [ -f "$STATE_FILE" ]; then
+    CMD="$CMD --incoming \"exec: cat $STATE_FILE\""
+fi
+eval $CMD
\ No newline at end of file
@@ -0,0 +1,36 @@
+/opt/cloud/workspace/servers/test-guest/if-down-br0-vnet0.sh vnet0 &
+wait
+echo 1 > /opt/cloud/workspace/servers/test-guest/vnc
+ DISK_0=/opt/cloud/workspace/disks/disk-0
+STATE_FILE=`ls -d /opt/cloud/workspace/servers/test-guest/STATEFILE* | head -n 1`
+PID_FILE=/opt/cloud/workspace/servers/test-guest/pid
+DEFAULT_QEMU_CMD='/usr/bin/qemu-system'
+QEMU_CMD=$DEFAULT_QEMU_CMD
+QEMU_CMD_KVM_ARG=-enable-kvm
+
+function nic_speed() {
+    $QEMU_CMD $QEMU_CMD_KVM_ARG -device virtio-net-pci,help 2>&1 | grep -q "\<speed="
+    if [ "$?" -eq "0" ]; then
+        echo ",speed=$1"
+    fi
+}
+
+function nic_mtu() {
+    local bridge="$1"; shift
+
+    $QEMU_CMD $QEMU_CMD_KVM_ARG -device virtio-net-pci,help 2>&1 | grep -q '\<host_mtu='
+    if [ "$?" -eq "0" ]; then
+        local origmtu="$(<"/sys/class/net/$bridge/mtu")"
+        if [ -n "$origmtu" -a "$origmtu" -gt 576 ]; then
+            echo ",host_mtu=$(($origmtu - 60))"
+        fi
+    fi
+}
+CMD="$QEMU_CMD $QEMU_CMD_KVM_ARG -S -cpu qemu64,+kvm_pv_eoi,+vmx,+ssse3,+sse4.1,+sse4.2,-x2apic,+aes,+avx,+vme,+pat,+ss,+pclmulqdq,+xsave,level=13,kvm=off -chardev socket,id=hmqmondev,port=55901,host=127.0.0.1,nodelay,server,nowait -mon chardev=hmqmondev,id=hmqmon,mode=readline -rtc base=utc,clock=host,driftfix=none -daemonize -nodefaults -no-user-config  -global kvm-pit.lost_tick_policy=discard -machine q35,accel=kvm,dump-guest-core=off -k en-us -smp cpus=2,sockets=2,cores=64,maxcpus=128 -name 'golden-vm',debug-threads=on  -m 2048M,slots=4,maxmem=524288M -object memory-backend-ram,id=mem,size=2048M -numa node,memdev=mem -bios /opt/cloud/contrib/OVMF.fd -device virtio-serial -usb -device usb-kbd -device usb-tablet -vga std -vnc :1 -object iothread,id=iothread0 -device virtio-scsi-pci,id=scsi -drive file=$DISK_0,if=none,id=drive_0,cache=none,aio=native,file.locking=off -device scsi-hd,drive=drive_0,bus=scsi.0,id=drive_0 -device ide-cd,drive=ide0-cd0,bus=ide.1 -drive id=ide0-cd0,media=cdrom,if=none -netdev type=tap,id=vnet0,ifname=vnet0,script=/opt/cloud/workspace/servers/test-guest/if-up-br0-vnet0.sh,downscript=/opt/cloud/workspace/servers/test-guest/if-down-br0-vnet0.sh -device e1000-82545em,id=netdev-vnet0,netdev=vnet0,mac=00:22:0a:00:00:00 -device qemu-xhci,id=usb -pidfile /opt/cloud/workspace/servers/test-guest/pid   -chardev socket,path=/opt/cloud/workspace/servers/test-guest/qga.sock,server,nowait,id=qga0 -device virtserialport,chardev=qga0,name=org.qemu.guest_agent.0 -chardev pty,id=charserial0 -device isa-serial,chardev=charserial0,id=serial0 -device pvpanic"
+
+if [ ! -z "$STATE_FILE" ] && [ -d "$STATE_FILE" ] && [ -f "$STATE_FILE/content" ]; then
+    CMD="$CMD --incoming \"exec: cat $STATE_FILE/content\""
+elif [ ! -z "$STATE_FILE" ] && [ -f "$STATE_FILE" ]; then
+    CMD="$CMD --incoming \"exec: cat $STATE_FILE\""
+fi
+eval $CMD
\ No newline at end of file
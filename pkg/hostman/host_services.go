@@ -15,10 +15,14 @@
 package hostman
 
 import (
+	"context"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path/filepath"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	execlient "yunion.io/x/executor/client"
 	"yunion.io/x/log"
 	"yunion.io/x/pkg/errors"
@@ -139,6 +143,7 @@ func (host *SHostService) RunService() {
 
 	cronManager.AddJobEveryFewDays(
 		"CleanRecycleDiskFiles", 1, 3, 0, 0, storageman.CleanRecycleDiskfiles, false)
+	cronManager.AddJobAtIntervals("ReconcileMigratePorts", 10*time.Minute, guestman.ReconcileMigratePorts)
 	cronManager.Start()
 
 	close(guestChan)
@@ -158,10 +163,16 @@ func (host *SHostService) initHandlers(app *appsrv.Application) {
 	downloader.AddDownloadHandler("", app)
 	kubehandlers.AddKubeAgentHandler("", app)
 	hosthandler.AddHostHandler("", app)
+	app.AddDefaultHandler("GET", "/metrics", metricsHandler, "metrics")
 
 	app_common.ExportOptionsHandler(app, &options.HostOptions)
 }
 
+// metricsHandler exposes guest lifecycle counters for prometheus to scrape
+func metricsHandler(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	promhttp.Handler().ServeHTTP(w, r)
+}
+
 func (host *SHostService) initEtcdConfig() error {
 	etcdEndpoint, err := app_common.FetchEtcdServiceInfo()
 	if err != nil {
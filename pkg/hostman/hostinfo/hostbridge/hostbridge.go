@@ -357,6 +357,45 @@ func (d *SBaseBridgeDriver) generateIfupScripts(driver IBridgeDriver, scriptPath
 	return d.saveFileExecutable(scriptPath, script)
 }
 
+// getIp6UpScripts enables ipv6 on guest tap of ipv6 nic, the tap is a bridge port,
+// so it must not autoconfigure addresses from router advertisements of guests
+func getIp6UpScripts(ifVar string, nic *api.GuestnetworkJsonDesc) string {
+	if len(nic.Ip6) == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("IP6='%s'\n", nic.Ip6)
+	s += fmt.Sprintf("sysctl -qw net.ipv6.conf.%s.disable_ipv6=0\n", ifVar)
+	s += fmt.Sprintf("sysctl -qw net.ipv6.conf.%s.accept_ra=0\n", ifVar)
+	s += fmt.Sprintf("sysctl -qw net.ipv6.conf.%s.autoconf=0\n", ifVar)
+	return s
+}
+
+// getIp6NeighUpScripts routes guest ipv6 address to bridge and adds its
+// neighbour entry, so host on the ipv6 link of bridge reaches guest without
+// waiting for neighbour discovery, like presending arp for ipv4. Bridge
+// without global ipv6 address is left untouched. IP6 is set by getIp6UpScripts
+func getIp6NeighUpScripts(switchVar string, nic *api.GuestnetworkJsonDesc) string {
+	if len(nic.Ip6) == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("if ip -6 address show dev %s scope global | grep -q inet6; then\n", switchVar)
+	s += fmt.Sprintf("    ip -6 route replace $IP6/128 dev %s\n", switchVar)
+	s += fmt.Sprintf("    ip -6 neigh replace $IP6 lladdr %s dev %s nud stale\n", nic.Mac, switchVar)
+	s += "fi\n"
+	return s
+}
+
+// getIp6NeighDownScripts removes entries added by getIp6NeighUpScripts,
+// they are on bridge so are removed even if tap is already gone
+func getIp6NeighDownScripts(switchVar string, nic *api.GuestnetworkJsonDesc) string {
+	if len(nic.Ip6) == 0 {
+		return ""
+	}
+	s := fmt.Sprintf("ip -6 neigh del %s dev %s > /dev/null 2>&1\n", nic.Ip6, switchVar)
+	s += fmt.Sprintf("ip -6 route del %s/128 dev %s > /dev/null 2>&1\n", nic.Ip6, switchVar)
+	return s
+}
+
 func (d *SBaseBridgeDriver) GetMetadataServerPort() int {
 	return options.HostOptions.Port + 1000
 }
@@ -0,0 +1,186 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package hostbridge
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	api "yunion.io/x/onecloud/pkg/apis/compute"
+	"yunion.io/x/onecloud/pkg/util/netutils2"
+)
+
+// missing tap name which should never exist on the test host
+const testMissingTap = "vnet-gone-0"
+
+func runDownScript(t *testing.T, script string, args ...string) {
+	shell, err := exec.LookPath("bash")
+	if err != nil {
+		t.Skip("bash not found")
+	}
+	dir, err := ioutil.TempDir("", "hostbridge")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	scriptPath := path.Join(dir, "if-down.sh")
+	assert.NoError(t, ioutil.WriteFile(scriptPath, []byte(script), 0755))
+	// empty PATH makes sure no bridge tools are reached for a missing tap
+	cmd := exec.Command(shell, append([]string{scriptPath}, args...)...)
+	cmd.Env = []string{"PATH="}
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, "output: %s", out)
+	assert.Empty(t, string(out))
+}
+
+func TestSOVSBridgeDriver_getDownScripts(t *testing.T) {
+	d := &SOVSBridgeDriver{
+		SBaseBridgeDriver: SBaseBridgeDriver{
+			bridge: netutils2.NewNetInterface("br-test"),
+		},
+	}
+	nic := &api.GuestnetworkJsonDesc{
+		Ifname: testMissingTap,
+		Ip:     "10.0.0.2",
+		Mac:    "00:22:00:00:00:01",
+		Vlan:   1,
+	}
+	script, err := d.getDownScripts(nic, false)
+	assert.NoError(t, err)
+	assert.Contains(t, script, "if [ ! -e /sys/class/net/$IF ]; then\n")
+	runDownScript(t, script)
+}
+
+func TestSLinuxBridgeDriver_getDownScripts(t *testing.T) {
+	d := &SLinuxBridgeDriver{
+		SBaseBridgeDriver: SBaseBridgeDriver{
+			bridge: netutils2.NewNetInterface("br-test"),
+		},
+	}
+	nic := &api.GuestnetworkJsonDesc{
+		Ifname: testMissingTap,
+	}
+	script, err := d.getDownScripts(nic, false)
+	assert.NoError(t, err)
+	assert.Contains(t, script, "if [ ! -e /sys/class/net/$1 ]; then\n")
+	runDownScript(t, script, testMissingTap)
+}
+
+func TestGetUpScriptsIp6(t *testing.T) {
+	ovs := &SOVSBridgeDriver{
+		SBaseBridgeDriver: SBaseBridgeDriver{
+			bridge: netutils2.NewNetInterface("br-test"),
+		},
+	}
+	linux := &SLinuxBridgeDriver{
+		SBaseBridgeDriver: SBaseBridgeDriver{
+			bridge: netutils2.NewNetInterface("br-test"),
+		},
+	}
+	cases := []struct {
+		name    string
+		nic     *api.GuestnetworkJsonDesc
+		wantIp6 bool
+	}{
+		{
+			name: "ipv4 only",
+			nic: &api.GuestnetworkJsonDesc{
+				Ifname: "vnet1",
+				Ip:     "10.0.0.2",
+				Mac:    "00:22:00:00:00:01",
+				Vlan:   1,
+			},
+		},
+		{
+			name: "ipv6 only",
+			nic: &api.GuestnetworkJsonDesc{
+				Ifname: "vnet1",
+				Ip6:    "2001:db8::2",
+				Mac:    "00:22:00:00:00:01",
+				Vlan:   1,
+			},
+			wantIp6: true,
+		},
+		{
+			name: "dual stack",
+			nic: &api.GuestnetworkJsonDesc{
+				Ifname: "vnet1",
+				Ip:     "10.0.0.2",
+				Ip6:    "2001:db8::2",
+				Mac:    "00:22:00:00:00:01",
+				Vlan:   1,
+			},
+			wantIp6: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			script, err := ovs.getUpScripts(c.nic, false)
+			assert.NoError(t, err)
+			assert.Contains(t, script, fmt.Sprintf("IP='%s'\n", c.nic.Ip))
+			if c.wantIp6 {
+				assert.Contains(t, script, "IP6='2001:db8::2'\n")
+				assert.Contains(t, script, "sysctl -qw net.ipv6.conf.$IF.disable_ipv6=0\n")
+				assert.Contains(t, script, "sysctl -qw net.ipv6.conf.$IF.accept_ra=0\n")
+				assert.Contains(t, script, "sysctl -qw net.ipv6.conf.$IF.autoconf=0\n")
+				addPort := strings.Index(script, "ovs-vsctl add-port $SWITCH $IF $TAG\n")
+				neigh := strings.Index(script, "if ip -6 address show dev $SWITCH scope global | grep -q inet6; then\n"+
+					"    ip -6 route replace $IP6/128 dev $SWITCH\n"+
+					"    ip -6 neigh replace $IP6 lladdr 00:22:00:00:00:01 dev $SWITCH nud stale\n"+
+					"fi\n")
+				assert.True(t, addPort >= 0 && neigh > addPort, "ipv6 neigh should follow add-port")
+			} else {
+				assert.NotContains(t, script, "IP6=")
+				assert.NotContains(t, script, "ipv6")
+				assert.NotContains(t, script, "ip -6")
+			}
+
+			script, err = ovs.getDownScripts(c.nic, false)
+			assert.NoError(t, err)
+			if c.wantIp6 {
+				assert.Contains(t, script, "ip -6 neigh del 2001:db8::2 dev $SWITCH > /dev/null 2>&1\n")
+				assert.Contains(t, script, "ip -6 route del 2001:db8::2/128 dev $SWITCH > /dev/null 2>&1\n")
+			} else {
+				assert.NotContains(t, script, "ip -6")
+			}
+
+			script, err = linux.getUpScripts(c.nic, false)
+			assert.NoError(t, err)
+			if c.wantIp6 {
+				assert.Contains(t, script, "sysctl -qw net.ipv6.conf.$1.accept_ra=0\n")
+				assert.Contains(t, script, "    ip -6 route replace $IP6/128 dev ${switch}\n")
+				assert.Contains(t, script, "    ip -6 neigh replace $IP6 lladdr 00:22:00:00:00:01 dev ${switch} nud stale\n")
+			} else {
+				assert.NotContains(t, script, "ipv6")
+				assert.NotContains(t, script, "ip -6")
+			}
+
+			script, err = linux.getDownScripts(c.nic, false)
+			assert.NoError(t, err)
+			if c.wantIp6 {
+				assert.Contains(t, script, "ip -6 neigh del 2001:db8::2 dev ${switch} > /dev/null 2>&1\n")
+				assert.Contains(t, script, "ip -6 route del 2001:db8::2/128 dev ${switch} > /dev/null 2>&1\n")
+			} else {
+				assert.NotContains(t, script, "ip -6")
+			}
+		})
+	}
+}
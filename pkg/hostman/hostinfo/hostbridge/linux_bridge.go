@@ -98,14 +98,21 @@ func (l *SLinuxBridgeDriver) getUpScripts(nic *api.GuestnetworkJsonDesc, isSlave
 		s += fmt.Sprintf("ip link set dev $1 mtu %d\n", 1500+options.HostOptions.TunnelPaddingBytes)
 	}
 	s += "ip address flush dev $1\n"
+	s += getIp6UpScripts("$1", nic)
 	s += "ip link set dev $1 up\n"
 	s += "brctl addif ${switch} $1\n"
+	s += getIp6NeighUpScripts("${switch}", nic)
 	return s, nil
 }
 
 func (l *SLinuxBridgeDriver) getDownScripts(nic *api.GuestnetworkJsonDesc, isSlave bool) (string, error) {
 	s := "#!/bin/sh\n\n"
 	s += fmt.Sprintf("switch='%s'\n", l.bridge)
+	s += getIp6NeighDownScripts("${switch}", nic)
+	// tap may already be gone, e.g. after qemu crashed
+	s += "if [ ! -e /sys/class/net/$1 ]; then\n"
+	s += "    exit 0\n"
+	s += "fi\n"
 	s += "brctl show ${switch} | grep $1\n"
 	s += "if [ $? -ne '0' ]; then\n"
 	s += "    exit 0\n"
@@ -113,6 +120,7 @@ func (l *SLinuxBridgeDriver) getDownScripts(nic *api.GuestnetworkJsonDesc, isSla
 	s += "ip addr flush dev $1\n"
 	s += "ip link set dev $1 down\n"
 	s += "brctl delif ${switch} $1\n"
+	s += "exit 0\n"
 	return s, nil
 }
 
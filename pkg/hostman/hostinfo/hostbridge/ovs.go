@@ -164,6 +164,7 @@ func (o *SOVSBridgeDriver) getUpScripts(nic *api.GuestnetworkJsonDesc, isSlave b
 			1500+options.HostOptions.TunnelPaddingBytes)
 	}
 	s += "ip address flush dev $IF\n"
+	s += getIp6UpScripts("$IF", nic)
 	s += "ip link set dev $IF up\n"
 	s += "ovs-vsctl list-ifaces $SWITCH | grep -w $IF > /dev/null 2>&1\n"
 	s += "if [ $? -eq '0' ]; then\n"
@@ -173,6 +174,7 @@ func (o *SOVSBridgeDriver) getUpScripts(nic *api.GuestnetworkJsonDesc, isSlave b
 	s += "    TAG=\"tag=$VLAN_ID\"\n"
 	s += "fi\n"
 	s += "ovs-vsctl add-port $SWITCH $IF $TAG\n"
+	s += getIp6NeighUpScripts("$SWITCH", nic)
 	if vpcProvider == compute.VPC_PROVIDER_OVN {
 		if !isSlave {
 			s += "ovs-vsctl set Interface $IF external_ids:iface-id=iface-$NET_ID-$IF\n"
@@ -211,6 +213,12 @@ func (o *SOVSBridgeDriver) getDownScripts(nic *api.GuestnetworkJsonDesc, isSlave
 	s += fmt.Sprintf("IP='%s'\n", ip)
 	s += fmt.Sprintf("MAC='%s'\n", mac)
 	s += fmt.Sprintf("VLAN_ID=%d\n", vlan)
+	s += getIp6NeighDownScripts("$SWITCH", nic)
+	// tap may already be gone, e.g. after qemu crashed, only drop the stale port
+	s += "if [ ! -e /sys/class/net/$IF ]; then\n"
+	s += "    ovs-vsctl -- --if-exists del-port $SWITCH $IF > /dev/null 2>&1\n"
+	s += "    exit 0\n"
+	s += "fi\n"
 	s += "PORT=$(ovs-ofctl show $SWITCH | grep -w $IF)\n"
 	s += "if [ $? -ne '0' ]; then\n"
 	s += "    exit 0\n"
@@ -219,6 +227,7 @@ func (o *SOVSBridgeDriver) getDownScripts(nic *api.GuestnetworkJsonDesc, isSlave
 	s += "PORT=$(echo $PORT | awk 'BEGIN{FS=\"(\"}{print $1}')\n"
 	s += "ip link set dev $IF down\n"
 	s += "ovs-vsctl -- --if-exists del-port $SWITCH $IF\n"
+	s += "exit 0\n"
 	return s, nil
 }
 
@@ -166,6 +166,14 @@ func (h *SHostInfo) IsNestedVirtualization() bool {
 	return utils.IsInStringArray("hypervisor", h.Cpu.cpuFeatures)
 }
 
+func (h *SHostInfo) IsProcessorIntel() bool {
+	return sysutils.IsProcessorIntel()
+}
+
+func (h *SHostInfo) IsProcessorAmd() bool {
+	return sysutils.IsProcessorAmd()
+}
+
 func (h *SHostInfo) IsHugepagesEnabled() bool {
 	return options.HostOptions.HugepagesOption == "native"
 }
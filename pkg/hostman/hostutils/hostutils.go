@@ -36,11 +36,8 @@ import (
 	"yunion.io/x/onecloud/pkg/mcclient/modules/k8s"
 )
 
-type IHost interface {
-	GetZoneId() string
-	GetHostId() string
-	GetMediumType() string
-	GetMasterIp() string
+// HostCapabilities is the host info guest start options depend on
+type HostCapabilities interface {
 	GetCpuArchitecture() string
 	IsAarch64() bool
 
@@ -49,6 +46,17 @@ type IHost interface {
 
 	IsKvmSupport() bool
 	IsNestedVirtualization() bool
+	IsProcessorIntel() bool
+	IsProcessorAmd() bool
+}
+
+type IHost interface {
+	HostCapabilities
+
+	GetZoneId() string
+	GetHostId() string
+	GetMediumType() string
+	GetMasterIp() string
 
 	PutHostOnline() error
 	StartDHCPServer()
@@ -17,6 +17,7 @@ package isolated_device
 import (
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"yunion.io/x/jsonutils"
@@ -96,6 +97,10 @@ type isolatedDeviceManager struct {
 	host            IHost
 	devices         []IDevice
 	DetachedDevices []*CloudDeviceInfo
+
+	// qemu params keyed by joined device addrs, dropped once devices change
+	paramsLock  sync.Mutex
+	paramsCache map[string]*QemuParams
 }
 
 func NewManager(host IHost) IsolatedDeviceManager {
@@ -103,6 +108,7 @@ func NewManager(host IHost) IsolatedDeviceManager {
 		host:            host,
 		devices:         make([]IDevice, 0),
 		DetachedDevices: make([]*CloudDeviceInfo, 0),
+		paramsCache:     make(map[string]*QemuParams),
 	}
 	// Do probe laster - Qiu Jian
 	return man
@@ -113,6 +119,7 @@ func (man *isolatedDeviceManager) GetDevices() []IDevice {
 }
 
 func (man *isolatedDeviceManager) ProbePCIDevices(skipGPUs, skipUSBs bool) error {
+	defer man.invalidateQemuParams()
 	man.devices = make([]IDevice, 0)
 	if !skipGPUs {
 		gpus, err := getPassthroughGPUS()
@@ -174,6 +181,7 @@ func (man *isolatedDeviceManager) GetDeviceByAddr(addr string) IDevice {
 }
 
 func (man *isolatedDeviceManager) BatchCustomProbe() error {
+	defer man.invalidateQemuParams()
 	for _, dev := range man.devices {
 		if err := dev.CustomProbe(); err != nil {
 			return err
@@ -213,8 +221,28 @@ func (man *isolatedDeviceManager) StartDetachTask() {
 	}()
 }
 
+// GetQemuParams returns cached params of the same devAddrs, the order of
+// devAddrs is part of the key as device indexes depend on it
 func (man *isolatedDeviceManager) GetQemuParams(devAddrs []string) *QemuParams {
-	return getQemuParams(man, devAddrs)
+	if len(devAddrs) == 0 {
+		return nil
+	}
+	key := strings.Join(devAddrs, ",")
+	man.paramsLock.Lock()
+	defer man.paramsLock.Unlock()
+	if params, ok := man.paramsCache[key]; ok {
+		return params
+	}
+	params := getQemuParams(man, devAddrs)
+	man.paramsCache[key] = params
+	return params
+}
+
+// invalidateQemuParams drops cached qemu params after devices changed
+func (man *isolatedDeviceManager) invalidateQemuParams() {
+	man.paramsLock.Lock()
+	defer man.paramsLock.Unlock()
+	man.paramsCache = make(map[string]*QemuParams)
 }
 
 type sBaseDevice struct {
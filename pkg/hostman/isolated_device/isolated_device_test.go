@@ -16,6 +16,7 @@ package isolated_device
 
 import (
 	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -73,3 +74,61 @@ func Test_parseLspci(t *testing.T) {
 		})
 	}
 }
+
+func TestIsolatedDeviceManager_GetQemuParams(t *testing.T) {
+	man := NewManager(nil).(*isolatedDeviceManager)
+	man.devices = []IDevice{
+		NewGPUHPCDevice(&PCIDevice{Addr: "00:08.0"}),
+		NewGPUHPCDevice(&PCIDevice{Addr: "00:09.0"}),
+	}
+
+	if params := man.GetQemuParams(nil); params != nil {
+		t.Fatalf("want nil params of no devices, got %#v", params)
+	}
+
+	params := man.GetQemuParams([]string{"00:08.0"})
+	want := []string{" -device vfio-pci,host=00:08.0,multifunction=on"}
+	if params == nil || !reflect.DeepEqual(params.Devices, want) {
+		t.Fatalf("miss: want devices %v, got %#v", want, params)
+	}
+
+	// cached params are returned even though devices changed behind the manager
+	man.devices = man.devices[1:]
+	if got := man.GetQemuParams([]string{"00:08.0"}); got != params {
+		t.Fatalf("hit: want cached %p, got %p", params, got)
+	}
+	if got := man.GetQemuParams([]string{"00:09.0"}); got == params || !reflect.DeepEqual(got.Devices, []string{" -device vfio-pci,host=00:09.0,multifunction=on"}) {
+		t.Fatalf("miss of another addr set: got %#v", got)
+	}
+
+	man.invalidateQemuParams()
+	if got := man.GetQemuParams([]string{"00:08.0"}); got == params || len(got.Devices) != 0 {
+		t.Fatalf("invalidated: want params without removed device, got %#v", got)
+	}
+}
+
+func TestIsolatedDeviceManager_GetQemuParamsConcurrent(t *testing.T) {
+	man := NewManager(nil).(*isolatedDeviceManager)
+	man.devices = []IDevice{NewGPUHPCDevice(&PCIDevice{Addr: "00:08.0"})}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if params := man.GetQemuParams([]string{"00:08.0"}); params == nil {
+					t.Error("nil params")
+					return
+				}
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				man.invalidateQemuParams()
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,75 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"yunion.io/x/log"
+)
+
+const (
+	AUDIT_DIRECTION_SEND    = ">"
+	AUDIT_DIRECTION_RECEIVE = "<"
+
+	AUDIT_TIME_FORMAT = "2006-01-02T15:04:05.000000Z07:00"
+
+	redactedValue = "******"
+)
+
+var (
+	// qmp arguments, e.g. set_password password and secret object data
+	redactJsonReg = regexp.MustCompile(`"(password|data|secret|key-secret)"(\s*:\s*)"(?:[^"\\]|\\.)*"`)
+	// hmp commands, e.g. set_password vnc xxx and change vnc password xxx
+	redactHmpPasswordReg = regexp.MustCompile(`\b(set_password\s+\S+\s+|change\s+vnc\s+password\s+)[^\s"\\]+`)
+)
+
+// RedactMonitorTraffic masks sensitive values of monitor commands and responses
+func RedactMonitorTraffic(data string) string {
+	data = redactJsonReg.ReplaceAllString(data, `"$1"$2"`+redactedValue+`"`)
+	return redactHmpPasswordReg.ReplaceAllString(data, "${1}"+redactedValue)
+}
+
+// SMonitorAuditLogger appends monitor traffic of a guest to audit file
+type SMonitorAuditLogger struct {
+	filePath string
+	mutex    sync.Mutex
+}
+
+func NewMonitorAuditLogger(filePath string) *SMonitorAuditLogger {
+	return &SMonitorAuditLogger{filePath: filePath}
+}
+
+func formatAuditLine(t time.Time, proto, direction, data string) string {
+	return fmt.Sprintf("%s %s %s %s\n", t.Format(AUDIT_TIME_FORMAT), proto, direction, RedactMonitorTraffic(data))
+}
+
+func (l *SMonitorAuditLogger) Log(proto, direction, data string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	f, err := os.OpenFile(l.filePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Errorf("open monitor audit log %s: %s", l.filePath, err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(formatAuditLine(time.Now(), proto, direction, data)); err != nil {
+		log.Errorf("write monitor audit log %s: %s", l.filePath, err)
+	}
+}
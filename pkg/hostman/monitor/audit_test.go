@@ -0,0 +1,114 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactMonitorTraffic(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		{
+			in:   `{"execute":"set_password","arguments":{"password":"s3cr3t","protocol":"vnc"}}`,
+			want: `{"execute":"set_password","arguments":{"password":"******","protocol":"vnc"}}`,
+		},
+		{
+			in:   `{"execute":"object-add","arguments":{"id":"sec0","data":"a2V5\"x","format":"base64"}}`,
+			want: `{"execute":"object-add","arguments":{"id":"sec0","data":"******","format":"base64"}}`,
+		},
+		{
+			in:   `{"execute":"human-monitor-command","arguments":{"command-line":"set_password vnc s3cr3t"}}`,
+			want: `{"execute":"human-monitor-command","arguments":{"command-line":"set_password vnc ******"}}`,
+		},
+		{
+			in:   "set_password vnc s3cr3t",
+			want: "set_password vnc ******",
+		},
+		{
+			in:   "change vnc password s3cr3t",
+			want: "change vnc password ******",
+		},
+		{
+			in:   `{"execute":"query-status"}`,
+			want: `{"execute":"query-status"}`,
+		},
+		{
+			in:   `{"event":"STOP","data":{},"timestamp":{"seconds":1}}`,
+			want: `{"event":"STOP","data":{},"timestamp":{"seconds":1}}`,
+		},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, RedactMonitorTraffic(c.in))
+	}
+}
+
+func Test_formatAuditLine(t *testing.T) {
+	ts := time.Date(2022, 3, 4, 5, 6, 7, 8000, time.UTC)
+	assert.Equal(t,
+		"2022-03-04T05:06:07.000008Z QMP > {\"execute\":\"set_password\",\"arguments\":{\"password\":\"******\"}}\n",
+		formatAuditLine(ts, "QMP", AUDIT_DIRECTION_SEND, `{"execute":"set_password","arguments":{"password":"abc"}}`))
+	assert.Equal(t,
+		"2022-03-04T05:06:07.000008Z HMP < VM status: running\n",
+		formatAuditLine(ts, "HMP", AUDIT_DIRECTION_RECEIVE, "VM status: running"))
+}
+
+func TestQmpMonitor_AuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor-audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	logPath := path.Join(dir, "monitor-audit.log")
+
+	s := newFakeQmpServer(t, nil)
+	m := NewQmpMonitor("fake", "fake", func(error) {}, func(error) {}, func() {}, nil)
+	m.SetAuditLogger(NewMonitorAuditLogger(logPath))
+	assert.NoError(t, m.Connect("127.0.0.1", s.Port()))
+	defer m.Disconnect()
+
+	done := make(chan string)
+	m.SetVncPassword("vnc", "s3cr3t", func(res string) { done <- res })
+	select {
+	case res := <-done:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("set vnc password timeout")
+	}
+
+	content, err := ioutil.ReadFile(logPath)
+	assert.NoError(t, err)
+	assert.NotContains(t, string(content), "s3cr3t")
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	// greeting, qmp_capabilities and set_password with their returns,
+	// commands may be written before the return of previous one
+	if assert.Len(t, lines, 5) {
+		assert.Contains(t, lines[0], ` QMP < {"QMP":`)
+		assert.Contains(t, lines[1], ` QMP > {"execute":"qmp_capabilities"}`)
+		assert.Contains(t, string(content), ` QMP > {"execute":"set_password","arguments":{"password":"******","protocol":"vnc"}}`+"\n")
+		assert.Equal(t, 2, strings.Count(string(content), ` QMP < {"return":{}}`+"\n"))
+		for _, line := range lines {
+			_, err := time.Parse(AUDIT_TIME_FORMAT, strings.SplitN(line, " ", 2)[0])
+			assert.NoError(t, err)
+		}
+	}
+}
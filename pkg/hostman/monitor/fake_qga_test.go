@@ -0,0 +1,119 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// fakeQgaAgent answers guest agent commands on unix socket
+type fakeQgaAgent struct {
+	socketPath string
+	listener   net.Listener
+	handler    fakeQmpHandler
+	// replies nothing to the command, like guest-shutdown on success
+	noReply string
+
+	mutex    sync.Mutex
+	commands []*fakeQmpCommand
+}
+
+func newFakeQgaAgent(t *testing.T, handler fakeQmpHandler) *fakeQgaAgent {
+	dir, err := ioutil.TempDir("", "fake-qga")
+	if err != nil {
+		t.Fatalf("temp dir: %s", err)
+	}
+	socketPath := path.Join(dir, "qga.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	a := &fakeQgaAgent{socketPath: socketPath, listener: listener, handler: handler}
+	go a.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		os.RemoveAll(dir)
+	})
+	return a
+}
+
+// SetNoReply makes agent reply nothing on receiving command execute
+func (a *fakeQgaAgent) SetNoReply(execute string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.noReply = execute
+}
+
+// Commands returns commands received except guest-sync
+func (a *fakeQgaAgent) Commands() []*fakeQmpCommand {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]*fakeQmpCommand{}, a.commands...)
+}
+
+func (a *fakeQgaAgent) serve() {
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+		a.handle(conn)
+	}
+}
+
+func (a *fakeQgaAgent) handle(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	for {
+		cmd := &fakeQmpCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			return
+		}
+		if cmd.Execute == "guest-sync" {
+			args := struct {
+				Id int64 `json:"id"`
+			}{}
+			json.Unmarshal(cmd.Args, &args)
+			// a stale response left by previous client comes first
+			writeFakeQmpMessage(conn, map[string]interface{}{"return": map[string]interface{}{}})
+			writeFakeQmpMessage(conn, map[string]interface{}{"return": args.Id})
+			continue
+		}
+		a.mutex.Lock()
+		a.commands = append(a.commands, cmd)
+		noReply := a.noReply
+		a.mutex.Unlock()
+		if len(noReply) > 0 && cmd.Execute == noReply {
+			continue
+		}
+
+		var ret interface{} = map[string]interface{}{}
+		var qgaErr *Error
+		if a.handler != nil {
+			ret, qgaErr = a.handler(cmd)
+		}
+		if qgaErr != nil {
+			writeFakeQmpMessage(conn, map[string]interface{}{"error": qgaErr})
+		} else {
+			writeFakeQmpMessage(conn, map[string]interface{}{"return": ret})
+		}
+	}
+}
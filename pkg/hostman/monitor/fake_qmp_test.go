@@ -0,0 +1,191 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+)
+
+type fakeQmpCommand struct {
+	Execute string          `json:"execute"`
+	Args    json.RawMessage `json:"arguments,omitempty"`
+}
+
+// fakeQmpHandler returns the return value or the error of a command
+type fakeQmpHandler func(cmd *fakeQmpCommand) (interface{}, *Error)
+
+// fakeQmpServer speaks just enough qmp for monitor tests
+type fakeQmpServer struct {
+	listener net.Listener
+	handler  fakeQmpHandler
+	// drop connection instead of responding to the command
+	dropOn string
+
+	mutex    sync.Mutex
+	commands []*fakeQmpCommand
+	conns    []net.Conn
+	accepted int
+}
+
+// SetDropOn makes server drop the connection on receiving command execute
+func (s *fakeQmpServer) SetDropOn(execute string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.dropOn = execute
+}
+
+func newFakeQmpServer(t *testing.T, handler fakeQmpHandler) *fakeQmpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	s := &fakeQmpServer{listener: listener, handler: handler}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeQmpServer) Port() int {
+	return s.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (s *fakeQmpServer) Close() {
+	s.listener.Close()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// DropConnections closes connected clients, server keeps listening
+func (s *fakeQmpServer) DropConnections() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+	s.conns = nil
+}
+
+// Connections returns count of accepted connections
+func (s *fakeQmpServer) Connections() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.accepted
+}
+
+// Commands returns commands received except qmp_capabilities
+func (s *fakeQmpServer) Commands() []*fakeQmpCommand {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]*fakeQmpCommand{}, s.commands...)
+}
+
+// SendEvent pushes an event to all connected clients
+func (s *fakeQmpServer) SendEvent(event string, data map[string]interface{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, conn := range s.conns {
+		writeFakeQmpMessage(conn, map[string]interface{}{
+			"event":     event,
+			"data":      data,
+			"timestamp": map[string]int64{"seconds": 0, "microseconds": 0},
+		})
+	}
+}
+
+func (s *fakeQmpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		s.conns = append(s.conns, conn)
+		s.accepted += 1
+		s.mutex.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func writeFakeQmpMessage(conn net.Conn, msg interface{}) {
+	b, _ := json.Marshal(msg)
+	conn.Write(append(b, '\n'))
+}
+
+func (s *fakeQmpServer) handle(conn net.Conn) {
+	writeFakeQmpMessage(conn, map[string]interface{}{
+		"QMP": map[string]interface{}{
+			"version": map[string]interface{}{
+				"qemu":    map[string]int{"major": 4, "minor": 2, "micro": 0},
+				"package": "",
+			},
+			"capabilities": []string{},
+		},
+	})
+	decoder := json.NewDecoder(conn)
+	for {
+		cmd := &fakeQmpCommand{}
+		if err := decoder.Decode(cmd); err != nil {
+			return
+		}
+		if cmd.Execute == "qmp_capabilities" {
+			writeFakeQmpMessage(conn, map[string]interface{}{"return": map[string]interface{}{}})
+			continue
+		}
+		s.mutex.Lock()
+		s.commands = append(s.commands, cmd)
+		dropOn := s.dropOn
+		s.mutex.Unlock()
+		if len(dropOn) > 0 && cmd.Execute == dropOn {
+			conn.Close()
+			return
+		}
+
+		var ret interface{} = map[string]interface{}{}
+		var qmpErr *Error
+		if s.handler != nil {
+			ret, qmpErr = s.handler(cmd)
+		}
+		if qmpErr != nil {
+			writeFakeQmpMessage(conn, map[string]interface{}{"error": qmpErr})
+		} else {
+			if ret == nil {
+				ret = map[string]interface{}{}
+			}
+			writeFakeQmpMessage(conn, map[string]interface{}{"return": ret})
+		}
+	}
+}
+
+// connectFakeQmpMonitor returns a qmp monitor connected to server
+func connectFakeQmpMonitor(t *testing.T, s *fakeQmpServer, onEvent qmpEventCallback) *QmpMonitor {
+	connected := make(chan struct{})
+	m := NewQmpMonitor("fake", "fake",
+		func(error) {}, func(error) {},
+		func() { close(connected) },
+		onEvent,
+	)
+	if err := m.Connect("127.0.0.1", s.Port()); err != nil {
+		t.Fatalf("connect fake qmp: %s", err)
+	}
+	<-connected
+	t.Cleanup(m.Disconnect)
+	return m
+}
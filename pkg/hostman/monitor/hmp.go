@@ -75,7 +75,8 @@ func (m *HmpMonitor) read(r io.Reader) {
 		if len(res) == 0 {
 			continue
 		}
-		log.Infof("HMP Read %s: %s", m.server, res)
+		log.Infof("HMP Read %s: %s", m.server, RedactMonitorTraffic(res))
+		m.audit("HMP", AUDIT_DIRECTION_RECEIVE, res)
 		if m.connected {
 			go m.callBack(res)
 		} else {
@@ -120,8 +121,9 @@ func (m *HmpMonitor) callBack(res string) {
 }
 
 func (m *HmpMonitor) write(cmd []byte) error {
+	log.Infof("HMP Write %s: %s", m.server, RedactMonitorTraffic(string(cmd)))
+	m.audit("HMP", AUDIT_DIRECTION_SEND, string(cmd))
 	cmd = append(cmd, '\n')
-	log.Infof("HMP Write %s: %s", m.server, string(cmd))
 	length, index := len(cmd), 0
 	for index < length {
 		i, err := m.rwc.Write(cmd)
@@ -148,7 +150,7 @@ func (m *HmpMonitor) query() {
 		err := m.write([]byte(cmd))
 		m.mutex.Unlock()
 		if err != nil {
-			log.Errorf("Write %s to monitor error %s: %s", cmd, m.server, err)
+			log.Errorf("Write %s to monitor error %s: %s", RedactMonitorTraffic(cmd), m.server, err)
 			break
 		}
 	}
@@ -511,6 +513,31 @@ func (m *HmpMonitor) NetdevDel(id string, callback StringCallback) {
 	m.Query(cmd, callback)
 }
 
+func (m *HmpMonitor) SetLink(name string, up bool, callback StringCallback) {
+	state := "off"
+	if up {
+		state = "on"
+	}
+	m.Query(fmt.Sprintf("set_link %s %s", name, state), callback)
+}
+
+// hmp balloon takes size in MB
+func (m *HmpMonitor) SetBalloon(sizeBytes int64, callback StringCallback) {
+	m.Query(fmt.Sprintf("balloon %d", sizeBytes/1024/1024), callback)
+}
+
+func (m *HmpMonitor) ScreenDump(filename string, callback StringCallback) {
+	m.Query(fmt.Sprintf("screendump %s", filename), callback)
+}
+
+func (m *HmpMonitor) SendKey(keys []string, holdTime int, callback StringCallback) {
+	cmd := fmt.Sprintf("sendkey %s", strings.Join(keys, "-"))
+	if holdTime > 0 {
+		cmd = fmt.Sprintf("%s %d", cmd, holdTime)
+	}
+	m.Query(cmd, callback)
+}
+
 func (m *HmpMonitor) SaveState(stateFilePath string, callback StringCallback) {
 	cmd := fmt.Sprintf(`migrate -d "%s"`, getSaveStatefileUri(stateFilePath))
 	m.Query(cmd, callback)
@@ -36,7 +36,7 @@ type BlockJob struct {
 	Len    int64
 	Paused bool
 	Ready  bool
-	// running|ready
+	// running|ready|concluded
 	Status string
 	// ok|
 	IoStatus string `json:"io-status"`
@@ -105,6 +105,17 @@ type QemuBlock struct {
 	}
 }
 
+const (
+	BLOCK_JOB_STATUS_RUNNING   = "running"
+	BLOCK_JOB_STATUS_READY     = "ready"
+	BLOCK_JOB_STATUS_CONCLUDED = "concluded"
+)
+
+// IsConcluded tells job finished and waits to be dismissed
+func (self *BlockJob) IsConcluded() bool {
+	return self.Status == BLOCK_JOB_STATUS_CONCLUDED
+}
+
 type blockSizeByte int64
 
 func (self blockSizeByte) String() string {
@@ -146,6 +157,7 @@ type Monitor interface {
 	ConnectWithSocket(address string) error
 	Disconnect()
 	IsConnected() bool
+	SetAuditLogger(l *SMonitorAuditLogger)
 
 	// The callback function will be called in another goroutine
 	SimpleCommand(cmd string, callback StringCallback)
@@ -197,6 +209,17 @@ type Monitor interface {
 
 	NetdevAdd(id, netType string, params map[string]string, callback StringCallback)
 	NetdevDel(id string, callback StringCallback)
+	SetLink(name string, up bool, callback StringCallback)
+
+	// SetBalloon inflates or deflates balloon to make guest memory sizeBytes
+	SetBalloon(sizeBytes int64, callback StringCallback)
+
+	// ScreenDump writes current display of guest to filename in ppm format
+	ScreenDump(filename string, callback StringCallback)
+
+	// SendKey presses keys of qcodes together, releases them after holdTime
+	// milliseconds, qemu default is used if holdTime is 0
+	SendKey(keys []string, holdTime int, callback StringCallback)
 
 	SaveState(statFilePath string, callback StringCallback)
 }
@@ -220,6 +243,8 @@ type SBaseMonitor struct {
 	mutex   *sync.Mutex
 	writing bool
 	reading bool
+
+	auditLogger *SMonitorAuditLogger
 }
 
 func NewBaseMonitor(server, sid string, OnMonitorConnected MonitorSuccFunc, OnMonitorDisConnect, OnMonitorTimeout MonitorErrorFunc) *SBaseMonitor {
@@ -270,6 +295,16 @@ func (m *SBaseMonitor) IsConnected() bool {
 	return m.connected
 }
 
+func (m *SBaseMonitor) SetAuditLogger(l *SMonitorAuditLogger) {
+	m.auditLogger = l
+}
+
+func (m *SBaseMonitor) audit(proto, direction, data string) {
+	if m.auditLogger != nil {
+		m.auditLogger.Log(proto, direction, data)
+	}
+}
+
 func (m *SBaseMonitor) QemuMonitorCommand(cmd string, callback StringCallback) error {
 	return errors.ErrNotSupported
 }
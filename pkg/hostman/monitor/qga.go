@@ -0,0 +1,192 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
+)
+
+// https://qemu.readthedocs.io/en/latest/interop/qemu-ga-ref.html
+const QGA_COMMAND_TIMEOUT = 10 * time.Second
+
+// guest-fstrim walks all mounted filesystems, which may take minutes on large disks
+const QGA_FSTRIM_TIMEOUT = 10 * time.Minute
+
+// commands not replying on success may still reply an error in a short while
+const QGA_NO_REPLY_WAIT = time.Second
+
+const (
+	QGA_SHUTDOWN_MODE_POWERDOWN = "powerdown"
+	QGA_SHUTDOWN_MODE_HALT      = "halt"
+	QGA_SHUTDOWN_MODE_REBOOT    = "reboot"
+)
+
+type qgaResponse struct {
+	Return   json.RawMessage `json:"return"`
+	ErrorVal *Error          `json:"error"`
+}
+
+// QemuGuestAgent talks to qemu guest agent through the chardev unix socket,
+// agent serves one client at a time, so commands are synchronous and serialized
+type QemuGuestAgent struct {
+	id         string
+	socketPath string
+	timeout    time.Duration
+
+	mutex *sync.Mutex
+}
+
+func NewQemuGuestAgent(id, socketPath string) *QemuGuestAgent {
+	return &QemuGuestAgent{
+		id:         id,
+		socketPath: socketPath,
+		timeout:    QGA_COMMAND_TIMEOUT,
+		mutex:      &sync.Mutex{},
+	}
+}
+
+func (qga *QemuGuestAgent) SetTimeout(timeout time.Duration) {
+	qga.timeout = timeout
+}
+
+func (qga *QemuGuestAgent) writeCommand(conn net.Conn, cmd *Command) error {
+	b, err := json.Marshal(cmd)
+	if err != nil {
+		return errors.Wrap(err, "marshal command")
+	}
+	if _, err := conn.Write(append(b, '\n')); err != nil {
+		return errors.Wrapf(err, "write %s", cmd.Execute)
+	}
+	return nil
+}
+
+// sync flushes stale responses of previous clients left in the channel
+func (qga *QemuGuestAgent) sync(conn net.Conn, decoder *json.Decoder) error {
+	id := rand.Int63n(1 << 31)
+	cmd := &Command{
+		Execute: "guest-sync",
+		Args:    map[string]int64{"id": id},
+	}
+	if err := qga.writeCommand(conn, cmd); err != nil {
+		return err
+	}
+	for {
+		res := &qgaResponse{}
+		if err := decoder.Decode(res); err != nil {
+			return errors.Wrap(err, "read guest-sync")
+		}
+		if res.ErrorVal != nil {
+			return errors.Wrap(res.ErrorVal, "guest-sync")
+		}
+		var ret int64
+		if err := json.Unmarshal(res.Return, &ret); err == nil && ret == id {
+			return nil
+		}
+		log.Debugf("qga %s drop stale response %s", qga.id, res.Return)
+	}
+}
+
+// Exec runs command and returns raw return value
+func (qga *QemuGuestAgent) Exec(execute string, args interface{}) ([]byte, error) {
+	return qga.exec(execute, args, false, qga.timeout)
+}
+
+func (qga *QemuGuestAgent) exec(execute string, args interface{}, noReply bool, timeout time.Duration) ([]byte, error) {
+	qga.mutex.Lock()
+	defer qga.mutex.Unlock()
+
+	conn, err := net.DialTimeout("unix", qga.socketPath, qga.timeout)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial qga %s", qga.socketPath)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	decoder := json.NewDecoder(conn)
+	if err := qga.sync(conn, decoder); err != nil {
+		return nil, errors.Wrap(err, "sync")
+	}
+	if err := qga.writeCommand(conn, &Command{Execute: execute, Args: args}); err != nil {
+		return nil, err
+	}
+	if noReply {
+		conn.SetReadDeadline(time.Now().Add(QGA_NO_REPLY_WAIT))
+	}
+	res := &qgaResponse{}
+	if err := decoder.Decode(res); err != nil {
+		if noReply {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "read %s response", execute)
+	}
+	if res.ErrorVal != nil {
+		return nil, errors.Wrap(res.ErrorVal, execute)
+	}
+	return res.Return, nil
+}
+
+func (qga *QemuGuestAgent) GuestPing() error {
+	_, err := qga.Exec("guest-ping", nil)
+	return err
+}
+
+// GuestSetTime set guest system time to t and write it to guest rtc
+func (qga *QemuGuestAgent) GuestSetTime(t time.Time) error {
+	_, err := qga.Exec("guest-set-time", map[string]int64{"time": t.UnixNano()})
+	return err
+}
+
+// GuestShutdown asks guest os to powerdown, halt or reboot, agent replies nothing on success
+// as guest is going down, so only an error reply fails it
+func (qga *QemuGuestAgent) GuestShutdown(mode string) error {
+	_, err := qga.exec("guest-shutdown", map[string]string{"mode": mode}, true, qga.timeout)
+	return err
+}
+
+// GuestFilesystemTrimResult is trim result of a guest filesystem, Error is
+// set when the filesystem failed to be trimmed
+type GuestFilesystemTrimResult struct {
+	Path    string `json:"path"`
+	Trimmed int64  `json:"trimmed,omitempty"`
+	Minimum int64  `json:"minimum,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// GuestFsTrim discards unused blocks of mounted filesystems in guest, free
+// ranges shorter than minimum bytes are skipped, 0 means trimming all
+func (qga *QemuGuestAgent) GuestFsTrim(minimum int64) ([]GuestFilesystemTrimResult, error) {
+	var args interface{}
+	if minimum > 0 {
+		args = map[string]int64{"minimum": minimum}
+	}
+	ret, err := qga.exec("guest-fstrim", args, false, QGA_FSTRIM_TIMEOUT)
+	if err != nil {
+		return nil, err
+	}
+	res := struct {
+		Paths []GuestFilesystemTrimResult `json:"paths"`
+	}{}
+	if err := json.Unmarshal(ret, &res); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal guest-fstrim response %s", ret)
+	}
+	return res.Paths, nil
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package monitor
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQemuGuestAgent_GuestSetTime(t *testing.T) {
+	a := newFakeQgaAgent(t, nil)
+	qga := NewQemuGuestAgent("test", a.socketPath)
+
+	now := time.Unix(1650000000, 123)
+	assert.NoError(t, qga.GuestSetTime(now))
+	assert.NoError(t, qga.GuestPing())
+
+	cmds := a.Commands()
+	if assert.Len(t, cmds, 2) {
+		assert.Equal(t, "guest-set-time", cmds[0].Execute)
+		args := struct {
+			Time int64 `json:"time"`
+		}{}
+		assert.NoError(t, json.Unmarshal(cmds[0].Args, &args))
+		assert.Equal(t, now.UnixNano(), args.Time)
+		assert.Equal(t, "guest-ping", cmds[1].Execute)
+	}
+}
+
+func TestQemuGuestAgent_Error(t *testing.T) {
+	a := newFakeQgaAgent(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		return nil, &Error{Class: "CommandNotFound", Desc: "The command guest-set-time has not been found"}
+	})
+	qga := NewQemuGuestAgent("test", a.socketPath)
+	err := qga.GuestSetTime(time.Now())
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "CommandNotFound")
+	}
+}
+
+func TestQemuGuestAgent_NotRunning(t *testing.T) {
+	qga := NewQemuGuestAgent("test", "/nonexistent/qga.sock")
+	qga.SetTimeout(time.Second)
+	assert.Error(t, qga.GuestPing())
+}
+
+func TestQemuGuestAgent_GuestShutdown(t *testing.T) {
+	a := newFakeQgaAgent(t, nil)
+	a.SetNoReply("guest-shutdown")
+	qga := NewQemuGuestAgent("test", a.socketPath)
+
+	assert.NoError(t, qga.GuestShutdown(QGA_SHUTDOWN_MODE_REBOOT))
+	cmds := a.Commands()
+	if assert.Len(t, cmds, 1) {
+		assert.Equal(t, "guest-shutdown", cmds[0].Execute)
+		assert.JSONEq(t, `{"mode":"reboot"}`, string(cmds[0].Args))
+	}
+
+	a = newFakeQgaAgent(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		return nil, &Error{Class: "GenericError", Desc: "command guest-shutdown has been disabled"}
+	})
+	qga = NewQemuGuestAgent("test", a.socketPath)
+	assert.Error(t, qga.GuestShutdown(QGA_SHUTDOWN_MODE_REBOOT))
+}
+
+func TestQemuGuestAgent_GuestFsTrim(t *testing.T) {
+	a := newFakeQgaAgent(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		return map[string]interface{}{
+			"paths": []map[string]interface{}{
+				{"path": "/", "trimmed": 1048576, "minimum": 0},
+				{"path": "/boot", "error": "Operation not supported"},
+			},
+		}, nil
+	})
+	qga := NewQemuGuestAgent("test", a.socketPath)
+
+	results, err := qga.GuestFsTrim(0)
+	assert.NoError(t, err)
+	assert.Equal(t, []GuestFilesystemTrimResult{
+		{Path: "/", Trimmed: 1048576},
+		{Path: "/boot", Error: "Operation not supported"},
+	}, results)
+
+	_, err = qga.GuestFsTrim(65536)
+	assert.NoError(t, err)
+	cmds := a.Commands()
+	if assert.Len(t, cmds, 2) {
+		assert.Equal(t, "guest-fstrim", cmds[0].Execute)
+		assert.Len(t, cmds[0].Args, 0)
+		assert.JSONEq(t, `{"minimum":65536}`, string(cmds[1].Args))
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"regexp"
 	"runtime/debug"
 	"strings"
@@ -55,6 +56,16 @@ var ignoreEvents = []string{`"RTC_CHANGE"`}
 type qmpMonitorCallBack func(*Response)
 type qmpEventCallback func(*Event)
 
+// default timeout of a qmp command, counted from it is queued
+const QMP_COMMAND_TIMEOUT = 120 * time.Second
+
+// qmpCommandCallback is answered either by qmp response or by timeout, never both
+type qmpCommandCallback struct {
+	cb       qmpMonitorCallBack
+	timer    *time.Timer
+	answered bool
+}
+
 type Response struct {
 	Return   []byte
 	ErrorVal *Error
@@ -107,10 +118,25 @@ func (e *Error) Error() string {
 type QmpMonitor struct {
 	SBaseMonitor
 
-	qmpEventFunc  qmpEventCallback
-	commandQueue  []*Command
-	callbackQueue []qmpMonitorCallBack
-	jobs          map[string]BlockJob
+	qmpEventFunc   qmpEventCallback
+	commandQueue   []*Command
+	callbackQueue  []*qmpCommandCallback
+	commandTimeout time.Duration
+	jobs           map[string]BlockJob
+
+	// reconnect on connection dropped, retries 0 means disabled
+	reconnect struct {
+		protocol   string
+		address    string
+		retries    int
+		backoff    time.Duration
+		maxBackoff time.Duration
+		// attempts since last successful handshake
+		attempts int
+		ongoing  bool
+	}
+	// closed by Disconnect, should not reconnect
+	closed bool
 
 	blkStream struct {
 		idx    int
@@ -121,16 +147,17 @@ type QmpMonitor struct {
 func NewQmpMonitor(server, sid string, OnMonitorDisConnect, OnMonitorTimeout MonitorErrorFunc,
 	OnMonitorConnected MonitorSuccFunc, qmpEventFunc qmpEventCallback) *QmpMonitor {
 	m := &QmpMonitor{
-		SBaseMonitor:  *NewBaseMonitor(server, sid, OnMonitorConnected, OnMonitorDisConnect, OnMonitorTimeout),
-		qmpEventFunc:  qmpEventFunc,
-		commandQueue:  make([]*Command, 0),
-		callbackQueue: make([]qmpMonitorCallBack, 0),
-		jobs:          map[string]BlockJob{},
+		SBaseMonitor:   *NewBaseMonitor(server, sid, OnMonitorConnected, OnMonitorDisConnect, OnMonitorTimeout),
+		qmpEventFunc:   qmpEventFunc,
+		commandQueue:   make([]*Command, 0),
+		callbackQueue:  make([]*qmpCommandCallback, 0),
+		commandTimeout: QMP_COMMAND_TIMEOUT,
+		jobs:           map[string]BlockJob{},
 	}
 
 	// On qmp init must set capabilities
 	m.commandQueue = append(m.commandQueue, &Command{Execute: "qmp_capabilities"})
-	m.callbackQueue = append(m.callbackQueue, nil)
+	m.callbackQueue = append(m.callbackQueue, &qmpCommandCallback{})
 
 	return m
 }
@@ -144,15 +171,124 @@ func (m *QmpMonitor) actionResult(res *Response) string {
 	}
 }
 
+// SetCommandTimeout set timeout of commands queued afterwards, 0 means no timeout
+func (m *QmpMonitor) SetCommandTimeout(timeout time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.commandTimeout = timeout
+}
+
+// EnableReconnect reconnects up to retries times with exponential backoff when connection dropped,
+// in-flight commands are failed, queued commands are sent after capabilities handshake again
+func (m *QmpMonitor) EnableReconnect(retries int, backoff, maxBackoff time.Duration) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.reconnect.retries = retries
+	m.reconnect.backoff = backoff
+	m.reconnect.maxBackoff = maxBackoff
+}
+
+func (m *QmpMonitor) Disconnect() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.closed = true
+	if m.connected || m.reconnect.ongoing {
+		m.connected = false
+		m.rwc.Close()
+	}
+}
+
+// failInflightCommands answers commands written but not responded yet with error
+func (m *QmpMonitor) failInflightCommands(reason error) {
+	m.mutex.Lock()
+	inflight := len(m.callbackQueue) - len(m.commandQueue)
+	cbs := m.callbackQueue[:inflight]
+	m.callbackQueue = m.callbackQueue[inflight:]
+	m.mutex.Unlock()
+	for _, c := range cbs {
+		m.mutex.Lock()
+		answered := c.answered
+		c.answered = true
+		m.mutex.Unlock()
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		if !answered {
+			m.runCallback(c.cb, &Response{
+				ErrorVal: &Error{
+					Class: "Disconnected",
+					Desc:  fmt.Sprintf("monitor connection dropped: %v", reason),
+				},
+			})
+		}
+	}
+}
+
+// tryReconnect returns true if dialed again, the handshake continues in new reader
+func (m *QmpMonitor) tryReconnect(reason error) bool {
+	m.failInflightCommands(reason)
+
+	m.mutex.Lock()
+	protocol, address := m.reconnect.protocol, m.reconnect.address
+	backoff, maxBackoff := m.reconnect.backoff, m.reconnect.maxBackoff
+	m.mutex.Unlock()
+
+	for {
+		m.mutex.Lock()
+		if m.closed || m.reconnect.attempts >= m.reconnect.retries {
+			m.reconnect.ongoing = false
+			m.mutex.Unlock()
+			return false
+		}
+		m.reconnect.attempts += 1
+		attempt := m.reconnect.attempts
+		m.mutex.Unlock()
+
+		delay := backoff << uint(attempt-1)
+		if delay > maxBackoff || delay <= 0 {
+			delay = maxBackoff
+		}
+		time.Sleep(delay)
+
+		conn, err := net.Dial(protocol, address)
+		if err != nil {
+			log.Errorf("QMP reconnect %s attempt %d: %s", m.server, attempt, err)
+			continue
+		}
+		log.Infof("QMP reconnect %s attempt %d success", m.server, attempt)
+		m.mutex.Lock()
+		// must set capabilities again before queued commands
+		m.commandQueue = append([]*Command{{Execute: "qmp_capabilities"}}, m.commandQueue...)
+		m.callbackQueue = append([]*qmpCommandCallback{{}}, m.callbackQueue...)
+		m.reconnect.ongoing = true
+		m.onConnectSuccess(conn)
+		m.mutex.Unlock()
+		go m.read(conn)
+		return true
+	}
+}
+
 func (m *QmpMonitor) callBack(res *Response) {
 	m.mutex.Lock()
 	if len(m.callbackQueue) == 0 {
 		m.mutex.Unlock()
 		return
 	}
-	cb := m.callbackQueue[0]
+	c := m.callbackQueue[0]
 	m.callbackQueue = m.callbackQueue[1:]
+	// qmp responses are in order, the late response of a timed out command is dropped
+	answered := c.answered
+	c.answered = true
 	m.mutex.Unlock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	if !answered {
+		m.runCallback(c.cb, res)
+	}
+}
+
+func (m *QmpMonitor) runCallback(cb qmpMonitorCallBack, res *Response) {
 	if cb != nil {
 		go func() {
 			defer func() {
@@ -165,6 +301,22 @@ func (m *QmpMonitor) callBack(res *Response) {
 	}
 }
 
+func (m *QmpMonitor) onCommandTimeout(c *qmpCommandCallback, cmd *Command) {
+	m.mutex.Lock()
+	answered := c.answered
+	c.answered = true
+	m.mutex.Unlock()
+	if !answered {
+		log.Errorf("QMP command %s of %s timeout", cmd.Execute, m.server)
+		m.runCallback(c.cb, &Response{
+			ErrorVal: &Error{
+				Class: "Timeout",
+				Desc:  fmt.Sprintf("command %s timeout", cmd.Execute),
+			},
+		})
+	}
+}
+
 func (m *QmpMonitor) read(r io.Reader) {
 	if !m.checkReading() {
 		return
@@ -178,7 +330,8 @@ func (m *QmpMonitor) read(r io.Reader) {
 			continue
 		}
 		if val, ok := objmap["event"]; !ok || !utils.IsInStringArray(string(*val), ignoreEvents) {
-			log.Infof("QMP Read %s: %s", m.server, string(b))
+			log.Infof("QMP Read %s: %s", m.server, RedactMonitorTraffic(string(b)))
+			m.audit("QMP", AUDIT_DIRECTION_RECEIVE, string(b))
 		}
 		if val, ok := objmap["error"]; ok {
 			var res = &Response{}
@@ -219,10 +372,17 @@ func (m *QmpMonitor) read(r io.Reader) {
 
 			// remove reader timeout
 			m.rwc.SetReadDeadline(time.Time{})
+			m.mutex.Lock()
 			m.connected = true
 			m.timeout = false
+			reconnected := m.reconnect.ongoing
+			m.reconnect.ongoing = false
+			m.reconnect.attempts = 0
+			m.mutex.Unlock()
 			go m.query()
-			go m.OnMonitorConnected()
+			if !reconnected {
+				go m.OnMonitorConnected()
+			}
 		}
 	}
 
@@ -231,13 +391,21 @@ func (m *QmpMonitor) read(r io.Reader) {
 	if err != nil {
 		log.Infof("QMP Disconnected %s: %s", m.server, err)
 	}
-	if m.timeout {
+	m.mutex.Lock()
+	timeout, connected := m.timeout, (m.connected || m.reconnect.ongoing) && !m.closed
+	reconnect := m.reconnect.retries > 0
+	m.connected = false
+	m.reconnect.ongoing = false
+	m.reading = false
+	m.mutex.Unlock()
+	if timeout {
 		m.OnMonitorTimeout(err)
-	} else if m.connected {
-		m.connected = false
+	} else if connected {
+		if reconnect && m.tryReconnect(err) {
+			return
+		}
 		m.OnMonitorDisConnect(err)
 	}
-	m.reading = false
 }
 
 func (m *QmpMonitor) watchEvent(event *Event) {
@@ -250,7 +418,8 @@ func (m *QmpMonitor) watchEvent(event *Event) {
 }
 
 func (m *QmpMonitor) write(cmd []byte) error {
-	log.Infof("QMP Write %s: %s", m.server, string(cmd))
+	log.Infof("QMP Write %s: %s", m.server, RedactMonitorTraffic(string(cmd)))
+	m.audit("QMP", AUDIT_DIRECTION_SEND, string(cmd))
 	length, index := len(cmd), 0
 	for index < length {
 		i, err := m.rwc.Write(cmd)
@@ -262,49 +431,59 @@ func (m *QmpMonitor) write(cmd []byte) error {
 	return nil
 }
 
+// query is the only writer of the connection, so commands are never interleaved
 func (m *QmpMonitor) query() {
 	if !m.checkWriting() {
 		return
 	}
 	for {
+		// pop cmd, check empty queue and clear writing at once,
+		// otherwise command queued in between is left unsent
+		m.mutex.Lock()
 		if len(m.commandQueue) == 0 {
-			break
+			m.writing = false
+			m.mutex.Unlock()
+			return
 		}
-
-		// pop cmd
-		m.mutex.Lock()
 		cmd := m.commandQueue[0]
 		m.commandQueue = m.commandQueue[1:]
 
 		c, _ := json.Marshal(cmd)
 		err := m.write(c)
-		m.mutex.Unlock()
 		if err != nil {
-			log.Errorf("Write %s to monitor %s error: %s", c, m.server, err)
-			break
+			m.writing = false
+			m.mutex.Unlock()
+			log.Errorf("Write %s to monitor %s error: %s", RedactMonitorTraffic(string(c)), m.server, err)
+			return
 		}
+		m.mutex.Unlock()
 	}
-	m.writing = false
 }
 
 func (m *QmpMonitor) Query(cmd *Command, cb qmpMonitorCallBack) {
 	// push cmd
 	m.mutex.Lock()
+	c := &qmpCommandCallback{cb: cb}
+	if cb != nil && m.commandTimeout > 0 {
+		c.timer = time.AfterFunc(m.commandTimeout, func() { m.onCommandTimeout(c, cmd) })
+	}
 	m.commandQueue = append(m.commandQueue, cmd)
-	m.callbackQueue = append(m.callbackQueue, cb)
+	m.callbackQueue = append(m.callbackQueue, c)
+	writing, reading, connected := m.writing, m.reading, m.connected
 	m.mutex.Unlock()
 
-	if m.connected {
-		if !m.writing {
+	if connected {
+		if !writing {
 			go m.query()
 		}
-		if !m.reading {
+		if !reading {
 			go m.read(m.rwc)
 		}
 	}
 }
 
 func (m *QmpMonitor) ConnectWithSocket(address string) error {
+	m.reconnect.protocol, m.reconnect.address = "unix", address
 	err := m.SBaseMonitor.connect("unix", address)
 	if err != nil {
 		return err
@@ -314,7 +493,8 @@ func (m *QmpMonitor) ConnectWithSocket(address string) error {
 }
 
 func (m *QmpMonitor) Connect(host string, port int) error {
-	err := m.SBaseMonitor.connect("tcp", fmt.Sprintf("%s:%d", host, port))
+	m.reconnect.protocol, m.reconnect.address = "tcp", fmt.Sprintf("%s:%d", host, port)
+	err := m.SBaseMonitor.connect("tcp", m.reconnect.address)
 	if err != nil {
 		return err
 	}
@@ -662,24 +842,22 @@ func (m *QmpMonitor) MigrateSetParameter(key string, val interface{}, callback S
 	m.Query(cmd, cb)
 }
 
+// MigrateIncoming starts listening on address for incoming migration,
+// qemu must be started with -incoming defer
 func (m *QmpMonitor) MigrateIncoming(address string, callback StringCallback) {
-	/*
-			 * var (
-			 * 	cb = func(res *Response) {
-			 * 		callback(m.actionResult(res))
-			 * 	}
-			 * 	cmd = &Command{
-			 * 		Execute: "migrate-incoming",
-			 * 		Args: map[string]interface{}{
-			 * 			"uri": address,
-			 * 		},
-			 * 	}
-			 * )
-		     *
-			 * m.Query(cmd, cb)
-	*/
-	cmd := fmt.Sprintf("migrate_incoming %s", address)
-	m.HumanMonitorCommand(cmd, callback)
+	var (
+		cb = func(res *Response) {
+			callback(m.actionResult(res))
+		}
+		cmd = &Command{
+			Execute: "migrate-incoming",
+			Args: map[string]interface{}{
+				"uri": address,
+			},
+		}
+	)
+
+	m.Query(cmd, cb)
 }
 
 func (m *QmpMonitor) Migrate(
@@ -817,6 +995,89 @@ func (m *QmpMonitor) blockJobs(res *Response) ([]BlockJob, error) {
 	return jobs, nil
 }
 
+// block job state polling interval of long running jobs
+var blockJobPollInterval = time.Second
+
+func decodeBlockJobs(res *Response) ([]BlockJob, error) {
+	if res.ErrorVal != nil {
+		return nil, errors.Errorf("query-block-jobs: %s", res.ErrorVal.Error())
+	}
+	ret, err := jsonutils.Parse(res.Return)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse block jobs %s", res.Return)
+	}
+	jobs := []BlockJob{}
+	if err := ret.Unmarshal(&jobs); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal block jobs %s", ret)
+	}
+	return jobs, nil
+}
+
+// MirrorDisk mirrors drive to existing target image and pivots drive to target
+// once mirror job is ready, onProgress is called on every poll of mirror job
+func (m *QmpMonitor) MirrorDisk(drive, target, format string, onProgress func(BlockJob), callback StringCallback) {
+	cmd := &Command{
+		Execute: "drive-mirror",
+		Args: map[string]interface{}{
+			"device": drive,
+			"target": target,
+			"format": format,
+			"mode":   "existing",
+			"sync":   "full",
+		},
+	}
+	m.Query(cmd, func(res *Response) {
+		if err := m.actionResult(res); len(err) > 0 {
+			callback(err)
+			return
+		}
+		m.waitMirrorReady(drive, onProgress, callback)
+	})
+}
+
+// QueryBlockJobs returns decoded state of current block jobs
+func (m *QmpMonitor) QueryBlockJobs(callback func([]BlockJob, error)) {
+	m.Query(&Command{Execute: "query-block-jobs"}, func(res *Response) {
+		callback(decodeBlockJobs(res))
+	})
+}
+
+func (m *QmpMonitor) waitMirrorReady(drive string, onProgress func(BlockJob), callback StringCallback) {
+	m.QueryBlockJobs(func(jobs []BlockJob, err error) {
+		if err != nil {
+			callback(err.Error())
+			return
+		}
+		var job *BlockJob
+		for i := range jobs {
+			if jobs[i].Device == drive {
+				job = &jobs[i]
+				break
+			}
+		}
+		if job == nil {
+			callback(fmt.Sprintf("mirror job of %s missing", drive))
+			return
+		}
+		if onProgress != nil {
+			onProgress(*job)
+		}
+		if !job.Ready {
+			time.AfterFunc(blockJobPollInterval, func() {
+				m.waitMirrorReady(drive, onProgress, callback)
+			})
+			return
+		}
+		cmd := &Command{
+			Execute: "block-job-complete",
+			Args:    map[string]interface{}{"device": drive},
+		}
+		m.Query(cmd, func(res *Response) {
+			callback(m.actionResult(res))
+		})
+	})
+}
+
 func (m *QmpMonitor) GetBlockJobCounts(callback func(jobs int)) {
 	var cb = func(res *Response) {
 		jobs, err := m.blockJobs(res)
@@ -929,9 +1190,150 @@ func (m *QmpMonitor) StartNbdServer(port int, exportAllDevice, writable bool, ca
 	m.HumanMonitorCommand(cmd, callback)
 }
 
+// ResizeDisk grows drive online via qmp block_resize, shrinking is rejected
+// and resizing to current size is a no-op
 func (m *QmpMonitor) ResizeDisk(driveName string, sizeMB int64, callback StringCallback) {
-	cmd := fmt.Sprintf("block_resize %s %d", driveName, sizeMB)
-	m.HumanMonitorCommand(cmd, callback)
+	newSize := sizeMB * 1024 * 1024
+	m.GetBlocks(func(blocks []QemuBlock) {
+		if blocks == nil {
+			callback(fmt.Sprintf("query block of %s failed", driveName))
+			return
+		}
+		var block *QemuBlock
+		for i := range blocks {
+			if blocks[i].Device == driveName {
+				block = &blocks[i]
+				break
+			}
+		}
+		if block == nil {
+			callback(fmt.Sprintf("drive %s not found", driveName))
+			return
+		}
+		curSize := block.Inserted.Image.VirtualSize
+		if newSize < curSize {
+			callback(fmt.Sprintf("drive %s can't shrink from %d to %d bytes", driveName, curSize, newSize))
+			return
+		}
+		if newSize == curSize {
+			callback("")
+			return
+		}
+		cmd := &Command{
+			Execute: "block_resize",
+			Args: map[string]interface{}{
+				"device": driveName,
+				"size":   newSize,
+			},
+		}
+		m.Query(cmd, func(res *Response) {
+			callback(m.actionResult(res))
+		})
+	})
+}
+
+// run states of qemu reported by query-status
+const (
+	RUN_STATE_RUNNING   = "running"
+	RUN_STATE_PAUSED    = "paused"
+	RUN_STATE_PRELAUNCH = "prelaunch"
+	RUN_STATE_INMIGRATE = "inmigrate"
+	RUN_STATE_SHUTDOWN  = "shutdown"
+)
+
+// QueryRunState returns run state of qemu via query-status
+func (m *QmpMonitor) QueryRunState(callback func(string, error)) {
+	m.Query(&Command{Execute: "query-status"}, func(res *Response) {
+		if res.ErrorVal != nil {
+			callback("", errors.Errorf("query-status: %s", res.ErrorVal.Error()))
+			return
+		}
+		status := struct {
+			Status string `json:"status"`
+		}{}
+		if err := json.Unmarshal(res.Return, &status); err != nil {
+			callback("", errors.Wrapf(err, "unmarshal status %s", res.Return))
+			return
+		}
+		callback(status.Status, nil)
+	})
+}
+
+// runStateCommand issues cmd when current run state is one of from,
+// it is a no-op when guest already is in state target unless target is empty
+func (m *QmpMonitor) runStateCommand(cmd, target string, from []string, callback func(string, error)) {
+	m.QueryRunState(func(state string, err error) {
+		if err != nil {
+			callback("", err)
+			return
+		}
+		if len(target) > 0 && state == target {
+			callback(state, nil)
+			return
+		}
+		if !utils.IsInStringArray(state, from) {
+			callback(state, errors.Errorf("can't %s guest in state %s", cmd, state))
+			return
+		}
+		m.Query(&Command{Execute: cmd}, func(res *Response) {
+			if res.ErrorVal != nil {
+				callback(state, errors.Errorf("%s: %s", cmd, res.ErrorVal.Error()))
+				return
+			}
+			m.QueryRunState(callback)
+		})
+	})
+}
+
+// Pause stops vcpus of running guest via qmp stop, callback receives resulting run state
+func (m *QmpMonitor) Pause(callback func(string, error)) {
+	m.runStateCommand("stop", RUN_STATE_PAUSED, []string{RUN_STATE_RUNNING}, callback)
+}
+
+// Resume continues paused guest via qmp cont, callback receives resulting run state
+func (m *QmpMonitor) Resume(callback func(string, error)) {
+	m.runStateCommand("cont", RUN_STATE_RUNNING, []string{RUN_STATE_PAUSED, RUN_STATE_PRELAUNCH}, callback)
+}
+
+// Reset hard resets running guest via qmp system_reset, like pressing reset button.
+// Guest os is not notified, data not flushed to disks is lost and filesystems
+// may need repair, prefer reboot through guest agent when guest responds
+func (m *QmpMonitor) Reset(callback func(string, error)) {
+	m.runStateCommand("system_reset", "", []string{RUN_STATE_RUNNING}, callback)
+}
+
+// poll interval of WaitIncomingReady
+const INCOMING_READY_POLL_INTERVAL = 200 * time.Millisecond
+
+// WaitIncomingReady polls run state until destination qemu waits for incoming
+// migration, source must not start migrating before that. It gives up early
+// when qemu is running or shut down, which never turns into inmigrate again
+func (m *QmpMonitor) WaitIncomingReady(timeout time.Duration, callback func(error)) {
+	deadline := time.Now().Add(timeout)
+	var poll func()
+	poll = func() {
+		m.QueryRunState(func(state string, err error) {
+			if err == nil {
+				switch state {
+				case RUN_STATE_INMIGRATE:
+					callback(nil)
+					return
+				case RUN_STATE_RUNNING, RUN_STATE_SHUTDOWN:
+					callback(errors.Errorf("qemu is %s, not waiting for incoming migration", state))
+					return
+				}
+			}
+			if time.Now().After(deadline) {
+				if err == nil {
+					err = errors.Errorf("run state %s", state)
+				}
+				callback(errors.Wrapf(errors.ErrTimeout, "wait incoming ready: %s", err))
+				return
+			}
+			time.AfterFunc(INCOMING_READY_POLL_INTERVAL, poll)
+		})
+	}
+	poll()
 }
 
 func (m *QmpMonitor) GetCpuCount(callback func(count int)) {
@@ -990,12 +1392,16 @@ func (m *QmpMonitor) BlockIoThrottle(driveName string, bps, iops int64, callback
 }
 
 func (m *QmpMonitor) CancelBlockJob(driveName string, force bool, callback StringCallback) {
-	cmd := "block_job_cancel "
-	if force {
-		cmd += "-f "
+	cmd := &Command{
+		Execute: "block-job-cancel",
+		Args: map[string]interface{}{
+			"device": driveName,
+			"force":  force,
+		},
 	}
-	cmd += driveName
-	m.HumanMonitorCommand(cmd, callback)
+	m.Query(cmd, func(res *Response) {
+		callback(m.actionResult(res))
+	})
 }
 
 func (m *QmpMonitor) BlockJobComplete(drive string, callback StringCallback) {
@@ -1042,6 +1448,169 @@ func (m *QmpMonitor) NetdevDel(id string, callback StringCallback) {
 	m.HumanMonitorCommand(cmd, callback)
 }
 
+// SetLink sets link of nic device or netdev up or down, guest sees carrier changes
+func (m *QmpMonitor) SetLink(name string, up bool, callback StringCallback) {
+	var (
+		cb = func(res *Response) {
+			callback(m.actionResult(res))
+		}
+		cmd = &Command{
+			Execute: "set_link",
+			Args: map[string]interface{}{
+				"name": name,
+				"up":   up,
+			},
+		}
+	)
+	m.Query(cmd, cb)
+}
+
+// BalloonInfo is guest memory seen through virtio balloon, sizes in bytes
+type BalloonInfo struct {
+	Actual int64 `json:"actual"`
+
+	// stats reported by guest balloon driver, -1 if guest doesn't report
+	FreeMemory      int64 `json:"free_memory"`
+	AvailableMemory int64 `json:"available_memory"`
+	TotalMemory     int64 `json:"total_memory"`
+	// unix time of last stats update, 0 means stats are never polled
+	StatsUpdatedAt int64 `json:"stats_updated_at"`
+}
+
+func decodeBalloonInfo(res *Response) (*BalloonInfo, error) {
+	if res.ErrorVal != nil {
+		return nil, errors.Errorf("query-balloon: %s", res.ErrorVal.Error())
+	}
+	ret := struct {
+		Actual int64 `json:"actual"`
+	}{}
+	if err := json.Unmarshal(res.Return, &ret); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal balloon info %s", res.Return)
+	}
+	return &BalloonInfo{
+		Actual:          ret.Actual,
+		FreeMemory:      -1,
+		AvailableMemory: -1,
+		TotalMemory:     -1,
+	}, nil
+}
+
+func decodeBalloonStats(res *Response, info *BalloonInfo) error {
+	if res.ErrorVal != nil {
+		return errors.Errorf("qom-get guest-stats: %s", res.ErrorVal.Error())
+	}
+	ret := struct {
+		Stats      map[string]int64 `json:"stats"`
+		LastUpdate int64            `json:"last-update"`
+	}{}
+	if err := json.Unmarshal(res.Return, &ret); err != nil {
+		return errors.Wrapf(err, "unmarshal balloon stats %s", res.Return)
+	}
+	info.StatsUpdatedAt = ret.LastUpdate
+	for key, val := range map[string]*int64{
+		"stat-free-memory":      &info.FreeMemory,
+		"stat-available-memory": &info.AvailableMemory,
+		"stat-total-memory":     &info.TotalMemory,
+	} {
+		if stat, ok := ret.Stats[key]; ok {
+			*val = stat
+		}
+	}
+	return nil
+}
+
+// QueryBalloon returns actual memory of guest, guest memory stats are read
+// from balloon device of qom path statsPath if it's not empty
+func (m *QmpMonitor) QueryBalloon(statsPath string, callback func(*BalloonInfo, error)) {
+	m.Query(&Command{Execute: "query-balloon"}, func(res *Response) {
+		info, err := decodeBalloonInfo(res)
+		if err != nil || len(statsPath) == 0 {
+			callback(info, err)
+			return
+		}
+		cmd := &Command{
+			Execute: "qom-get",
+			Args: map[string]interface{}{
+				"path":     statsPath,
+				"property": "guest-stats",
+			},
+		}
+		m.Query(cmd, func(res *Response) {
+			if err := decodeBalloonStats(res, info); err != nil {
+				callback(nil, err)
+				return
+			}
+			callback(info, nil)
+		})
+	})
+}
+
+// SetBalloonStatsPolling makes balloon device of qom path poll guest memory
+// stats every interval seconds, 0 stops polling
+func (m *QmpMonitor) SetBalloonStatsPolling(path string, interval int, callback StringCallback) {
+	var (
+		cb = func(res *Response) {
+			callback(m.actionResult(res))
+		}
+		cmd = &Command{
+			Execute: "qom-set",
+			Args: map[string]interface{}{
+				"path":     path,
+				"property": "guest-stats-polling-interval",
+				"value":    interval,
+			},
+		}
+	)
+	m.Query(cmd, cb)
+}
+
+func (m *QmpMonitor) SetBalloon(sizeBytes int64, callback StringCallback) {
+	var (
+		cb = func(res *Response) {
+			callback(m.actionResult(res))
+		}
+		cmd = &Command{
+			Execute: "balloon",
+			Args:    map[string]interface{}{"value": sizeBytes},
+		}
+	)
+	m.Query(cmd, cb)
+}
+
+func (m *QmpMonitor) ScreenDump(filename string, callback StringCallback) {
+	var (
+		cb = func(res *Response) {
+			callback(m.actionResult(res))
+		}
+		cmd = &Command{
+			Execute: "screendump",
+			Args:    map[string]interface{}{"filename": filename},
+		}
+	)
+	m.Query(cmd, cb)
+}
+
+func (m *QmpMonitor) SendKey(keys []string, holdTime int, callback StringCallback) {
+	keyValues := make([]map[string]string, 0, len(keys))
+	for _, key := range keys {
+		keyValues = append(keyValues, map[string]string{"type": "qcode", "data": key})
+	}
+	args := map[string]interface{}{"keys": keyValues}
+	if holdTime > 0 {
+		args["hold-time"] = holdTime
+	}
+	var (
+		cb = func(res *Response) {
+			callback(m.actionResult(res))
+		}
+		cmd = &Command{
+			Execute: "send-key",
+			Args:    args,
+		}
+	)
+	m.Query(cmd, cb)
+}
+
 func (m *QmpMonitor) SaveState(stateFilePath string, callback StringCallback) {
 	var (
 		cb = func(res *Response) {
@@ -1056,3 +1625,56 @@ func (m *QmpMonitor) SaveState(stateFilePath string, callback StringCallback) {
 	)
 	m.Query(cmd, cb)
 }
+
+// ProbeQmpStatus runs query-status on a short lived connection to qmp server
+// at tcp address and returns run state of qemu, e.g. prelaunch or running.
+// It tells qemu is responsive before the long lived monitor connects.
+func ProbeQmpStatus(address string, timeout time.Duration) (string, error) {
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return "", errors.Wrapf(err, "dial qmp %s", address)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	decoder := json.NewDecoder(conn)
+	greeting := map[string]json.RawMessage{}
+	if err := decoder.Decode(&greeting); err != nil {
+		return "", errors.Wrap(err, "read qmp greeting")
+	}
+	if _, ok := greeting["QMP"]; !ok {
+		return "", errors.Errorf("unexpected qmp greeting %v", greeting)
+	}
+	ret := struct {
+		Status string `json:"status"`
+	}{}
+	for _, cmd := range []string{"qmp_capabilities", "query-status"} {
+		b, _ := json.Marshal(&Command{Execute: cmd})
+		if _, err := conn.Write(append(b, '\n')); err != nil {
+			return "", errors.Wrapf(err, "write %s", cmd)
+		}
+		for {
+			res := struct {
+				Event    string          `json:"event"`
+				Return   json.RawMessage `json:"return"`
+				ErrorVal *Error          `json:"error"`
+			}{}
+			if err := decoder.Decode(&res); err != nil {
+				return "", errors.Wrapf(err, "read %s response", cmd)
+			}
+			if len(res.Event) > 0 {
+				continue
+			}
+			if res.ErrorVal != nil {
+				return "", errors.Wrap(res.ErrorVal, cmd)
+			}
+			if cmd == "query-status" {
+				if err := json.Unmarshal(res.Return, &ret); err != nil {
+					return "", errors.Wrapf(err, "unmarshal query-status response %s", res.Return)
+				}
+			}
+			break
+		}
+	}
+	return ret.Status, nil
+}
@@ -15,10 +15,18 @@
 package monitor
 
 import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/stretchr/testify/assert"
+
 	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
 )
 
 func TestQmpMonitor_Connect(t *testing.T) {
@@ -43,3 +51,873 @@ func TestQmpMonitor_Connect(t *testing.T) {
 	m.Disconnect()
 	time.Sleep(3 * time.Second)
 }
+
+func echoQmpHandler(cmd *fakeQmpCommand) (interface{}, *Error) {
+	if cmd.Execute == "slow" {
+		time.Sleep(300 * time.Millisecond)
+	}
+	return map[string]interface{}{"execute": cmd.Execute, "arguments": cmd.Args}, nil
+}
+
+func TestQmpMonitor_ConcurrentQuery(t *testing.T) {
+	s := newFakeQmpServer(t, echoQmpHandler)
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	const count = 100
+	var wg sync.WaitGroup
+	errs := make(chan error, count)
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			done := make(chan *Response, 1)
+			m.Query(&Command{
+				Execute: "echo",
+				Args:    map[string]int{"index": i},
+			}, func(res *Response) { done <- res })
+			defer wg.Done()
+			select {
+			case res := <-done:
+				ret := struct {
+					Arguments struct {
+						Index int `json:"index"`
+					} `json:"arguments"`
+				}{}
+				if res.ErrorVal != nil {
+					errs <- res.ErrorVal
+				} else if err := json.Unmarshal(res.Return, &ret); err != nil {
+					errs <- err
+				} else if ret.Arguments.Index != i {
+					errs <- fmt.Errorf("command %d got response of %d", i, ret.Arguments.Index)
+				}
+			case <-time.After(10 * time.Second):
+				errs <- fmt.Errorf("command %d no response", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	assert.Len(t, s.Commands(), count)
+}
+
+func TestQmpMonitor_CommandTimeout(t *testing.T) {
+	s := newFakeQmpServer(t, echoQmpHandler)
+	m := connectFakeQmpMonitor(t, s, nil)
+	m.SetCommandTimeout(100 * time.Millisecond)
+
+	slow := make(chan *Response, 2)
+	m.Query(&Command{Execute: "slow"}, func(res *Response) { slow <- res })
+	select {
+	case res := <-slow:
+		if assert.NotNil(t, res.ErrorVal) {
+			assert.Equal(t, "Timeout", res.ErrorVal.Class)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slow command not timeout")
+	}
+
+	// late response of slow command must not be delivered to next command
+	m.SetCommandTimeout(5 * time.Second)
+	fast := make(chan *Response, 1)
+	m.Query(&Command{Execute: "fast"}, func(res *Response) { fast <- res })
+	select {
+	case res := <-fast:
+		assert.Nil(t, res.ErrorVal)
+		assert.Contains(t, string(res.Return), `"execute":"fast"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("fast command no response")
+	}
+	assert.Len(t, slow, 0)
+}
+
+func waitQmpResponse(t *testing.T, ch chan *Response) *Response {
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait qmp response timeout")
+	}
+	return nil
+}
+
+func TestQmpMonitor_Reconnect(t *testing.T) {
+	s := newFakeQmpServer(t, echoQmpHandler)
+	connectedCount := 0
+	disconnected := make(chan error, 1)
+	connected := make(chan struct{}, 2)
+	m := NewQmpMonitor("fake", "fake",
+		func(err error) { disconnected <- err }, func(error) {},
+		func() { connectedCount++; connected <- struct{}{} },
+		nil,
+	)
+	m.EnableReconnect(3, 10*time.Millisecond, 100*time.Millisecond)
+	assert.NoError(t, m.Connect("127.0.0.1", s.Port()))
+	defer m.Disconnect()
+	<-connected
+
+	// in-flight command fails when connection dropped
+	s.SetDropOn("hang")
+	ch := make(chan *Response, 1)
+	m.Query(&Command{Execute: "hang"}, func(res *Response) { ch <- res })
+	res := waitQmpResponse(t, ch)
+	if assert.NotNil(t, res.ErrorVal) {
+		assert.Equal(t, "Disconnected", res.ErrorVal.Class)
+	}
+
+	// next command is served after reconnected
+	m.Query(&Command{Execute: "echo"}, func(res *Response) { ch <- res })
+	res = waitQmpResponse(t, ch)
+	assert.Nil(t, res.ErrorVal)
+	assert.Contains(t, string(res.Return), `"execute":"echo"`)
+	assert.Equal(t, 2, s.Connections())
+	assert.Equal(t, 1, connectedCount)
+	assert.True(t, m.IsConnected())
+	assert.Len(t, disconnected, 0)
+
+	// dropped by server again
+	s.DropConnections()
+	m.Query(&Command{Execute: "echo"}, func(res *Response) { ch <- res })
+	res = waitQmpResponse(t, ch)
+	if res.ErrorVal != nil {
+		// command written before connection dropped noticed
+		assert.Equal(t, "Disconnected", res.ErrorVal.Class)
+	} else {
+		assert.Contains(t, string(res.Return), `"execute":"echo"`)
+	}
+	assert.Len(t, disconnected, 0)
+}
+
+func TestQmpMonitor_ReconnectFailed(t *testing.T) {
+	s := newFakeQmpServer(t, echoQmpHandler)
+	disconnected := make(chan error, 1)
+	connected := make(chan struct{}, 1)
+	m := NewQmpMonitor("fake", "fake",
+		func(err error) { disconnected <- err }, func(error) {},
+		func() { connected <- struct{}{} },
+		nil,
+	)
+	m.EnableReconnect(2, 10*time.Millisecond, 20*time.Millisecond)
+	assert.NoError(t, m.Connect("127.0.0.1", s.Port()))
+	<-connected
+
+	// server gone, reconnect gives up and reports disconnect
+	s.Close()
+	select {
+	case <-disconnected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("monitor disconnect not reported")
+	}
+	assert.Equal(t, 1, s.Connections())
+	assert.False(t, m.IsConnected())
+}
+
+func blockQmpHandler(cmd *fakeQmpCommand) (interface{}, *Error) {
+	switch cmd.Execute {
+	case "query-block":
+		return []map[string]interface{}{
+			{
+				"device": "drive_0",
+				"inserted": map[string]interface{}{
+					"image": map[string]interface{}{"virtual-size": 10 * 1024 * 1024 * 1024},
+				},
+			},
+		}, nil
+	case "block_resize":
+		return map[string]interface{}{}, nil
+	}
+	return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+}
+
+func resizeFakeQmpDisk(t *testing.T, m *QmpMonitor, drive string, sizeMB int64) string {
+	ch := make(chan string, 1)
+	m.ResizeDisk(drive, sizeMB, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		return res
+	case <-time.After(5 * time.Second):
+		t.Fatal("resize disk no response")
+	}
+	return ""
+}
+
+func TestQmpMonitor_ResizeDisk(t *testing.T) {
+	s := newFakeQmpServer(t, blockQmpHandler)
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	assert.Equal(t, "", resizeFakeQmpDisk(t, m, "drive_0", 20*1024))
+	cmds := s.Commands()
+	last := cmds[len(cmds)-1]
+	assert.Equal(t, "block_resize", last.Execute)
+	assert.JSONEq(t, `{"device":"drive_0","size":21474836480}`, string(last.Args))
+
+	// same size is a no-op
+	assert.Equal(t, "", resizeFakeQmpDisk(t, m, "drive_0", 10*1024))
+	assert.Len(t, s.Commands(), len(cmds)+1)
+}
+
+func TestQmpMonitor_ResizeDiskShrink(t *testing.T) {
+	s := newFakeQmpServer(t, blockQmpHandler)
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	assert.Contains(t, resizeFakeQmpDisk(t, m, "drive_0", 5*1024), "can't shrink")
+	assert.Contains(t, resizeFakeQmpDisk(t, m, "drive_1", 20*1024), "not found")
+	for _, cmd := range s.Commands() {
+		assert.NotEqual(t, "block_resize", cmd.Execute)
+	}
+}
+
+func TestQmpMonitor_MirrorDisk(t *testing.T) {
+	interval := blockJobPollInterval
+	blockJobPollInterval = 10 * time.Millisecond
+	defer func() { blockJobPollInterval = interval }()
+
+	polls := 0
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		switch cmd.Execute {
+		case "drive-mirror", "block-job-complete":
+			return map[string]interface{}{}, nil
+		case "query-block-jobs":
+			polls += 1
+			job := map[string]interface{}{
+				"device": "drive_0", "type": "mirror", "len": 1024, "offset": 512 * polls,
+				"ready": polls >= 2, "status": "running",
+			}
+			if polls >= 2 {
+				job["status"] = "ready"
+			}
+			return []interface{}{job}, nil
+		}
+		return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	progress := []int64{}
+	ch := make(chan string, 1)
+	m.MirrorDisk("drive_0", "/opt/cloud/target", "qcow2",
+		func(job BlockJob) { progress = append(progress, job.Offset) },
+		func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror disk no response")
+	}
+	assert.Equal(t, []int64{512, 1024}, progress)
+
+	executes := []string{}
+	for _, cmd := range s.Commands() {
+		executes = append(executes, cmd.Execute)
+		if cmd.Execute == "drive-mirror" {
+			assert.JSONEq(t, `{"device":"drive_0","target":"/opt/cloud/target","format":"qcow2","mode":"existing","sync":"full"}`, string(cmd.Args))
+		}
+		if cmd.Execute == "block-job-complete" {
+			assert.JSONEq(t, `{"device":"drive_0"}`, string(cmd.Args))
+		}
+	}
+	assert.Equal(t, []string{"drive-mirror", "query-block-jobs", "query-block-jobs", "block-job-complete"}, executes)
+}
+
+func TestQmpMonitor_MirrorDiskJobMissing(t *testing.T) {
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		if cmd.Execute == "query-block-jobs" {
+			return []interface{}{}, nil
+		}
+		return map[string]interface{}{}, nil
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	ch := make(chan string, 1)
+	m.MirrorDisk("drive_0", "/opt/cloud/target", "raw", nil, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Contains(t, res, "missing")
+	case <-time.After(5 * time.Second):
+		t.Fatal("mirror disk no response")
+	}
+}
+
+func Test_decodeBlockJobs(t *testing.T) {
+	jobs, err := decodeBlockJobs(&Response{Return: []byte(`[
+		{"device":"drive_0","type":"mirror","len":2048,"offset":1024,"busy":true,"paused":false,"ready":false,"status":"running","io-status":"ok","speed":0},
+		{"device":"drive_1","type":"mirror","len":2048,"offset":2048,"busy":false,"ready":true,"status":"ready"},
+		{"device":"drive_2","type":"commit","len":4096,"offset":4096,"status":"concluded"}
+	]`)})
+	assert.NoError(t, err)
+	if assert.Len(t, jobs, 3) {
+		assert.Equal(t, "drive_0", jobs[0].Device)
+		assert.Equal(t, "mirror", jobs[0].Type)
+		assert.Equal(t, int64(2048), jobs[0].Len)
+		assert.Equal(t, int64(1024), jobs[0].Offset)
+		assert.Equal(t, BLOCK_JOB_STATUS_RUNNING, jobs[0].Status)
+		assert.Equal(t, "ok", jobs[0].IoStatus)
+		assert.True(t, jobs[0].Busy)
+		assert.False(t, jobs[0].Ready)
+
+		assert.True(t, jobs[1].Ready)
+		assert.Equal(t, BLOCK_JOB_STATUS_READY, jobs[1].Status)
+
+		assert.Equal(t, "commit", jobs[2].Type)
+		assert.True(t, jobs[2].IsConcluded())
+		assert.False(t, jobs[1].IsConcluded())
+	}
+
+	_, err = decodeBlockJobs(&Response{ErrorVal: &Error{Class: "GenericError", Desc: "failed"}})
+	assert.Error(t, err)
+}
+
+func TestQmpMonitor_QueryBlockJobs(t *testing.T) {
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		switch cmd.Execute {
+		case "query-block-jobs":
+			return []interface{}{map[string]interface{}{"device": "drive_0", "type": "stream", "len": 100, "offset": 10, "status": "running"}}, nil
+		case "block-job-cancel":
+			return map[string]interface{}{}, nil
+		}
+		return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	jobsCh := make(chan []BlockJob, 1)
+	m.QueryBlockJobs(func(jobs []BlockJob, err error) {
+		assert.NoError(t, err)
+		jobsCh <- jobs
+	})
+	select {
+	case jobs := <-jobsCh:
+		if assert.Len(t, jobs, 1) {
+			assert.Equal(t, "stream", jobs[0].Type)
+			assert.Equal(t, int64(10), jobs[0].Offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query block jobs no response")
+	}
+
+	ch := make(chan string, 1)
+	m.CancelBlockJob("drive_0", true, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("cancel block job no response")
+	}
+	cmds := s.Commands()
+	last := cmds[len(cmds)-1]
+	assert.Equal(t, "block-job-cancel", last.Execute)
+	assert.JSONEq(t, `{"device":"drive_0","force":true}`, string(last.Args))
+}
+
+// runStateQmpHandler keeps run state of a fake guest switched by stop/cont
+func runStateQmpHandler(state *string) fakeQmpHandler {
+	return func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		switch cmd.Execute {
+		case "query-status":
+			return map[string]interface{}{"status": *state, "running": *state == RUN_STATE_RUNNING}, nil
+		case "stop":
+			*state = RUN_STATE_PAUSED
+			return nil, nil
+		case "cont":
+			*state = RUN_STATE_RUNNING
+			return nil, nil
+		case "system_reset":
+			return nil, nil
+		}
+		return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+	}
+}
+
+func waitFakeQmpRunState(t *testing.T, do func(func(string, error))) (string, error) {
+	type result struct {
+		state string
+		err   error
+	}
+	ch := make(chan result, 1)
+	do(func(state string, err error) { ch <- result{state, err} })
+	select {
+	case r := <-ch:
+		return r.state, r.err
+	case <-time.After(5 * time.Second):
+		t.Fatal("run state command no response")
+	}
+	return "", nil
+}
+
+func fakeQmpExecutes(s *fakeQmpServer) []string {
+	executes := []string{}
+	for _, cmd := range s.Commands() {
+		executes = append(executes, cmd.Execute)
+	}
+	return executes
+}
+
+func TestQmpMonitor_PauseResume(t *testing.T) {
+	cases := []struct {
+		name     string
+		state    string
+		pause    bool
+		want     string
+		wantErr  bool
+		executes []string
+	}{
+		{
+			name:     "pause running",
+			state:    RUN_STATE_RUNNING,
+			pause:    true,
+			want:     RUN_STATE_PAUSED,
+			executes: []string{"query-status", "stop", "query-status"},
+		},
+		{
+			name:     "resume paused",
+			state:    RUN_STATE_PAUSED,
+			want:     RUN_STATE_RUNNING,
+			executes: []string{"query-status", "cont", "query-status"},
+		},
+		{
+			name:     "resume prelaunch",
+			state:    RUN_STATE_PRELAUNCH,
+			want:     RUN_STATE_RUNNING,
+			executes: []string{"query-status", "cont", "query-status"},
+		},
+		{
+			name:     "pause paused is no-op",
+			state:    RUN_STATE_PAUSED,
+			pause:    true,
+			want:     RUN_STATE_PAUSED,
+			executes: []string{"query-status"},
+		},
+		{
+			name:     "resume running is no-op",
+			state:    RUN_STATE_RUNNING,
+			want:     RUN_STATE_RUNNING,
+			executes: []string{"query-status"},
+		},
+		{
+			name:     "pause incoming migration",
+			state:    RUN_STATE_INMIGRATE,
+			pause:    true,
+			want:     RUN_STATE_INMIGRATE,
+			wantErr:  true,
+			executes: []string{"query-status"},
+		},
+		{
+			name:     "resume shutdown",
+			state:    RUN_STATE_SHUTDOWN,
+			want:     RUN_STATE_SHUTDOWN,
+			wantErr:  true,
+			executes: []string{"query-status"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			state := c.state
+			s := newFakeQmpServer(t, runStateQmpHandler(&state))
+			m := connectFakeQmpMonitor(t, s, nil)
+
+			do := m.Resume
+			if c.pause {
+				do = m.Pause
+			}
+			got, err := waitFakeQmpRunState(t, do)
+			if c.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, c.want, got)
+			assert.Equal(t, c.executes, fakeQmpExecutes(s))
+		})
+	}
+}
+
+func TestQmpMonitor_PauseFailed(t *testing.T) {
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		if cmd.Execute == "query-status" {
+			return map[string]interface{}{"status": RUN_STATE_RUNNING, "running": true}, nil
+		}
+		return nil, &Error{Class: "GenericError", Desc: "stop failed"}
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	state, err := waitFakeQmpRunState(t, m.Pause)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "stop failed")
+	assert.Equal(t, RUN_STATE_RUNNING, state)
+}
+
+func TestQmpMonitor_Reset(t *testing.T) {
+	state := RUN_STATE_RUNNING
+	s := newFakeQmpServer(t, runStateQmpHandler(&state))
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	got, err := waitFakeQmpRunState(t, m.Reset)
+	assert.NoError(t, err)
+	assert.Equal(t, RUN_STATE_RUNNING, got)
+	assert.Equal(t, []string{"query-status", "system_reset", "query-status"}, fakeQmpExecutes(s))
+
+	// reset is refused unless guest is running
+	state = RUN_STATE_PAUSED
+	got, err = waitFakeQmpRunState(t, m.Reset)
+	assert.Error(t, err)
+	assert.Equal(t, RUN_STATE_PAUSED, got)
+	assert.Equal(t, []string{"query-status", "system_reset", "query-status", "query-status"}, fakeQmpExecutes(s))
+}
+
+func TestQmpMonitor_MigrateIncoming(t *testing.T) {
+	listening := ""
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		if cmd.Execute != "migrate-incoming" {
+			return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+		}
+		if len(listening) > 0 {
+			return nil, &Error{Class: "GenericError", Desc: "The incoming migration has already been started"}
+		}
+		var args struct {
+			Uri string
+		}
+		json.Unmarshal(cmd.Args, &args)
+		listening = args.Uri
+		return nil, nil
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	migrateIncoming := func() string {
+		ch := make(chan string, 1)
+		m.MigrateIncoming("tcp:0:4397", func(res string) { ch <- res })
+		select {
+		case res := <-ch:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatal("migrate-incoming no response")
+		}
+		return ""
+	}
+
+	assert.Equal(t, "", migrateIncoming())
+	assert.Equal(t, "tcp:0:4397", listening)
+	assert.JSONEq(t, `{"uri":"tcp:0:4397"}`, string(s.Commands()[0].Args))
+
+	// callers look for error in result
+	assert.Contains(t, strings.ToLower(migrateIncoming()), "error")
+}
+
+func TestQmpMonitor_WaitIncomingReady(t *testing.T) {
+	// reports prelaunch for the first queries, inmigrate after
+	var (
+		mutex    sync.Mutex
+		notReady = 2
+		states   = []string{}
+	)
+	reset := func(n int) []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		got := states
+		states, notReady = []string{}, n
+		return got
+	}
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		if cmd.Execute != "query-status" {
+			return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		state := RUN_STATE_INMIGRATE
+		if len(states) < notReady {
+			state = RUN_STATE_PRELAUNCH
+		} else if notReady < 0 {
+			state = RUN_STATE_RUNNING
+		}
+		states = append(states, state)
+		return map[string]interface{}{"status": state, "running": state == RUN_STATE_RUNNING}, nil
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	wait := func(timeout time.Duration) error {
+		ch := make(chan error, 1)
+		m.WaitIncomingReady(timeout, func(err error) { ch <- err })
+		select {
+		case err := <-ch:
+			return err
+		case <-time.After(5 * time.Second):
+			t.Fatal("wait incoming ready no response")
+		}
+		return nil
+	}
+
+	assert.NoError(t, wait(2*time.Second))
+
+	// never ready
+	assert.Equal(t, []string{RUN_STATE_PRELAUNCH, RUN_STATE_PRELAUNCH, RUN_STATE_INMIGRATE}, reset(100))
+	err := wait(3 * INCOMING_READY_POLL_INTERVAL / 2)
+	assert.True(t, errors.Cause(err) == errors.ErrTimeout, "%v", err)
+
+	// already running, fails without waiting for timeout
+	assert.True(t, len(reset(-1)) > 1, "polled until timeout")
+	err = wait(time.Minute)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "qemu is running")
+	}
+	assert.Len(t, reset(0), 1)
+}
+
+func TestQmpMonitor_SetLink(t *testing.T) {
+	links := map[string]bool{"netdev-vnet0": true}
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		if cmd.Execute != "set_link" {
+			return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+		}
+		var args struct {
+			Name string
+			Up   bool
+		}
+		json.Unmarshal(cmd.Args, &args)
+		if _, ok := links[args.Name]; !ok {
+			return nil, &Error{Class: "DeviceNotFound", Desc: fmt.Sprintf("Device '%s' not found", args.Name)}
+		}
+		links[args.Name] = args.Up
+		return nil, nil
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	setLink := func(name string, up bool) string {
+		ch := make(chan string, 1)
+		m.SetLink(name, up, func(res string) { ch <- res })
+		select {
+		case res := <-ch:
+			return res
+		case <-time.After(5 * time.Second):
+			t.Fatal("set_link no response")
+		}
+		return ""
+	}
+
+	assert.Equal(t, "", setLink("netdev-vnet0", false))
+	assert.False(t, links["netdev-vnet0"])
+	assert.JSONEq(t, `{"name":"netdev-vnet0","up":false}`, string(s.Commands()[0].Args))
+
+	assert.Equal(t, "", setLink("netdev-vnet0", true))
+	assert.True(t, links["netdev-vnet0"])
+	assert.JSONEq(t, `{"name":"netdev-vnet0","up":true}`, string(s.Commands()[1].Args))
+
+	assert.Contains(t, setLink("netdev-vnet9", false), "not found")
+}
+
+func TestQmpMonitor_QueryBalloon(t *testing.T) {
+	const statsPath = "/machine/peripheral/balloon0"
+	pollingInterval := 0
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		var args struct {
+			Path     string
+			Property string
+			Value    int
+		}
+		json.Unmarshal(cmd.Args, &args)
+		switch cmd.Execute {
+		case "query-balloon":
+			return map[string]interface{}{"actual": 4294967296}, nil
+		case "qom-get":
+			if args.Path != statsPath {
+				return nil, &Error{Class: "DeviceNotFound", Desc: fmt.Sprintf("Device '%s' not found", args.Path)}
+			}
+			if pollingInterval == 0 {
+				return map[string]interface{}{
+					"stats":       map[string]interface{}{"stat-free-memory": -1, "stat-available-memory": -1, "stat-total-memory": -1},
+					"last-update": 0,
+				}, nil
+			}
+			return map[string]interface{}{
+				"stats": map[string]interface{}{
+					"stat-free-memory":      1073741824,
+					"stat-available-memory": 2147483648,
+					"stat-total-memory":     4100000000,
+					"stat-swap-in":          0,
+				},
+				"last-update": 1700000000,
+			}, nil
+		case "qom-set":
+			if args.Path != statsPath || args.Property != "guest-stats-polling-interval" {
+				return nil, &Error{Class: "GenericError", Desc: "invalid property"}
+			}
+			pollingInterval = args.Value
+			return map[string]interface{}{}, nil
+		}
+		return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	queryBalloon := func(path string) (*BalloonInfo, error) {
+		type result struct {
+			info *BalloonInfo
+			err  error
+		}
+		ch := make(chan result, 1)
+		m.QueryBalloon(path, func(info *BalloonInfo, err error) { ch <- result{info, err} })
+		select {
+		case r := <-ch:
+			return r.info, r.err
+		case <-time.After(5 * time.Second):
+			t.Fatal("query balloon no response")
+		}
+		return nil, nil
+	}
+
+	// actual size only
+	info, err := queryBalloon("")
+	assert.NoError(t, err)
+	assert.Equal(t, &BalloonInfo{Actual: 4294967296, FreeMemory: -1, AvailableMemory: -1, TotalMemory: -1}, info)
+	assert.Equal(t, []string{"query-balloon"}, fakeQmpExecutes(s))
+
+	// stats not polled yet
+	info, err = queryBalloon(statsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, &BalloonInfo{Actual: 4294967296, FreeMemory: -1, AvailableMemory: -1, TotalMemory: -1}, info)
+
+	ch := make(chan string, 1)
+	m.SetBalloonStatsPolling(statsPath, 10, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("set balloon stats polling no response")
+	}
+	assert.Equal(t, 10, pollingInterval)
+
+	info, err = queryBalloon(statsPath)
+	assert.NoError(t, err)
+	assert.Equal(t, &BalloonInfo{
+		Actual:          4294967296,
+		FreeMemory:      1073741824,
+		AvailableMemory: 2147483648,
+		TotalMemory:     4100000000,
+		StatsUpdatedAt:  1700000000,
+	}, info)
+
+	_, err = queryBalloon("/machine/peripheral/balloon9")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "not found")
+	}
+}
+
+func TestQmpMonitor_QueryBalloonNoDevice(t *testing.T) {
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		return nil, &Error{Class: "DeviceNotActive", Desc: "No balloon device has been activated"}
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	ch := make(chan error, 1)
+	m.QueryBalloon("/machine/peripheral/balloon0", func(info *BalloonInfo, err error) {
+		assert.Nil(t, info)
+		ch <- err
+	})
+	select {
+	case err := <-ch:
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "No balloon device")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("query balloon no response")
+	}
+	assert.Equal(t, []string{"query-balloon"}, fakeQmpExecutes(s))
+}
+
+func TestQmpMonitor_SetBalloon(t *testing.T) {
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		if cmd.Execute != "balloon" {
+			return nil, &Error{Class: "CommandNotFound", Desc: cmd.Execute}
+		}
+		return map[string]interface{}{}, nil
+	})
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	ch := make(chan string, 1)
+	m.SetBalloon(2147483648, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("balloon no response")
+	}
+	assert.JSONEq(t, `{"value":2147483648}`, string(s.Commands()[0].Args))
+}
+
+func TestProbeQmpStatus(t *testing.T) {
+	s := newFakeQmpServer(t, func(cmd *fakeQmpCommand) (interface{}, *Error) {
+		return map[string]interface{}{"status": "prelaunch", "running": false, "singlestep": false}, nil
+	})
+	address := fmt.Sprintf("127.0.0.1:%d", s.Port())
+	status, err := ProbeQmpStatus(address, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, "prelaunch", status)
+	cmds := s.Commands()
+	if assert.Len(t, cmds, 1) {
+		assert.Equal(t, "query-status", cmds[0].Execute)
+	}
+
+	// accepted but never greeted, like a hung qemu
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	_, err = ProbeQmpStatus(listener.Addr().String(), 200*time.Millisecond)
+	assert.Error(t, err)
+
+	listener.Close()
+	_, err = ProbeQmpStatus(listener.Addr().String(), 200*time.Millisecond)
+	assert.Error(t, err)
+}
+
+func TestQmpMonitor_ScreenDump(t *testing.T) {
+	s := newFakeQmpServer(t, nil)
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	ch := make(chan string, 1)
+	m.ScreenDump("/opt/cloud/workspace/servers/test-guest/screendump.ppm", func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("screendump no response")
+	}
+	cmds := s.Commands()
+	if assert.Len(t, cmds, 1) {
+		assert.Equal(t, "screendump", cmds[0].Execute)
+		assert.JSONEq(t, `{"filename":"/opt/cloud/workspace/servers/test-guest/screendump.ppm"}`, string(cmds[0].Args))
+	}
+}
+
+func TestQmpMonitor_SendKey(t *testing.T) {
+	s := newFakeQmpServer(t, nil)
+	m := connectFakeQmpMonitor(t, s, nil)
+
+	ch := make(chan string, 1)
+	m.SendKey([]string{"ctrl", "alt", "delete"}, 0, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("send-key no response")
+	}
+	m.SendKey([]string{"ret"}, 200, func(res string) { ch <- res })
+	select {
+	case res := <-ch:
+		assert.Equal(t, "", res)
+	case <-time.After(5 * time.Second):
+		t.Fatal("send-key no response")
+	}
+	cmds := s.Commands()
+	if assert.Len(t, cmds, 2) {
+		assert.Equal(t, "send-key", cmds[0].Execute)
+		assert.JSONEq(t, `{"keys":[{"type":"qcode","data":"ctrl"},{"type":"qcode","data":"alt"},{"type":"qcode","data":"delete"}]}`, string(cmds[0].Args))
+		assert.JSONEq(t, `{"keys":[{"type":"qcode","data":"ret"}],"hold-time":200}`, string(cmds[1].Args))
+	}
+}
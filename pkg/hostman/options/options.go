@@ -77,6 +77,8 @@ type SHostOptions struct {
 	ChntpwPath string `help:"path to chntpw tool" default:"/usr/local/bin/chntpw.static"`
 	OvmfPath   string `help:"Path to OVMF.fd" default:"/opt/cloud/contrib/OVMF.fd"`
 
+	AcpiTablesDir string `help:"Directory of acpi table files guests may load by metadata acpi_tables, tables out of it are refused" default:"/opt/cloud/contrib/acpi"`
+
 	LinuxDefaultRootUser    bool `help:"Default account for linux system is root"`
 	WindowsDefaultAdminUser bool `default:"true" help:"Default account for Windows system is Administrator"`
 
@@ -85,6 +87,19 @@ type SHostOptions struct {
 	HugepagesOption  string `help:"Hugepages option: disable|native|transparent" default:"transparent"`
 	EnableQmpMonitor bool   `help:"Enable qmp monitor" default:"true"`
 
+	HugepagesMemRoundUp bool `help:"Round up memory of guests to multiple of hugepage size, otherwise guests with misaligned memory fail to start" default:"false"`
+
+	RealtimeRequireStableClocksource bool `help:"Refuse to start realtime guests if host clocksource isn't tsc or arch_sys_counter, otherwise only warn" default:"false"`
+
+	EnableMonitorAuditLog bool `help:"Record monitor commands and responses of guests to audit log" default:"false"`
+
+	QemuLogGuestErrors  bool `help:"Only log invalid guest operations instead of all items to qemu log when log level is debug" default:"false"`
+	EnableQemuTrace     bool `help:"Allow guests to enable qemu trace events by metadata qemu_trace_enable and qemu_trace_events, for debugging only" default:"false"`
+	QemuDumpGuestCore   bool `help:"Include guest memory in core dumps of qemu, for debugging only" default:"false"`
+	AllowQemuNoShutdown bool `help:"Allow guests to keep qemu alive after powered off by metadata no_shutdown, for debugging only" default:"false"`
+
+	SyncGuestTimeAfterResume bool `help:"Sync guest time by guest agent after resumed from state file or live migrated" default:"false"`
+
 	PrivatePrefixes []string `help:"IPv4 private prefixes"`
 	LocalImagePath  []string `help:"Local image storage paths"`
 	SharedStorages  []string `help:"Path of shared storages"`
@@ -111,6 +126,8 @@ type SHostOptions struct {
 	SetVncPassword         bool `default:"true" help:"Auto set vnc password after monitor connected"`
 	UseBootVga             bool `default:"false" help:"Use boot VGA GPU for guest"`
 
+	VncListenAddress string `help:"Address vnc of guests listens on, e.g. management ip, listen on all addresses if empty"`
+
 	EnableCpuBinding         bool `default:"false" help:"Enable cpu binding and rebalance"`
 	EnableOpenflowController bool `default:"false"`
 
@@ -174,16 +191,45 @@ type SHostOptions struct {
 
 	EnableVmUuid bool `help:"enable vm UUID" default:"true" json:"enable_vm_uuid"`
 
+	EnableQemuProcessTitle bool `help:"set qemu process title as guest uuid" default:"false"`
+
+	SpiceStreamingVideo        string `help:"spice streaming video mode of vdi guests, off|all|filter"`
+	SpiceImageCompression      string `help:"spice image compression of vdi guests, auto_glz|auto_lz|quic|glz|lz|off"`
+	SpiceJpegWanCompression    string `help:"spice jpeg wan compression of vdi guests, auto|never|always"`
+	SpiceZlibGlzWanCompression string `help:"spice zlib glz wan compression of vdi guests, auto|never|always"`
+	SpicePlaybackCompression   string `help:"spice playback compression of vdi guests, on|off"`
+
+	MaxConcurrentGuestStarts int `help:"max count of guests launched at the same time, 0 means no limit" default:"0"`
+
+	DefaultNicDriver string `help:"driver of guest nic not specifying one, e.g. virtio, e1000, e1000e" default:"virtio"`
+
+	SecurityDriver string `help:"linux security module guest files are labeled for, none|selinux|apparmor" default:"none"`
+
+	QemuRunasUser string `help:"drop privileges of qemu process to this user after setup, guest home dir and encrypt key file are handed over to the user on launch, disks and files opened by qemu later must be accessible to it; nic down scripts are run by host agent instead of qemu and nic hotplug is not supported"`
+
 	EnableVirtioRngDevice bool `help:"enable qemu virtio-rng device" default:"true"`
 
+	BalloonStatsPollingSeconds int `help:"Seconds between guest memory stats polls of balloon device, 0 disables polling" default:"10"`
+
+	StartScriptSleepBeforeLaunch bool `help:"sleep 1 second in guest start script before launching qemu" default:"true"`
+	QemuStartupTimeoutSeconds    int  `help:"Seconds to wait for launched qemu creating pid file and answering qmp query-status, guest start fails if it doesn't in time" default:"30"`
+
 	RestrictQemuImgConvertWorker bool `help:"restrict qemu-img convert worker" default:"false"`
 
 	DefaultLiveMigrateDowntime float32 `help:"allow downtime in seconds for live migrate" default:"5.0"`
+	LiveMigrateDeferIncoming   bool    `help:"start live migrate destination with -incoming defer and listen by migrate-incoming after qmp connected" default:"false"`
 
 	LocalBackupStoragePath string `help:"path for mounting backup nfs storage" default:"/opt/cloud/workspace/backupstorage"`
 	LocalBackupTempPath    string `help:"the local temporary directory for backup" default:"/opt/cloud/workspace/run/backups"`
 
 	BinaryMemcleanPath string `help:"execute binary memclean path" default:"/opt/yunion/bin/memclean"`
+
+	GuestStopGraceSeconds int `help:"Seconds waiting for guest to power down before stop script sends SIGTERM to qemu" default:"5"`
+	GuestStopTermSeconds  int `help:"Seconds waiting for qemu to exit after SIGTERM before stop script sends SIGKILL" default:"5"`
+
+	GuestPreStartHook  string `help:"Script run before launching qemu with GUEST_ID, GUEST_UUID and GUEST_NAME in env, guest start fails if it exits non-zero"`
+	GuestPostStartHook string `help:"Script run after guest is running with GUEST_ID, GUEST_UUID, GUEST_NAME, GUEST_PID and GUEST_VNC_PORT in env, failures are logged only"`
+	GuestPostStopHook  string `help:"Script run after qemu is stopped with GUEST_ID, GUEST_UUID and GUEST_NAME in env, failures are ignored"`
 }
 
 var (
@@ -25,6 +25,7 @@ import (
 	"strings"
 
 	"yunion.io/x/log"
+	"yunion.io/x/pkg/errors"
 
 	"yunion.io/x/onecloud/pkg/util/fileutils2"
 	"yunion.io/x/onecloud/pkg/util/procutils"
@@ -442,6 +443,51 @@ func NewCGroupCPUTask(pid, name string, coreNum int) CGroupCPUTask {
 	return cgroup
 }
 
+const (
+	CPU_CFS_PERIOD_US = "cpu.cfs_period_us"
+	CPU_CFS_QUOTA_US  = "cpu.cfs_quota_us"
+	// cgroup v2 "$QUOTA $PERIOD"
+	CPU_MAX = "cpu.max"
+
+	cpuCfsPeriodUs   = 100000
+	cpuCfsQuotaMinUs = 1000
+)
+
+// SetCpuThrottle throttles percent of cpu time of the task's cores,
+// 0 removes the limit
+func (c *CGroupCPUTask) SetCpuThrottle(coreNum, percent int) error {
+	if percent < 0 || percent > 100 {
+		return errors.Errorf("invalid cpu throttle percent %d, should be in 0..100", percent)
+	}
+	if !c.taskIsExist() {
+		return errors.Wrapf(errors.ErrNotFound, "cgroup task %s", c.TaskPath())
+	}
+	quota := -1
+	if percent > 0 {
+		quota = cpuCfsPeriodUs * coreNum * (100 - percent) / 100
+		if quota < cpuCfsQuotaMinUs {
+			quota = cpuCfsQuotaMinUs
+		}
+	}
+	if fileutils2.Exists(path.Join(c.TaskPath(), CPU_MAX)) {
+		val := "max"
+		if quota > 0 {
+			val = fmt.Sprintf("%d", quota)
+		}
+		if !c.SetParam(CPU_MAX, fmt.Sprintf("%s %d", val, cpuCfsPeriodUs)) {
+			return errors.Errorf("failed set %s of %s", CPU_MAX, c.GroupName())
+		}
+		return nil
+	}
+	if !c.SetParams(map[string]string{CPU_CFS_PERIOD_US: fmt.Sprintf("%d", cpuCfsPeriodUs)}) {
+		return errors.Errorf("failed set %s of %s", CPU_CFS_PERIOD_US, c.GroupName())
+	}
+	if !c.SetParam(CPU_CFS_QUOTA_US, fmt.Sprintf("%d", quota)) {
+		return errors.Errorf("failed set %s of %s", CPU_CFS_QUOTA_US, c.GroupName())
+	}
+	return nil
+}
+
 /**
  *  CGroupIOTask
  */
@@ -638,6 +684,11 @@ func CgroupSet(pid, name string, coreNum int) bool {
 	return true
 }
 
+func CgroupCpuThrottle(pid, name string, coreNum, percent int) error {
+	task := NewCGroupCPUTask(pid, name, 0)
+	return task.SetCpuThrottle(coreNum, percent)
+}
+
 func CgroupIoHardlimitSet(
 	pid, name string, coreNum int,
 	params map[string]int, devId string,
@@ -0,0 +1,109 @@
+// Copyright 2019 Yunion
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cgrouputils
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func newFakeCgroupFs(t *testing.T, name string, files ...string) string {
+	root, err := ioutil.TempDir("", "cgroup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	savedPath := cgroupsPath
+	cgroupsPath = root
+	t.Cleanup(func() {
+		cgroupsPath = savedPath
+		os.RemoveAll(root)
+	})
+	taskPath := path.Join(root, "cpu", name)
+	if err := os.MkdirAll(taskPath, 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		if err := ioutil.WriteFile(path.Join(taskPath, f), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return taskPath
+}
+
+func readCgroupParam(t *testing.T, taskPath, name string) string {
+	content, err := ioutil.ReadFile(path.Join(taskPath, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(content))
+}
+
+func TestCgroupCpuThrottle(t *testing.T) {
+	t.Run("cgroup v1", func(t *testing.T) {
+		taskPath := newFakeCgroupFs(t, "server_1", CPU_CFS_PERIOD_US, CPU_CFS_QUOTA_US)
+		cases := []struct {
+			coreNum int
+			percent int
+			want    string
+		}{
+			{2, 25, "150000"},
+			{1, 50, "50000"},
+			{1, 100, "1000"},
+			{4, 0, "-1"},
+		}
+		for _, c := range cases {
+			if err := CgroupCpuThrottle("1", "server_1", c.coreNum, c.percent); err != nil {
+				t.Fatalf("throttle %d%%: %v", c.percent, err)
+			}
+			if got := readCgroupParam(t, taskPath, CPU_CFS_QUOTA_US); got != c.want {
+				t.Errorf("throttle %d cores %d%% quota got %s want %s", c.coreNum, c.percent, got, c.want)
+			}
+			if got := readCgroupParam(t, taskPath, CPU_CFS_PERIOD_US); got != "100000" {
+				t.Errorf("period got %s want 100000", got)
+			}
+		}
+	})
+
+	t.Run("cgroup v2", func(t *testing.T) {
+		taskPath := newFakeCgroupFs(t, "server_2", CPU_MAX)
+		if err := CgroupCpuThrottle("2", "server_2", 2, 50); err != nil {
+			t.Fatal(err)
+		}
+		if got := readCgroupParam(t, taskPath, CPU_MAX); got != "100000 100000" {
+			t.Errorf("cpu.max got %q", got)
+		}
+		if err := CgroupCpuThrottle("2", "server_2", 2, 0); err != nil {
+			t.Fatal(err)
+		}
+		if got := readCgroupParam(t, taskPath, CPU_MAX); got != "max 100000" {
+			t.Errorf("cpu.max got %q", got)
+		}
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		newFakeCgroupFs(t, "server_3")
+		for _, percent := range []int{-1, 101} {
+			if err := CgroupCpuThrottle("3", "server_3", 1, percent); err == nil {
+				t.Errorf("throttle %d%% should fail", percent)
+			}
+		}
+		if err := CgroupCpuThrottle("4", "server_4", 1, 10); err == nil {
+			t.Errorf("throttle missing cgroup should fail")
+		}
+	})
+}
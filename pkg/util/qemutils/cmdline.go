@@ -43,6 +43,28 @@ func NewCmdline(content string) (*Cmdline, error) {
 	return cl, nil
 }
 
+// NewCmdlineFromArgs builds cmdline from argv of a process, e.g. read from
+// proc cmdline, values keep their spaces as argument boundaries are known
+func NewCmdlineFromArgs(args []string) (*Cmdline, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, errors.Errorf("empty args")
+	}
+	cl := &Cmdline{
+		options: make([]Option, 0),
+	}
+	key, vals := args[0], []string{}
+	for _, arg := range args[1:] {
+		if strings.HasPrefix(arg, "-") && len(arg) > 1 {
+			cl.options = append(cl.options, Option{Key: key, Value: strings.Join(vals, " ")})
+			key, vals = arg[1:], []string{}
+			continue
+		}
+		vals = append(vals, arg)
+	}
+	cl.options = append(cl.options, Option{Key: key, Value: strings.Join(vals, " ")})
+	return cl, nil
+}
+
 type Option struct {
 	Key   string
 	Value string
@@ -76,6 +98,10 @@ func (cl *Cmdline) FilterOption(filter OptionFilter) {
 	cl.options = opts
 }
 
+func (cl *Cmdline) GetOptions() []Option {
+	return cl.options
+}
+
 func (cl *Cmdline) AddOption(opts ...Option) *Cmdline {
 	cl.options = append(cl.options, opts...)
 	return cl
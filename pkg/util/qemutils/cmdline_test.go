@@ -97,3 +97,24 @@ func TestNewCmdline(t *testing.T) {
 		})
 	}
 }
+
+func TestNewCmdlineFromArgs(t *testing.T) {
+	cl, err := NewCmdlineFromArgs([]string{
+		"/usr/bin/qemu-system-x86_64", "-name", "my guest,debug-threads=on", "-S",
+		"-m", "1024M", "--incoming", "exec: cat /opt/state", "-append", "console=ttyS0 quiet",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Option{
+		{"/usr/bin/qemu-system-x86_64", ""},
+		{"name", "my guest,debug-threads=on"},
+		{"S", ""},
+		{"m", "1024M"},
+		{"-incoming", "exec: cat /opt/state"},
+		{"append", "console=ttyS0 quiet"},
+	}, cl.GetOptions())
+
+	_, err = NewCmdlineFromArgs(nil)
+	assert.Error(t, err)
+	_, err = NewCmdlineFromArgs([]string{""})
+	assert.Error(t, err)
+}